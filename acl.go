@@ -0,0 +1,236 @@
+package dkvs
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// keys starting with this prefix are used by the cluster itself, and can't be
+// read or written through the client routes
+const reservedPrefix = "__dkvs/"
+
+// the access list is stored as a single key, so that it gets replicated like
+// any other write and every node enforces the same rules
+const aclKey = reservedPrefix + "acl"
+
+// Principal is a client allowed to access the cluster
+type Principal struct {
+	Name string `json:"name"`
+	// admins can read and write every key, and manage the access list
+	Admin bool    `json:"admin,omitempty"`
+	Rules []*Rule `json:"rules,omitempty"`
+}
+
+// Rule grants permissions on the keys starting with Prefix
+type Rule struct {
+	Prefix string `json:"prefix"`
+	Read   bool   `json:"read,omitempty"`
+	Write  bool   `json:"write,omitempty"`
+}
+
+// accessList maps token hashes to principals. Tokens are only stored hashed.
+type accessList map[string]*Principal
+
+// aclCache keeps the parsed access list of a node, refreshed when the
+// version of the stored list changes
+type aclCache struct {
+	version uint64
+	list    accessList
+	lock    sync.Mutex
+}
+
+var errorNoAdmin = &Error{Code: CodeBadRequest, Message: "the access list needs at least one admin"}
+
+// tokenID hashes a token into the ID of its principal
+func tokenID(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// accessList returns the current access list, empty if access control is
+// disabled
+func (n *Node) accessList() (accessList, error) {
+	e, err := n.storage.Lookup(aclKey)
+	if errors.Is(err, ErrorKeyNotFound) {
+		return accessList{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	n.acl.lock.Lock()
+	defer n.acl.lock.Unlock()
+
+	if n.acl.list == nil || n.acl.version != e.Version {
+		list := accessList{}
+		if err := json.Unmarshal(e.Value, &list); err != nil {
+			return nil, err
+		}
+		n.acl.list, n.acl.version = list, e.Version
+	}
+
+	return n.acl.list, nil
+}
+
+// authorize checks that the token grants access to all the keys. A nil slice
+// of keys only requires the token to be valid. Access control is disabled
+// until the access list has a principal.
+func (n *Node) authorize(token string, write bool, keys ...string) error {
+	list, err := n.accessList()
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		if strings.HasPrefix(key, reservedPrefix) {
+			return ErrorForbidden
+		}
+	}
+
+	if len(list) == 0 {
+		return nil
+	}
+
+	p, ok := list[tokenID(token)]
+	if !ok {
+		return ErrorUnauthorized
+	}
+
+	for _, key := range keys {
+		if !p.allowed(key, write) {
+			return ErrorForbidden
+		}
+	}
+
+	return nil
+}
+
+// authorizeAdmin checks that the token belongs to an admin, or that access
+// control is still disabled
+func (n *Node) authorizeAdmin(token string) error {
+	list, err := n.accessList()
+	if err != nil {
+		return err
+	}
+
+	if len(list) == 0 {
+		return nil
+	}
+
+	p, ok := list[tokenID(token)]
+	if !ok {
+		return ErrorUnauthorized
+	}
+	if !p.Admin {
+		return ErrorForbidden
+	}
+	return nil
+}
+
+func (p *Principal) allowed(key string, write bool) bool {
+	if p.Admin {
+		return true
+	}
+
+	for _, r := range p.Rules {
+		if strings.HasPrefix(key, r.Prefix) && ((write && r.Write) || (!write && r.Read)) {
+			return true
+		}
+	}
+	return false
+}
+
+// ListAccess returns the principals allowed to access the cluster, by ID
+func (n *Node) ListAccess(ctx context.Context) (map[string]*Principal, error) {
+	return n.accessList()
+}
+
+// GrantAccess allows a token to access the cluster with the permissions of p.
+// The first principal must be an admin.
+// This can only be run on the master.
+func (n *Node) GrantAccess(ctx context.Context, token string, p *Principal) (string, error) {
+	id := tokenID(token)
+
+	return id, n.updateAccessList(ctx, func(list accessList) error {
+		list[id] = p
+		return nil
+	})
+}
+
+// RevokeAccess removes a principal from the access list. The last admin can't
+// be removed.
+// This can only be run on the master.
+func (n *Node) RevokeAccess(ctx context.Context, id string) error {
+	return n.updateAccessList(ctx, func(list accessList) error {
+		if _, ok := list[id]; !ok {
+			return ErrorKeyNotFound
+		}
+		delete(list, id)
+		return nil
+	})
+}
+
+// updateAccessList applies a change to the access list, retrying if it is
+// changed concurrently
+func (n *Node) updateAccessList(ctx context.Context, change func(accessList) error) error {
+	if !n.IsMaster() {
+		return ErrorNotMaster
+	}
+
+	for {
+		var version uint64
+		list := accessList{}
+
+		e, err := n.storage.Lookup(aclKey)
+		if err == nil {
+			version = e.Version
+			if err := json.Unmarshal(e.Value, &list); err != nil {
+				return err
+			}
+		} else if !errors.Is(err, ErrorKeyNotFound) {
+			return err
+		}
+
+		if err := change(list); err != nil {
+			return err
+		}
+		if !list.hasAdmin() {
+			return errorNoAdmin
+		}
+
+		payload, err := json.Marshal(list)
+		if err != nil {
+			return err
+		}
+
+		// version 0 would make the write unconditional, so the very first
+		// list is written without check
+		_, err = n.PutValue(ctx, aclKey, payload, encoding, version)
+		if !errors.Is(err, ErrorConflict) {
+			return err
+		}
+	}
+}
+
+func (list accessList) hasAdmin() bool {
+	for _, p := range list {
+		if p.Admin {
+			return true
+		}
+	}
+	return false
+}
+
+// requestToken extracts the token of a client request, sent either as a
+// bearer token or as an API key
+func requestToken(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	return r.Header.Get("X-Api-Key")
+}
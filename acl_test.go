@@ -0,0 +1,130 @@
+package dkvs
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// Test writing through a slave, which redirects the client to the master on
+// another host, with access control enabled
+func TestAccessControlRedirect(t *testing.T) {
+	ctx := context.Background()
+	net := NewMemoryNetwork()
+	m, slaves := memoryCluster(t, net, WriteConcernAll, "slave:1")
+
+	if _, err := m.GrantAccess(ctx, "admin-token", &Principal{Name: "admin", Admin: true}); err != nil {
+		t.Fatalf("granting access failed: %v", err)
+	}
+	if _, err := m.GrantAccess(ctx, "writer-token", &Principal{Name: "writer", Rules: []*Rule{{Prefix: "", Read: true, Write: true}}}); err != nil {
+		t.Fatalf("granting access failed: %v", err)
+	}
+
+	c := net.Client("slave:1")
+	c.SetToken("writer-token")
+	if err := c.Put(ctx, "a", []byte("1")); err != nil {
+		t.Fatalf("put through the slave failed: %v", err)
+	}
+	if _, err := c.Incr(ctx, "n"); err != nil {
+		t.Errorf("increment through the slave failed: %v", err)
+	}
+	expectValue(t, slaves[0], "a", "1")
+
+	anonymous := net.Client("slave:1")
+	if err := anonymous.Put(ctx, "a", []byte("2")); !errors.Is(err, ErrorUnauthorized) {
+		t.Errorf("expected %v, got %v", ErrorUnauthorized, err)
+	}
+}
+
+// Test that the access list is replicated and enforced by every node
+func TestAccessControl(t *testing.T) {
+	masterAddr := ":5555"
+	slaveAddr := ":5656"
+
+	m, err := startMaster(masterAddr)
+	if m != nil {
+		defer m.Close()
+	}
+	if err != nil {
+		t.Errorf("creating a master failed with error: %v", err)
+		return
+	}
+
+	// wait for the server to start
+	time.Sleep(100 * time.Millisecond)
+
+	s, err := startSlave(slaveAddr, masterAddr)
+	if s != nil {
+		defer s.Close()
+	}
+	if err != nil {
+		t.Errorf("creating a slave failed with error: %v", err)
+		return
+	}
+
+	if _, err := m.GrantAccess(context.Background(), "team-a-token", &Principal{Name: "team a", Rules: []*Rule{{Prefix: "a/", Read: true, Write: true}}}); err != errorNoAdmin {
+		t.Errorf("expected %v, got %v", errorNoAdmin, err)
+		return
+	}
+
+	if _, err := m.GrantAccess(context.Background(), "admin-token", &Principal{Name: "admin", Admin: true}); err != nil {
+		t.Errorf("granting access failed: %v", err)
+		return
+	}
+	if _, err := m.GrantAccess(context.Background(), "team-a-token", &Principal{Name: "team a", Rules: []*Rule{{Prefix: "a/", Read: true, Write: true}}}); err != nil {
+		t.Errorf("granting access failed: %v", err)
+		return
+	}
+	teamBID, err := m.GrantAccess(context.Background(), "team-b-token", &Principal{Name: "team b", Rules: []*Rule{{Prefix: "a/", Read: true}}})
+	if err != nil {
+		t.Errorf("granting access failed: %v", err)
+		return
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	anonymous := NewClient(slaveAddr)
+	admin := NewClient(slaveAddr)
+	admin.SetToken("admin-token")
+	teamA := NewClient(slaveAddr)
+	teamA.SetToken("team-a-token")
+	teamB := NewClient(slaveAddr)
+	teamB.SetToken("team-b-token")
+
+	if err := anonymous.Put(context.Background(), "a/x", []byte("1")); !errors.Is(err, ErrorUnauthorized) {
+		t.Errorf("expected %v, got %v", ErrorUnauthorized, err)
+	}
+
+	// writes are authorized by the slave, then by the master
+	if err := teamA.Put(context.Background(), "a/x", []byte("1")); err != nil {
+		t.Errorf("put failed: %v", err)
+	}
+	if err := teamA.Put(context.Background(), "b/x", []byte("1")); !errors.Is(err, ErrorForbidden) {
+		t.Errorf("expected %v, got %v", ErrorForbidden, err)
+	}
+	if err := teamB.Put(context.Background(), "a/x", []byte("2")); !errors.Is(err, ErrorForbidden) {
+		t.Errorf("expected %v, got %v", ErrorForbidden, err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	if val, err := teamB.Get(context.Background(), "a/x"); err != nil || string(val) != "1" {
+		t.Errorf(`expected "1", got "%s" (%v)`, val, err)
+	}
+
+	// the access list itself can't be read as a key, even by admins
+	if _, err := admin.Get(context.Background(), aclKey); !errors.Is(err, ErrorForbidden) {
+		t.Errorf("expected %v, got %v", ErrorForbidden, err)
+	}
+
+	if err := m.RevokeAccess(context.Background(), teamBID); err != nil {
+		t.Errorf("revoking access failed: %v", err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	if _, err := teamB.Get(context.Background(), "a/x"); !errors.Is(err, ErrorUnauthorized) {
+		t.Errorf("expected %v, got %v", ErrorUnauthorized, err)
+	}
+}
@@ -0,0 +1,852 @@
+package dkvs
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultContentType is used for values written without a content type
+const defaultContentType = "application/octet-stream"
+
+// keyHandler serves the /v1/keys/{key} resource
+func (t *httpTransport) keyHandler(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/v1/keys/")
+	if key == "" {
+		writeError(w, ErrorKeyNotFound)
+		return
+	}
+
+	write := r.Method != http.MethodGet && r.Method != http.MethodHead
+	if !t.authorized(w, r, write, key) {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		t.getKey(w, r, key)
+	case http.MethodPut:
+		t.putKey(w, r, key)
+	case http.MethodDelete:
+		t.deleteKey(w, r, key)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PUT, DELETE")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (t *httpTransport) getKey(w http.ResponseWriter, r *http.Request, key string) {
+	revision, err := queryRevision(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	e, err := t.n.ReadEntryAt(r.Context(), key, revision)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	contentType := e.ContentType
+	if contentType == "" {
+		contentType = defaultContentType
+	}
+
+	w.Header().Set("ETag", etag(e.Version))
+	if matchesETag(r.Header.Get("If-None-Match"), e.Version) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(e.Value)))
+	w.WriteHeader(http.StatusOK)
+
+	if r.Method != http.MethodHead {
+		w.Write(e.Value)
+	}
+}
+
+func (t *httpTransport) putKey(w http.ResponseWriter, r *http.Request, key string) {
+	if !t.n.IsMaster() {
+		t.redirectToMaster(w, r)
+		return
+	}
+
+	version, err := t.precondition(r, key)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	val, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, badRequest(err))
+		return
+	}
+
+	e, created, err := t.n.putValue(r.Context(), key, val, r.Header.Get("Content-Type"), version)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("ETag", etag(e.Version))
+	if created {
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (t *httpTransport) deleteKey(w http.ResponseWriter, r *http.Request, key string) {
+	if !t.n.IsMaster() {
+		t.redirectToMaster(w, r)
+		return
+	}
+
+	version, err := t.precondition(r, key)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if err := t.n.DeleteValue(r.Context(), key, version); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// precondition turns the If-Match header into the version a write expects,
+// 0 meaning the write is unconditional
+func (t *httpTransport) precondition(r *http.Request, key string) (uint64, error) {
+	ifMatch := r.Header.Get("If-Match")
+	if ifMatch == "" {
+		return 0, nil
+	}
+
+	e, err := t.n.ReadEntry(r.Context(), key)
+	if errors.Is(err, ErrorKeyNotFound) {
+		return 0, ErrorConflict
+	} else if err != nil {
+		return 0, err
+	}
+
+	if !matchesETag(ifMatch, e.Version) {
+		return 0, ErrorConflict
+	}
+
+	// pinning the version we just read keeps the check atomic: if the key
+	// changes before the write is applied, the storage rejects it
+	return e.Version, nil
+}
+
+// redirectToMaster sends writes received by a slave to the master, or
+// rejects them if the master's address is unknown
+func (t *httpTransport) redirectToMaster(w http.ResponseWriter, r *http.Request) {
+	m := t.n.master()
+	if m == nil || m.Address == "" {
+		writeError(w, ErrorNotMaster)
+		return
+	}
+
+	url := t.n.url(m.Address, r.URL.RequestURI())
+	http.Redirect(w, r, url, http.StatusTemporaryRedirect)
+}
+
+// keysHandler serves batch reads: GET /v1/keys?key=a&key=b. The keys are
+// read at the same revision, given with ?revision=N or the current one, which
+// is returned in the X-Revision header.
+func (t *httpTransport) keysHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	type item struct {
+		Key         string `json:"key"`
+		Value       []byte `json:"value,omitempty"`
+		ContentType string `json:"content_type,omitempty"`
+		Version     uint64 `json:"version,omitempty"`
+		Error       *Error `json:"error,omitempty"`
+	}
+	items := make([]*item, 0)
+
+	if !t.authorized(w, r, false) {
+		return
+	}
+	token := requestToken(r)
+
+	revision, err := queryRevision(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	// storages without past revisions are read as they are
+	if revision == 0 {
+		if current, err := t.n.Revision(r.Context()); err == nil {
+			revision = current
+		}
+	}
+	if revision != 0 {
+		w.Header().Set("X-Revision", strconv.FormatUint(revision, 10))
+	}
+
+	for _, key := range r.URL.Query()["key"] {
+		i := &item{Key: key}
+		if err := t.n.authorize(token, false, key); err != nil {
+			i.Error = toError(err)
+		} else if e, err := t.n.ReadEntryAt(r.Context(), key, revision); err != nil {
+			i.Error = toError(err)
+		} else {
+			i.Value = e.Value
+			i.ContentType = e.ContentType
+			i.Version = e.Version
+		}
+		items = append(items, i)
+	}
+
+	writeJSON(w, http.StatusOK, items)
+}
+
+// incrHandler adds to the numeric value of a key: POST /v1/incr/{key}?by=N,
+// or POST /v1/decr/{key}?by=N to subtract. N defaults to 1 and is an integer,
+// unless float=true is given.
+func (t *httpTransport) incrHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	decr := strings.HasPrefix(r.URL.Path, "/v1/decr/")
+	key := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/v1/incr/"), "/v1/decr/")
+	if key == "" {
+		writeError(w, ErrorKeyNotFound)
+		return
+	}
+	if !t.authorized(w, r, true, key) {
+		return
+	}
+	if !t.n.IsMaster() {
+		t.redirectToMaster(w, r)
+		return
+	}
+
+	query := r.URL.Query()
+	by := query.Get("by")
+	if by == "" {
+		by = "1"
+	}
+
+	var value interface{}
+	if float, _ := strconv.ParseBool(query.Get("float")); float {
+		delta, err := strconv.ParseFloat(by, 64)
+		if err != nil {
+			writeError(w, badRequest(fmt.Errorf("invalid increment: %v", err)))
+			return
+		}
+		if decr {
+			delta = -delta
+		}
+		if value, err = t.n.IncrByFloat(r.Context(), key, delta); err != nil {
+			writeError(w, err)
+			return
+		}
+	} else {
+		delta, err := strconv.ParseInt(by, 10, 64)
+		if err != nil || (decr && delta == math.MinInt64) {
+			writeError(w, badRequest(fmt.Errorf("invalid increment %q", by)))
+			return
+		}
+		if decr {
+			delta = -delta
+		}
+		if value, err = t.n.IncrBy(r.Context(), key, delta); err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"key": key, "value": value})
+}
+
+// opsHandler applies an operation on a typed value: POST /v1/ops with a
+// {"op": "lpush", "key": "a", "values": [...]} body, returning the result of
+// the operation as {"result": ...}. Writes are redirected to the master.
+func (t *httpTransport) opsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var op typeOp
+	if err := json.NewDecoder(r.Body).Decode(&op); err != nil {
+		writeError(w, badRequest(err))
+		return
+	}
+	write, ok := typeOps[op.Op]
+	if !ok {
+		writeError(w, badRequest(fmt.Errorf("unknown operation %q", op.Op)))
+		return
+	}
+	if op.Key == "" {
+		writeError(w, badRequest(errors.New("missing key")))
+		return
+	}
+
+	if !t.authorized(w, r, write, op.Key) {
+		return
+	}
+	if write && !t.n.IsMaster() {
+		t.redirectToMaster(w, r)
+		return
+	}
+
+	result, err := t.n.applyTypeOp(r.Context(), &op)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"result": result})
+}
+
+// historyHandler serves the past entries of a key the node keeps, oldest
+// first: GET /v1/history/{key}
+func (t *httpTransport) historyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	key := strings.TrimPrefix(r.URL.Path, "/v1/history/")
+	if key == "" {
+		writeError(w, ErrorKeyNotFound)
+		return
+	}
+	if !t.authorized(w, r, false, key) {
+		return
+	}
+
+	history, err := t.n.History(r.Context(), key)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, history)
+}
+
+// compactHandler forgets the entries the node replaced before a revision:
+// POST /v1/compact?revision=N. Each node compacts its own storage.
+func (t *httpTransport) compactHandler(w http.ResponseWriter, r *http.Request) {
+	if err := t.n.authorizeAdmin(requestToken(r)); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	revision, err := queryRevision(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if revision == 0 {
+		writeError(w, badRequest(errors.New("missing revision")))
+		return
+	}
+
+	if err := t.n.Compact(r.Context(), revision); err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// queryRevision returns the revision of the ?revision= parameter, 0 when
+// there is none
+func queryRevision(r *http.Request) (uint64, error) {
+	rev := r.URL.Query().Get("revision")
+	if rev == "" {
+		return 0, nil
+	}
+	revision, err := strconv.ParseUint(rev, 10, 64)
+	if err != nil {
+		return 0, badRequest(fmt.Errorf("invalid revision: %v", err))
+	}
+	return revision, nil
+}
+
+// scanHandler serves ordered scans of the keys, by range or by prefix, one
+// page at a time: GET /v1/scan?start=a&end=b&limit=10, GET
+// /v1/scan?prefix=a/ or GET /v1/scan?cursor=... for the next page. Keys the
+// client can't read are left out of the pages.
+func (t *httpTransport) scanHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !t.authorized(w, r, false) {
+		return
+	}
+	token := requestToken(r)
+
+	query := r.URL.Query()
+	limit := 0
+	if l := query.Get("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil {
+			writeError(w, badRequest(fmt.Errorf("invalid limit: %v", err)))
+			return
+		}
+	}
+
+	var page *Page
+	var err error
+	switch {
+	case query.Get("cursor") != "":
+		page, err = t.n.NextPage(r.Context(), query.Get("cursor"), limit)
+	case query.Has("prefix"):
+		page, err = t.n.Prefix(r.Context(), query.Get("prefix"), limit)
+	default:
+		page, err = t.n.Scan(r.Context(), query.Get("start"), query.Get("end"), limit)
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	resp := &pageResponse{Items: make([]*itemResponse, 0, len(page.Items)), Cursor: page.Cursor}
+	for _, i := range page.Items {
+		if t.n.authorize(token, false, i.Key) != nil {
+			continue
+		}
+		resp.Items = append(resp.Items, &itemResponse{
+			Key:         i.Key,
+			Value:       i.Value,
+			ContentType: i.ContentType,
+			Version:     i.Version,
+		})
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// pageResponse is the body of a scan response
+type pageResponse struct {
+	Items  []*itemResponse `json:"items"`
+	Cursor string          `json:"cursor,omitempty"`
+}
+
+type itemResponse struct {
+	Key         string `json:"key"`
+	Value       []byte `json:"value"`
+	ContentType string `json:"content_type,omitempty"`
+	Version     uint64 `json:"version"`
+}
+
+// txnHandler applies transactions: POST /v1/txn with a Txn body. The writes
+// need write access to their keys, and the comparisons read access.
+func (t *httpTransport) txnHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if !t.n.IsMaster() {
+		t.redirectToMaster(w, r)
+		return
+	}
+
+	var txn Txn
+	if err := json.NewDecoder(r.Body).Decode(&txn); err != nil {
+		writeError(w, badRequest(err))
+		return
+	}
+
+	read, written := txn.keys()
+	if !t.authorized(w, r, false, read...) || !t.authorized(w, r, true, written...) {
+		return
+	}
+
+	result, err := t.n.Txn(r.Context(), &txn)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// batchHandler applies batches of writes: POST /v1/batch with a
+// {"ops": [...]} body. Writes to keys the client can't write are reported as
+// forbidden, and the others applied.
+func (t *httpTransport) batchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if !t.n.IsMaster() {
+		t.redirectToMaster(w, r)
+		return
+	}
+
+	if !t.authorized(w, r, true) {
+		return
+	}
+	token := requestToken(r)
+
+	var p struct {
+		Ops []*BatchOp `json:"ops"`
+	}
+	// values are base64 encoded, which makes them a third larger
+	body := http.MaxBytesReader(w, r.Body, 2*maxBatchBytes)
+	if err := json.NewDecoder(body).Decode(&p); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeError(w, errorBatchTooLarge)
+		} else {
+			writeError(w, badRequest(err))
+		}
+		return
+	}
+
+	results := make([]*BatchResult, len(p.Ops))
+	allowed := make([]*BatchOp, 0, len(p.Ops))
+	for i, op := range p.Ops {
+		if err := t.n.authorize(token, true, op.Key); err != nil {
+			results[i] = &BatchResult{Key: op.Key, Error: toError(err)}
+			continue
+		}
+		allowed = append(allowed, op)
+	}
+
+	applied, err := t.n.WriteBatch(r.Context(), allowed)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	j := 0
+	for i := range results {
+		if results[i] == nil {
+			results[i] = applied[j]
+			j++
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string][]*BatchResult{"results": results})
+}
+
+// default and maximum time a long-polling watch waits for events
+const (
+	defaultPollTimeout = 30 * time.Second
+	maxPollTimeout     = 5 * time.Minute
+)
+
+// watchHandler serves watches of a key (GET /v1/watch?key=a) or of the keys
+// with a prefix (GET /v1/watch?prefix=a/), from the next write or from
+// revision=N. Clients accepting text/event-stream get the events as
+// Server-Sent Events, and resume from the Last-Event-ID header. The others
+// long-poll: they get the events as soon as there are some, or none after
+// timeout, along with the revision to poll next. Events of keys the client
+// can't read are left out.
+func (t *httpTransport) watchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	key, prefix := query.Get("key"), query.Has("prefix")
+	// the events of a prefix are checked one by one
+	keys := []string{key}
+	if prefix {
+		key, keys = query.Get("prefix"), nil
+	} else if key == "" {
+		writeError(w, badRequest(errors.New("watching needs a key or a prefix")))
+		return
+	}
+
+	if !t.authorized(w, r, false, keys...) {
+		return
+	}
+	token := requestToken(r)
+
+	revision, err := queryRevision(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if id := r.Header.Get("Last-Event-ID"); revision == 0 && id != "" {
+		last, err := strconv.ParseUint(id, 10, 64)
+		if err != nil {
+			writeError(w, badRequest(fmt.Errorf("invalid Last-Event-ID: %v", err)))
+			return
+		}
+		revision = last + 1
+	}
+
+	timeout := defaultPollTimeout
+	if d := query.Get("timeout"); d != "" {
+		var err error
+		if timeout, err = time.ParseDuration(d); err != nil || timeout < 0 {
+			writeError(w, badRequest(fmt.Errorf("invalid timeout %q", d)))
+			return
+		}
+		if timeout > maxPollTimeout {
+			timeout = maxPollTimeout
+		}
+	}
+
+	watcher, err := t.n.watch(r.Context(), key, prefix, revision)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	defer watcher.Close()
+
+	readable := func(e *Event) bool {
+		return t.n.authorize(token, false, e.Key) == nil
+	}
+	if strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		t.streamEvents(w, watcher, readable)
+		return
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	var events []*Event
+	select {
+	case e, ok := <-watcher.Events:
+		if ok {
+			events = append(events, e)
+		}
+	case <-timer.C:
+	}
+	more, err := t.n.watches.pending(watcher)
+	events = append(events, more...)
+	if len(events) == 0 && err != nil {
+		writeError(w, err)
+		return
+	}
+
+	resp := &watchResponse{Events: make([]*Event, 0, len(events)), Revision: watcher.from}
+	for _, e := range events {
+		if readable(e) {
+			resp.Events = append(resp.Events, e)
+		}
+		resp.Revision = e.Revision + 1
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// watchResponse is the body of a long-polling watch response
+type watchResponse struct {
+	Events []*Event `json:"events"`
+	// Revision is the revision to poll next
+	Revision uint64 `json:"revision"`
+}
+
+// streamEvents sends the events of a watcher as Server-Sent Events, until the
+// watch stops. Only the last event of a revision carries its id, so that
+// clients resuming from Last-Event-ID get whole revisions.
+func (t *httpTransport) streamEvents(w http.ResponseWriter, watcher *Watcher, readable func(*Event) bool) {
+	flusher := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for e := range watcher.Events {
+		events, _ := t.n.watches.pending(watcher)
+		events = append([]*Event{e}, events...)
+
+		var buf bytes.Buffer
+		for i, e := range events {
+			if readable(e) {
+				data, _ := json.Marshal(e)
+				fmt.Fprintf(&buf, "event: %s\ndata: %s\n", e.Type, data)
+			}
+			if i == len(events)-1 || events[i+1].Revision != e.Revision {
+				fmt.Fprintf(&buf, "id: %d\n", e.Revision)
+			}
+			if buf.Len() > 0 {
+				buf.WriteString("\n")
+				w.Write(buf.Bytes())
+				buf.Reset()
+			}
+		}
+		flusher.Flush()
+	}
+
+	if err := watcher.Err(); err != nil {
+		data, _ := json.Marshal(&errorEnvelope{Error: toError(err)})
+		fmt.Fprintf(w, "event: error\ndata: %s\n\n", data)
+		flusher.Flush()
+	}
+}
+
+// nodesHandler serves the list of nodes: GET /v1/nodes
+func (t *httpTransport) nodesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !t.authorized(w, r, false) {
+		return
+	}
+
+	nodes, err := t.n.ListNodes(r.Context())
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, nodes)
+}
+
+// aclHandler lists the principals (GET /v1/acl) or grants access to a token
+// (POST /v1/acl)
+func (t *httpTransport) aclHandler(w http.ResponseWriter, r *http.Request) {
+	if err := t.n.authorizeAdmin(requestToken(r)); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		list, err := t.n.ListAccess(r.Context())
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, list)
+
+	case http.MethodPost:
+		if !t.n.IsMaster() {
+			t.redirectToMaster(w, r)
+			return
+		}
+
+		var p struct {
+			Token string `json:"token"`
+			Principal
+		}
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			writeError(w, badRequest(err))
+			return
+		}
+		if p.Token == "" {
+			writeError(w, badRequest(errors.New("missing token")))
+			return
+		}
+
+		id, err := t.n.GrantAccess(r.Context(), p.Token, &p.Principal)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"id": id})
+
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// principalHandler revokes access: DELETE /v1/acl/{id}
+func (t *httpTransport) principalHandler(w http.ResponseWriter, r *http.Request) {
+	if err := t.n.authorizeAdmin(requestToken(r)); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if r.Method != http.MethodDelete {
+		w.Header().Set("Allow", "DELETE")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !t.n.IsMaster() {
+		t.redirectToMaster(w, r)
+		return
+	}
+
+	if err := t.n.RevokeAccess(r.Context(), strings.TrimPrefix(r.URL.Path, "/v1/acl/")); err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writeError writes the JSON error envelope with the status matching the
+// error code
+func writeError(w http.ResponseWriter, err error) {
+	e := toError(err)
+
+	status, ok := statusCodes[e.Code]
+	if !ok {
+		status = http.StatusInternalServerError
+	}
+
+	if e.Retryable {
+		w.Header().Set("Retry-After", "1")
+	}
+	writeJSON(w, status, &errorEnvelope{Error: e})
+}
+
+// errorEnvelope is the body of every error response
+type errorEnvelope struct {
+	Error *Error `json:"error"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", encoding)
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+func etag(version uint64) string {
+	return `"` + strconv.FormatUint(version, 10) + `"`
+}
+
+// matchesETag checks an If-Match or If-None-Match header against a version
+func matchesETag(header string, version uint64) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == etag(version) {
+			return true
+		}
+	}
+	return false
+}
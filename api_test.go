@@ -0,0 +1,237 @@
+package dkvs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// Test the /v1/keys resource on a master and a slave
+func TestKeysAPI(t *testing.T) {
+	masterAddr := ":4141"
+	slaveAddr := ":4242"
+
+	m, err := startMaster(masterAddr)
+	if m != nil {
+		defer m.Close()
+	}
+	if err != nil {
+		t.Errorf("creating a master failed with error: %v", err)
+		return
+	}
+
+	// wait for the server to start
+	time.Sleep(100 * time.Millisecond)
+
+	s, err := startSlave(slaveAddr, masterAddr)
+	if s != nil {
+		defer s.Close()
+	}
+	if err != nil {
+		t.Errorf("creating a slave failed with error: %v", err)
+		return
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	url := "http://" + masterAddr + "/v1/keys/img/1"
+	value := []byte{0x89, 'P', 'N', 'G', 0x00, 0xff, 0xfe}
+
+	// Create
+	req, _ := http.NewRequest(http.MethodPut, url, bytes.NewReader(value))
+	req.Header.Set("Content-Type", "image/png")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Errorf("error putting key: %v", err)
+		return
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		t.Errorf("expected status %d, got %d", http.StatusCreated, resp.StatusCode)
+		return
+	}
+	tag := resp.Header.Get("ETag")
+	if tag != `"1"` {
+		t.Errorf(`expected ETag "1", got %s`, tag)
+		return
+	}
+
+	// Read
+	resp, err = http.Get(url)
+	if err != nil {
+		t.Errorf("error getting key: %v", err)
+		return
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if !bytes.Equal(body, value) {
+		t.Errorf("expected %v, got %v", value, body)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "image/png" {
+		t.Errorf("expected content type image/png, got %s", ct)
+	}
+
+	// Head
+	resp, err = http.Head(url)
+	if err != nil {
+		t.Errorf("error heading key: %v", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("ETag") != tag {
+		t.Errorf("unexpected HEAD response: %d %s", resp.StatusCode, resp.Header.Get("ETag"))
+	}
+
+	// Conditional update with a stale ETag
+	req, _ = http.NewRequest(http.MethodPut, url, bytes.NewReader([]byte("x")))
+	req.Header.Set("If-Match", `"42"`)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Errorf("error putting key: %v", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusPreconditionFailed {
+		t.Errorf("expected status %d, got %d", http.StatusPreconditionFailed, resp.StatusCode)
+	}
+
+	// Conditional update with the current ETag
+	req, _ = http.NewRequest(http.MethodPut, url, bytes.NewReader([]byte("x")))
+	req.Header.Set("If-Match", tag)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Errorf("error putting key: %v", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent || resp.Header.Get("ETag") != `"2"` {
+		t.Errorf("unexpected PUT response: %d %s", resp.StatusCode, resp.Header.Get("ETag"))
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	// Batch read from the slave
+	resp, err = http.Get("http://" + slaveAddr + "/v1/keys?key=img/1&key=missing")
+	if err != nil {
+		t.Errorf("error getting keys: %v", err)
+		return
+	}
+	var items []struct {
+		Key     string `json:"key"`
+		Value   []byte `json:"value"`
+		Version uint64 `json:"version"`
+		Error   *Error `json:"error"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&items)
+	resp.Body.Close()
+	if err != nil {
+		t.Errorf("couldn't decode batch response: %v", err)
+		return
+	}
+	if len(items) != 2 {
+		t.Errorf("expected 2 items, got %d", len(items))
+		return
+	}
+	if string(items[0].Value) != "x" || items[0].Version != 2 {
+		t.Errorf("unexpected item: %+v", items[0])
+	}
+	if !errors.Is(items[1].Error, ErrorKeyNotFound) {
+		t.Errorf("expected %v, got %+v", ErrorKeyNotFound, items[1])
+	}
+
+	// Writing to the slave redirects to the master
+	noRedirect := &http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	req, _ = http.NewRequest(http.MethodDelete, "http://"+slaveAddr+"/v1/keys/img/1", nil)
+	resp, err = noRedirect.Do(req)
+	if err != nil {
+		t.Errorf("error deleting key: %v", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTemporaryRedirect || resp.Header.Get("Location") != "http://"+masterAddr+"/v1/keys/img/1" {
+		t.Errorf("unexpected redirect: %d %s", resp.StatusCode, resp.Header.Get("Location"))
+	}
+
+	// Delete, following the redirect
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Errorf("error deleting key: %v", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("expected status %d, got %d", http.StatusNoContent, resp.StatusCode)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	resp, err = http.Get("http://" + slaveAddr + "/v1/keys/img/1")
+	if err != nil {
+		t.Errorf("error getting key: %v", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected status %d, got %d", http.StatusNotFound, resp.StatusCode)
+	}
+
+	// Create again: the key is created, and keeps increasing its version
+	req, _ = http.NewRequest(http.MethodPut, url, bytes.NewReader(value))
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Errorf("error putting key: %v", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated || resp.Header.Get("ETag") != `"3"` {
+		t.Errorf("unexpected PUT response: %d %s", resp.StatusCode, resp.Header.Get("ETag"))
+	}
+}
+
+// Test that values that aren't valid UTF-8 are written, replicated and read
+// unchanged
+func TestBinaryValues(t *testing.T) {
+	ctx := context.Background()
+	net := NewMemoryNetwork()
+	m, _ := memoryCluster(t, net, WriteConcernAll, "slave:1")
+
+	val := make([]byte, 256)
+	for i := range val {
+		val[i] = byte(i)
+	}
+
+	c := net.Client("slave:1")
+	if err := c.Put(ctx, "bin", val); err != nil {
+		t.Fatalf("put failed: %v", err)
+	}
+	if actual, err := c.Get(ctx, "bin"); err != nil || !bytes.Equal(actual, val) {
+		t.Errorf("expected the value to be read unchanged, got %v (%v)", actual, err)
+	}
+	page, err := c.Prefix(ctx, "bin", 0)
+	if err != nil || len(page.Items) != 1 || !bytes.Equal(page.Items[0].Value, val) {
+		t.Errorf("expected the value to be scanned unchanged, got %+v (%v)", page, err)
+	}
+
+	// a slave joining later gets the value through the initial replication
+	s, err := startSlave("slave:2", m.Address, WithConfig(m.config), WithTransport(net.Transport()))
+	if s != nil {
+		defer s.Close()
+	}
+	if err != nil {
+		t.Fatalf("creating a slave failed: %v", err)
+	}
+	if actual, err := s.ReadValue(ctx, "bin"); err != nil || !bytes.Equal(actual, val) {
+		t.Errorf("expected the value to be replicated unchanged, got %v (%v)", actual, err)
+	}
+}
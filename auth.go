@@ -0,0 +1,190 @@
+package dkvs
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// headers carrying the signature of node to node requests
+const (
+	headerNode      = "X-Dkvs-Node"
+	headerTimestamp = "X-Dkvs-Timestamp"
+	headerSignature = "X-Dkvs-Signature"
+	// streamed bodies are only known once sent: the headers are signed
+	// without them, and the signature of the whole request is sent as a
+	// trailer
+	headerStreamSignature = "X-Dkvs-Stream-Signature"
+)
+
+// signed requests older or newer than this are rejected, to limit replays
+const maxClockSkew = 30 * time.Second
+
+// signature computes the HMAC of a request, binding the route, the sender,
+// the time and the payload together
+func signature(secret []byte, method, path, nodeID, timestamp string, body []byte) string {
+	sum := sha256.Sum256(body)
+	return signDigest(secret, method, path, nodeID, timestamp, sum[:])
+}
+
+// signDigest computes the HMAC of a request from the hash of its payload. The
+// headers of streamed requests are signed without any.
+func signDigest(secret []byte, method, path, nodeID, timestamp string, digest []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(method + "\n" + path + "\n" + nodeID + "\n" + timestamp + "\n"))
+	mac.Write(digest)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// sign adds the sender ID, the time and the signature to a request
+func (n *Node) sign(r *http.Request, body []byte) {
+	if len(n.secret) == 0 {
+		return
+	}
+
+	timestamp := strconv.FormatInt(n.now().Unix(), 10)
+
+	r.Header.Set(headerNode, n.ID)
+	r.Header.Set(headerTimestamp, timestamp)
+	r.Header.Set(headerSignature, signature(n.secret, r.Method, r.URL.RequestURI(), n.ID, timestamp, body))
+}
+
+// signStream signs the headers of a request whose body is streamed, and
+// returns the body to send, which sets the signature of the whole request as
+// a trailer once read
+func (n *Node) signStream(r *http.Request, body io.Reader) io.Reader {
+	if len(n.secret) == 0 {
+		return body
+	}
+
+	timestamp := strconv.FormatInt(n.now().Unix(), 10)
+	path := r.URL.RequestURI()
+
+	r.Header.Set(headerNode, n.ID)
+	r.Header.Set(headerTimestamp, timestamp)
+	r.Header.Set(headerStreamSignature, signDigest(n.secret, r.Method, path, n.ID, timestamp, nil))
+	r.Trailer = http.Header{headerSignature: nil}
+
+	return &hashingReader{r: body, hash: sha256.New(), eof: func(sum []byte) error {
+		r.Trailer.Set(headerSignature, signDigest(n.secret, r.Method, path, n.ID, timestamp, sum))
+		return nil
+	}}
+}
+
+// authenticate checks the signature of a request sent by another node, and
+// returns the ID of the sender
+func (n *Node) authenticate(r *http.Request) (string, error) {
+	sender := r.Header.Get(headerNode)
+	if len(n.secret) == 0 {
+		return sender, nil
+	}
+
+	timestamp := r.Header.Get(headerTimestamp)
+	if !n.recent(timestamp) {
+		return "", ErrorUnauthorized
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return "", err
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	expected := signature(n.secret, r.Method, r.URL.RequestURI(), sender, timestamp, body)
+	if !hmac.Equal([]byte(expected), []byte(r.Header.Get(headerSignature))) {
+		return "", ErrorUnauthorized
+	}
+
+	return sender, nil
+}
+
+// authenticateStream checks the signature of the headers of a streamed
+// request sent by another node, and returns the ID of the sender. The body is
+// checked while it is read: reading it fails at its end if its signature
+// doesn't match.
+func (n *Node) authenticateStream(r *http.Request) (string, error) {
+	sender := r.Header.Get(headerNode)
+	if len(n.secret) == 0 {
+		return sender, nil
+	}
+
+	timestamp := r.Header.Get(headerTimestamp)
+	if !n.recent(timestamp) {
+		return "", ErrorUnauthorized
+	}
+
+	path := r.URL.RequestURI()
+	expected := signDigest(n.secret, r.Method, path, sender, timestamp, nil)
+	if !hmac.Equal([]byte(expected), []byte(r.Header.Get(headerStreamSignature))) {
+		return "", ErrorUnauthorized
+	}
+
+	r.Body = ioutil.NopCloser(&hashingReader{r: r.Body, hash: sha256.New(), eof: func(sum []byte) error {
+		// the trailer is read along with the end of the body
+		expected := signDigest(n.secret, r.Method, path, sender, timestamp, sum)
+		if !hmac.Equal([]byte(expected), []byte(r.Trailer.Get(headerSignature))) {
+			return ErrorUnauthorized
+		}
+		return nil
+	}})
+
+	return sender, nil
+}
+
+// recent checks that a request was signed within the allowed clock skew
+func (n *Node) recent(timestamp string) bool {
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	skew := n.now().Sub(time.Unix(seconds, 0))
+	return skew <= maxClockSkew && skew >= -maxClockSkew
+}
+
+// hashingReader hashes what it reads, and calls eof with the hash at the end
+// of the data; an error of eof replaces io.EOF
+type hashingReader struct {
+	r    io.Reader
+	hash hash.Hash
+	eof  func(sum []byte) error
+	err  error
+	done bool
+}
+
+func (h *hashingReader) Read(p []byte) (int, error) {
+	if h.done {
+		return 0, h.err
+	}
+
+	n, err := h.r.Read(p)
+	h.hash.Write(p[:n])
+	if err == io.EOF {
+		h.done = true
+		h.err = io.EOF
+		if eofErr := h.eof(h.hash.Sum(nil)); eofErr != nil {
+			h.err = eofErr
+		}
+		return n, h.err
+	}
+	return n, err
+}
+
+// isFromMaster checks that a request was sent by the master. A slave that
+// hasn't received the nodes list yet doesn't know its master, and accepts
+// any authenticated node. The sender is only authenticated by the cluster
+// secret, which every node holds: without mutual TLS, this only stops callers
+// without the secret, as any node can claim to be the master.
+func (n *Node) isFromMaster(sender string) bool {
+	n.nMutex.RLock()
+	defer n.nMutex.RUnlock()
+
+	master := n.masterID()
+	return master == "" || master == sender
+}
@@ -0,0 +1,151 @@
+package dkvs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Test that slaves only apply writes signed by their master
+func TestSignedReplication(t *testing.T) {
+	masterAddr := ":5353"
+	slaveAddr := ":5454"
+
+	mc := DefaultConfig(masterAddr)
+	mc.ClusterSecret = "s3cret"
+
+	m, err := startMaster(masterAddr, WithConfig(mc))
+	if m != nil {
+		defer m.Close()
+	}
+	if err != nil {
+		t.Errorf("creating a master failed with error: %v", err)
+		return
+	}
+
+	// wait for the server to start
+	time.Sleep(100 * time.Millisecond)
+
+	s, err := startSlave(slaveAddr, masterAddr, WithConfig(mc))
+	if s != nil {
+		defer s.Close()
+	}
+	if err != nil {
+		t.Errorf("creating a slave failed with error: %v", err)
+		return
+	}
+
+	if err := m.WriteValue(context.Background(), "key", []byte("val")); err != nil {
+		t.Errorf("write failed: %v", err)
+		return
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	if val, err := s.ReadValue(context.Background(), "key"); err != nil || string(val) != "val" {
+		t.Errorf(`expected "val", got "%s" (%v)`, val, err)
+		return
+	}
+
+	payload := []byte(`{"key": "key", "entry": {"v": "hacked", "n": 99}}`)
+	url := "http://" + slaveAddr + "/receive"
+
+	type testCase struct {
+		name     string
+		sender   *Node
+		expected error
+	}
+
+	testCases := []*testCase{
+		// unsigned
+		{name: "unsigned", sender: &Node{ID: m.ID, client: &http.Client{}}, expected: ErrorUnauthorized},
+		// signed with another secret
+		{name: "wrong secret", sender: &Node{ID: m.ID, client: &http.Client{}, secret: []byte("guess")}, expected: ErrorUnauthorized},
+		// signed by a node of the cluster which isn't the master
+		{name: "not master", sender: &Node{ID: "intruder", client: &http.Client{}, secret: []byte("s3cret")}, expected: ErrorForbidden},
+	}
+
+	for _, test := range testCases {
+		resp, err := test.sender.post(context.Background(), url, encoding, bytes.NewReader(payload))
+		if err != nil {
+			t.Errorf("%s: error posting /receive: %v", test.name, err)
+			continue
+		}
+		err = decodeError(resp)
+		resp.Body.Close()
+
+		if !errors.Is(err, test.expected) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, err)
+		}
+	}
+
+	if val, err := s.ReadValue(context.Background(), "key"); err != nil || string(val) != "val" {
+		t.Errorf(`expected "val", got "%s" (%v)`, val, err)
+	}
+}
+
+// Test that streamed requests are signed by their trailer
+func TestSignedStream(t *testing.T) {
+	receiver := &Node{secret: []byte("s3cret")}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := receiver.authenticateStream(r); err != nil {
+			writeError(w, err)
+			return
+		}
+		if _, err := ioutil.ReadAll(r.Body); err != nil {
+			writeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	type testCase struct {
+		name     string
+		secret   string
+		tamper   bool
+		expected error
+	}
+
+	testCases := []*testCase{
+		{name: "signed", secret: "s3cret"},
+		{name: "wrong secret", secret: "guess", expected: ErrorUnauthorized},
+		// data appended to the body once the trailer was computed
+		{name: "tampered", secret: "s3cret", tamper: true, expected: ErrorUnauthorized},
+	}
+
+	for _, test := range testCases {
+		sender := &Node{ID: "master", secret: []byte(test.secret)}
+
+		req, err := http.NewRequest(http.MethodPost, srv.URL+"/replicate?index=1", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var body io.Reader = sender.signStream(req, strings.NewReader("data"))
+		if test.tamper {
+			body = io.MultiReader(body, strings.NewReader("more data"))
+		}
+		req.Body = ioutil.NopCloser(body)
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Errorf("%s: error posting the stream: %v", test.name, err)
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			err = decodeError(resp)
+		}
+		resp.Body.Close()
+
+		if !errors.Is(err, test.expected) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, err)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package dkvs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+const (
+	// maximum number of writes of a batch
+	maxBatchOps = 1000
+	// maximum size of the keys and values of a batch
+	maxBatchBytes = 4 << 20
+)
+
+var errorBatchTooLarge = &Error{
+	Code:    CodeTooLarge,
+	Message: fmt.Sprintf("a batch has at most %d writes and %d bytes of keys and values", maxBatchOps, maxBatchBytes),
+}
+
+// BatchOp is a write of a batch: a put or the deletion of a key. When Version
+// isn't 0, the write only succeeds if it matches the current version of the
+// key.
+type BatchOp struct {
+	Op          string `json:"op"`
+	Key         string `json:"key"`
+	Value       []byte `json:"value,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	Version     uint64 `json:"version,omitempty"`
+}
+
+// BatchResult is the outcome of a write of a batch
+type BatchResult struct {
+	Key string `json:"key"`
+	// Version is the new version of the key, 0 for deletions
+	Version uint64 `json:"version,omitempty"`
+	// Error tells why the write wasn't applied
+	Error *Error `json:"error,omitempty"`
+}
+
+// validate rejects a write that can't be applied whatever the data
+func (op *BatchOp) validate() error {
+	if op.Key == "" {
+		return badRequest(errors.New("write without key"))
+	}
+	if op.Op != OpPut && op.Op != OpDelete {
+		return badRequest(fmt.Errorf("unknown write %q", op.Op))
+	}
+	return nil
+}
+
+// prepareBatch checks the writes of a batch in order against the current
+// versions of the keys, each write seeing the previous ones. It returns the
+// write applying each operation, or why it can't be applied. Storages call it
+// while holding their lock.
+func prepareBatch(ops []*BatchOp, lookup versionLookup) ([]*Write, []error, error) {
+	writes := make([]*Write, len(ops))
+	errs := make([]error, len(ops))
+	pending := make(map[string]*Write)
+	// last version of each key, which a deleted key keeps
+	last := make(map[string]uint64)
+
+	for i, op := range ops {
+		current, ok := pending[op.Key]
+		if !ok {
+			e, v, err := lookup(op.Key)
+			if err != nil {
+				return nil, nil, err
+			}
+			current = &Write{Key: op.Key, Entry: e}
+			last[op.Key] = v
+		}
+
+		var version uint64
+		if current.Entry != nil {
+			version = current.Entry.Version
+		}
+		switch {
+		case op.Version != 0 && op.Version != version:
+			errs[i] = ErrorConflict
+			continue
+		case op.Op == OpDelete && current.Entry == nil:
+			errs[i] = ErrorKeyNotFound
+			continue
+		}
+
+		w := &Write{Key: op.Key}
+		if op.Op == OpPut {
+			w.Entry = &Entry{
+				Value:       append([]byte{}, op.Value...),
+				ContentType: op.ContentType,
+				Version:     last[op.Key] + 1,
+			}
+			last[op.Key] = w.Entry.Version
+		}
+		writes[i] = w
+		pending[op.Key] = w
+	}
+	return writes, errs, nil
+}
+
+// applied returns the writes of a batch that were applied, in order
+func applied(writes []*Write) []*Write {
+	result := make([]*Write, 0, len(writes))
+	for _, w := range writes {
+		if w != nil {
+			result = append(result, w)
+		}
+	}
+	return result
+}
+
+// WriteBatch applies many writes at once on the master, and pushes them to
+// the slaves as a single message. Writes that can't be applied, such as
+// deletions of missing keys or writes expecting another version, are
+// reported in their result, and the others are applied together. The error
+// is about the batch as a whole: too large, or not replicated for the write
+// concern.
+// This can only be run on the master.
+func (n *Node) WriteBatch(ctx context.Context, ops []*BatchOp) ([]*BatchResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if !n.IsMaster() {
+		return nil, ErrorNotMaster
+	}
+
+	size := 0
+	for _, op := range ops {
+		size += len(op.Key) + len(op.Value)
+	}
+	if len(ops) > maxBatchOps || size > maxBatchBytes {
+		return nil, errorBatchTooLarge
+	}
+
+	results := make([]*BatchResult, len(ops))
+	valid := make([]*BatchOp, 0, len(ops))
+	keys := make([]string, 0, len(ops))
+	for i, op := range ops {
+		results[i] = &BatchResult{Key: op.Key}
+		if err := op.validate(); err != nil {
+			results[i].Error = toError(err)
+			continue
+		}
+		valid = append(valid, op)
+		keys = append(keys, op.Key)
+	}
+
+	var writes []*Write
+	var errs []error
+	_, span := n.startSpan(ctx, "storage.batch")
+	index, err := n.commit(keys, func() ([]*Write, error) {
+		var err error
+		writes, errs, err = n.storage.Batch(valid)
+		return applied(writes), err
+	})
+	span.finish(err)
+	if err != nil {
+		return nil, err
+	}
+
+	j := 0
+	for _, r := range results {
+		if r.Error != nil {
+			continue
+		}
+		if errs[j] != nil {
+			r.Error = toError(errs[j])
+		} else if writes[j].Entry != nil {
+			r.Version = writes[j].Entry.Version
+		}
+		j++
+	}
+
+	if writes = applied(writes); len(writes) == 0 {
+		return results, nil
+	}
+	return results, n.pushWritesToSlaves(ctx, index, writes)
+}
@@ -0,0 +1,111 @@
+package dkvs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"testing"
+)
+
+// Test batches through a slave, which redirects them to the master
+func TestWriteBatch(t *testing.T) {
+	ctx := context.Background()
+	net := NewMemoryNetwork()
+	m, slaves := memoryCluster(t, net, WriteConcernAll, "slave:1")
+	s := slaves[0]
+	c := net.Client("slave:1")
+
+	m.WriteValue(ctx, "existing", []byte("0"))
+
+	// a batch is pushed to the slave as a single message
+	var messages int32
+	net.SetFaults(func(from, to string, msg *Message) Fault {
+		if msg.Kind == MessageWrite || msg.Kind == MessageWrites {
+			atomic.AddInt32(&messages, 1)
+		}
+		return Fault{}
+	})
+
+	ops := []*BatchOp{
+		{Op: OpPut, Key: "a", Value: []byte("1")},
+		{Op: OpPut, Key: "a", Value: []byte("2"), Version: 1},
+		{Op: OpPut, Key: "b", Value: []byte("1"), Version: 3},
+		{Op: OpDelete, Key: "missing"},
+		{Op: OpDelete, Key: "existing"},
+		{Op: "increment", Key: "c"},
+		{Op: OpPut, Key: reservedPrefix + "acl"},
+	}
+	results, err := c.WriteBatch(ctx, ops)
+	if err != nil {
+		t.Fatalf("batch failed: %v", err)
+	}
+
+	expected := []struct {
+		version uint64
+		err     error
+	}{
+		{1, nil},
+		{2, nil},
+		{0, ErrorConflict},
+		{0, ErrorKeyNotFound},
+		{0, nil},
+		{0, &Error{Code: CodeBadRequest}},
+		{0, ErrorForbidden},
+	}
+	if len(results) != len(expected) {
+		t.Fatalf("expected %d results, got %d", len(expected), len(results))
+	}
+	for i, r := range results {
+		if r.Key != ops[i].Key || r.Version != expected[i].version || (r.Error == nil) != (expected[i].err == nil) ||
+			(r.Error != nil && !errors.Is(r.Error, expected[i].err)) {
+			t.Errorf("%d: expected version %d and error %v, got %+v", i, expected[i].version, expected[i].err, r)
+		}
+	}
+
+	expectValue(t, s, "a", "2")
+	if _, err := s.ReadValue(ctx, "existing"); !errors.Is(err, ErrorKeyNotFound) {
+		t.Errorf("expected the key to be deleted, got %v", err)
+	}
+	if n := atomic.LoadInt32(&messages); n != 1 {
+		t.Errorf("expected 1 replication message, got %d", n)
+	}
+
+	tooLarge := make([]*BatchOp, maxBatchOps+1)
+	for i := range tooLarge {
+		tooLarge[i] = &BatchOp{Op: OpPut, Key: fmt.Sprintf("k%d", i)}
+	}
+	if _, err := c.WriteBatch(ctx, tooLarge); !errors.Is(err, &Error{Code: CodeTooLarge}) {
+		t.Errorf("expected the batch to be too large, got %v", err)
+	}
+	if _, err := c.WriteBatch(ctx, []*BatchOp{{Op: OpPut, Key: "big", Value: make([]byte, maxBatchBytes)}}); !errors.Is(err, &Error{Code: CodeTooLarge}) {
+		t.Errorf("expected the batch to be too large, got %v", err)
+	}
+}
+
+// Test that storages see the previous writes of a batch
+func TestStorageBatch(t *testing.T) {
+	lsm, err := OpenLSM(t.TempDir(), nil)
+	if err != nil {
+		t.Fatalf("opening failed: %v", err)
+	}
+	defer lsm.Close()
+
+	for name, s := range map[string]Storage{"memory": NewStore(), "lsm": lsm} {
+		writes, errs, err := s.Batch([]*BatchOp{
+			{Op: OpPut, Key: "a", Value: []byte("1")},
+			{Op: OpDelete, Key: "a", Version: 1},
+			{Op: OpDelete, Key: "a"},
+			{Op: OpPut, Key: "a", Value: []byte("2"), Version: 2},
+		})
+		if err != nil || errs[0] != nil || errs[1] != nil || errs[2] != ErrorKeyNotFound || errs[3] != ErrorConflict {
+			t.Errorf("%s: unexpected errors %v (%v)", name, errs, err)
+		}
+		if len(writes) != 4 || writes[0].Entry.Version != 1 || writes[1].Entry != nil || writes[2] != nil {
+			t.Errorf("%s: unexpected writes %+v", name, writes)
+		}
+		if _, err := s.Lookup("a"); err != ErrorKeyNotFound {
+			t.Errorf("%s: expected a to be deleted, got %v", name, err)
+		}
+	}
+}
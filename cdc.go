@@ -0,0 +1,603 @@
+package dkvs
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// files of the change log, in the CDC directory, named after the offset
+	// of their first change in the log
+	changeLogPrefix = "changes-"
+	changeLogSuffix = ".log"
+	// file of the change log before it was split, read as its first segment
+	legacyChangeLogFile = "changes.log"
+	// size above which the change log starts a new segment when it isn't set
+	defaultCDCSegmentSize = 64 << 20
+	// changes delivered at once when the batch size isn't set
+	defaultCDCBatchSize = 100
+	// delay between two deliveries of the same changes when it isn't set
+	defaultCDCRetryDelay = time.Second
+)
+
+// Change is a write applied by a node, as streamed to the sinks
+type Change struct {
+	// Revision is the replication index of the write; the writes of a
+	// transaction or of a batch share the same revision
+	Revision uint64 `json:"revision"`
+	// Time is when the node applied the write
+	Time        time.Time `json:"time"`
+	Type        string    `json:"type"`
+	Key         string    `json:"key"`
+	Value       []byte    `json:"value,omitempty"`
+	ContentType string    `json:"content_type,omitempty"`
+	Version     uint64    `json:"version,omitempty"`
+	// OldValue and OldVersion are the entry replaced or deleted; OldVersion
+	// is 0 when the key didn't exist
+	OldValue   []byte `json:"old_value,omitempty"`
+	OldVersion uint64 `json:"old_version,omitempty"`
+}
+
+// Sink receives the changes applied by a node, in order. Failed deliveries
+// are retried with the same changes, and changes delivered right before the
+// node stops may be delivered again when it restarts, so a sink can get a
+// change more than once; its key and version identify it.
+type Sink interface {
+	Deliver(ctx context.Context, changes []*Change) error
+	Close() error
+}
+
+// encodeChanges writes changes as JSON lines
+func encodeChanges(changes []*Change) []byte {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for _, c := range changes {
+		encoder.Encode(c)
+	}
+	return buf.Bytes()
+}
+
+// NewWriterSink creates a sink writing the changes to w as JSON lines, e.g.
+// to os.Stdout
+func NewWriterSink(w io.Writer) Sink {
+	return &writerSink{w: w}
+}
+
+type writerSink struct {
+	w io.Writer
+}
+
+func (s *writerSink) Deliver(ctx context.Context, changes []*Change) error {
+	_, err := s.w.Write(encodeChanges(changes))
+	return err
+}
+
+func (s *writerSink) Close() error {
+	return nil
+}
+
+// NewFileSink creates a sink appending the changes to the file at path as
+// JSON lines, synced after each delivery
+func NewFileSink(path string) (Sink, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &fileSink{f: f}, nil
+}
+
+type fileSink struct {
+	f *os.File
+}
+
+func (s *fileSink) Deliver(ctx context.Context, changes []*Change) error {
+	if _, err := s.f.Write(encodeChanges(changes)); err != nil {
+		return err
+	}
+	return s.f.Sync()
+}
+
+func (s *fileSink) Close() error {
+	return s.f.Close()
+}
+
+// NewWebhookSink creates a sink posting the changes to url as JSON lines,
+// with the content type application/x-ndjson. Responses other than 2xx fail
+// the delivery.
+func NewWebhookSink(url string) Sink {
+	return &webhookSink{url: url, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+type webhookSink struct {
+	url    string
+	client *http.Client
+}
+
+func (s *webhookSink) Deliver(ctx context.Context, changes []*Change) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(encodeChanges(changes)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
+
+func (s *webhookSink) Close() error {
+	s.client.CloseIdleConnections()
+	return nil
+}
+
+// changeLog appends the changes applied by a node to files, which each sink
+// streams from the offset it reached, persisted after each delivery. Changes
+// are delivered at least once, even across restarts.
+//
+// The log is split into segments: a new one is started once the last one is
+// larger than the segment size, and the segments delivered to every sink are
+// deleted.
+type changeLog struct {
+	n    *Node
+	dir  string
+	lock sync.Mutex
+	// last segment, which changes are appended to
+	f *os.File
+	// offsets of the first change of each segment, oldest first
+	segments []int64
+	// offset following the last change
+	size int64
+	// offset reached by each sink
+	delivered map[string]int64
+	// closed and replaced when changes are appended
+	appended chan struct{}
+
+	sinks       map[string]Sink
+	segmentSize int64
+	batchSize   int
+	retryDelay  time.Duration
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// openChangeLog creates the sinks of the cdc settings, and opens the change
+// log when the node has sinks
+func (n *Node) openChangeLog(sinks map[string]Sink) error {
+	c := n.config.CDC
+	if c == nil {
+		if len(sinks) > 0 {
+			return &ConfigError{"cdc.dir", "is required by the sinks"}
+		}
+		return nil
+	}
+
+	all := make(map[string]Sink, len(sinks)+3)
+	for name, s := range sinks {
+		all[name] = s
+	}
+	if c.File != "" {
+		s, err := NewFileSink(c.File)
+		if err != nil {
+			return fmt.Errorf("opening cdc file: %v", err)
+		}
+		all["file"] = s
+	}
+	if c.Stdout {
+		all["stdout"] = NewWriterSink(os.Stdout)
+	}
+	if c.Webhook != "" {
+		all["webhook"] = NewWebhookSink(c.Webhook)
+	}
+	if len(all) == 0 {
+		return nil
+	}
+
+	l, err := openChangeLog(n, c, all)
+	if err != nil {
+		return fmt.Errorf("opening change log: %v", err)
+	}
+	n.changes = l
+	return nil
+}
+
+// openChangeLog opens the change log in the directory of the config, and
+// starts streaming it to the sinks
+func openChangeLog(n *Node, c *CDCConfig, sinks map[string]Sink) (*changeLog, error) {
+	if err := os.MkdirAll(c.Dir, 0755); err != nil {
+		return nil, err
+	}
+	segments, err := listSegments(c.Dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(segments) == 0 {
+		segments = []int64{0}
+	}
+
+	last := segments[len(segments)-1]
+	f, err := os.OpenFile(segmentPath(c.Dir, last), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	l := &changeLog{
+		n:           n,
+		dir:         c.Dir,
+		f:           f,
+		segments:    segments,
+		size:        last + info.Size(),
+		delivered:   make(map[string]int64, len(sinks)),
+		appended:    make(chan struct{}),
+		sinks:       sinks,
+		segmentSize: int64(c.SegmentSize),
+		batchSize:   c.BatchSize,
+		retryDelay:  time.Duration(c.RetryDelay),
+	}
+	if l.segmentSize == 0 {
+		l.segmentSize = defaultCDCSegmentSize
+	}
+	if l.batchSize == 0 {
+		l.batchSize = defaultCDCBatchSize
+	}
+	if l.retryDelay == 0 {
+		l.retryDelay = defaultCDCRetryDelay
+	}
+	l.ctx, l.cancel = context.WithCancel(context.Background())
+
+	// the offsets are read before streaming, so that no segment is deleted
+	// before every sink is accounted for
+	for name := range sinks {
+		offset, err := readOffset(l.offsetPath(name))
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("reading the offset of sink %s: %v", name, err)
+		}
+		if offset < segments[0] || offset > l.size {
+			n.logWarn("the change log doesn't hold the offset of a sink, streaming it from its start",
+				"sink", name, "offset", offset)
+			offset = segments[0]
+		}
+		l.delivered[name] = offset
+	}
+
+	for name, s := range sinks {
+		l.wg.Add(1)
+		go l.stream(name, s, l.delivered[name])
+	}
+	return l, nil
+}
+
+// segmentPath returns the path of the segment starting at an offset
+func segmentPath(dir string, offset int64) string {
+	return filepath.Join(dir, fmt.Sprintf("%s%020d%s", changeLogPrefix, offset, changeLogSuffix))
+}
+
+// listSegments returns the offsets of the segments of the change log, oldest
+// first. The log written before it was split becomes the first segment.
+func listSegments(dir string) ([]int64, error) {
+	legacy := filepath.Join(dir, legacyChangeLogFile)
+	if _, err := os.Stat(legacy); err == nil {
+		if err := os.Rename(legacy, segmentPath(dir, 0)); err != nil {
+			return nil, err
+		}
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var segments []int64
+	for _, f := range files {
+		name := f.Name()
+		if !strings.HasPrefix(name, changeLogPrefix) || !strings.HasSuffix(name, changeLogSuffix) {
+			continue
+		}
+		offset, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(name, changeLogPrefix), changeLogSuffix), 10, 64)
+		if err == nil {
+			segments = append(segments, offset)
+		}
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i] < segments[j] })
+	return segments, nil
+}
+
+// offsetPath returns the path of the file holding the offset of a sink
+func (l *changeLog) offsetPath(name string) string {
+	return filepath.Join(l.dir, name+".offset")
+}
+
+// previousEntries reads the entries of keys before they are written, for the
+// change log
+func (n *Node) previousEntries(keys []string) map[string]*Entry {
+	if n.changes == nil {
+		return nil
+	}
+
+	previous := make(map[string]*Entry, len(keys))
+	for _, key := range keys {
+		if e, err := n.storage.Lookup(key); err == nil {
+			previous[key] = e
+		}
+	}
+	return previous
+}
+
+// publish notifies the watchers of writes, and appends them to the change
+// log; the caller must hold the lock of the watches
+func (n *Node) publish(index uint64, writes []*Write, previous map[string]*Entry) {
+	n.watches.publish(index, writes)
+
+	if n.changes == nil {
+		return
+	}
+	if err := n.changes.append(index, n.now(), writes, previous); err != nil {
+		n.logError("appending to the change log failed", "index", index, "error", err)
+	}
+}
+
+// append adds the changes of writes to the log, and wakes the sinks up once
+// they are synced to the disk. The keys reserved by dkvs, such as the ACL,
+// aren't changes.
+func (l *changeLog) append(index uint64, at time.Time, writes []*Write, previous map[string]*Entry) error {
+	changes := make([]*Change, 0, len(writes))
+	for _, w := range writes {
+		if strings.HasPrefix(w.Key, reservedPrefix) {
+			continue
+		}
+
+		c := &Change{Revision: index, Time: at, Type: EventDelete, Key: w.Key}
+		if w.Entry != nil {
+			c.Type = EventPut
+			c.Value = w.Entry.Value
+			c.ContentType = w.Entry.ContentType
+			c.Version = w.Entry.Version
+		}
+		if old := previous[w.Key]; old != nil {
+			c.OldValue = old.Value
+			c.OldVersion = old.Version
+		}
+		// a batch can write a key more than once
+		previous[w.Key] = w.Entry
+		changes = append(changes, c)
+	}
+	if len(changes) == 0 {
+		return nil
+	}
+	data := encodeChanges(changes)
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	start := l.segments[len(l.segments)-1]
+	if l.size-start >= l.segmentSize {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+		start = l.size
+	}
+
+	_, err := l.f.Write(data)
+	if err == nil {
+		err = l.f.Sync()
+	}
+	if err != nil {
+		// sinks only read whole lines, which are on the disk
+		l.f.Truncate(l.size - start)
+		return err
+	}
+	l.size += int64(len(data))
+	close(l.appended)
+	l.appended = make(chan struct{})
+	return nil
+}
+
+// rotate starts a new segment at the end of the log; the caller holds the
+// lock
+func (l *changeLog) rotate() error {
+	f, err := os.OpenFile(segmentPath(l.dir, l.size), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	l.f.Close()
+	l.f = f
+	l.segments = append(l.segments, l.size)
+	return nil
+}
+
+// segment returns the offsets of the start and of the end of the segment
+// holding an offset; the caller holds the lock
+func (l *changeLog) segment(offset int64) (int64, int64) {
+	i := sort.Search(len(l.segments), func(i int) bool { return l.segments[i] > offset }) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i == len(l.segments)-1 {
+		return l.segments[i], l.size
+	}
+	return l.segments[i], l.segments[i+1]
+}
+
+// deliver records the offset reached by a sink, and deletes the segments
+// every sink delivered
+func (l *changeLog) deliver(name string, offset int64) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.delivered[name] = offset
+	for _, o := range l.delivered {
+		if o < offset {
+			offset = o
+		}
+	}
+	for len(l.segments) > 1 && l.segments[1] <= offset {
+		if err := os.Remove(segmentPath(l.dir, l.segments[0])); err != nil && !os.IsNotExist(err) {
+			l.n.logError("deleting a segment of the change log failed", "offset", l.segments[0], "error", err)
+			return
+		}
+		l.segments = l.segments[1:]
+	}
+}
+
+// stream delivers the log to a sink from its offset, until the log is closed
+func (l *changeLog) stream(name string, s Sink, offset int64) {
+	defer l.wg.Done()
+
+	// segment being read, and its offset
+	var r *os.File
+	var opened int64
+	defer func() {
+		if r != nil {
+			r.Close()
+		}
+	}()
+
+	for {
+		l.lock.Lock()
+		start, end := l.segment(offset)
+		size, appended := l.size, l.appended
+		l.lock.Unlock()
+
+		if offset == size {
+			select {
+			case <-appended:
+				continue
+			case <-l.ctx.Done():
+				return
+			}
+		}
+
+		if r == nil || opened != start {
+			if r != nil {
+				r.Close()
+			}
+			var err error
+			if r, err = os.Open(segmentPath(l.dir, start)); err != nil {
+				l.n.logError("opening the change log failed", "sink", name, "offset", start, "error", err)
+				return
+			}
+			opened = start
+		}
+
+		changes, next, err := readChanges(r, offset-start, end-start, l.batchSize)
+		if err != nil {
+			l.n.logError("reading the change log failed", "sink", name, "offset", offset, "error", err)
+			return
+		}
+
+		for try := 1; ; try++ {
+			err := s.Deliver(l.ctx, changes)
+			if err == nil {
+				l.n.metrics.cdcDeliveries.inc(name, "success")
+				break
+			}
+			if l.ctx.Err() != nil {
+				return
+			}
+
+			l.n.metrics.cdcDeliveries.inc(name, "failure")
+			l.n.logWarn("delivering changes failed", "sink", name, "try", try, "error", err)
+			select {
+			case <-time.After(l.retryDelay):
+			case <-l.ctx.Done():
+				return
+			}
+		}
+
+		offset = start + next
+		if err := writeOffset(l.offsetPath(name), offset); err != nil {
+			l.n.logError("saving the offset of a sink failed", "sink", name, "error", err)
+			continue
+		}
+		l.deliver(name, offset)
+	}
+}
+
+// readChanges reads at most max changes of the log from offset, and returns
+// the offset following them
+func readChanges(r io.ReaderAt, offset, size int64, max int) ([]*Change, int64, error) {
+	reader := bufio.NewReader(io.NewSectionReader(r, offset, size-offset))
+
+	var changes []*Change
+	for len(changes) < max {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, 0, err
+		}
+
+		var c Change
+		if err := json.Unmarshal(line, &c); err != nil {
+			return nil, 0, fmt.Errorf("invalid change: %v", err)
+		}
+		changes = append(changes, &c)
+		offset += int64(len(line))
+	}
+	return changes, offset, nil
+}
+
+// readOffset reads the offset persisted by a sink, 0 if there is none yet
+func readOffset(path string) (int64, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+}
+
+// writeOffset persists the offset of a sink, replacing the previous one
+// atomically
+func writeOffset(path string, offset int64) error {
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(strconv.FormatInt(offset, 10)), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// close stops streaming, then closes the sinks and the log
+func (l *changeLog) close() error {
+	l.cancel()
+	l.wg.Wait()
+
+	var err error
+	for name, s := range l.sinks {
+		if closeErr := s.Close(); closeErr != nil && err == nil {
+			err = fmt.Errorf("closing sink %s: %v", name, closeErr)
+		}
+	}
+	if closeErr := l.f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
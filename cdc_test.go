@@ -0,0 +1,241 @@
+package dkvs
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// recordingSink records the changes delivered, failing the first deliveries
+type recordingSink struct {
+	changes  chan *Change
+	failures int
+}
+
+func (s *recordingSink) Deliver(ctx context.Context, changes []*Change) error {
+	if s.failures > 0 {
+		s.failures--
+		return errors.New("unavailable")
+	}
+	for _, c := range changes {
+		s.changes <- c
+	}
+	return nil
+}
+
+func (s *recordingSink) Close() error {
+	return nil
+}
+
+func nextChange(t *testing.T, s *recordingSink) *Change {
+	t.Helper()
+
+	select {
+	case c := <-s.changes:
+		return c
+	case <-time.After(time.Second):
+		t.Fatalf("no change delivered")
+	}
+	return nil
+}
+
+// Test streaming the changes of a slave, and resuming after a restart
+func TestChangeLog(t *testing.T) {
+	ctx := context.Background()
+	net := NewMemoryNetwork()
+	m, _ := memoryCluster(t, net, WriteConcernAll)
+
+	dir := t.TempDir()
+	c := DefaultConfig("")
+	c.CDC = &CDCConfig{Dir: dir, RetryDelay: Duration(time.Millisecond)}
+	sink := &recordingSink{changes: make(chan *Change, 10), failures: 2}
+	s, err := startSlave("slave:1", "master:1", WithConfig(c), WithTransport(net.Transport()), WithSink("test", sink))
+	if err != nil {
+		t.Fatalf("creating a slave failed with error: %v", err)
+	}
+
+	m.WriteValue(ctx, "a", []byte("1"))
+	m.WriteValue(ctx, "a", []byte("2"))
+	m.WriteBatch(ctx, []*BatchOp{
+		{Op: OpPut, Key: "b", Value: []byte("1")},
+		{Op: OpDelete, Key: "a"},
+	})
+
+	expected := []Change{
+		{Revision: 1, Type: EventPut, Key: "a", Value: []byte("1"), Version: 1},
+		{Revision: 2, Type: EventPut, Key: "a", Value: []byte("2"), Version: 2, OldValue: []byte("1"), OldVersion: 1},
+		{Revision: 3, Type: EventPut, Key: "b", Value: []byte("1"), Version: 1},
+		{Revision: 3, Type: EventDelete, Key: "a", OldValue: []byte("2"), OldVersion: 2},
+	}
+	for _, ex := range expected {
+		c := nextChange(t, sink)
+		if c.Revision != ex.Revision || c.Type != ex.Type || c.Key != ex.Key || string(c.Value) != string(ex.Value) ||
+			c.Version != ex.Version || string(c.OldValue) != string(ex.OldValue) || c.OldVersion != ex.OldVersion || c.Time.IsZero() {
+			t.Errorf("expected %+v, got %+v", ex, c)
+		}
+	}
+	s.Close()
+
+	// the offset of the sink was saved, so nothing is delivered again
+	info, _ := os.Stat(segmentPath(dir, 0))
+	data, _ := ioutil.ReadFile(filepath.Join(dir, "test.offset"))
+	if offset, err := strconv.ParseInt(string(data), 10, 64); err != nil || offset != info.Size() {
+		t.Errorf("expected the offset %d, got %s (%v)", info.Size(), data, err)
+	}
+
+	sink = &recordingSink{changes: make(chan *Change, 10)}
+	s, err = startSlave("slave:2", "master:1", WithConfig(c), WithTransport(net.Transport()), WithSink("test", sink))
+	if err != nil {
+		t.Fatalf("creating a slave failed with error: %v", err)
+	}
+	defer s.Close()
+
+	// the keys reserved by dkvs aren't changes
+	m.PutValue(ctx, reservedPrefix+"test", []byte("1"), "", 0)
+	m.WriteValue(ctx, "c", []byte("1"))
+	if c := nextChange(t, sink); c.Key != "c" {
+		t.Errorf("expected the change of c, got %+v", c)
+	}
+}
+
+// Test that the change log is split into segments, deleted once every sink
+// delivered them
+func TestChangeLogSegments(t *testing.T) {
+	ctx := context.Background()
+	net := NewMemoryNetwork()
+	m, _ := memoryCluster(t, net, WriteConcernAll)
+
+	dir := t.TempDir()
+	c := DefaultConfig("")
+	c.CDC = &CDCConfig{Dir: dir, SegmentSize: 1, RetryDelay: Duration(time.Millisecond)}
+	fast := &recordingSink{changes: make(chan *Change, 10)}
+	// deliveries to the slow sink wait for the changes to be read
+	slow := &recordingSink{changes: make(chan *Change)}
+	s, err := startSlave("slave:1", "master:1", WithConfig(c), WithTransport(net.Transport()),
+		WithSink("fast", fast), WithSink("slow", slow))
+	if err != nil {
+		t.Fatalf("creating a slave failed with error: %v", err)
+	}
+	defer s.Close()
+
+	for i := 1; i <= 3; i++ {
+		m.WriteValue(ctx, "a", []byte(strconv.Itoa(i)))
+	}
+	for i := 1; i <= 3; i++ {
+		nextChange(t, fast)
+	}
+	if segments, err := listSegments(dir); err != nil || len(segments) != 3 {
+		t.Errorf("expected 3 segments kept for the slow sink, got %v (%v)", segments, err)
+	}
+
+	for i := uint64(1); i <= 3; i++ {
+		if c := nextChange(t, slow); c.Version != i {
+			t.Errorf("expected the change %d of a, got %+v", i, c)
+		}
+	}
+	var segments []int64
+	for start := time.Now(); time.Since(start) < time.Second; time.Sleep(time.Millisecond) {
+		if segments, err = listSegments(dir); err != nil || len(segments) == 1 {
+			break
+		}
+	}
+	if len(segments) != 1 {
+		t.Errorf("expected only the last segment to be kept, got %v (%v)", segments, err)
+	}
+}
+
+// Test that a slave publishes the writes in order, once, when they arrive out
+// of order and twice
+func TestChangeLogReorder(t *testing.T) {
+	ctx := context.Background()
+	net := NewMemoryNetwork()
+	m, _ := memoryCluster(t, net, WriteConcernAsync)
+
+	c := DefaultConfig("")
+	c.CDC = &CDCConfig{Dir: t.TempDir(), RetryDelay: Duration(time.Millisecond)}
+	sink := &recordingSink{changes: make(chan *Change, 10)}
+	s, err := startSlave("slave:1", "master:1", WithConfig(c), WithTransport(net.Transport()), WithSink("test", sink))
+	if err != nil {
+		t.Fatalf("creating a slave failed with error: %v", err)
+	}
+	defer s.Close()
+
+	net.SetFaults(func(from, to string, msg *Message) Fault {
+		if msg.Kind != MessageWrite {
+			return Fault{}
+		}
+		return Fault{Reorder: string(msg.Entry.Value) == "1", Duplicates: 1}
+	})
+
+	m.WriteValue(ctx, "a", []byte("1"))
+	time.Sleep(10 * time.Millisecond)
+	m.WriteValue(ctx, "a", []byte("2"))
+	m.WriteValue(ctx, "a", []byte("3"))
+
+	for i := uint64(1); i <= 3; i++ {
+		c := nextChange(t, sink)
+		if c.Revision != i || c.Version != i || c.OldVersion != i-1 {
+			t.Errorf("expected the change %d of a, got %+v", i, c)
+		}
+	}
+
+	select {
+	case c := <-sink.changes:
+		t.Errorf("expected no more changes, got %+v", c)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// Test the file and webhook sinks set in the config
+func TestSinks(t *testing.T) {
+	received := make(chan string, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Type") != "application/x-ndjson" {
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			return
+		}
+		scanner := bufio.NewScanner(r.Body)
+		for scanner.Scan() {
+			received <- scanner.Text()
+		}
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	c := DefaultConfig("")
+	c.CDC = &CDCConfig{Dir: dir, File: filepath.Join(dir, "changes.json"), Webhook: srv.URL}
+
+	net := NewMemoryNetwork()
+	m, err := startMaster("master:1", WithConfig(c), WithTransport(net.Transport()))
+	if err != nil {
+		t.Fatalf("creating a master failed with error: %v", err)
+	}
+	m.WriteValue(context.Background(), "a", []byte("1"))
+
+	select {
+	case line := <-received:
+		if line[:len(`{"revision":1,`)] != `{"revision":1,` {
+			t.Errorf("unexpected change %s", line)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("no change posted to the webhook")
+	}
+
+	// the sinks are streamed independently
+	var data []byte
+	for start := time.Now(); len(data) == 0 && time.Since(start) < time.Second; time.Sleep(time.Millisecond) {
+		data, err = ioutil.ReadFile(c.CDC.File)
+	}
+	if err != nil || len(data) == 0 || data[len(data)-1] != '\n' {
+		t.Errorf("expected the change to be written to the file, got %q (%v)", data, err)
+	}
+	m.Close()
+}
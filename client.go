@@ -0,0 +1,617 @@
+package dkvs
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Client is a client for the /v1 HTTP API of a node. Writes sent to a slave
+// are followed to the master.
+type Client struct {
+	addr   string
+	scheme string
+	token  string
+	http   *http.Client
+}
+
+// NewClient creates a client for the node listening on addr
+func NewClient(addr string) *Client {
+	return newClient(addr, "http", nil)
+}
+
+// NewTLSClient creates a client for a node serving HTTPS
+func NewTLSClient(addr string, tlsConfig *tls.Config) *Client {
+	return newClient(addr, "https", &http.Transport{TLSClientConfig: tlsConfig})
+}
+
+func newClient(addr, scheme string, transport http.RoundTripper) *Client {
+	c := &Client{addr: addr, scheme: scheme}
+	c.http = &http.Client{Transport: transport, CheckRedirect: c.followToMaster}
+	return c
+}
+
+// followToMaster lets the token follow the redirection of a write from the
+// node of the client to the master, which net/http drops when they don't
+// share a host name. The token is only sent along a single redirection from
+// the node of the client, with the same scheme.
+func (c *Client) followToMaster(req *http.Request, via []*http.Request) error {
+	if len(via) >= 10 {
+		return errors.New("stopped after 10 redirects")
+	}
+
+	from := via[0].URL
+	if c.token != "" && len(via) == 1 && from.Host == c.addr && req.URL.Scheme == from.Scheme {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	return nil
+}
+
+// SetToken sets the token sent to authenticate the requests
+func (c *Client) SetToken(token string) {
+	c.token = token
+}
+
+// Get reads the value of a key
+func (c *Client) Get(ctx context.Context, key string) ([]byte, error) {
+	return c.GetAt(ctx, key, 0)
+}
+
+// GetAt reads the value of a key as it was at a revision of the node, or as
+// it is when revision is 0
+func (c *Client) GetAt(ctx context.Context, key string, revision uint64) ([]byte, error) {
+	u := c.keyURL(key)
+	if revision != 0 {
+		u += "?revision=" + strconv.FormatUint(revision, 10)
+	}
+
+	resp, err := c.get(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, decodeError(resp)
+	}
+
+	return ioutil.ReadAll(resp.Body)
+}
+
+// Put writes the value of a key
+func (c *Client) Put(ctx context.Context, key string, val []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, c.keyURL(key), bytes.NewReader(val))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", defaultContentType)
+
+	return c.do(req)
+}
+
+// CompareAndSwap writes new as the value of a key if its current value is
+// old, and fails with ErrorConflict otherwise. The write is conditioned on the
+// version read, so that it fails if the key changes in between.
+func (c *Client) CompareAndSwap(ctx context.Context, key string, old, new []byte) error {
+	resp, err := c.get(ctx, c.keyURL(key))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return decodeError(resp)
+	}
+
+	val, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(val, old) {
+		return ErrorConflict
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, c.keyURL(key), bytes.NewReader(new))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", defaultContentType)
+	req.Header.Set("If-Match", resp.Header.Get("ETag"))
+
+	return c.do(req)
+}
+
+// Delete removes a key
+func (c *Client) Delete(ctx context.Context, key string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, c.keyURL(key), nil)
+	if err != nil {
+		return err
+	}
+
+	return c.do(req)
+}
+
+// Txn applies a transaction on the master; see Node.Txn
+func (c *Client) Txn(ctx context.Context, txn *Txn) (*TxnResult, error) {
+	body, err := json.Marshal(txn)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.scheme+"://"+c.addr+"/v1/txn", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", encoding)
+
+	resp, err := c.send(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, decodeError(resp)
+	}
+
+	var result TxnResult
+	return &result, json.NewDecoder(resp.Body).Decode(&result)
+}
+
+// WriteBatch applies many writes at once on the master, and returns the
+// result of each write; see Node.WriteBatch
+func (c *Client) WriteBatch(ctx context.Context, ops []*BatchOp) ([]*BatchResult, error) {
+	body, err := json.Marshal(map[string][]*BatchOp{"ops": ops})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.scheme+"://"+c.addr+"/v1/batch", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", encoding)
+
+	resp, err := c.send(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, decodeError(resp)
+	}
+
+	var p struct {
+		Results []*BatchResult `json:"results"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&p); err != nil {
+		return nil, err
+	}
+	return p.Results, nil
+}
+
+// Incr adds 1 to the integer value of a key on the master, and returns the
+// result; see Node.IncrBy
+func (c *Client) Incr(ctx context.Context, key string) (int64, error) {
+	return c.IncrBy(ctx, key, 1)
+}
+
+// Decr subtracts 1 from the integer value of a key, see Incr
+func (c *Client) Decr(ctx context.Context, key string) (int64, error) {
+	return c.IncrBy(ctx, key, -1)
+}
+
+// IncrBy adds delta to the integer value of a key, see Incr
+func (c *Client) IncrBy(ctx context.Context, key string, delta int64) (int64, error) {
+	var result int64
+	err := c.incr(ctx, key, url.Values{"by": {strconv.FormatInt(delta, 10)}}, &result)
+	return result, err
+}
+
+// IncrByFloat adds delta to the value of a key as a float, see Incr
+func (c *Client) IncrByFloat(ctx context.Context, key string, delta float64) (float64, error) {
+	var result float64
+	query := url.Values{"by": {strconv.FormatFloat(delta, 'g', -1, 64)}, "float": {"true"}}
+	err := c.incr(ctx, key, query, &result)
+	return result, err
+}
+
+func (c *Client) incr(ctx context.Context, key string, query url.Values, result interface{}) error {
+	u := c.scheme + "://" + c.addr + "/v1/incr/" + url.PathEscape(key) + "?" + query.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.send(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return decodeError(resp)
+	}
+
+	p := struct {
+		Value interface{} `json:"value"`
+	}{result}
+	return json.NewDecoder(resp.Body).Decode(&p)
+}
+
+// HSet sets a field of the hash of a key, see Node.HSet
+func (c *Client) HSet(ctx context.Context, key, field string, val []byte) error {
+	return c.op(ctx, &typeOp{Op: "hset", Key: key, Field: field, Value: val}, nil)
+}
+
+// HGet returns a field of the hash of a key
+func (c *Client) HGet(ctx context.Context, key, field string) ([]byte, error) {
+	var val []byte
+	err := c.op(ctx, &typeOp{Op: "hget", Key: key, Field: field}, &val)
+	return val, err
+}
+
+// HGetAll returns every field of the hash of a key
+func (c *Client) HGetAll(ctx context.Context, key string) (map[string][]byte, error) {
+	var h map[string][]byte
+	err := c.op(ctx, &typeOp{Op: "hgetall", Key: key}, &h)
+	return h, err
+}
+
+// HDel removes fields of the hash of a key, see Node.HDel
+func (c *Client) HDel(ctx context.Context, key string, fields ...string) (int, error) {
+	var removed int
+	err := c.op(ctx, &typeOp{Op: "hdel", Key: key, Fields: fields}, &removed)
+	return removed, err
+}
+
+// LPush inserts values at the head of the list of a key, see Node.LPush
+func (c *Client) LPush(ctx context.Context, key string, values ...[]byte) (int, error) {
+	var length int
+	err := c.op(ctx, &typeOp{Op: "lpush", Key: key, Values: values}, &length)
+	return length, err
+}
+
+// RPush appends values to the list of a key, see Node.RPush
+func (c *Client) RPush(ctx context.Context, key string, values ...[]byte) (int, error) {
+	var length int
+	err := c.op(ctx, &typeOp{Op: "rpush", Key: key, Values: values}, &length)
+	return length, err
+}
+
+// LPop removes and returns the first value of the list of a key
+func (c *Client) LPop(ctx context.Context, key string) ([]byte, error) {
+	var val []byte
+	err := c.op(ctx, &typeOp{Op: "lpop", Key: key}, &val)
+	return val, err
+}
+
+// RPop removes and returns the last value of the list of a key
+func (c *Client) RPop(ctx context.Context, key string) ([]byte, error) {
+	var val []byte
+	err := c.op(ctx, &typeOp{Op: "rpop", Key: key}, &val)
+	return val, err
+}
+
+// LRange returns the values of the list of a key, see Node.LRange
+func (c *Client) LRange(ctx context.Context, key string, start, stop int) ([][]byte, error) {
+	var values [][]byte
+	err := c.op(ctx, &typeOp{Op: "lrange", Key: key, Start: start, Stop: stop}, &values)
+	return values, err
+}
+
+// SAdd adds members to the set of a key, see Node.SAdd
+func (c *Client) SAdd(ctx context.Context, key string, members ...string) (int, error) {
+	var added int
+	err := c.op(ctx, &typeOp{Op: "sadd", Key: key, Members: members}, &added)
+	return added, err
+}
+
+// SRem removes members from the set of a key, see Node.SRem
+func (c *Client) SRem(ctx context.Context, key string, members ...string) (int, error) {
+	var removed int
+	err := c.op(ctx, &typeOp{Op: "srem", Key: key, Members: members}, &removed)
+	return removed, err
+}
+
+// SMembers returns the members of the set of a key, in order
+func (c *Client) SMembers(ctx context.Context, key string) ([]string, error) {
+	var members []string
+	err := c.op(ctx, &typeOp{Op: "smembers", Key: key}, &members)
+	return members, err
+}
+
+// ZAdd adds members to the sorted set of a key, see Node.ZAdd
+func (c *Client) ZAdd(ctx context.Context, key string, members ...*ZMember) (int, error) {
+	var added int
+	err := c.op(ctx, &typeOp{Op: "zadd", Key: key, Scores: members}, &added)
+	return added, err
+}
+
+// ZRem removes members from the sorted set of a key, see Node.ZRem
+func (c *Client) ZRem(ctx context.Context, key string, members ...string) (int, error) {
+	var removed int
+	err := c.op(ctx, &typeOp{Op: "zrem", Key: key, Members: members}, &removed)
+	return removed, err
+}
+
+// ZRangeByScore returns the members of the sorted set of a key whose score is
+// between min and max included; see Node.ZRangeByScore
+func (c *Client) ZRangeByScore(ctx context.Context, key string, min, max float64) ([]*ZMember, error) {
+	// infinite bounds can't be encoded in JSON, and are left out
+	op := &typeOp{Op: "zrangebyscore", Key: key}
+	if !math.IsInf(min, -1) {
+		op.Min = &min
+	}
+	if !math.IsInf(max, 1) {
+		op.Max = &max
+	}
+
+	var members []*ZMember
+	err := c.op(ctx, op, &members)
+	return members, err
+}
+
+// op sends an operation on a typed value, and decodes its result into result
+// unless it is nil
+func (c *Client) op(ctx context.Context, op *typeOp, result interface{}) error {
+	body, err := json.Marshal(op)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.scheme+"://"+c.addr+"/v1/ops", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", encoding)
+
+	resp, err := c.send(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return decodeError(resp)
+	}
+
+	p := struct {
+		Result interface{} `json:"result"`
+	}{result}
+	return json.NewDecoder(resp.Body).Decode(&p)
+}
+
+// Watch returns a watcher of the changes of a key, from revision or from the
+// next write when revision is 0, long-polling the node; see Node.Watch
+func (c *Client) Watch(ctx context.Context, key string, revision uint64) (*Watcher, error) {
+	return c.watch(ctx, url.Values{"key": {key}}, revision)
+}
+
+// WatchPrefix returns a watcher of the changes of the keys starting with
+// prefix; see Watch
+func (c *Client) WatchPrefix(ctx context.Context, prefix string, revision uint64) (*Watcher, error) {
+	return c.watch(ctx, url.Values{"prefix": {prefix}}, revision)
+}
+
+func (c *Client) watch(ctx context.Context, query url.Values, revision uint64) (*Watcher, error) {
+	// the first poll returns right away, with the errors such as compacted
+	// revisions, and the revision to start from
+	resp, err := c.poll(ctx, query, revision, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	w := &Watcher{events: make(chan *Event, watchBuffer), cancel: cancel}
+	w.Events = w.events
+
+	go func() {
+		defer close(w.events)
+		for {
+			for _, e := range resp.Events {
+				select {
+				case w.events <- e:
+				case <-ctx.Done():
+					return
+				}
+			}
+
+			if resp, err = c.poll(ctx, query, resp.Revision, defaultPollTimeout); err != nil {
+				if ctx.Err() == nil {
+					w.err = err
+				}
+				return
+			}
+		}
+	}()
+	return w, nil
+}
+
+// poll waits for the events from revision, up to timeout
+func (c *Client) poll(ctx context.Context, query url.Values, revision uint64, timeout time.Duration) (*watchResponse, error) {
+	query.Set("revision", strconv.FormatUint(revision, 10))
+	query.Set("timeout", timeout.String())
+
+	resp, err := c.get(ctx, c.scheme+"://"+c.addr+"/v1/watch?"+query.Encode())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, decodeError(resp)
+	}
+
+	var body watchResponse
+	return &body, json.NewDecoder(resp.Body).Decode(&body)
+}
+
+// Scan returns the keys from start included to end excluded, an empty end
+// meaning no upper bound, at most limit at a time; see Node.Scan
+func (c *Client) Scan(ctx context.Context, start, end string, limit int) (*Page, error) {
+	return c.scan(ctx, url.Values{"start": {start}, "end": {end}}, limit)
+}
+
+// Prefix returns the keys starting with prefix, at most limit at a time
+func (c *Client) Prefix(ctx context.Context, prefix string, limit int) (*Page, error) {
+	return c.scan(ctx, url.Values{"prefix": {prefix}}, limit)
+}
+
+// NextPage continues a scan from the cursor of the previous page
+func (c *Client) NextPage(ctx context.Context, cursor string, limit int) (*Page, error) {
+	return c.scan(ctx, url.Values{"cursor": {cursor}}, limit)
+}
+
+func (c *Client) scan(ctx context.Context, query url.Values, limit int) (*Page, error) {
+	if limit > 0 {
+		query.Set("limit", strconv.Itoa(limit))
+	}
+
+	resp, err := c.get(ctx, c.scheme+"://"+c.addr+"/v1/scan?"+query.Encode())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, decodeError(resp)
+	}
+
+	var body pageResponse
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+
+	page := &Page{Items: make([]*Item, len(body.Items)), Cursor: body.Cursor}
+	for i, item := range body.Items {
+		page.Items[i] = &Item{
+			Key:   item.Key,
+			Entry: Entry{Value: item.Value, ContentType: item.ContentType, Version: item.Version},
+		}
+	}
+	return page, nil
+}
+
+// History lists the past entries of a key the node keeps, oldest first
+func (c *Client) History(ctx context.Context, key string) ([]*KeyRevision, error) {
+	resp, err := c.get(ctx, c.scheme+"://"+c.addr+"/v1/history/"+url.PathEscape(key))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, decodeError(resp)
+	}
+
+	var history []*KeyRevision
+	if err := json.NewDecoder(resp.Body).Decode(&history); err != nil {
+		return nil, err
+	}
+	return history, nil
+}
+
+// Compact makes the node forget the entries it replaced before a revision
+func (c *Client) Compact(ctx context.Context, revision uint64) error {
+	u := c.scheme + "://" + c.addr + "/v1/compact?revision=" + strconv.FormatUint(revision, 10)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, nil)
+	if err != nil {
+		return err
+	}
+	return c.do(req)
+}
+
+// Nodes lists the nodes known by the node
+func (c *Client) Nodes(ctx context.Context) ([]*Node, error) {
+	resp, err := c.get(ctx, c.scheme+"://"+c.addr+"/v1/nodes")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, decodeError(resp)
+	}
+
+	var nodes []*Node
+	if err := json.NewDecoder(resp.Body).Decode(&nodes); err != nil {
+		return nil, err
+	}
+	return nodes, nil
+}
+
+func (c *Client) get(ctx context.Context, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return c.send(req)
+}
+
+// send authenticates and sends a request
+func (c *Client) send(req *http.Request) (*http.Response, error) {
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	return c.http.Do(req)
+}
+
+// Status returns the replication state of the node, which can be used to
+// avoid reading from lagging slaves
+func (c *Client) Status(ctx context.Context) (*Status, error) {
+	resp, err := c.get(ctx, c.scheme+"://"+c.addr+"/status")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, decodeError(resp)
+	}
+
+	var s Status
+	return &s, json.NewDecoder(resp.Body).Decode(&s)
+}
+
+func (c *Client) do(req *http.Request) error {
+	resp, err := c.send(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return decodeError(resp)
+	}
+	return nil
+}
+
+func (c *Client) keyURL(key string) string {
+	return c.scheme + "://" + c.addr + "/v1/keys/" + url.PathEscape(key)
+}
+
+// decodeError reads the error envelope of a failed response
+func decodeError(resp *http.Response) error {
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	var envelope errorEnvelope
+	if err := json.Unmarshal(body, &envelope); err != nil || envelope.Error == nil {
+		return fmt.Errorf("unexpected response %d: %s", resp.StatusCode, body)
+	}
+
+	return envelope.Error
+}
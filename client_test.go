@@ -0,0 +1,121 @@
+package dkvs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// Test the client against a master and check that errors match with errors.Is
+func TestClient(t *testing.T) {
+	masterAddr := ":4343"
+
+	m, err := startMaster(masterAddr)
+	if m != nil {
+		defer m.Close()
+	}
+	if err != nil {
+		t.Errorf("creating a master failed with error: %v", err)
+		return
+	}
+
+	// wait for the server to start
+	time.Sleep(100 * time.Millisecond)
+
+	c := NewClient(masterAddr)
+
+	if err := c.Put(context.Background(), "a/b", []byte("c")); err != nil {
+		t.Errorf("put failed: %v", err)
+		return
+	}
+
+	val, err := c.Get(context.Background(), "a/b")
+	if err != nil {
+		t.Errorf("get failed: %v", err)
+		return
+	}
+	if string(val) != "c" {
+		t.Errorf(`expected "c", got "%s"`, val)
+	}
+
+	_, err = c.Get(context.Background(), "missing")
+	if !errors.Is(err, ErrorKeyNotFound) {
+		t.Errorf("expected %v, got %v", ErrorKeyNotFound, err)
+	}
+
+	if err := c.Delete(context.Background(), "missing"); !errors.Is(err, ErrorKeyNotFound) {
+		t.Errorf("expected %v, got %v", ErrorKeyNotFound, err)
+	}
+
+	// per key errors are kept by /multi
+	buffer := bytes.NewBufferString(`{"keys": ["a/b", "missing"]}`)
+	resp, err := http.Post("http://"+masterAddr+"/multi", encoding, buffer)
+	if err != nil {
+		t.Errorf("error posting /multi: %v", err)
+		return
+	}
+	defer resp.Body.Close()
+
+	var rp []struct {
+		Key   string `json:"k"`
+		Error *Error `json:"e"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&rp); err != nil {
+		t.Errorf("couldn't decode /multi response: %v", err)
+		return
+	}
+	if len(rp) != 2 || rp[0].Error != nil || !errors.Is(rp[1].Error, ErrorKeyNotFound) {
+		t.Errorf("unexpected /multi response: %+v", rp)
+	}
+}
+
+// Test that errors are mapped to the right status codes
+func TestWriteError(t *testing.T) {
+	type testCase struct {
+		err       error
+		status    int
+		code      ErrorCode
+		retryable bool
+	}
+
+	testCases := []*testCase{
+		{err: ErrorKeyNotFound, status: http.StatusNotFound, code: CodeKeyNotFound},
+		{err: ErrorNotMaster, status: http.StatusMisdirectedRequest, code: CodeNotMaster},
+		{err: ErrorSyncing, status: http.StatusServiceUnavailable, code: CodeSyncing, retryable: true},
+		{err: ErrorConflict, status: http.StatusPreconditionFailed, code: CodeConflict},
+		{err: errors.New("boom"), status: http.StatusInternalServerError, code: CodeInternal},
+	}
+
+	for _, test := range testCases {
+		w := &recorder{header: make(http.Header)}
+		writeError(w, test.err)
+
+		if w.status != test.status {
+			t.Errorf("%v: expected status %d, got %d", test.err, test.status, w.status)
+		}
+
+		var envelope errorEnvelope
+		if err := json.Unmarshal(w.body.Bytes(), &envelope); err != nil {
+			t.Errorf("%v: couldn't decode envelope: %v", test.err, err)
+			continue
+		}
+		if envelope.Error.Code != test.code || envelope.Error.Retryable != test.retryable {
+			t.Errorf("%v: unexpected envelope %+v", test.err, envelope.Error)
+		}
+	}
+}
+
+// recorder is a minimal http.ResponseWriter
+type recorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (r *recorder) Header() http.Header         { return r.header }
+func (r *recorder) Write(b []byte) (int, error) { return r.body.Write(b) }
+func (r *recorder) WriteHeader(status int)      { r.status = status }
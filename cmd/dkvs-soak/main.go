@@ -0,0 +1,97 @@
+// Command dkvs-soak runs a workload against an in-process dkvs cluster while
+// injecting random faults, until the duration elapses or it receives SIGINT
+// or SIGTERM. It prints a summary of the history and the consistency
+// guarantees it satisfies, and can save it as JSON. It exits with an error if
+// the history doesn't satisfy the required guarantee.
+//
+// Usage:
+//
+//	dkvs-soak -nodes 5 -duration 1h -fault-interval 5s -history history.json
+//	dkvs-soak -nodes 1 -require linearizable
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/tsauvajon/dkvs"
+	"github.com/tsauvajon/dkvs/harness"
+)
+
+func main() {
+	if err := run(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func run() error {
+	c := harness.DefaultConfig()
+
+	var faults string
+	for _, f := range c.Faults {
+		faults += "," + string(f)
+	}
+
+	flag.IntVar(&c.Nodes, "nodes", c.Nodes, "number of nodes, including the master")
+	flag.IntVar(&c.Clients, "clients", c.Clients, "number of concurrent clients")
+	flag.IntVar(&c.Keys, "keys", c.Keys, "number of keys")
+	flag.DurationVar(&c.Duration, "duration", c.Duration, "duration of the workload")
+	flag.DurationVar(&c.OpTimeout, "op-timeout", c.OpTimeout, "time a client waits for an operation")
+	flag.StringVar(&c.WriteConcern, "write-concern", c.WriteConcern, "write concern of the master: async, one or all")
+	flag.DurationVar(&c.FaultInterval, "fault-interval", c.FaultInterval, "interval between faults, 0 to disable them")
+	flag.StringVar(&faults, "faults", faults[1:], "comma separated kinds of faults: crash, restart, partition, heal, skew")
+	flag.DurationVar(&c.MaxSkew, "max-skew", c.MaxSkew, "maximum clock skew")
+	flag.Int64Var(&c.Seed, "seed", c.Seed, "seed of the random choices")
+	historyPath := flag.String("history", "", "file to save the history to, as JSON")
+	require := flag.String("require", "", "guarantee the history must satisfy: linearizable, read-your-writes or monotonic-reads")
+	verbose := flag.Bool("v", false, "log the faults and the warnings of the nodes")
+	flag.Parse()
+
+	c.Faults = nil
+	for _, f := range strings.Split(faults, ",") {
+		if f = strings.TrimSpace(f); f != "" {
+			c.Faults = append(c.Faults, harness.FaultKind(f))
+		}
+	}
+	if *verbose {
+		c.Logger = dkvs.NewLogger(os.Stderr, slog.LevelInfo, false)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	fmt.Printf("running for %v with seed %d\n", c.Duration, c.Seed)
+
+	h, err := harness.Run(ctx, c)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(h.Summary())
+
+	if *historyPath != "" {
+		data, err := json.MarshalIndent(h, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(*historyPath, data, 0644); err != nil {
+			return err
+		}
+	}
+
+	r := harness.Check(h)
+	fmt.Println(r)
+
+	if *require != "" && !r.Satisfies(harness.Guarantee(*require)) {
+		return fmt.Errorf("the history isn't %s", *require)
+	}
+	return nil
+}
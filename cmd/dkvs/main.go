@@ -0,0 +1,72 @@
+// Command dkvs runs a node of the key-value store until it receives SIGINT or
+// SIGTERM.
+//
+// Usage:
+//
+//	dkvs -addr :8080                      # master
+//	dkvs -addr :8081 -master :8080        # slave
+//	dkvs -config node.yaml
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/tsauvajon/dkvs"
+)
+
+func main() {
+	if err := run(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func run() error {
+	configPath := flag.String("config", "", "JSON, YAML or TOML config file")
+	addr := flag.String("addr", "", "address to listen on, overrides the config")
+	master := flag.String("master", "", "address of the master to join, overrides the config")
+	flag.Parse()
+
+	// flags take precedence over the environment and the file, and are
+	// validated along with them
+	if *addr != "" {
+		os.Setenv("DKVS_ADDRESS", *addr)
+	}
+	if *master != "" {
+		os.Setenv("DKVS_MASTER_ADDRESS", *master)
+	}
+
+	c, err := dkvs.LoadConfig(*configPath)
+	if err != nil {
+		return err
+	}
+
+	var n *dkvs.Node
+	if c.MasterAddress != "" {
+		n, err = dkvs.NewSlave(c.Address, c.MasterAddress, dkvs.WithConfig(c))
+	} else {
+		n, err = dkvs.NewMaster(c.Address, dkvs.WithConfig(c))
+	}
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := n.Start(ctx); err != nil {
+		return err
+	}
+
+	<-ctx.Done()
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Duration(c.ShutdownTimeout))
+	defer cancel()
+	return n.Shutdown(shutdownCtx)
+}
@@ -1,15 +1,238 @@
 package dkvs
 
-import "time"
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
 
-type config struct {
-	retriesCount   int
-	retriesDelayMs time.Duration
+// Config holds the settings of a node. It can be loaded from a JSON, YAML or
+// TOML file and from environment variables with LoadConfig.
+type Config struct {
+	// address the node listens on and advertises to the other nodes
+	Address string `json:"address"`
+	// address of the master that a slave joins
+	MasterAddress string `json:"master_address,omitempty"`
+
+	// timeout of the requests sent to other nodes, and of the writes waiting
+	// for the slaves when the write concern isn't async
+	RequestTimeout Duration `json:"request_timeout"`
+	// how long the transport waits for pending requests when stopping
+	ShutdownTimeout Duration `json:"shutdown_timeout"`
+
+	Retry     RetryConfig     `json:"retry"`
+	Heartbeat HeartbeatConfig `json:"heartbeat"`
+	Storage   StorageConfig   `json:"storage"`
+
+	// streaming of the changes to sinks, disabled when nil
+	CDC *CDCConfig `json:"cdc,omitempty"`
+
+	// TLS and mutual TLS between nodes, disabled when nil
+	TLS *TLSConfig `json:"tls,omitempty"`
+	// secret shared by the nodes to sign their requests, disabled when empty
+	ClusterSecret string `json:"cluster_secret,omitempty"`
+
+	// how many slaves must acknowledge a write before the master answers:
+	// async (none), one or all
+	WriteConcern string `json:"write_concern"`
+
+	// serve the original POST-only client routes (/read, /write, /multi,
+	// /list) alongside the /v1 API
+	LegacyRoutes bool `json:"legacy_routes"`
+}
+
+// RetryConfig sets how pushes to the slaves are retried: the delay between
+// two tries is multiplied by Backoff after each failure, up to MaxDelay
+type RetryConfig struct {
+	Count    int      `json:"count"`
+	Delay    Duration `json:"delay"`
+	Backoff  float64  `json:"backoff"`
+	MaxDelay Duration `json:"max_delay"`
+}
+
+// HeartbeatConfig sets how often nodes check each other's health, and after
+// how long without answer a node is considered down. They are reserved for
+// the health checks, which aren't implemented yet.
+type HeartbeatConfig struct {
+	Interval Duration `json:"interval"`
+	Timeout  Duration `json:"timeout"`
+}
+
+// StorageConfig selects the storage engine of a node
+type StorageConfig struct {
+	// "memory", or "lsm" to persist the data in path
+	Backend string `json:"backend"`
+	// directory holding the data of persistent backends
+	Path string `json:"path,omitempty"`
+	// number of past revisions the memory backend keeps for point-in-time
+	// reads, all of them when 0
+	Retention int `json:"retention"`
+}
+
+// CDCConfig sets where a node streams the changes it applies. Besides the
+// sinks set here, sinks can be added with WithSink.
+type CDCConfig struct {
+	// directory holding the change log and the offsets of the sinks
+	Dir string `json:"dir"`
+	// file the changes are appended to as JSON lines, disabled when empty
+	File string `json:"file,omitempty"`
+	// write the changes to the standard output as JSON lines
+	Stdout bool `json:"stdout,omitempty"`
+	// URL the changes are posted to as JSON lines, disabled when empty
+	Webhook string `json:"webhook,omitempty"`
+	// size above which the change log starts a new file, 64MB when 0
+	SegmentSize int `json:"segment_size,omitempty"`
+	// maximum number of changes delivered at once, 100 when 0
+	BatchSize int `json:"batch_size,omitempty"`
+	// delay before delivering changes again after a failure, 1s when 0
+	RetryDelay Duration `json:"retry_delay,omitempty"`
+}
+
+// write concerns
+const (
+	WriteConcernAsync = "async"
+	WriteConcernOne   = "one"
+	WriteConcernAll   = "all"
+)
+
+// Duration is a time.Duration written as a string such as "1.5s" in
+// configuration files
+type Duration time.Duration
+
+// MarshalJSON writes the duration as a string
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// UnmarshalJSON reads a duration string
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("expected a duration such as \"1s\", got %s", b)
+	}
+
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// ConfigError is a configuration error on a given field
+type ConfigError struct {
+	Field   string
+	Message string
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("invalid config: %s: %s", e.Field, e.Message)
+}
+
+// DefaultConfig returns the default settings of a node listening on addr
+func DefaultConfig(addr string) *Config {
+	return &Config{
+		Address:         addr,
+		RequestTimeout:  Duration(5 * time.Second),
+		ShutdownTimeout: Duration(time.Second),
+		Retry: RetryConfig{
+			Count:    3,
+			Delay:    Duration(time.Second),
+			Backoff:  2,
+			MaxDelay: Duration(10 * time.Second),
+		},
+		Heartbeat: HeartbeatConfig{
+			Interval: Duration(time.Second),
+			Timeout:  Duration(5 * time.Second),
+		},
+		Storage:      StorageConfig{Backend: "memory", Retention: defaultRetention},
+		WriteConcern: WriteConcernAsync,
+		LegacyRoutes: true,
+	}
+}
+
+// Validate checks the settings, and names the first invalid field
+func (c *Config) Validate() error {
+	switch {
+	case c.Address == "":
+		return &ConfigError{"address", "is required"}
+	case !strings.Contains(c.Address, ":"):
+		return &ConfigError{"address", fmt.Sprintf("%q should be host:port", c.Address)}
+	case c.MasterAddress != "" && !strings.Contains(c.MasterAddress, ":"):
+		return &ConfigError{"master_address", fmt.Sprintf("%q should be host:port", c.MasterAddress)}
+	case c.Retry.Count < 1:
+		return &ConfigError{"retry.count", "should be at least 1"}
+	case c.Retry.Backoff < 1:
+		return &ConfigError{"retry.backoff", "should be at least 1"}
+	case c.Retry.MaxDelay < c.Retry.Delay:
+		return &ConfigError{"retry.max_delay", "should be greater than retry.delay"}
+	case c.Heartbeat.Timeout < c.Heartbeat.Interval:
+		return &ConfigError{"heartbeat.timeout", "should be greater than heartbeat.interval"}
+	case c.Storage.Backend != "memory" && c.Storage.Backend != "lsm":
+		return &ConfigError{"storage.backend", fmt.Sprintf("unknown backend %q", c.Storage.Backend)}
+	case c.Storage.Backend == "lsm" && c.Storage.Path == "":
+		return &ConfigError{"storage.path", "is required by the lsm backend"}
+	case c.Storage.Retention < 0:
+		return &ConfigError{"storage.retention", "should be positive"}
+	case c.CDC != nil && c.CDC.Dir == "":
+		return &ConfigError{"cdc.dir", "is required"}
+	case c.CDC != nil && c.CDC.SegmentSize < 0:
+		return &ConfigError{"cdc.segment_size", "should be positive"}
+	case c.CDC != nil && c.CDC.BatchSize < 0:
+		return &ConfigError{"cdc.batch_size", "should be positive"}
+	case c.CDC != nil && c.CDC.RetryDelay < 0:
+		return &ConfigError{"cdc.retry_delay", "should be positive"}
+	case c.WriteConcern != WriteConcernAsync && c.WriteConcern != WriteConcernOne && c.WriteConcern != WriteConcernAll:
+		return &ConfigError{"write_concern", fmt.Sprintf("%q should be async, one or all", c.WriteConcern)}
+	}
+
+	durations := []struct {
+		field string
+		value Duration
+	}{
+		{"request_timeout", c.RequestTimeout},
+		{"shutdown_timeout", c.ShutdownTimeout},
+		{"retry.delay", c.Retry.Delay},
+		{"retry.max_delay", c.Retry.MaxDelay},
+		{"heartbeat.interval", c.Heartbeat.Interval},
+		{"heartbeat.timeout", c.Heartbeat.Timeout},
+	}
+	for _, d := range durations {
+		if d.value <= 0 {
+			return &ConfigError{d.field, "should be positive"}
+		}
+	}
+
+	if c.TLS != nil && c.TLS.Certificate == nil && (c.TLS.CertFile == "" || c.TLS.KeyFile == "") {
+		return &ConfigError{"tls.cert_file", "a certificate and a key are required"}
+	}
+	if c.TLS != nil && c.TLS.CA == nil && c.TLS.CAFile == "" {
+		return &ConfigError{"tls.ca_file", "the cluster CA is required"}
+	}
+
+	return nil
+}
+
+// retryDelay returns the delay before the given retry, starting at 1
+func (c *Config) retryDelay(retry int) time.Duration {
+	delay := float64(c.Retry.Delay)
+	for i := 1; i < retry; i++ {
+		delay *= c.Retry.Backoff
+		if delay >= float64(c.Retry.MaxDelay) {
+			return time.Duration(c.Retry.MaxDelay)
+		}
+	}
+	return time.Duration(delay)
 }
 
-var defaultConfig = &config{
-	retriesCount:   3,
-	retriesDelayMs: 10000,
+// defaults holds what can't be loaded from a file, used when the options of a
+// node don't set it
+var defaults = struct {
+	logger       Logger
+	spanExporter SpanExporter
+}{
+	logger: defaultLogger(),
 }
 
 var encoding = "application/json"
@@ -0,0 +1,234 @@
+package dkvs
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Test loading the same settings from every file format
+func TestLoadConfig(t *testing.T) {
+	files := map[string]string{
+		"config.json": `{
+			"address": ":8080",
+			"master_address": "master:8080",
+			"retry": {"count": 5, "delay": "500ms"},
+			"tls": {"cert_file": "node.pem", "key_file": "node.key", "ca_file": "ca.pem"},
+			"write_concern": "all",
+			"legacy_routes": false
+		}`,
+		"config.yaml": `
+# node settings
+address: ":8080"
+master_address: master:8080
+retry:
+  count: 5
+  delay: 500ms # half a second
+tls:
+  cert_file: node.pem
+  key_file: node.key
+  ca_file: 'ca.pem'
+write_concern: all
+legacy_routes: false
+`,
+		"config.toml": `
+address = ":8080"
+master_address = "master:8080"
+write_concern = "all"
+legacy_routes = false
+
+[retry]
+count = 5
+delay = "500ms"
+
+[tls]
+cert_file = "node.pem"
+key_file = "node.key"
+ca_file = "ca.pem" # cluster CA
+`,
+	}
+
+	dir := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		c, err := LoadConfig(path)
+		if err != nil {
+			t.Errorf("%s: loading failed: %v", name, err)
+			continue
+		}
+
+		if c.Address != ":8080" || c.MasterAddress != "master:8080" {
+			t.Errorf("%s: wrong addresses %q and %q", name, c.Address, c.MasterAddress)
+		}
+		if c.Retry.Count != 5 || c.Retry.Delay != Duration(500*time.Millisecond) {
+			t.Errorf("%s: wrong retry settings %+v", name, c.Retry)
+		}
+		if c.TLS == nil || c.TLS.CertFile != "node.pem" || c.TLS.KeyFile != "node.key" || c.TLS.CAFile != "ca.pem" {
+			t.Errorf("%s: wrong tls settings %+v", name, c.TLS)
+		}
+		if c.WriteConcern != WriteConcernAll || c.LegacyRoutes {
+			t.Errorf("%s: wrong write concern %q or legacy routes %v", name, c.WriteConcern, c.LegacyRoutes)
+		}
+		// settings missing from the file keep their default value
+		if c.Retry.Backoff != 2 || c.RequestTimeout != Duration(5*time.Second) {
+			t.Errorf("%s: expected default values, got %+v", name, c)
+		}
+	}
+}
+
+// Test that the environment overrides the file
+func TestLoadConfigEnv(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := ioutil.WriteFile(path, []byte(`{"address": ":8080", "retry": {"count": 5}}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("DKVS_RETRY_COUNT", "7")
+	t.Setenv("DKVS_RETRY_MAX_DELAY", "1m")
+	t.Setenv("DKVS_CLUSTER_SECRET", "s3cret")
+
+	c, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("loading failed: %v", err)
+	}
+
+	if c.Address != ":8080" || c.Retry.Count != 7 || c.Retry.MaxDelay != Duration(time.Minute) || c.ClusterSecret != "s3cret" {
+		t.Errorf("environment not applied: %+v", c)
+	}
+	if c.TLS != nil {
+		t.Errorf("expected tls to stay disabled, got %+v", c.TLS)
+	}
+
+	t.Setenv("DKVS_TLS_CA_FILE", "ca.pem")
+	if _, err := LoadConfig(path); !isConfigError(err, "tls.cert_file") {
+		t.Errorf("expected an error on tls.cert_file, got %v", err)
+	}
+}
+
+// Test that invalid settings are reported with their name
+func TestConfigErrors(t *testing.T) {
+	type testCase struct {
+		file  string
+		field string
+	}
+
+	testCases := []*testCase{
+		{file: `{"address": ":8080", "retries": 3}`, field: "retries"},
+		{file: `{"address": ":8080", "retry": {"count": "three"}}`, field: "retry.count"},
+		{file: `{"address": ":8080", "retry": {"count": 0}}`, field: "retry.count"},
+		{file: `{"address": ":8080", "retry": {"delay": "10"}}`, field: "retry.delay"},
+		{file: `{"address": ":8080", "retry": {"delay": "1m"}}`, field: "retry.max_delay"},
+		{file: `{"address": ":8080", "request_timeout": "-1s"}`, field: "request_timeout"},
+		{file: `{"address": ":8080", "storage": {"backend": "disk"}}`, field: "storage.backend"},
+		{file: `{"address": ":8080", "storage": {"backend": "lsm"}}`, field: "storage.path"},
+		{file: `{"address": ":8080", "storage": {"retention": -1}}`, field: "storage.retention"},
+		{file: `{"address": ":8080", "write_concern": "most"}`, field: "write_concern"},
+		{file: `{"address": ":8080", "cdc": {"stdout": true}}`, field: "cdc.dir"},
+		{file: `{"address": ":8080", "cdc": {"dir": "cdc", "segment_size": -1}}`, field: "cdc.segment_size"},
+		{file: `{"address": ":8080", "storage": "memory"}`, field: "storage"},
+		{file: `{"address": "8080"}`, field: "address"},
+		{file: `{}`, field: "address"},
+	}
+
+	path := filepath.Join(t.TempDir(), "config.json")
+	for _, test := range testCases {
+		if err := ioutil.WriteFile(path, []byte(test.file), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := LoadConfig(path); !isConfigError(err, test.field) {
+			t.Errorf("%s: expected an error on %s, got %v", test.file, test.field, err)
+		}
+	}
+
+	if _, err := NewSlave(":8080", ""); !isConfigError(err, "master_address") {
+		t.Errorf("expected an error on master_address, got %v", err)
+	}
+
+	// the storage isn't opened by an invalid slave
+	c := DefaultConfig(":8080")
+	c.Storage = StorageConfig{Backend: "lsm", Path: filepath.Join(t.TempDir(), "data")}
+	if _, err := NewSlave("", "", WithConfig(c)); !isConfigError(err, "master_address") {
+		t.Errorf("expected an error on master_address, got %v", err)
+	}
+	if _, err := os.Stat(c.Storage.Path); !os.IsNotExist(err) {
+		t.Errorf("expected the storage not to be opened, got %v", err)
+	}
+}
+
+// Test the comments and the syntax not supported in YAML and TOML files
+func TestConfigFileSyntax(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	// a # only starts a comment after a space
+	secrets := map[string]string{
+		"config.yaml": "address: \":8080\"\ncluster_secret: abc#123 # shared secret\n",
+		"config.toml": "address = \":8080\"\ncluster_secret = \"abc#123\" # shared secret\n",
+	}
+	for name, content := range secrets {
+		c, err := LoadConfig(write(name, content))
+		if err != nil {
+			t.Errorf("%s: loading failed: %v", name, err)
+		} else if c.ClusterSecret != "abc#123" {
+			t.Errorf("%s: expected the secret abc#123, got %q", name, c.ClusterSecret)
+		}
+	}
+
+	unsupported := map[string][]string{
+		"config.yaml": {
+			"address: [\":8080\"]\n",
+			"address: {port: 8080}\n",
+			"address: |\n  :8080\n",
+			"address: &addr \":8080\"\n",
+			"address: \":8080\n",
+			"address: \":8080\" :9090\n",
+		},
+		"config.toml": {
+			"address = :8080\n",
+			"address = \"\"\":8080\"\"\"\n",
+			"address = \":8080\n",
+			"address = ':8080' ':9090'\n",
+		},
+	}
+	for name, contents := range unsupported {
+		for _, content := range contents {
+			if _, err := LoadConfig(write(name, content)); err == nil {
+				t.Errorf("%s: expected an error on %q", name, content)
+			}
+		}
+	}
+}
+
+func isConfigError(err error, field string) bool {
+	var configErr *ConfigError
+	return errors.As(err, &configErr) && configErr.Field == field
+}
+
+// Test the delays between retries
+func TestRetryDelay(t *testing.T) {
+	c := DefaultConfig(":8080")
+	c.Retry.Delay = Duration(time.Second)
+	c.Retry.Backoff = 3
+	c.Retry.MaxDelay = Duration(5 * time.Second)
+
+	expected := []time.Duration{time.Second, 3 * time.Second, 5 * time.Second, 5 * time.Second}
+	for i, delay := range expected {
+		if actual := c.retryDelay(i + 1); actual != delay {
+			t.Errorf("retry %d: expected %v, got %v", i+1, delay, actual)
+		}
+	}
+}
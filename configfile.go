@@ -0,0 +1,455 @@
+package dkvs
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// envPrefix prefixes the environment variables overriding the settings, e.g.
+// DKVS_RETRY_MAX_DELAY for retry.max_delay
+const envPrefix = "DKVS"
+
+// LoadConfig reads the settings of a node from a file, then from the
+// environment, and validates them. The format of the file depends on its
+// extension: .json, .yaml, .yml or .toml; YAML and TOML files are limited to
+// sections of key/value pairs. Without path, only the environment is read.
+// Settings that aren't set keep their default value.
+func LoadConfig(path string) (*Config, error) {
+	c := DefaultConfig("")
+
+	if path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("reading config: %v", err)
+		}
+
+		var settings map[string]interface{}
+		switch ext := filepath.Ext(path); ext {
+		case ".json":
+			settings, err = parseJSON(data)
+		case ".yaml", ".yml":
+			settings, err = parseYAML(data)
+		case ".toml":
+			settings, err = parseTOML(data)
+		default:
+			err = fmt.Errorf("unknown config format %q", ext)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("parsing %s: %v", path, err)
+		}
+
+		if err := setSettings(reflect.ValueOf(c).Elem(), "", settings); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, err := setEnv(reflect.ValueOf(c).Elem(), envPrefix, ""); err != nil {
+		return nil, err
+	}
+
+	return c, c.Validate()
+}
+
+// settingName returns the name of a setting in files, empty if it can't be
+// set from a file
+func settingName(f reflect.StructField) string {
+	name := strings.Split(f.Tag.Get("json"), ",")[0]
+	if name == "-" || f.PkgPath != "" {
+		return ""
+	}
+	return name
+}
+
+func joinPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+// setSettings sets the fields of a struct from parsed settings, where values
+// are either strings or nested settings
+func setSettings(v reflect.Value, path string, settings map[string]interface{}) error {
+	names := make([]string, 0, len(settings))
+	for name := range settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fields := make(map[string]reflect.Value)
+	for i := 0; i < v.NumField(); i++ {
+		if name := settingName(v.Type().Field(i)); name != "" {
+			fields[name] = v.Field(i)
+		}
+	}
+
+	for _, name := range names {
+		fieldPath := joinPath(path, name)
+		field, ok := fields[name]
+		if !ok {
+			return &ConfigError{fieldPath, "unknown setting"}
+		}
+
+		switch value := settings[name].(type) {
+		case map[string]interface{}:
+			if field.Kind() == reflect.Ptr {
+				if field.IsNil() {
+					field.Set(reflect.New(field.Type().Elem()))
+				}
+				field = field.Elem()
+			}
+			if field.Kind() != reflect.Struct {
+				return &ConfigError{fieldPath, "expected a value, got a section"}
+			}
+			if err := setSettings(field, fieldPath, value); err != nil {
+				return err
+			}
+		case string:
+			if err := setValue(field, fieldPath, value); err != nil {
+				return err
+			}
+		default:
+			return &ConfigError{fieldPath, fmt.Sprintf("unsupported value %v", value)}
+		}
+	}
+
+	return nil
+}
+
+var durationType = reflect.TypeOf(Duration(0))
+
+// setValue parses a value according to the type of the field
+func setValue(field reflect.Value, path, value string) error {
+	invalid := func(err error) error {
+		return &ConfigError{path, fmt.Sprintf("invalid value %q: %v", value, err)}
+	}
+
+	switch {
+	case field.Type() == durationType:
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return invalid(err)
+		}
+		field.SetInt(int64(d))
+	case field.Kind() == reflect.String:
+		field.SetString(value)
+	case field.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return invalid(err)
+		}
+		field.SetBool(b)
+	case field.Kind() == reflect.Int:
+		i, err := strconv.Atoi(value)
+		if err != nil {
+			return invalid(err)
+		}
+		field.SetInt(int64(i))
+	case field.Kind() == reflect.Float64:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return invalid(err)
+		}
+		field.SetFloat(f)
+	default:
+		return &ConfigError{path, "expected a section, got a value"}
+	}
+
+	return nil
+}
+
+// setEnv sets the fields of a struct from the environment, and reports whether
+// any was set
+func setEnv(v reflect.Value, prefix, path string) (bool, error) {
+	set := false
+
+	for i := 0; i < v.NumField(); i++ {
+		name := settingName(v.Type().Field(i))
+		if name == "" {
+			continue
+		}
+		field := v.Field(i)
+		env := prefix + "_" + strings.ToUpper(name)
+		fieldPath := joinPath(path, name)
+
+		switch {
+		case field.Kind() == reflect.Struct:
+			ok, err := setEnv(field, env, fieldPath)
+			if err != nil {
+				return false, err
+			}
+			set = set || ok
+		case field.Kind() == reflect.Ptr:
+			// sections such as tls are only created when one of their
+			// settings is set
+			section := field
+			if field.IsNil() {
+				section = reflect.New(field.Type().Elem())
+			}
+			ok, err := setEnv(section.Elem(), env, fieldPath)
+			if err != nil {
+				return false, err
+			}
+			if ok && field.IsNil() {
+				field.Set(section)
+			}
+			set = set || ok
+		default:
+			value, ok := os.LookupEnv(env)
+			if !ok {
+				continue
+			}
+			if err := setValue(field, fieldPath, value); err != nil {
+				return false, err
+			}
+			set = true
+		}
+	}
+
+	return set, nil
+}
+
+// parseJSON parses a JSON file into settings
+func parseJSON(data []byte) (map[string]interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	var raw map[string]interface{}
+	if err := decoder.Decode(&raw); err != nil {
+		return nil, err
+	}
+	return jsonSettings(raw)
+}
+
+// jsonSettings converts decoded JSON values to strings
+func jsonSettings(raw map[string]interface{}) (map[string]interface{}, error) {
+	settings := make(map[string]interface{})
+	for name, value := range raw {
+		switch value := value.(type) {
+		case map[string]interface{}:
+			nested, err := jsonSettings(value)
+			if err != nil {
+				return nil, err
+			}
+			settings[name] = nested
+		case string:
+			settings[name] = value
+		case json.Number:
+			settings[name] = value.String()
+		case bool:
+			settings[name] = strconv.FormatBool(value)
+		default:
+			return nil, fmt.Errorf("%s: unsupported value %v", name, value)
+		}
+	}
+	return settings, nil
+}
+
+// parseYAML parses the subset of YAML made of nested mappings of scalars
+func parseYAML(data []byte) (map[string]interface{}, error) {
+	root := make(map[string]interface{})
+
+	// mappings containing the current line, by indentation
+	type level struct {
+		indent   int
+		settings map[string]interface{}
+	}
+	stack := []level{{-1, root}}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text := stripComment(scanner.Text())
+		content := strings.TrimSpace(text)
+		if content == "" || content == "---" {
+			continue
+		}
+
+		indent := len(text) - len(strings.TrimLeft(text, " "))
+		if strings.HasPrefix(strings.TrimLeft(text, " "), "\t") {
+			return nil, fmt.Errorf("line %d: tabs can't be used for indentation", line)
+		}
+		if strings.HasPrefix(content, "- ") {
+			return nil, fmt.Errorf("line %d: lists aren't supported", line)
+		}
+
+		colon := strings.Index(content, ":")
+		if colon <= 0 {
+			return nil, fmt.Errorf("line %d: expected key: value", line)
+		}
+		name := unquote(strings.TrimSpace(content[:colon]))
+		value := strings.TrimSpace(content[colon+1:])
+
+		for indent <= stack[len(stack)-1].indent {
+			stack = stack[:len(stack)-1]
+		}
+		parent := stack[len(stack)-1].settings
+
+		if value == "" {
+			section := make(map[string]interface{})
+			parent[name] = section
+			stack = append(stack, level{indent, section})
+			continue
+		}
+		if strings.ContainsAny(value[:1], "[{|>&*!%@`") {
+			return nil, fmt.Errorf("line %d: unsupported value %s", line, value)
+		}
+		if err := checkQuoted(value); err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		parent[name] = unquote(value)
+	}
+
+	return root, scanner.Err()
+}
+
+// parseTOML parses the subset of TOML made of tables of scalars
+func parseTOML(data []byte) (map[string]interface{}, error) {
+	root := make(map[string]interface{})
+	table := root
+
+	// section returns the nested table of a dotted name, creating it if needed
+	section := func(from map[string]interface{}, names []string) (map[string]interface{}, error) {
+		for _, name := range names {
+			name = unquote(strings.TrimSpace(name))
+			next, ok := from[name]
+			if !ok {
+				next = make(map[string]interface{})
+				from[name] = next
+			}
+			if from, ok = next.(map[string]interface{}); !ok {
+				return nil, fmt.Errorf("%s is a value, not a table", name)
+			}
+		}
+		return from, nil
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		content := strings.TrimSpace(stripComment(scanner.Text()))
+		if content == "" {
+			continue
+		}
+
+		if strings.HasPrefix(content, "[") {
+			if !strings.HasSuffix(content, "]") || strings.HasPrefix(content, "[[") {
+				return nil, fmt.Errorf("line %d: invalid table %s", line, content)
+			}
+			var err error
+			if table, err = section(root, strings.Split(content[1:len(content)-1], ".")); err != nil {
+				return nil, fmt.Errorf("line %d: %v", line, err)
+			}
+			continue
+		}
+
+		equal := strings.Index(content, "=")
+		if equal <= 0 {
+			return nil, fmt.Errorf("line %d: expected key = value", line)
+		}
+		names := strings.Split(strings.TrimSpace(content[:equal]), ".")
+		value := strings.TrimSpace(content[equal+1:])
+		if strings.HasPrefix(value, "[") || strings.HasPrefix(value, "{") {
+			return nil, fmt.Errorf("line %d: arrays and inline tables aren't supported", line)
+		}
+		if strings.HasPrefix(value, `"""`) || strings.HasPrefix(value, "'''") {
+			return nil, fmt.Errorf("line %d: multi-line strings aren't supported", line)
+		}
+		if err := checkQuoted(value); err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		// unlike YAML, TOML only has quoted strings
+		if !isQuoted(value) && !isTOMLScalar(value) {
+			return nil, fmt.Errorf("line %d: strings must be quoted: %s", line, value)
+		}
+
+		parent, err := section(table, names[:len(names)-1])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		parent[unquote(strings.TrimSpace(names[len(names)-1]))] = unquote(value)
+	}
+
+	return root, scanner.Err()
+}
+
+// stripComment removes a trailing comment, which starts with a # at the start
+// of the line or after a space, outside of quoted strings. Like in YAML, a #
+// right after other characters is part of the value, e.g. abc#123. Quotes
+// only start a string at the start of a value, so that plain values such as
+// it's keep their quote.
+func stripComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		prev := byte(' ')
+		if i > 0 {
+			prev = line[i-1]
+		}
+
+		switch {
+		case quote == '"' && c == '\\':
+			i++
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case (c == '"' || c == '\'') && strings.IndexByte(" \t:=", prev) >= 0:
+			quote = c
+		case c == '#' && (prev == ' ' || prev == '\t'):
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// isQuoted tells whether a value is a quoted string
+func isQuoted(s string) bool {
+	return strings.HasPrefix(s, `"`) || strings.HasPrefix(s, "'")
+}
+
+// checkQuoted rejects quoted strings that aren't closed, or followed by more
+// than a comment, rather than reading them as something else
+func checkQuoted(s string) error {
+	switch {
+	case strings.HasPrefix(s, `"`):
+		if _, err := strconv.Unquote(s); err != nil {
+			return fmt.Errorf("invalid string %s", s)
+		}
+	case strings.HasPrefix(s, "'"):
+		if len(s) < 2 || !strings.HasSuffix(s, "'") || strings.Contains(s[1:len(s)-1], "'") {
+			return fmt.Errorf("invalid string %s", s)
+		}
+	}
+	return nil
+}
+
+// isTOMLScalar tells whether an unquoted TOML value is a boolean or a number
+func isTOMLScalar(s string) bool {
+	if s == "true" || s == "false" {
+		return true
+	}
+	_, err := strconv.ParseFloat(strings.ReplaceAll(s, "_", ""), 64)
+	return err == nil
+}
+
+// unquote removes the quotes around a string, if any
+func unquote(s string) string {
+	if len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"' {
+		if unquoted, err := strconv.Unquote(s); err == nil {
+			return unquoted
+		}
+	}
+	if len(s) >= 2 && s[0] == '\'' && s[len(s)-1] == '\'' {
+		return s[1 : len(s)-1]
+	}
+	return s
+}
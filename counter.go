@@ -0,0 +1,85 @@
+package dkvs
+
+import (
+	"context"
+	"math"
+	"strconv"
+)
+
+// counterContentType is the content type of the values written by increments,
+// which are stored as decimal text
+const counterContentType = "text/plain"
+
+var (
+	errorNotInteger = &Error{Code: CodeBadRequest, Message: "value is not an integer"}
+	errorNotNumber  = &Error{Code: CodeBadRequest, Message: "value is not a number"}
+	errorOverflow   = &Error{Code: CodeBadRequest, Message: "increment would overflow"}
+)
+
+// Incr adds 1 to the integer value of a key, see IncrBy
+func (n *Node) Incr(ctx context.Context, key string) (int64, error) {
+	return n.IncrBy(ctx, key, 1)
+}
+
+// Decr subtracts 1 from the integer value of a key, see IncrBy
+func (n *Node) Decr(ctx context.Context, key string) (int64, error) {
+	return n.IncrBy(ctx, key, -1)
+}
+
+// IncrBy adds delta to the integer value of a key, a missing key counting as
+// 0, and returns the result. The result is pushed to the slaves as a regular
+// write.
+// This can only be run on the master.
+func (n *Node) IncrBy(ctx context.Context, key string, delta int64) (int64, error) {
+	var result int64
+	err := n.increment(ctx, key, func(current []byte) ([]byte, error) {
+		var v int64
+		if current != nil {
+			var err error
+			if v, err = strconv.ParseInt(string(current), 10, 64); err != nil {
+				return nil, errorNotInteger
+			}
+		}
+		if (delta > 0 && v > math.MaxInt64-delta) || (delta < 0 && v < math.MinInt64-delta) {
+			return nil, errorOverflow
+		}
+
+		result = v + delta
+		return []byte(strconv.FormatInt(result, 10)), nil
+	})
+	return result, err
+}
+
+// IncrByFloat adds delta to the value of a key as a float, see IncrBy
+func (n *Node) IncrByFloat(ctx context.Context, key string, delta float64) (float64, error) {
+	var result float64
+	err := n.increment(ctx, key, func(current []byte) ([]byte, error) {
+		var v float64
+		if current != nil {
+			var err error
+			if v, err = strconv.ParseFloat(string(current), 64); err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+				return nil, errorNotNumber
+			}
+		}
+
+		result = v + delta
+		if math.IsNaN(result) || math.IsInf(result, 0) {
+			return nil, errorOverflow
+		}
+		return []byte(strconv.FormatFloat(result, 'g', -1, 64)), nil
+	})
+	return result, err
+}
+
+// increment replaces the value of a key by its update, see modify
+func (n *Node) increment(ctx context.Context, key string, update func(current []byte) ([]byte, error)) error {
+	return n.modify(ctx, key, "storage.incr", func(current *Entry) ([]byte, string, bool, error) {
+		var val []byte
+		if current != nil {
+			val = current.Value
+		}
+
+		val, err := update(val)
+		return val, counterContentType, err == nil, err
+	})
+}
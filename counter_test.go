@@ -0,0 +1,69 @@
+package dkvs
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+)
+
+// Test concurrent increments through a slave, which redirects them to the
+// master
+func TestIncr(t *testing.T) {
+	ctx := context.Background()
+	net := NewMemoryNetwork()
+	m, slaves := memoryCluster(t, net, WriteConcernAll, "slave:1")
+	s := slaves[0]
+	c := net.Client("slave:1")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := c.Incr(ctx, "counter"); err != nil {
+				t.Errorf("incrementing failed: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	expectValue(t, m, "counter", "20")
+	expectValue(t, s, "counter", "20")
+
+	if v, err := c.IncrBy(ctx, "counter", -25); err != nil || v != -5 {
+		t.Errorf("expected -5, got %d (%v)", v, err)
+	}
+	if v, err := c.Decr(ctx, "counter"); err != nil || v != -6 {
+		t.Errorf("expected -6, got %d (%v)", v, err)
+	}
+	if e, _ := s.ReadEntry(ctx, "counter"); e.ContentType != counterContentType || e.Version != 22 {
+		t.Errorf("unexpected entry %+v", e)
+	}
+
+	if v, err := c.IncrByFloat(ctx, "ratio", 0.5); err != nil || v != 0.5 {
+		t.Errorf("expected 0.5, got %v (%v)", v, err)
+	}
+	if v, err := c.IncrByFloat(ctx, "counter", 1.5); err != nil || v != -4.5 {
+		t.Errorf("expected -4.5, got %v (%v)", v, err)
+	}
+	expectValue(t, s, "ratio", "0.5")
+
+	// integer increments don't apply to floats, nor to other values
+	m.WriteValue(ctx, "name", []byte("dkvs"))
+	for _, key := range []string{"ratio", "name"} {
+		if _, err := c.Incr(ctx, key); !errors.Is(err, errorNotInteger) {
+			t.Errorf("%s: expected %v, got %v", key, errorNotInteger, err)
+		}
+	}
+	if _, err := c.IncrByFloat(ctx, "name", 1); !errors.Is(err, errorNotNumber) {
+		t.Errorf("expected %v, got %v", errorNotNumber, err)
+	}
+
+	m.WriteValue(ctx, "max", []byte("9223372036854775807"))
+	if _, err := m.Incr(ctx, "max"); !errors.Is(err, errorOverflow) {
+		t.Errorf("expected %v, got %v", errorOverflow, err)
+	}
+	if _, err := s.Incr(ctx, "counter"); !errors.Is(err, ErrorNotMaster) {
+		t.Errorf("expected %v, got %v", ErrorNotMaster, err)
+	}
+}
@@ -1,9 +1,97 @@
 package dkvs
 
-import "errors"
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+)
 
 var errorNotImplemented = errors.New("not implemented")
 
-var errorKeyNotFound = errors.New("key not found")
-var errorNotMaster = errors.New("this node isn't the master")
-var errorNotSlave = errors.New("this node isn't a slave")
+// ErrorCode identifies a kind of error returned by a node
+type ErrorCode string
+
+// Error codes returned by nodes
+const (
+	CodeKeyNotFound  ErrorCode = "key_not_found"
+	CodeNotMaster    ErrorCode = "not_master"
+	CodeNotSlave     ErrorCode = "not_slave"
+	CodeSyncing      ErrorCode = "syncing"
+	CodeConflict     ErrorCode = "conflict"
+	CodeTimeout      ErrorCode = "timeout"
+	CodeUnauthorized ErrorCode = "unauthorized"
+	CodeForbidden    ErrorCode = "forbidden"
+	CodeBadRequest   ErrorCode = "bad_request"
+	CodeTooLarge     ErrorCode = "too_large"
+	CodeCompacted    ErrorCode = "compacted"
+	CodeInternal     ErrorCode = "internal"
+)
+
+// Error is an error returned by a node. Errors are compared by code, so an
+// error decoded from an HTTP response matches the exported values with
+// errors.Is.
+type Error struct {
+	Code      ErrorCode `json:"code"`
+	Message   string    `json:"message"`
+	Retryable bool      `json:"retryable"`
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// Is reports whether target is an *Error with the same code
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Code == e.Code
+}
+
+// Errors returned by nodes
+var (
+	ErrorKeyNotFound  = &Error{Code: CodeKeyNotFound, Message: "key not found"}
+	ErrorNotMaster    = &Error{Code: CodeNotMaster, Message: "this node isn't the master"}
+	ErrorNotSlave     = &Error{Code: CodeNotSlave, Message: "this node isn't a slave"}
+	ErrorSyncing      = &Error{Code: CodeSyncing, Message: "this node is still syncing with the master", Retryable: true}
+	ErrorConflict     = &Error{Code: CodeConflict, Message: "version conflict"}
+	ErrorTimeout      = &Error{Code: CodeTimeout, Message: "timed out", Retryable: true}
+	ErrorUnauthorized = &Error{Code: CodeUnauthorized, Message: "unauthorized"}
+	ErrorForbidden    = &Error{Code: CodeForbidden, Message: "forbidden"}
+	ErrorCompacted    = &Error{Code: CodeCompacted, Message: "revision compacted"}
+)
+
+var statusCodes = map[ErrorCode]int{
+	CodeKeyNotFound:  http.StatusNotFound,
+	CodeNotMaster:    http.StatusMisdirectedRequest,
+	CodeNotSlave:     http.StatusConflict,
+	CodeSyncing:      http.StatusServiceUnavailable,
+	CodeConflict:     http.StatusPreconditionFailed,
+	CodeTimeout:      http.StatusGatewayTimeout,
+	CodeUnauthorized: http.StatusUnauthorized,
+	CodeForbidden:    http.StatusForbidden,
+	CodeBadRequest:   http.StatusBadRequest,
+	CodeTooLarge:     http.StatusRequestEntityTooLarge,
+	CodeCompacted:    http.StatusGone,
+	CodeInternal:     http.StatusInternalServerError,
+}
+
+// toError converts any error to an *Error, classifying timeouts and falling
+// back to an internal error
+func toError(err error) *Error {
+	var e *Error
+	if errors.As(err, &e) {
+		return e
+	}
+
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return &Error{Code: CodeTimeout, Message: err.Error(), Retryable: true}
+	}
+
+	return &Error{Code: CodeInternal, Message: err.Error()}
+}
+
+// badRequest wraps a malformed request error
+func badRequest(err error) *Error {
+	return &Error{Code: CodeBadRequest, Message: err.Error()}
+}
@@ -1,3 +1,3 @@
 module github.com/tsauvajon/dkvs
 
-go 1.12
+go 1.21
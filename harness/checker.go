@@ -0,0 +1,539 @@
+package harness
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Guarantee is a consistency guarantee a history can satisfy
+type Guarantee string
+
+// Guarantees checked by Check, from the strongest. A linearizable history
+// satisfies the others.
+const (
+	// every operation seems to happen at once between its invocation and its
+	// completion
+	Linearizable Guarantee = "linearizable"
+	// a process reads its own writes, or newer values
+	ReadYourWrites Guarantee = "read-your-writes"
+	// a process never reads a value older than one it read before
+	MonotonicReads Guarantee = "monotonic-reads"
+)
+
+// Result is the outcome of checking a history
+type Result struct {
+	// guarantees satisfied by the history, from the strongest
+	Guarantees []Guarantee
+	// one counterexample for each guarantee the history violates
+	Counterexamples []*Counterexample
+}
+
+// Counterexample is a minimal part of a history violating a guarantee: the
+// guarantee holds without any of its operations
+type Counterexample struct {
+	Guarantee Guarantee
+	Key       string
+	Reason    string
+	// invocations and completions of the operations, in the order of the
+	// history; operations without completion may have happened
+	Events []Event
+}
+
+// Satisfies tells whether the history satisfies a guarantee
+func (r *Result) Satisfies(g Guarantee) bool {
+	for _, s := range r.Guarantees {
+		if s == g {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Result) String() string {
+	var b strings.Builder
+	if len(r.Guarantees) == 0 {
+		b.WriteString("no guarantee satisfied")
+	} else {
+		fmt.Fprintf(&b, "satisfies %s", joinGuarantees(r.Guarantees))
+	}
+	for _, c := range r.Counterexamples {
+		fmt.Fprintf(&b, "\n%s", c)
+	}
+	return b.String()
+}
+
+func (c *Counterexample) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s violated on key %s: %s", c.Guarantee, c.Key, c.Reason)
+	for _, e := range c.Events {
+		fmt.Fprintf(&b, "\n  %s", e)
+	}
+	return b.String()
+}
+
+func (e Event) String() string {
+	s := fmt.Sprintf("%v process %d %s %s %s", e.Time, e.Process, e.Type, e.Op, e.Key)
+	if e.Op == OpCAS {
+		s += fmt.Sprintf(" %q ->", e.Expected)
+	}
+	if e.Op != OpGet || e.Type == OK {
+		s += fmt.Sprintf(" %q", e.Value)
+	}
+	s += " on " + e.Node
+	if e.Error != "" {
+		s += ": " + e.Error
+	}
+	return s
+}
+
+func joinGuarantees(guarantees []Guarantee) string {
+	names := make([]string, len(guarantees))
+	for i, g := range guarantees {
+		names[i] = string(g)
+	}
+	return strings.Join(names, ", ")
+}
+
+// Check checks a history against a register per key, initially empty. If it
+// isn't linearizable, it checks the session guarantees of the processes.
+//
+// Linearizability is checked with the algorithm of Wing and Gong, which is
+// exponential in the worst case: long histories with many concurrent or
+// indeterminate writes on the same key can take a long time.
+func Check(h *History) *Result {
+	h.lock.Lock()
+	events := append([]Event(nil), h.Events...)
+	h.lock.Unlock()
+
+	r := &Result{}
+	ops := operations(events)
+
+	keys := make([]string, 0, len(ops))
+	for key := range ops {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if !linearizable(ops[key]) {
+			r.Counterexamples = append(r.Counterexamples, &Counterexample{
+				Guarantee: Linearizable,
+				Key:       key,
+				Reason:    "the operations can't be ordered consistently with a register",
+				Events:    eventsOf(minimize(ops[key])),
+			})
+			break
+		}
+	}
+	if len(r.Counterexamples) == 0 {
+		r.Guarantees = []Guarantee{Linearizable, ReadYourWrites, MonotonicReads}
+		return r
+	}
+
+	for _, g := range []Guarantee{ReadYourWrites, MonotonicReads} {
+		if c := checkSession(g, keys, ops); c != nil {
+			r.Counterexamples = append(r.Counterexamples, c)
+		} else {
+			r.Guarantees = append(r.Guarantees, g)
+		}
+	}
+	return r
+}
+
+// operation is an operation that may have taken effect: it either completed
+// successfully, or it is a write whose outcome is unknown
+type operation struct {
+	Event
+	// value read by a get
+	output string
+	// positions of the invocation and of the completion in the history; an
+	// unknown outcome completes at -1
+	invoke, complete int
+	// events shown in counterexamples; an operation interrupted by the end
+	// of the history has no completion
+	invokeEvent   Event
+	completeEvent *Event
+	completedAt   int
+}
+
+// determinate tells whether the operation is known to have taken effect
+func (op *operation) determinate() bool {
+	return op.complete >= 0
+}
+
+// operations pairs the invocations with their completions, and groups the
+// operations by key. Failed operations, and reads that didn't complete, had
+// no effect and are left out.
+func operations(events []Event) map[string][]*operation {
+	ops := make(map[string][]*operation)
+	pending := make(map[int]*operation)
+
+	for i, e := range events {
+		if e.Type == Invoke {
+			op := &operation{Event: e, invoke: i, complete: -1, invokeEvent: e}
+			pending[e.Process] = op
+			ops[e.Key] = append(ops[e.Key], op)
+			continue
+		}
+
+		op := pending[e.Process]
+		if op == nil {
+			continue
+		}
+		delete(pending, e.Process)
+
+		completion := e
+		switch e.Type {
+		case OK:
+			op.complete = i
+			op.output = e.Value
+			op.completeEvent, op.completedAt = &completion, i
+		case Info:
+			op.completeEvent, op.completedAt = &completion, i
+		case Fail:
+			op.Type = Fail
+		}
+	}
+
+	for key, list := range ops {
+		kept := list[:0]
+		for _, op := range list {
+			if op.Type != Fail && (op.determinate() || op.Op != OpGet) {
+				kept = append(kept, op)
+			}
+		}
+		ops[key] = kept
+	}
+	return ops
+}
+
+// eventsOf returns the events of operations, in the order of the history
+func eventsOf(ops []*operation) []Event {
+	type positioned struct {
+		position int
+		event    Event
+	}
+	var list []positioned
+	for _, op := range ops {
+		list = append(list, positioned{op.invoke, op.invokeEvent})
+		if op.completeEvent != nil {
+			list = append(list, positioned{op.completedAt, *op.completeEvent})
+		}
+	}
+	sort.SliceStable(list, func(i, j int) bool { return list[i].position < list[j].position })
+
+	events := make([]Event, len(list))
+	for i, p := range list {
+		events[i] = p.event
+	}
+	return events
+}
+
+// step applies an operation to the register, and tells whether the result
+// matches the one observed
+func step(state string, op *operation) (string, bool) {
+	switch op.Op {
+	case OpGet:
+		return state, state == op.output
+	case OpSet:
+		return op.Value, true
+	case OpCAS:
+		return op.Value, state == op.Expected
+	}
+	return state, false
+}
+
+// entry is the invocation or the completion of an operation, in a linked list
+// ordered as the history
+type entry struct {
+	op   *operation
+	id   int
+	call bool
+	// completion of an invocation, nil if the outcome is unknown
+	match      *entry
+	prev, next *entry
+}
+
+// lift removes an operation from the list
+func (e *entry) lift() {
+	e.prev.next = e.next
+	if e.next != nil {
+		e.next.prev = e.prev
+	}
+	if m := e.match; m != nil {
+		m.prev.next = m.next
+		if m.next != nil {
+			m.next.prev = m.prev
+		}
+	}
+}
+
+// unlift puts back an operation removed by lift
+func (e *entry) unlift() {
+	if m := e.match; m != nil {
+		m.prev.next = m
+		if m.next != nil {
+			m.next.prev = m
+		}
+	}
+	e.prev.next = e
+	if e.next != nil {
+		e.next.prev = e
+	}
+}
+
+// linearizable searches an order of the operations that is consistent with
+// the register and with the order of the history. Writes with an unknown
+// outcome never complete, and may be left out.
+func linearizable(ops []*operation) bool {
+	type positioned struct {
+		position int
+		entry    *entry
+	}
+	var list []positioned
+	determinate := 0
+	for id, op := range ops {
+		call := &entry{op: op, id: id, call: true}
+		list = append(list, positioned{op.invoke, call})
+		if op.determinate() {
+			call.match = &entry{op: op, id: id}
+			list = append(list, positioned{op.complete, call.match})
+			determinate++
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].position < list[j].position })
+
+	head := &entry{}
+	last := head
+	for _, p := range list {
+		p.entry.prev, last.next = last, p.entry
+		last = p.entry
+	}
+
+	type frame struct {
+		entry *entry
+		state string
+	}
+	var stack []frame
+	linearized := make([]byte, (len(ops)+7)/8)
+	// states already explored, by operations linearized and register value
+	seen := make(map[string]bool)
+
+	state := ""
+	e := head.next
+	for determinate > 0 {
+		if e != nil && e.call {
+			if next, ok := step(state, e.op); ok {
+				linearized[e.id/8] |= 1 << (e.id % 8)
+				key := string(linearized) + "\x00" + next
+				if !seen[key] {
+					seen[key] = true
+					stack = append(stack, frame{e, state})
+					state = next
+					e.lift()
+					if e.match != nil {
+						determinate--
+					}
+					e = head.next
+					continue
+				}
+				linearized[e.id/8] &^= 1 << (e.id % 8)
+			}
+			e = e.next
+			continue
+		}
+
+		// an operation completed before being linearized: undo the last
+		// choice
+		if len(stack) == 0 {
+			return false
+		}
+		f := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		state = f.state
+		linearized[f.entry.id/8] &^= 1 << (f.entry.id % 8)
+		f.entry.unlift()
+		if f.entry.match != nil {
+			determinate++
+		}
+		e = f.entry.next
+	}
+	return true
+}
+
+// truncate returns the operations of the history cut before a position: the
+// outcome of writes completing after it becomes unknown, and reads
+// completing after it are left out
+func truncate(ops []*operation, position int) []*operation {
+	var kept []*operation
+	for _, op := range ops {
+		if op.invoke >= position {
+			continue
+		}
+		if op.complete >= position || (!op.determinate() && op.completedAt >= position) {
+			if op.Op == OpGet {
+				continue
+			}
+			copied := *op
+			copied.complete, copied.completeEvent = -1, nil
+			op = &copied
+		}
+		kept = append(kept, op)
+	}
+	return kept
+}
+
+// minimize finds a minimal set of operations that isn't linearizable: first
+// the shortest prefix of the history that isn't, then without every
+// operation that isn't needed for it. The writes of the values read or
+// expected by the operations are kept, so that the counterexample doesn't
+// merely read a value that nobody wrote.
+func minimize(ops []*operation) []*operation {
+	written := make(map[string]bool)
+	for _, op := range ops {
+		if op.Op != OpGet {
+			written[op.Value] = true
+		}
+	}
+
+	var positions []int
+	for _, op := range ops {
+		positions = append(positions, op.invoke+1)
+		if op.determinate() {
+			positions = append(positions, op.complete+1)
+		}
+	}
+	sort.Ints(positions)
+
+	i := sort.Search(len(positions), func(i int) bool {
+		return !linearizable(truncate(ops, positions[i]))
+	})
+	if i < len(positions) {
+		ops = truncate(ops, positions[i])
+	}
+
+	// removing a read can make the write of its value removable, so this
+	// repeats until no operation can be removed
+	for removed := true; removed; {
+		removed = false
+		for i := 0; i < len(ops); {
+			without := append(append([]*operation(nil), ops[:i]...), ops[i+1:]...)
+			if !explained(without, written) || linearizable(without) {
+				i++
+				continue
+			}
+			ops, removed = without, true
+		}
+	}
+	return ops
+}
+
+// explained tells whether the operations include the writes of the values
+// they read or expect, when these values were written in the history
+func explained(ops []*operation, written map[string]bool) bool {
+	values := make(map[string]bool)
+	for _, op := range ops {
+		if op.Op != OpGet {
+			values[op.Value] = true
+		}
+	}
+
+	for _, op := range ops {
+		needed := op.Expected
+		if op.Op == OpGet {
+			needed = op.output
+		}
+		if needed != "" && written[needed] && !values[needed] {
+			return false
+		}
+	}
+	return true
+}
+
+// checkSession checks a session guarantee on every key, and returns a
+// counterexample for the first violation
+func checkSession(g Guarantee, keys []string, ops map[string][]*operation) *Counterexample {
+	// writes by key and value; values are expected to be written once
+	writes := make(map[string]map[string]*operation)
+	for key, list := range ops {
+		writes[key] = make(map[string]*operation)
+		for _, op := range list {
+			if op.Op != OpGet {
+				writes[key][op.Value] = op
+			}
+		}
+	}
+
+	// older tells whether the value a was certainly overwritten by b: the
+	// register starts empty, and a write completing before another one is
+	// invoked is applied first by the master
+	older := func(key, a, b string) bool {
+		if a == b || b == "" {
+			return false
+		}
+		if a == "" {
+			return true
+		}
+		wa, wb := writes[key][a], writes[key][b]
+		return wa != nil && wb != nil && wa.determinate() && wa.complete < wb.invoke
+	}
+
+	type session struct {
+		process int
+		key     string
+	}
+	lastWrite := make(map[session]*operation)
+	lastRead := make(map[session]*operation)
+
+	for _, key := range keys {
+		for _, op := range ops[key] {
+			if !op.determinate() {
+				continue
+			}
+			s := session{op.Process, op.Key}
+			write := writes[op.Key]
+			c := &Counterexample{Guarantee: g, Key: op.Key}
+
+			if op.Op != OpGet {
+				lastWrite[s] = op
+				continue
+			}
+
+			if op.output != "" && write[op.output] == nil {
+				c.Reason = fmt.Sprintf("read %q, which was never written", op.output)
+				c.Events = eventsOf([]*operation{op})
+				return c
+			}
+
+			switch g {
+			case ReadYourWrites:
+				if w := lastWrite[s]; w != nil && older(op.Key, op.output, w.Value) {
+					c.Reason = fmt.Sprintf("process %d read %q after writing %q", op.Process, op.output, w.Value)
+					c.Events = eventsOf(nonNil(write[op.output], w, op))
+					return c
+				}
+			case MonotonicReads:
+				if r := lastRead[s]; r != nil && older(op.Key, op.output, r.output) {
+					c.Reason = fmt.Sprintf("process %d read %q after reading %q", op.Process, op.output, r.output)
+					c.Events = eventsOf(nonNil(write[op.output], write[r.output], r, op))
+					return c
+				}
+			}
+			lastRead[s] = op
+		}
+	}
+
+	return nil
+}
+
+// nonNil returns the operations that aren't nil
+func nonNil(ops ...*operation) []*operation {
+	var kept []*operation
+	for _, op := range ops {
+		if op != nil {
+			kept = append(kept, op)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,220 @@
+package harness
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// history builds histories from events written as
+// {type, process, op, key, value, expected}
+func history(events ...[]interface{}) *History {
+	h := newHistory(0)
+	for i, e := range events {
+		event := Event{
+			Type:    EventType(e[0].(string)),
+			Process: e[1].(int),
+			Op:      e[2].(string),
+			Key:     e[3].(string),
+			Time:    time.Duration(i),
+		}
+		if len(e) > 4 {
+			event.Value = e[4].(string)
+		}
+		if len(e) > 5 {
+			event.Expected = e[5].(string)
+		}
+		h.Events = append(h.Events, event)
+	}
+	return h
+}
+
+func ev(fields ...interface{}) []interface{} {
+	return fields
+}
+
+func TestCheck(t *testing.T) {
+	type testCase struct {
+		name       string
+		history    *History
+		guarantees []Guarantee
+		// number of events of the counterexample of the strongest violated
+		// guarantee
+		counterexample int
+	}
+
+	testCases := []*testCase{
+		{
+			name: "concurrent read",
+			history: history(
+				ev("invoke", 0, "set", "k", "a"),
+				ev("invoke", 1, "get", "k"),
+				ev("ok", 1, "get", "k", ""),
+				ev("ok", 0, "set", "k", "a"),
+				ev("invoke", 1, "get", "k"),
+				ev("ok", 1, "get", "k", "a"),
+			),
+			guarantees: []Guarantee{Linearizable, ReadYourWrites, MonotonicReads},
+		},
+		{
+			name: "compare and swap",
+			history: history(
+				ev("invoke", 0, "set", "k", "a"),
+				ev("ok", 0, "set", "k", "a"),
+				ev("invoke", 0, "cas", "k", "b", "a"),
+				ev("ok", 0, "cas", "k", "b", "a"),
+				ev("invoke", 1, "cas", "k", "c", "a"),
+				ev("fail", 1, "cas", "k", "c", "a"),
+				ev("invoke", 1, "get", "k"),
+				ev("ok", 1, "get", "k", "b"),
+			),
+			guarantees: []Guarantee{Linearizable, ReadYourWrites, MonotonicReads},
+		},
+		{
+			name: "indeterminate write",
+			history: history(
+				ev("invoke", 0, "set", "k", "a"),
+				ev("info", 0, "set", "k", "a"),
+				ev("invoke", 1, "get", "k"),
+				ev("ok", 1, "get", "k", ""),
+				ev("invoke", 1, "get", "k"),
+				ev("ok", 1, "get", "k", "a"),
+			),
+			guarantees: []Guarantee{Linearizable, ReadYourWrites, MonotonicReads},
+		},
+		{
+			name: "stale read",
+			history: history(
+				ev("invoke", 0, "set", "k", "a"),
+				ev("ok", 0, "set", "k", "a"),
+				ev("invoke", 1, "get", "k"),
+				ev("ok", 1, "get", "k", ""),
+			),
+			guarantees:     []Guarantee{ReadYourWrites, MonotonicReads},
+			counterexample: 4,
+		},
+		{
+			name: "lost compare and swap",
+			history: history(
+				ev("invoke", 0, "set", "k", "a"),
+				ev("ok", 0, "set", "k", "a"),
+				ev("invoke", 0, "cas", "k", "b", "a"),
+				ev("ok", 0, "cas", "k", "b", "a"),
+				ev("invoke", 1, "cas", "k", "c", "a"),
+				ev("ok", 1, "cas", "k", "c", "a"),
+			),
+			guarantees:     []Guarantee{ReadYourWrites, MonotonicReads},
+			counterexample: 6,
+		},
+		{
+			name: "own write not read",
+			history: history(
+				ev("invoke", 0, "set", "k", "a"),
+				ev("ok", 0, "set", "k", "a"),
+				ev("invoke", 0, "get", "k"),
+				ev("ok", 0, "get", "k", ""),
+			),
+			guarantees:     []Guarantee{MonotonicReads},
+			counterexample: 4,
+		},
+		{
+			name: "read going back in time",
+			history: history(
+				ev("invoke", 0, "set", "k", "a"),
+				ev("ok", 0, "set", "k", "a"),
+				ev("invoke", 0, "set", "k", "b"),
+				ev("ok", 0, "set", "k", "b"),
+				ev("invoke", 1, "get", "k"),
+				ev("ok", 1, "get", "k", "b"),
+				ev("invoke", 1, "get", "k"),
+				ev("ok", 1, "get", "k", "a"),
+			),
+			guarantees:     []Guarantee{ReadYourWrites},
+			counterexample: 6,
+		},
+		{
+			name: "value never written",
+			history: history(
+				ev("invoke", 0, "set", "k", "a"),
+				ev("fail", 0, "set", "k", "a"),
+				ev("invoke", 1, "get", "k"),
+				ev("ok", 1, "get", "k", "a"),
+			),
+			guarantees:     nil,
+			counterexample: 2,
+		},
+	}
+
+	for _, test := range testCases {
+		r := Check(test.history)
+
+		if len(r.Guarantees) != len(test.guarantees) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.guarantees, r.Guarantees)
+			continue
+		}
+		for i, g := range test.guarantees {
+			if r.Guarantees[i] != g {
+				t.Errorf("%s: expected %v, got %v", test.name, test.guarantees, r.Guarantees)
+			}
+		}
+
+		if test.counterexample == 0 {
+			if len(r.Counterexamples) > 0 {
+				t.Errorf("%s: unexpected counterexamples:\n%s", test.name, r)
+			}
+			continue
+		}
+		if len(r.Counterexamples) == 0 || len(r.Counterexamples[0].Events) != test.counterexample {
+			t.Errorf("%s: expected a counterexample of %d events, got:\n%s", test.name, test.counterexample, r)
+		}
+	}
+}
+
+// Test that counterexamples leave out the operations that don't matter
+func TestMinimalCounterexample(t *testing.T) {
+	var events [][]interface{}
+	for i := 0; i < 50; i++ {
+		value := strconv.Itoa(i)
+		events = append(events,
+			ev("invoke", 0, "set", "k", value),
+			ev("ok", 0, "set", "k", value),
+			ev("invoke", 1, "get", "k"),
+			ev("ok", 1, "get", "k", value),
+		)
+	}
+	// reads the value written 2 writes ago
+	events = append(events,
+		ev("invoke", 1, "get", "k"),
+		ev("ok", 1, "get", "k", "47"),
+	)
+
+	r := Check(history(events...))
+	if r.Satisfies(Linearizable) {
+		t.Fatal("expected the history not to be linearizable")
+	}
+
+	// the write of the value read, the write overwriting it and the read
+	c := r.Counterexamples[0]
+	if len(c.Events) != 6 {
+		t.Errorf("expected a counterexample of 6 events, got:\n%s", c)
+	}
+}
+
+// Test that a single node is linearizable
+func TestCheckRun(t *testing.T) {
+	h, err := Run(context.Background(), &Config{
+		Nodes:    1,
+		Clients:  4,
+		Keys:     2,
+		Duration: 300 * time.Millisecond,
+		Seed:     1,
+	})
+	if err != nil {
+		t.Fatalf("run failed: %v", err)
+	}
+
+	if r := Check(h); !r.Satisfies(Linearizable) {
+		t.Errorf("expected the history to be linearizable, got:\n%s", r)
+	}
+}
@@ -0,0 +1,198 @@
+package harness
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tsauvajon/dkvs"
+)
+
+// errorMasterCrash is returned when crashing the master, which the cluster
+// couldn't recover from as there is no failover
+var errorMasterCrash = errors.New("the master can't be crashed: failover isn't implemented")
+
+// Cluster is a master and its slaves, connected by an in-memory network in
+// which faults are injected. The master listens on "node:0", and the slaves on
+// "node:1", "node:2"...
+type Cluster struct {
+	Network *dkvs.MemoryNetwork
+
+	config *dkvs.Config
+	logger dkvs.Logger
+	addrs  []string
+
+	lock sync.Mutex
+	// running nodes by address, nil when crashed
+	nodes map[string]*dkvs.Node
+	// clock offsets in nanoseconds by address; accessed atomically
+	skews map[string]*int64
+}
+
+// StartCluster starts a cluster of c.Nodes nodes
+func StartCluster(ctx context.Context, c *Config) (*Cluster, error) {
+	c = c.withDefaults()
+
+	config := dkvs.DefaultConfig("")
+	config.WriteConcern = c.WriteConcern
+	config.RequestTimeout = dkvs.Duration(c.OpTimeout / 2)
+	config.Retry.Delay = dkvs.Duration(10 * time.Millisecond)
+	config.Retry.MaxDelay = dkvs.Duration(100 * time.Millisecond)
+
+	cluster := &Cluster{
+		Network: dkvs.NewMemoryNetwork(),
+		config:  config,
+		logger:  c.Logger,
+		nodes:   make(map[string]*dkvs.Node),
+		skews:   make(map[string]*int64),
+	}
+	for i := 0; i < c.Nodes; i++ {
+		addr := fmt.Sprintf("node:%d", i)
+		cluster.addrs = append(cluster.addrs, addr)
+		cluster.skews[addr] = new(int64)
+	}
+
+	for _, addr := range cluster.addrs {
+		if err := cluster.start(ctx, addr); err != nil {
+			cluster.Close()
+			return nil, err
+		}
+	}
+
+	return cluster, nil
+}
+
+// start creates and starts the node listening on addr, with an empty storage
+func (c *Cluster) start(ctx context.Context, addr string) error {
+	skew := c.skews[addr]
+	opts := []dkvs.Option{
+		dkvs.WithConfig(c.config),
+		dkvs.WithTransport(c.Network.Transport()),
+		dkvs.WithLogger(c.logger),
+		dkvs.WithClock(func() time.Time {
+			return time.Now().Add(time.Duration(atomic.LoadInt64(skew)))
+		}),
+	}
+
+	var n *dkvs.Node
+	var err error
+	if addr == c.Master() {
+		n, err = dkvs.NewMaster(addr, opts...)
+	} else {
+		n, err = dkvs.NewSlave(addr, c.Master(), opts...)
+	}
+	if err != nil {
+		return err
+	}
+	if err := n.Start(ctx); err != nil {
+		return fmt.Errorf("starting %s: %v", addr, err)
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.nodes[addr] = n
+	return nil
+}
+
+// Addresses returns the addresses of the nodes, the master first
+func (c *Cluster) Addresses() []string {
+	return append([]string(nil), c.addrs...)
+}
+
+// Master returns the address of the master
+func (c *Cluster) Master() string {
+	return c.addrs[0]
+}
+
+// Node returns the node listening on addr, nil if it is crashed
+func (c *Cluster) Node(addr string) *dkvs.Node {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.nodes[addr]
+}
+
+// Crashed returns the addresses of the crashed nodes
+func (c *Cluster) Crashed() []string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	var crashed []string
+	for _, addr := range c.addrs {
+		if c.nodes[addr] == nil {
+			crashed = append(crashed, addr)
+		}
+	}
+	return crashed
+}
+
+// Client creates a client sending requests to the node listening on addr
+func (c *Cluster) Client(addr string) *dkvs.Client {
+	return c.Network.Client(addr)
+}
+
+// Crash stops a slave abruptly: it loses its storage, and requests it was
+// handling never get an answer
+func (c *Cluster) Crash(addr string) error {
+	if addr == c.Master() {
+		return errorMasterCrash
+	}
+
+	c.lock.Lock()
+	n := c.nodes[addr]
+	c.nodes[addr] = nil
+	c.lock.Unlock()
+
+	if n == nil {
+		return fmt.Errorf("%s isn't running", addr)
+	}
+	return n.Shutdown(context.Background())
+}
+
+// Restart starts a crashed slave again, which joins the master and gets a
+// copy of its data
+func (c *Cluster) Restart(ctx context.Context, addr string) error {
+	if n := c.Node(addr); n != nil {
+		return fmt.Errorf("%s is already running", addr)
+	}
+	if _, ok := c.skews[addr]; !ok {
+		return fmt.Errorf("unknown node %s", addr)
+	}
+	return c.start(ctx, addr)
+}
+
+// Partition splits the network: nodes of different groups can't reach each
+// other. Clients still reach every node.
+func (c *Cluster) Partition(groups ...[]string) {
+	c.Network.Partition(groups...)
+}
+
+// Heal removes the partitions
+func (c *Cluster) Heal() {
+	c.Network.Heal()
+}
+
+// Skew shifts the clock of a node by d from the actual time
+func (c *Cluster) Skew(addr string, d time.Duration) error {
+	skew, ok := c.skews[addr]
+	if !ok {
+		return fmt.Errorf("unknown node %s", addr)
+	}
+	atomic.StoreInt64(skew, int64(d))
+	return nil
+}
+
+// Close stops every node
+func (c *Cluster) Close() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for addr, n := range c.nodes {
+		if n != nil {
+			n.Close()
+		}
+		c.nodes[addr] = nil
+	}
+}
@@ -0,0 +1,264 @@
+// Package harness runs a workload against a dkvs cluster while injecting
+// faults: crashes and restarts of slaves, network partitions and clock skew.
+// It records the history of the operations, to check afterwards what
+// guarantees the cluster kept.
+//
+// The nodes run in the same process and communicate through an in-memory
+// network, so that a run can be part of the tests as well as a long-running
+// soak test (see cmd/dkvs-soak). Runs with the same seed make the same random
+// choices, but the interleaving of the operations still depends on timing.
+package harness
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/tsauvajon/dkvs"
+)
+
+// Config describes the cluster, the workload and the faults of a run
+type Config struct {
+	// number of nodes, including the master
+	Nodes int
+	// number of processes sending operations concurrently
+	Clients int
+	// number of keys the operations are spread on
+	Keys int
+	// duration of the workload
+	Duration time.Duration
+	// time a client waits for an operation to complete
+	OpTimeout time.Duration
+	// write concern of the master, see dkvs.Config
+	WriteConcern string
+
+	// faults are injected as in Schedule, or picked at random among Faults
+	// every FaultInterval without schedule
+	Schedule      []Step
+	FaultInterval time.Duration
+	Faults        []FaultKind
+	// clocks are skewed by up to MaxSkew, either way
+	MaxSkew time.Duration
+
+	// seed of the random choices of the workload and the faults
+	Seed int64
+	// logger of the nodes and the faults, which are silent without it
+	Logger dkvs.Logger
+}
+
+// DefaultConfig returns a config for a short run of 3 nodes, with random
+// faults of every kind
+func DefaultConfig() *Config {
+	return &Config{
+		Nodes:         3,
+		Clients:       5,
+		Keys:          3,
+		Duration:      10 * time.Second,
+		OpTimeout:     time.Second,
+		WriteConcern:  dkvs.WriteConcernAll,
+		FaultInterval: time.Second,
+		Faults:        []FaultKind{FaultCrash, FaultRestart, FaultPartition, FaultHeal, FaultSkew},
+		MaxSkew:       time.Minute,
+		Seed:          time.Now().UnixNano(),
+	}
+}
+
+// withDefaults returns a copy of the config, with the defaults of unset values
+func (c *Config) withDefaults() *Config {
+	defaults := DefaultConfig()
+	config := *c
+	if config.Nodes <= 0 {
+		config.Nodes = defaults.Nodes
+	}
+	if config.Clients <= 0 {
+		config.Clients = defaults.Clients
+	}
+	if config.Keys <= 0 {
+		config.Keys = defaults.Keys
+	}
+	if config.Duration <= 0 {
+		config.Duration = defaults.Duration
+	}
+	if config.OpTimeout <= 0 {
+		config.OpTimeout = defaults.OpTimeout
+	}
+	if config.WriteConcern == "" {
+		config.WriteConcern = defaults.WriteConcern
+	}
+	if config.Logger == nil {
+		config.Logger = dkvs.NewDiscardLogger()
+	}
+	return &config
+}
+
+// validate checks the kinds of the faults
+func (c *Config) validate() error {
+	kinds := append([]FaultKind(nil), c.Faults...)
+	for _, s := range c.Schedule {
+		kinds = append(kinds, s.Kind)
+	}
+
+	for _, kind := range kinds {
+		switch kind {
+		case FaultCrash, FaultRestart, FaultPartition, FaultHeal, FaultSkew:
+		default:
+			return fmt.Errorf("unknown fault %q", kind)
+		}
+	}
+	return nil
+}
+
+// Run starts a cluster, runs the workload while injecting the faults until
+// the duration elapsed or the context is done, and returns the history. Once
+// the workload is done, the faults are undone and the cluster is stopped.
+func Run(ctx context.Context, config *Config) (*History, error) {
+	config = config.withDefaults()
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+
+	cluster, err := StartCluster(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+	defer cluster.Close()
+
+	h := newHistory(config.Seed)
+
+	runCtx, cancel := context.WithTimeout(ctx, config.Duration)
+	defer cancel()
+
+	var nemesis sync.WaitGroup
+	nemesis.Add(1)
+	go func() {
+		defer nemesis.Done()
+		cluster.nemesis(runCtx, config, h)
+	}()
+
+	var clients sync.WaitGroup
+	for i := 0; i < config.Clients; i++ {
+		w := &worker{
+			cluster: cluster,
+			config:  config,
+			history: h,
+			process: i,
+			rand:    rand.New(rand.NewSource(config.Seed + int64(i) + 1)),
+			last:    make(map[string]string),
+		}
+		clients.Add(1)
+		go func() {
+			defer clients.Done()
+			w.run(runCtx)
+		}()
+	}
+
+	clients.Wait()
+	nemesis.Wait()
+	cluster.recover(context.WithoutCancel(ctx), h)
+
+	return h, nil
+}
+
+// worker is a client process sending one operation at a time
+type worker struct {
+	cluster *Cluster
+	config  *Config
+	history *History
+	process int
+	rand    *rand.Rand
+	// sequence number of the values written, unique with the process
+	seq int
+	// last value seen by the process for each key
+	last map[string]string
+}
+
+func (w *worker) run(ctx context.Context) {
+	addrs := w.cluster.Addresses()
+
+	for ctx.Err() == nil {
+		e := Event{
+			Type:    Invoke,
+			Process: w.process,
+			Key:     "k" + strconv.Itoa(w.rand.Intn(w.config.Keys)),
+			Node:    addrs[w.rand.Intn(len(addrs))],
+		}
+
+		switch p := w.rand.Intn(10); {
+		case p < 4:
+			e.Op = OpGet
+		case p < 8 || w.last[e.Key] == "":
+			e.Op = OpSet
+		default:
+			e.Op = OpCAS
+			e.Expected = w.last[e.Key]
+		}
+		if e.Op != OpGet {
+			w.seq++
+			e.Value = fmt.Sprintf("%d-%d", w.process, w.seq)
+		}
+
+		w.history.add(e)
+		e.Type, e.Value, e.Error = w.do(e)
+		w.history.add(e)
+
+		// a process can't tell whether an indeterminate operation happened,
+		// so it continues as a new process
+		if e.Type == Info {
+			w.process += w.config.Clients
+		}
+	}
+}
+
+// do sends an operation, and returns its outcome with the value read or
+// written
+func (w *worker) do(e Event) (EventType, string, string) {
+	// operations outlive the run, so that they complete
+	ctx, cancel := context.WithTimeout(context.Background(), w.config.OpTimeout)
+	defer cancel()
+
+	c := w.cluster.Client(e.Node)
+
+	var err error
+	switch e.Op {
+	case OpGet:
+		var val []byte
+		val, err = c.Get(ctx, e.Key)
+		if errors.Is(err, dkvs.ErrorKeyNotFound) {
+			val, err = nil, nil
+		}
+		if err == nil {
+			w.last[e.Key] = string(val)
+			return OK, string(val), ""
+		}
+	case OpSet:
+		err = c.Put(ctx, e.Key, []byte(e.Value))
+	case OpCAS:
+		err = c.CompareAndSwap(ctx, e.Key, []byte(e.Expected), []byte(e.Value))
+	}
+
+	if err == nil {
+		w.last[e.Key] = e.Value
+		return OK, e.Value, ""
+	}
+	return outcome(e.Op, err), e.Value, err.Error()
+}
+
+// outcome tells whether a failed operation certainly had no effect
+func outcome(op string, err error) EventType {
+	// reads have no effect
+	if op == OpGet {
+		return Fail
+	}
+
+	// errors returned by a node before writing, such as conflicts; timeouts
+	// may happen after the master applied the write
+	var e *dkvs.Error
+	if errors.As(err, &e) && e.Code != dkvs.CodeTimeout && e.Code != dkvs.CodeInternal {
+		return Fail
+	}
+	return Info
+}
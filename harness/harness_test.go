@@ -0,0 +1,133 @@
+package harness
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// checkCompletions checks that every operation is invoked, then completes
+// exactly once, before its process invokes another one
+func checkCompletions(t *testing.T, h *History) {
+	t.Helper()
+
+	pending := make(map[int]*Event)
+	for i := range h.Events {
+		e := &h.Events[i]
+		if e.Type == Invoke {
+			if pending[e.Process] != nil {
+				t.Fatalf("process %d invoked %s before completing %s", e.Process, e.Op, pending[e.Process].Op)
+			}
+			pending[e.Process] = e
+			continue
+		}
+
+		invoke := pending[e.Process]
+		if invoke == nil || invoke.Op != e.Op || invoke.Key != e.Key {
+			t.Fatalf("unexpected completion %+v", e)
+		}
+		delete(pending, e.Process)
+	}
+
+	if len(pending) > 0 {
+		t.Errorf("%d operations never completed", len(pending))
+	}
+}
+
+// Test a run with random faults
+func TestRun(t *testing.T) {
+	h, err := Run(context.Background(), &Config{
+		Nodes:         3,
+		Clients:       4,
+		Keys:          2,
+		Duration:      time.Second,
+		OpTimeout:     200 * time.Millisecond,
+		FaultInterval: 100 * time.Millisecond,
+		Faults:        []FaultKind{FaultCrash, FaultRestart, FaultPartition, FaultHeal, FaultSkew},
+		MaxSkew:       time.Minute,
+		Seed:          1,
+	})
+	if err != nil {
+		t.Fatalf("run failed: %v", err)
+	}
+	t.Log(h.Summary())
+
+	checkCompletions(t, h)
+
+	ok := 0
+	for _, e := range h.Events {
+		if e.Type == OK {
+			ok++
+		}
+	}
+	if ok == 0 {
+		t.Error("expected some operations to succeed")
+	}
+	if len(h.Faults) == 0 {
+		t.Error("expected faults to be injected")
+	}
+}
+
+// Test that the faults of a schedule are injected in order, and undone at the
+// end of the run
+func TestSchedule(t *testing.T) {
+	h, err := Run(context.Background(), &Config{
+		Duration: 500 * time.Millisecond,
+		Schedule: []Step{
+			{At: 0, Kind: FaultCrash, Nodes: []string{"node:1"}},
+			{At: 50 * time.Millisecond, Kind: FaultCrash, Nodes: []string{"node:0"}},
+			{At: 100 * time.Millisecond, Kind: FaultPartition, Nodes: []string{"node:2"}},
+			{At: 150 * time.Millisecond, Kind: FaultSkew, Nodes: []string{"node:0"}, Skew: time.Hour},
+			{At: 200 * time.Millisecond, Kind: FaultHeal},
+		},
+		Seed: 1,
+	})
+	if err != nil {
+		t.Fatalf("run failed: %v", err)
+	}
+
+	checkCompletions(t, h)
+
+	expected := []FaultKind{FaultCrash, FaultCrash, FaultPartition, FaultSkew, FaultHeal, FaultHeal, FaultSkew, FaultRestart}
+	if len(h.Faults) != len(expected) {
+		t.Fatalf("expected %d faults, got %+v", len(expected), h.Faults)
+	}
+	for i, f := range h.Faults {
+		if f.Kind != expected[i] {
+			t.Errorf("fault %d: expected %s, got %s", i, expected[i], f.Kind)
+		}
+		// only crashing the master fails
+		if (f.Error != "") != (i == 1) {
+			t.Errorf("fault %d: unexpected error %q", i, f.Error)
+		}
+	}
+}
+
+// Test that a restarted slave gets the data written while it was down
+func TestRestart(t *testing.T) {
+	ctx := context.Background()
+	c, err := StartCluster(ctx, &Config{Nodes: 2})
+	if err != nil {
+		t.Fatalf("starting the cluster failed: %v", err)
+	}
+	defer c.Close()
+
+	if err := c.Crash("node:1"); err != nil {
+		t.Fatalf("crash failed: %v", err)
+	}
+	if _, err := c.Client("node:1").Get(ctx, "key"); err == nil {
+		t.Error("expected the crashed slave to be unreachable")
+	}
+
+	// the master keeps pushing to the crashed slave, so that the write isn't
+	// acknowledged by every slave
+	c.Client("node:0").Put(ctx, "key", []byte("val"))
+
+	if err := c.Restart(ctx, "node:1"); err != nil {
+		t.Fatalf("restart failed: %v", err)
+	}
+	val, err := c.Client("node:1").Get(ctx, "key")
+	if err != nil || string(val) != "val" {
+		t.Errorf(`expected "val", got "%s" (%v)`, val, err)
+	}
+}
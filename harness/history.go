@@ -0,0 +1,98 @@
+package harness
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// EventType tells whether an event starts or completes an operation
+type EventType string
+
+// Types of events. An operation is invoked, then completes as ok, fail when it
+// certainly had no effect, or info when it is unknown whether it had one.
+const (
+	Invoke EventType = "invoke"
+	OK     EventType = "ok"
+	Fail   EventType = "fail"
+	Info   EventType = "info"
+)
+
+// Operations of the workload
+const (
+	OpGet = "get"
+	OpSet = "set"
+	// cas sets Value if the current value is Expected
+	OpCAS = "cas"
+)
+
+// Event is the invocation or the completion of an operation by a process.
+// Absent keys are read as an empty value.
+type Event struct {
+	Type    EventType `json:"type"`
+	Process int       `json:"process"`
+	Op      string    `json:"op"`
+	Key     string    `json:"key"`
+	// value written, or read once a get completes
+	Value    string `json:"value,omitempty"`
+	Expected string `json:"expected,omitempty"`
+	// node the request was sent to
+	Node string `json:"node"`
+	// time since the start of the run
+	Time  time.Duration `json:"time"`
+	Error string        `json:"error,omitempty"`
+}
+
+// FaultEvent is a fault injected in the cluster
+type FaultEvent struct {
+	Time  time.Duration `json:"time"`
+	Kind  FaultKind     `json:"kind"`
+	Nodes []string      `json:"nodes,omitempty"`
+	Skew  time.Duration `json:"skew,omitempty"`
+	Error string        `json:"error,omitempty"`
+}
+
+// History records the operations of a run, in the order they were invoked and
+// completed, along with the faults injected meanwhile
+type History struct {
+	Seed   int64        `json:"seed"`
+	Events []Event      `json:"events"`
+	Faults []FaultEvent `json:"faults"`
+
+	start time.Time
+	lock  sync.Mutex
+}
+
+func newHistory(seed int64) *History {
+	return &History{Seed: seed, Events: make([]Event, 0), Faults: make([]FaultEvent, 0), start: time.Now()}
+}
+
+// add records an event, timestamped when it is recorded
+func (h *History) add(e Event) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	e.Time = time.Since(h.start)
+	h.Events = append(h.Events, e)
+}
+
+func (h *History) addFault(f FaultEvent) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	f.Time = time.Since(h.start)
+	h.Faults = append(h.Faults, f)
+}
+
+// Summary counts the operations by outcome, and the faults
+func (h *History) Summary() string {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	counts := make(map[EventType]int)
+	for _, e := range h.Events {
+		counts[e.Type]++
+	}
+	return fmt.Sprintf("%d operations: %d ok, %d failed, %d indeterminate; %d faults",
+		counts[Invoke], counts[OK], counts[Fail], counts[Info], len(h.Faults))
+}
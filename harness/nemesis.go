@@ -0,0 +1,172 @@
+package harness
+
+import (
+	"context"
+	"math/rand"
+	"time"
+)
+
+// FaultKind is a kind of fault injected in a cluster
+type FaultKind string
+
+// Kinds of faults
+const (
+	// crash slaves
+	FaultCrash FaultKind = "crash"
+	// restart crashed slaves
+	FaultRestart FaultKind = "restart"
+	// isolate nodes from the others
+	FaultPartition FaultKind = "partition"
+	// remove the partitions
+	FaultHeal FaultKind = "heal"
+	// shift the clock of nodes
+	FaultSkew FaultKind = "skew"
+)
+
+// Step is a fault injected at a given time of a run
+type Step struct {
+	At   time.Duration
+	Kind FaultKind
+	// nodes crashed, restarted or skewed, or isolated from the others by a
+	// partition
+	Nodes []string
+	Skew  time.Duration
+}
+
+// apply injects the fault of a step
+func (c *Cluster) apply(ctx context.Context, s Step) error {
+	switch s.Kind {
+	case FaultCrash:
+		for _, addr := range s.Nodes {
+			if err := c.Crash(addr); err != nil {
+				return err
+			}
+		}
+	case FaultRestart:
+		for _, addr := range s.Nodes {
+			if err := c.Restart(ctx, addr); err != nil {
+				return err
+			}
+		}
+	case FaultPartition:
+		isolated := make(map[string]bool)
+		for _, addr := range s.Nodes {
+			isolated[addr] = true
+		}
+		var others []string
+		for _, addr := range c.addrs {
+			if !isolated[addr] {
+				others = append(others, addr)
+			}
+		}
+		c.Partition(s.Nodes, others)
+	case FaultHeal:
+		c.Heal()
+	case FaultSkew:
+		for _, addr := range s.Nodes {
+			if err := c.Skew(addr, s.Skew); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// randomStep picks a fault among the kinds; it returns false when the fault
+// can't be injected, e.g. restarting while no node is crashed
+func (c *Cluster) randomStep(r *rand.Rand, kinds []FaultKind, maxSkew time.Duration) (Step, bool) {
+	s := Step{Kind: kinds[r.Intn(len(kinds))]}
+
+	switch s.Kind {
+	case FaultCrash:
+		var running []string
+		for _, addr := range c.addrs[1:] {
+			if c.Node(addr) != nil {
+				running = append(running, addr)
+			}
+		}
+		if len(running) == 0 {
+			return s, false
+		}
+		s.Nodes = []string{running[r.Intn(len(running))]}
+	case FaultRestart:
+		crashed := c.Crashed()
+		if len(crashed) == 0 {
+			return s, false
+		}
+		s.Nodes = []string{crashed[r.Intn(len(crashed))]}
+	case FaultPartition:
+		if len(c.addrs) < 2 {
+			return s, false
+		}
+		// a random subset that is neither empty nor the whole cluster
+		for _, i := range r.Perm(len(c.addrs))[:1+r.Intn(len(c.addrs)-1)] {
+			s.Nodes = append(s.Nodes, c.addrs[i])
+		}
+	case FaultSkew:
+		s.Nodes = []string{c.addrs[r.Intn(len(c.addrs))]}
+		s.Skew = time.Duration(r.Int63n(int64(2*maxSkew)+1)) - maxSkew
+	}
+	return s, true
+}
+
+// nemesis injects the faults of the schedule, or random faults every interval
+// without schedule, until the context is done
+func (c *Cluster) nemesis(ctx context.Context, config *Config, h *History) {
+	record := func(s Step) {
+		f := FaultEvent{Kind: s.Kind, Nodes: s.Nodes, Skew: s.Skew}
+		if err := c.apply(ctx, s); err != nil {
+			f.Error = err.Error()
+		}
+		c.logger.Info("injected fault", "kind", f.Kind, "nodes", f.Nodes, "skew", f.Skew, "error", f.Error)
+		h.addFault(f)
+	}
+
+	if len(config.Schedule) > 0 {
+		for _, s := range config.Schedule {
+			select {
+			case <-time.After(s.At - time.Since(h.start)):
+				record(s)
+			case <-ctx.Done():
+				return
+			}
+		}
+		return
+	}
+
+	if config.FaultInterval <= 0 || len(config.Faults) == 0 {
+		return
+	}
+
+	r := rand.New(rand.NewSource(config.Seed))
+	ticker := time.NewTicker(config.FaultInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if s, ok := c.randomStep(r, config.Faults, config.MaxSkew); ok {
+				record(s)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// recover heals the partitions, resets the clocks and restarts the crashed
+// nodes, so that the cluster can converge at the end of a run
+func (c *Cluster) recover(ctx context.Context, h *History) {
+	steps := []Step{{Kind: FaultHeal}, {Kind: FaultSkew, Nodes: c.Addresses()}}
+	if crashed := c.Crashed(); len(crashed) > 0 {
+		steps = append(steps, Step{Kind: FaultRestart, Nodes: crashed})
+	}
+
+	for _, s := range steps {
+		f := FaultEvent{Kind: s.Kind, Nodes: s.Nodes}
+		if err := c.apply(ctx, s); err != nil {
+			f.Error = err.Error()
+		}
+		h.addFault(f)
+	}
+}
@@ -0,0 +1,64 @@
+package dkvs
+
+import (
+	"io"
+	"log/slog"
+	"os"
+)
+
+// Logger is the structured logger used by nodes and transports. Arguments are
+// alternating keys and values, and *slog.Logger implements it.
+type Logger interface {
+	Debug(msg string, args ...interface{})
+	Info(msg string, args ...interface{})
+	Warn(msg string, args ...interface{})
+	Error(msg string, args ...interface{})
+}
+
+// NewLogger creates a logger writing records of at least the given level to
+// w, as JSON or as key=value text
+func NewLogger(w io.Writer, level slog.Level, json bool) Logger {
+	opts := &slog.HandlerOptions{Level: level}
+	if json {
+		return slog.New(slog.NewJSONHandler(w, opts))
+	}
+	return slog.New(slog.NewTextHandler(w, opts))
+}
+
+// NewDiscardLogger creates a logger that drops every record, e.g. to silence
+// nodes in tests
+func NewDiscardLogger() Logger {
+	return NewLogger(io.Discard, slog.LevelError+1, false)
+}
+
+// SetLogger sets the logger used by the nodes created afterwards
+func SetLogger(l Logger) {
+	defaults.logger = l
+}
+
+func defaultLogger() Logger {
+	return NewLogger(os.Stderr, slog.LevelInfo, false)
+}
+
+// fields adds the node ID and role to the fields of a record
+func (n *Node) fields(args []interface{}) []interface{} {
+	role := "slave"
+	if n.IsMaster() {
+		role = "master"
+	}
+	return append([]interface{}{"node", n.ID, "role", role}, args...)
+}
+
+// log returns the logger of the node, falling back to the default one for
+// nodes that weren't created by a constructor
+func (n *Node) log() Logger {
+	if n.logger == nil {
+		return defaults.logger
+	}
+	return n.logger
+}
+
+func (n *Node) logDebug(msg string, args ...interface{}) { n.log().Debug(msg, n.fields(args)...) }
+func (n *Node) logInfo(msg string, args ...interface{})  { n.log().Info(msg, n.fields(args)...) }
+func (n *Node) logWarn(msg string, args ...interface{})  { n.log().Warn(msg, n.fields(args)...) }
+func (n *Node) logError(msg string, args ...interface{}) { n.log().Error(msg, n.fields(args)...) }
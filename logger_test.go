@@ -0,0 +1,47 @@
+package dkvs
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"log/slog"
+	"os"
+	"testing"
+)
+
+// Silence the nodes during tests, unless running in verbose mode
+func TestMain(m *testing.M) {
+	flag.Parse()
+	if !testing.Verbose() {
+		SetLogger(NewDiscardLogger())
+	}
+	os.Exit(m.Run())
+}
+
+// Test that records are written as JSON with the fields of the node
+func TestJSONLogger(t *testing.T) {
+	buf := new(bytes.Buffer)
+	n := &Node{ID: "node1", MasterID: "node1", logger: NewLogger(buf, slog.LevelInfo, true)}
+
+	n.logDebug("dropped", "key", "k")
+	n.logInfo("kept", "key", "k")
+
+	var record map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Errorf("expected a single JSON record, got %s: %v", buf.String(), err)
+		return
+	}
+
+	expected := map[string]interface{}{
+		"level": "INFO",
+		"msg":   "kept",
+		"node":  "node1",
+		"role":  "master",
+		"key":   "k",
+	}
+	for k, v := range expected {
+		if record[k] != v {
+			t.Errorf("expected %s to be %v, got %v", k, v, record[k])
+		}
+	}
+}
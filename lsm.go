@@ -0,0 +1,1021 @@
+package dkvs
+
+import (
+	"container/heap"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	manifestFile = "MANIFEST"
+	walFile      = "wal.log"
+	// bytes of memtable bookkeeping counted for each write
+	memtableOverhead = 32
+	// bytes of replicated keys logged and applied at once
+	replicationBatchSize = 1 << 20
+)
+
+var errorStorageClosed = errors.New("storage closed")
+
+// LSMOptions tunes an LSM storage. Zero values are replaced by defaults.
+type LSMOptions struct {
+	// MemtableSize is the number of bytes written to the memtable before it
+	// is flushed to a table (4MB)
+	MemtableSize int
+	// BlockSize is the size of the blocks of the tables, read at once (4KB)
+	BlockSize int
+	// BloomBitsPerKey is the size of the bloom filters, about 1% of false
+	// positives with the default of 10
+	BloomBitsPerKey int
+	// L0Tables is the number of flushed tables that triggers a compaction (4)
+	L0Tables int
+	// TableSize is the size above which compactions start a new table (8MB)
+	TableSize int
+	// SyncWrites syncs the write-ahead log to the disk at each write, so
+	// that writes survive an OS crash and not only a process crash
+	SyncWrites bool
+}
+
+func (o *LSMOptions) withDefaults() *LSMOptions {
+	copied := LSMOptions{}
+	if o != nil {
+		copied = *o
+	}
+	if copied.MemtableSize <= 0 {
+		copied.MemtableSize = 4 << 20
+	}
+	if copied.BlockSize <= 0 {
+		copied.BlockSize = 4 << 10
+	}
+	if copied.BloomBitsPerKey <= 0 {
+		copied.BloomBitsPerKey = 10
+	}
+	if copied.L0Tables <= 0 {
+		copied.L0Tables = 4
+	}
+	if copied.TableSize <= 0 {
+		copied.TableSize = 8 << 20
+	}
+	return &copied
+}
+
+// LSM is a persistent storage, organized as a log-structured merge tree.
+//
+// Writes are appended to a write-ahead log and kept sorted in a memtable.
+// Full memtables are flushed to immutable sorted tables of level 0, which may
+// overlap each other. In the background, the tables of level 0 are merged
+// with the tables of level 1, which don't overlap, dropping overwritten
+// values. Deleted keys are kept as tombstones, along with their last version.
+type LSM struct {
+	dir     string
+	options *LSMOptions
+
+	lock    sync.RWMutex
+	mem     *skipList
+	memSize int
+	wal     *wal
+	// level 0 tables, newest first
+	l0 []*table
+	// level 1 tables, sorted by key
+	l1   []*table
+	next uint64
+	// revision of the storage the data was last replicated from, since the
+	// LSM doesn't keep revisions itself
+	revision uint64
+
+	compacting bool
+	compaction sync.WaitGroup
+	// a failed background compaction fails the following writes
+	err    error
+	closed bool
+}
+
+// manifest lists the tables of an LSM storage
+type manifest struct {
+	Next uint64   `json:"next"`
+	L0   []uint64 `json:"l0"`
+	L1   []uint64 `json:"l1"`
+}
+
+// OpenLSM opens the LSM storage in dir, creating it if needed. Writes that
+// were not flushed to a table are recovered from the write-ahead log.
+func OpenLSM(dir string, o *LSMOptions) (*LSM, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	s := &LSM{
+		dir:     dir,
+		options: o.withDefaults(),
+		mem:     newSkipList(),
+		next:    1,
+	}
+
+	var m manifest
+	data, err := ioutil.ReadFile(filepath.Join(dir, manifestFile))
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(data, &m); err != nil {
+			return nil, fmt.Errorf("reading manifest: %v", err)
+		}
+		s.next = m.Next
+	case !os.IsNotExist(err):
+		return nil, err
+	}
+
+	open := func(nums []uint64) ([]*table, error) {
+		tables := make([]*table, 0, len(nums))
+		for _, num := range nums {
+			t, err := openTable(dir, num)
+			if err != nil {
+				s.release()
+				return nil, err
+			}
+			tables = append(tables, t)
+		}
+		return tables, nil
+	}
+	if s.l0, err = open(m.L0); err != nil {
+		return nil, err
+	}
+	if s.l1, err = open(m.L1); err != nil {
+		return nil, err
+	}
+	s.removeOrphans(m)
+
+	s.wal, err = openWAL(filepath.Join(dir, walFile), s.options.SyncWrites, func(key string, e *Entry) {
+		s.mem.set(key, e)
+		s.memSize += recordSize(key, e)
+	})
+	if err != nil {
+		s.release()
+		return nil, err
+	}
+
+	s.maybeCompact()
+	return s, nil
+}
+
+// removeOrphans removes the tables left by a flush or a compaction
+// interrupted by a crash
+func (s *LSM) removeOrphans(m manifest) {
+	live := make(map[uint64]bool)
+	for _, num := range append(append([]uint64{}, m.L0...), m.L1...) {
+		live[num] = true
+	}
+
+	files, _ := ioutil.ReadDir(s.dir)
+	for _, f := range files {
+		name := f.Name()
+		if !strings.HasSuffix(name, ".sst") {
+			continue
+		}
+		num, err := strconv.ParseUint(strings.TrimSuffix(name, ".sst"), 10, 64)
+		if err == nil && !live[num] {
+			os.Remove(filepath.Join(s.dir, name))
+		}
+	}
+}
+
+// Close waits for the background compaction, and closes the files
+func (s *LSM) Close() error {
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		return nil
+	}
+	s.closed = true
+	s.lock.Unlock()
+
+	s.compaction.Wait()
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.release()
+	return s.wal.close()
+}
+
+// release drops the references to the current tables
+func (s *LSM) release() {
+	for _, t := range s.l0 {
+		t.release()
+	}
+	for _, t := range s.l1 {
+		t.release()
+	}
+	s.l0, s.l1 = nil, nil
+}
+
+func recordSize(key string, e *Entry) int {
+	return len(key) + len(e.Value) + len(e.ContentType) + memtableOverhead
+}
+
+func (s *LSM) Get(key string) ([]byte, error) {
+	e, err := s.Lookup(key)
+	if err != nil {
+		return nil, err
+	}
+	return e.Value, nil
+}
+
+func (s *LSM) Set(key string, val []byte) error {
+	_, err := s.Put(key, val, "", 0)
+	return err
+}
+
+func (s *LSM) Lookup(key string) (*Entry, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if s.closed {
+		return nil, errorStorageClosed
+	}
+	e, err := s.lookup(key)
+	if err != nil {
+		return nil, err
+	}
+	if e == nil {
+		return nil, ErrorKeyNotFound
+	}
+	return e.clone(), nil
+}
+
+// lookup returns the newest entry of a key, or nil if it was deleted or never
+// written. The caller holds the lock.
+func (s *LSM) lookup(key string) (*Entry, error) {
+	e, err := s.find(key)
+	return live(e), err
+}
+
+// find returns the newest entry of a key, a tombstone if it was deleted, or
+// nil if it was never written. The caller holds the lock.
+func (s *LSM) find(key string) (*Entry, error) {
+	if e := s.mem.get(key); e != nil {
+		return e, nil
+	}
+	for _, t := range s.l0 {
+		if e, err := t.get(key); err != nil || e != nil {
+			return e, err
+		}
+	}
+
+	i := sort.Search(len(s.l1), func(i int) bool { return s.l1[i].largest >= key })
+	if i == len(s.l1) {
+		return nil, nil
+	}
+	return s.l1[i].get(key)
+}
+
+// versions implements versionLookup, deleted keys keeping their version in
+// their tombstone. The caller holds the lock.
+func (s *LSM) versions(key string) (*Entry, uint64, error) {
+	e, err := s.find(key)
+	if e == nil || err != nil {
+		return nil, 0, err
+	}
+	return live(e), e.Version, nil
+}
+
+// live returns nil for tombstones
+func live(e *Entry) *Entry {
+	if e != nil && e.deleted {
+		return nil
+	}
+	return e
+}
+
+func (s *LSM) Put(key string, val []byte, contentType string, version uint64) (*Entry, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	current, last, err := s.versions(key)
+	if err != nil {
+		return nil, err
+	}
+	if version != 0 && (current == nil || version != current.Version) {
+		return nil, ErrorConflict
+	}
+
+	e := &Entry{
+		Value:       append([]byte{}, val...),
+		ContentType: contentType,
+		Version:     last + 1,
+	}
+	if err := s.write(&Write{Key: key, Entry: e}); err != nil {
+		return nil, err
+	}
+
+	return e.clone(), nil
+}
+
+func (s *LSM) Delete(key string, version uint64) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	e, err := s.lookup(key)
+	if err != nil {
+		return err
+	}
+	if e == nil {
+		return ErrorKeyNotFound
+	}
+	if version != 0 && version != e.Version {
+		return ErrorConflict
+	}
+
+	return s.write(&Write{Key: key})
+}
+
+func (s *LSM) Apply(key string, e *Entry) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if e == nil {
+		return s.write(&Write{Key: key})
+	}
+
+	// writes are pushed concurrently, so an older version can arrive last,
+	// even after the key was deleted
+	_, last, err := s.versions(key)
+	if err != nil {
+		return err
+	}
+	if last >= e.Version {
+		return nil
+	}
+
+	return s.write(&Write{Key: key, Entry: e.clone()})
+}
+
+// ReplicateFrom logs and applies the replicated keys in batches, holding the
+// lock until the end
+func (s *LSM) ReplicateFrom(data io.Reader) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if err := s.clear(); err != nil {
+		return err
+	}
+
+	var batch []*Write
+	var size int
+	begin := func(revision uint64) {
+		s.revision = revision
+	}
+	err := readReplication(data, begin, func(key string, e *Entry) error {
+		batch = append(batch, &Write{Key: key, Entry: e})
+		if size += recordSize(key, e); size < replicationBatchSize {
+			return nil
+		}
+		err := s.write(batch...)
+		batch, size = nil, 0
+		return err
+	})
+	if err != nil || len(batch) == 0 {
+		return err
+	}
+	return s.write(batch...)
+}
+
+// replicatedRevision returns the revision of the storage the data was last
+// replicated from
+func (s *LSM) replicatedRevision() uint64 {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.revision
+}
+
+// clear drops every key: the tables, the memtable and the log, once the
+// background compaction is done. The caller holds the lock.
+func (s *LSM) clear() error {
+	for s.compacting {
+		s.lock.Unlock()
+		s.compaction.Wait()
+		s.lock.Lock()
+	}
+	if s.closed {
+		return errorStorageClosed
+	}
+	if s.err != nil {
+		return s.err
+	}
+
+	l0, l1 := s.l0, s.l1
+	s.l0, s.l1 = nil, nil
+	if err := s.writeManifest(); err != nil {
+		s.l0, s.l1 = l0, l1
+		return err
+	}
+	for _, t := range append(l0, l1...) {
+		atomic.StoreInt32(&t.obsolete, 1)
+		t.release()
+	}
+
+	if err := s.wal.reset(); err != nil {
+		return err
+	}
+	s.mem = newSkipList()
+	s.memSize = 0
+	return nil
+}
+
+// write logs and applies writes, nil entries deleting their key, then
+// flushes the memtable if it is full. The writes are logged as a single
+// record, so that they are recovered together or not at all. The caller
+// holds the lock.
+func (s *LSM) write(writes ...*Write) error {
+	if s.closed {
+		return errorStorageClosed
+	}
+	if s.err != nil {
+		return s.err
+	}
+
+	// deletions are stored as tombstones keeping the last version of their
+	// key, which can be written by a previous write of the same batch
+	stored := make([]*Write, len(writes))
+	last := make(map[string]uint64)
+	for i, w := range writes {
+		e := w.Entry
+		if e == nil {
+			version, ok := last[w.Key]
+			if !ok {
+				_, v, err := s.versions(w.Key)
+				if err != nil {
+					return err
+				}
+				version = v
+			}
+			e = newTombstone(version)
+		}
+		last[w.Key] = e.Version
+		stored[i] = &Write{Key: w.Key, Entry: e}
+	}
+
+	if err := s.wal.append(stored); err != nil {
+		return err
+	}
+	for _, w := range stored {
+		s.mem.set(w.Key, w.Entry)
+		s.memSize += recordSize(w.Key, w.Entry)
+	}
+
+	if s.memSize >= s.options.MemtableSize {
+		return s.flush()
+	}
+	return nil
+}
+
+func (s *LSM) Txn(compares []*Compare, ops []*TxnOp) ([]*Write, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	writes, err := prepareTxn(compares, ops, s.versions)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(writes) > 0 {
+		if err := s.write(cloneWrites(writes)...); err != nil {
+			return nil, err
+		}
+	}
+	return writes, nil
+}
+
+func (s *LSM) Batch(ops []*BatchOp) ([]*Write, []error, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	writes, errs, err := prepareBatch(ops, s.versions)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if stored := cloneWrites(applied(writes)); len(stored) > 0 {
+		if err := s.write(stored...); err != nil {
+			return nil, nil, err
+		}
+	}
+	return writes, errs, nil
+}
+
+// cloneWrites copies writes, so that the entries returned to be replicated
+// don't share the stored ones
+func cloneWrites(writes []*Write) []*Write {
+	copied := make([]*Write, len(writes))
+	for i, w := range writes {
+		copied[i] = &Write{Key: w.Key}
+		if w.Entry != nil {
+			copied[i].Entry = w.Entry.clone()
+		}
+	}
+	return copied
+}
+
+func (s *LSM) ApplyWrites(writes []*Write) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	// last versions written by the previous writes, which aren't stored
+	// yet; 0 for deleted keys, since a put following a deletion in a batch
+	// was written after it on the master
+	pending := make(map[string]uint64)
+	applied := make([]*Write, 0, len(writes))
+	for _, w := range writes {
+		if w.Entry != nil {
+			// writes are pushed concurrently, so an older version can
+			// arrive last, even after the key was deleted
+			last, ok := pending[w.Key]
+			if !ok {
+				var err error
+				if _, last, err = s.versions(w.Key); err != nil {
+					return err
+				}
+			}
+			if last >= w.Entry.Version {
+				continue
+			}
+			w = &Write{Key: w.Key, Entry: w.Entry.clone()}
+			pending[w.Key] = w.Entry.Version
+		} else {
+			pending[w.Key] = 0
+		}
+		applied = append(applied, w)
+	}
+
+	if len(applied) == 0 {
+		return nil
+	}
+	return s.write(applied...)
+}
+
+// flush writes the memtable to a new level 0 table, then empties it along
+// with the write-ahead log. The caller holds the lock.
+func (s *LSM) flush() error {
+	if s.mem.length == 0 {
+		return nil
+	}
+
+	num := s.next
+	w, err := newTableWriter(tablePath(s.dir, num), s.options.BlockSize)
+	if err != nil {
+		return err
+	}
+	for x := s.mem.head.next[0]; x != nil; x = x.next[0] {
+		if err := w.add(x.key, x.entry); err != nil {
+			w.abort()
+			return err
+		}
+	}
+	if err := w.finish(s.options.BloomBitsPerKey); err != nil {
+		return err
+	}
+
+	t, err := openTable(s.dir, num)
+	if err != nil {
+		return err
+	}
+	s.next++
+	s.l0 = append([]*table{t}, s.l0...)
+	if err := s.writeManifest(); err != nil {
+		return err
+	}
+
+	// the table holds the writes of the log now
+	if err := s.wal.reset(); err != nil {
+		return err
+	}
+	s.mem = newSkipList()
+	s.memSize = 0
+
+	s.maybeCompact()
+	return nil
+}
+
+// writeManifest saves the list of tables. The caller holds the lock.
+func (s *LSM) writeManifest() error {
+	m := manifest{Next: s.next, L0: make([]uint64, 0), L1: make([]uint64, 0)}
+	for _, t := range s.l0 {
+		m.L0 = append(m.L0, t.num)
+	}
+	for _, t := range s.l1 {
+		m.L1 = append(m.L1, t.num)
+	}
+	data, err := json.Marshal(&m)
+	if err != nil {
+		return err
+	}
+
+	// renaming replaces the manifest atomically
+	path := filepath.Join(s.dir, manifestFile)
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// maybeCompact starts a background compaction when level 0 has too many
+// tables. The caller holds the lock.
+func (s *LSM) maybeCompact() {
+	if s.compacting || s.closed || s.err != nil || len(s.l0) < s.options.L0Tables {
+		return
+	}
+	s.compacting = true
+	s.compaction.Add(1)
+	go s.compact()
+}
+
+// compact merges the tables of level 0 with the overlapping tables of level
+// 1, into new tables of level 1
+func (s *LSM) compact() {
+	defer s.compaction.Done()
+
+	s.lock.Lock()
+	l0 := append([]*table{}, s.l0...)
+	smallest, largest := l0[0].smallest, l0[0].largest
+	for _, t := range l0 {
+		if t.smallest < smallest {
+			smallest = t.smallest
+		}
+		if t.largest > largest {
+			largest = t.largest
+		}
+	}
+	// level 1 tables don't overlap, so the overlapping ones follow each other
+	first := sort.Search(len(s.l1), func(i int) bool { return s.l1[i].largest >= smallest })
+	last := first
+	for last < len(s.l1) && s.l1[last].smallest <= largest {
+		last++
+	}
+	l1 := append([]*table{}, s.l1[first:last]...)
+
+	inputs := append(append([]*table{}, l0...), l1...)
+	for _, t := range inputs {
+		t.acquire()
+	}
+	// numbers of the new tables, reserved while holding the lock
+	next := func() uint64 {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		s.next++
+		return s.next - 1
+	}
+	s.lock.Unlock()
+
+	outputs, err := s.merge(inputs, next)
+	for _, t := range inputs {
+		t.release()
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.compacting = false
+	if err != nil {
+		s.err = fmt.Errorf("compaction failed: %v", err)
+		return
+	}
+
+	// flushes only add tables in front of level 0 meanwhile
+	s.l0 = s.l0[:len(s.l0)-len(l0)]
+	s.l1 = append(append(append([]*table{}, s.l1[:first]...), outputs...), s.l1[last:]...)
+	if err := s.writeManifest(); err != nil {
+		s.err = fmt.Errorf("compaction failed: %v", err)
+		return
+	}
+	for _, t := range inputs {
+		atomic.StoreInt32(&t.obsolete, 1)
+		t.release()
+	}
+
+	s.maybeCompact()
+}
+
+// merge writes the newest entries of the inputs to new tables. Tombstones are
+// kept even though level 1 is the last level, for the version of their key.
+func (s *LSM) merge(inputs []*table, next func() uint64) ([]*table, error) {
+	sources := make([]iterator, len(inputs))
+	for i, t := range inputs {
+		sources[i] = t.iterator("")
+	}
+	it := newMergeIterator(sources)
+
+	var outputs []*table
+	var w *tableWriter
+	var num uint64
+	finish := func() error {
+		if err := w.finish(s.options.BloomBitsPerKey); err != nil {
+			return err
+		}
+		w = nil
+		t, err := openTable(s.dir, num)
+		if err != nil {
+			return err
+		}
+		outputs = append(outputs, t)
+		return nil
+	}
+	fail := func(err error) ([]*table, error) {
+		if w != nil {
+			w.abort()
+		}
+		for _, t := range outputs {
+			atomic.StoreInt32(&t.obsolete, 1)
+			t.release()
+		}
+		return nil, err
+	}
+
+	for it.next() {
+		if w == nil {
+			num = next()
+			var err error
+			if w, err = newTableWriter(tablePath(s.dir, num), s.options.BlockSize); err != nil {
+				return fail(err)
+			}
+		}
+		if err := w.add(it.key(), it.entry()); err != nil {
+			return fail(err)
+		}
+		if w.size() >= uint64(s.options.TableSize) {
+			if err := finish(); err != nil {
+				return fail(err)
+			}
+		}
+	}
+	if err := it.err(); err != nil {
+		return fail(err)
+	}
+	if w != nil {
+		if err := finish(); err != nil {
+			return fail(err)
+		}
+	}
+	return outputs, nil
+}
+
+// iterator returns an iterator over the keys from start, including
+// tombstones. The caller holds the lock while using it.
+func (s *LSM) iterator(start string) iterator {
+	sources := []iterator{&skipListIterator{node: s.mem.seek(start)}}
+	for _, t := range s.l0 {
+		sources = append(sources, t.iterator(start))
+	}
+
+	i := sort.Search(len(s.l1), func(i int) bool { return s.l1[i].largest >= start })
+	sources = append(sources, &levelIterator{tables: s.l1[i:], start: start})
+	return newMergeIterator(sources)
+}
+
+func (s *LSM) Scan(start, end string, limit int) ([]*Item, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if s.closed {
+		return nil, errorStorageClosed
+	}
+
+	items := make([]*Item, 0)
+	it := s.iterator(start)
+	for it.next() {
+		if (end != "" && it.key() >= end) || (limit > 0 && len(items) == limit) {
+			break
+		}
+		if e := it.entry(); !e.deleted {
+			items = append(items, &Item{Key: it.key(), Entry: *e.clone()})
+		}
+	}
+	return items, it.err()
+}
+
+// ReplicateTo streams every key without holding the lock: the memtable is
+// copied, and the tables are kept open until the end.
+func (s *LSM) ReplicateTo(w io.Writer) error {
+	s.lock.RLock()
+	if s.closed {
+		s.lock.RUnlock()
+		return errorStorageClosed
+	}
+	// entries are never modified once in the memtable, so they are shared
+	mem := &sliceIterator{}
+	for x := s.mem.head.next[0]; x != nil; x = x.next[0] {
+		mem.keys = append(mem.keys, x.key)
+		mem.entries = append(mem.entries, x.entry)
+	}
+	sources := []iterator{mem}
+	tables := append(append([]*table{}, s.l0...), s.l1...)
+	for _, t := range tables {
+		t.acquire()
+	}
+	for _, t := range s.l0 {
+		sources = append(sources, t.iterator(""))
+	}
+	sources = append(sources, &levelIterator{tables: append([]*table{}, s.l1...)})
+	s.lock.RUnlock()
+
+	defer func() {
+		for _, t := range tables {
+			t.release()
+		}
+	}()
+
+	out := newReplicationWriter(w, 0)
+	it := newMergeIterator(sources)
+	for it.next() {
+		if it.entry().deleted {
+			continue
+		}
+		if err := out.write(it.key(), it.entry()); err != nil {
+			return err
+		}
+	}
+	if err := it.err(); err != nil {
+		return err
+	}
+	return out.close()
+}
+
+func (s *LSM) Stats() StorageStats {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	// approximate, as keys are counted once per table holding them
+	stats := StorageStats{Keys: s.mem.length, Bytes: s.memSize}
+	for _, t := range append(append([]*table{}, s.l0...), s.l1...) {
+		stats.Keys += int(t.count)
+		stats.Bytes += int(t.size)
+	}
+	return stats
+}
+
+// iterator iterates over keys in order, along with their entries
+type iterator interface {
+	next() bool
+	key() string
+	entry() *Entry
+	err() error
+}
+
+// skipListIterator iterates over the memtable, from the node it is created
+// with
+type skipListIterator struct {
+	node    *skipNode
+	current *skipNode
+}
+
+func (it *skipListIterator) next() bool {
+	if it.node == nil {
+		return false
+	}
+	it.current, it.node = it.node, it.node.next[0]
+	return true
+}
+
+func (it *skipListIterator) key() string   { return it.current.key }
+func (it *skipListIterator) entry() *Entry { return it.current.entry }
+func (it *skipListIterator) err() error    { return nil }
+
+// sliceIterator iterates over a copy of the memtable
+type sliceIterator struct {
+	keys    []string
+	entries []*Entry
+	i       int
+}
+
+func (it *sliceIterator) next() bool {
+	if it.i >= len(it.keys) {
+		return false
+	}
+	it.i++
+	return true
+}
+
+func (it *sliceIterator) key() string   { return it.keys[it.i-1] }
+func (it *sliceIterator) entry() *Entry { return it.entries[it.i-1] }
+func (it *sliceIterator) err() error    { return nil }
+
+// levelIterator iterates over sorted tables that don't overlap
+type levelIterator struct {
+	tables  []*table
+	start   string
+	current iterator
+}
+
+func (it *levelIterator) next() bool {
+	for {
+		if it.current != nil && it.current.next() {
+			return true
+		}
+		if it.current != nil && it.current.err() != nil {
+			return false
+		}
+		if len(it.tables) == 0 {
+			return false
+		}
+		it.current = it.tables[0].iterator(it.start)
+		it.tables = it.tables[1:]
+	}
+}
+
+func (it *levelIterator) key() string   { return it.current.key() }
+func (it *levelIterator) entry() *Entry { return it.current.entry() }
+func (it *levelIterator) err() error {
+	if it.current == nil {
+		return nil
+	}
+	return it.current.err()
+}
+
+// mergeIterator merges sources ordered from the newest to the oldest: when
+// several sources have a key, the entry of the newest one is returned
+type mergeIterator struct {
+	sources []iterator
+	heap    mergeHeap
+	k       string
+	e       *Entry
+	error   error
+}
+
+func newMergeIterator(sources []iterator) *mergeIterator {
+	it := &mergeIterator{sources: sources, heap: mergeHeap{sources: sources}}
+	for i, source := range sources {
+		if source.next() {
+			it.heap.indexes = append(it.heap.indexes, i)
+		} else if err := source.err(); err != nil {
+			it.error = err
+		}
+	}
+	heap.Init(&it.heap)
+	return it
+}
+
+func (it *mergeIterator) next() bool {
+	if it.error != nil || len(it.heap.indexes) == 0 {
+		return false
+	}
+
+	// the heap returns the newest source first among equal keys
+	first := it.sources[it.heap.indexes[0]]
+	it.k, it.e = first.key(), first.entry()
+
+	// skips the older entries of the key
+	for len(it.heap.indexes) > 0 && it.sources[it.heap.indexes[0]].key() == it.k {
+		i := heap.Pop(&it.heap).(int)
+		if it.sources[i].next() {
+			heap.Push(&it.heap, i)
+		} else if err := it.sources[i].err(); err != nil {
+			it.error = err
+			return false
+		}
+	}
+	return true
+}
+
+func (it *mergeIterator) key() string   { return it.k }
+func (it *mergeIterator) entry() *Entry { return it.e }
+func (it *mergeIterator) err() error    { return it.error }
+
+// mergeHeap orders sources by their current key, then from the newest
+type mergeHeap struct {
+	sources []iterator
+	indexes []int
+}
+
+func (h *mergeHeap) Len() int      { return len(h.indexes) }
+func (h *mergeHeap) Swap(i, j int) { h.indexes[i], h.indexes[j] = h.indexes[j], h.indexes[i] }
+func (h *mergeHeap) Less(i, j int) bool {
+	a, b := h.sources[h.indexes[i]].key(), h.sources[h.indexes[j]].key()
+	if a != b {
+		return a < b
+	}
+	return h.indexes[i] < h.indexes[j]
+}
+func (h *mergeHeap) Push(x interface{}) { h.indexes = append(h.indexes, x.(int)) }
+func (h *mergeHeap) Pop() interface{} {
+	x := h.indexes[len(h.indexes)-1]
+	h.indexes = h.indexes[:len(h.indexes)-1]
+	return x
+}
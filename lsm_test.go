@@ -0,0 +1,434 @@
+package dkvs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+// small sizes, so that a few hundred writes flush and compact tables
+func testLSMOptions() *LSMOptions {
+	return &LSMOptions{MemtableSize: 2 << 10, BlockSize: 256, L0Tables: 2, TableSize: 4 << 10}
+}
+
+func openTestLSM(t *testing.T, dir string) *LSM {
+	s, err := OpenLSM(dir, testLSMOptions())
+	if err != nil {
+		t.Fatalf("opening failed: %v", err)
+	}
+	return s
+}
+
+// checkLSM compares the keys of an LSM storage to the expected ones
+func checkLSM(t *testing.T, s *LSM, expected map[string]string) {
+	t.Helper()
+
+	for key, value := range expected {
+		e, err := s.Lookup(key)
+		if err != nil {
+			t.Fatalf("%s: lookup failed: %v", key, err)
+		}
+		if string(e.Value) != value {
+			t.Fatalf("%s: expected %q, got %q", key, value, e.Value)
+		}
+	}
+
+	var keys []string
+	for key := range expected {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	items, err := s.Scan("", "", 0)
+	if err != nil {
+		t.Fatalf("scan failed: %v", err)
+	}
+	if len(items) != len(keys) {
+		t.Fatalf("expected %d keys, scanned %d", len(keys), len(items))
+	}
+	for i, item := range items {
+		if item.Key != keys[i] || string(item.Value) != expected[item.Key] {
+			t.Fatalf("expected %s=%q at %d, got %s=%q", keys[i], expected[keys[i]], i, item.Key, item.Value)
+		}
+	}
+}
+
+// Test random writes and deletes across flushes, compactions and reopening
+func TestLSM(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestLSM(t, dir)
+	r := rand.New(rand.NewSource(1))
+
+	expected := make(map[string]string)
+	for i := 0; i < 2000; i++ {
+		key := fmt.Sprintf("key%03d", r.Intn(300))
+		if r.Intn(4) == 0 {
+			_, exists := expected[key]
+			if err := s.Delete(key, 0); (err == nil) != exists {
+				t.Fatalf("%s: unexpected delete result %v", key, err)
+			}
+			delete(expected, key)
+			continue
+		}
+
+		value := fmt.Sprintf("value%d", i)
+		if err := s.Set(key, []byte(value)); err != nil {
+			t.Fatalf("%s: setting failed: %v", key, err)
+		}
+		expected[key] = value
+	}
+
+	checkLSM(t, s, expected)
+
+	s.compaction.Wait()
+	if len(s.l1) == 0 {
+		t.Error("expected tables to be compacted")
+	}
+	if _, err := s.Lookup("missing"); err != ErrorKeyNotFound {
+		t.Errorf("expected a missing key not to be found, got %v", err)
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatalf("closing failed: %v", err)
+	}
+	s = openTestLSM(t, dir)
+	defer s.Close()
+	checkLSM(t, s, expected)
+}
+
+// Test recovering the writes that weren't flushed from the write-ahead log,
+// ignoring a record cut by a crash
+func TestLSMRecovery(t *testing.T) {
+	dir := t.TempDir()
+	s, err := OpenLSM(dir, nil)
+	if err != nil {
+		t.Fatalf("opening failed: %v", err)
+	}
+	if _, err := s.Put("a", []byte("1"), "text/plain", 0); err != nil {
+		t.Fatalf("setting failed: %v", err)
+	}
+	if _, err := s.Put("a", []byte("2"), "text/plain", 1); err != nil {
+		t.Fatalf("setting failed: %v", err)
+	}
+	if err := s.Set("b", []byte("1")); err != nil {
+		t.Fatalf("setting failed: %v", err)
+	}
+	if err := s.Delete("b", 0); err != nil {
+		t.Fatalf("deleting failed: %v", err)
+	}
+	s.Close()
+
+	f, err := os.OpenFile(filepath.Join(dir, walFile), os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{42, 0, 0, 0, 1, 2})
+	f.Close()
+
+	s, err = OpenLSM(dir, nil)
+	if err != nil {
+		t.Fatalf("reopening failed: %v", err)
+	}
+	defer s.Close()
+
+	e, err := s.Lookup("a")
+	if err != nil {
+		t.Fatalf("lookup failed: %v", err)
+	}
+	if string(e.Value) != "2" || e.Version != 2 || e.ContentType != "text/plain" {
+		t.Errorf("unexpected entry %+v", e)
+	}
+	if _, err := s.Lookup("b"); err != ErrorKeyNotFound {
+		t.Errorf("expected b to be deleted, got %v", err)
+	}
+
+	// the cut record was dropped, so new writes are recovered too
+	if err := s.Set("c", []byte("1")); err != nil {
+		t.Fatalf("setting failed: %v", err)
+	}
+	s.Close()
+	s, err = OpenLSM(dir, nil)
+	if err != nil {
+		t.Fatalf("reopening failed: %v", err)
+	}
+	defer s.Close()
+	if _, err := s.Lookup("c"); err != nil {
+		t.Errorf("expected c to be recovered, got %v", err)
+	}
+}
+
+// Test that the writes of a transaction cut by a crash are all lost
+func TestLSMTornTxn(t *testing.T) {
+	dir := t.TempDir()
+	s, err := OpenLSM(dir, nil)
+	if err != nil {
+		t.Fatalf("opening failed: %v", err)
+	}
+	s.Set("a", []byte("1"))
+	ops := []*TxnOp{{Op: OpPut, Key: "a", Value: []byte("2")}, {Op: OpPut, Key: "b", Value: []byte("2")}}
+	if _, err := s.Txn(nil, ops); err != nil {
+		t.Fatalf("transaction failed: %v", err)
+	}
+	s.Close()
+
+	path := filepath.Join(dir, walFile)
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(path, info.Size()-1); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = OpenLSM(dir, nil)
+	if err != nil {
+		t.Fatalf("reopening failed: %v", err)
+	}
+	defer s.Close()
+	if e, err := s.Lookup("a"); err != nil || string(e.Value) != "1" {
+		t.Errorf("expected a to be 1, got %+v (%v)", e, err)
+	}
+	if _, err := s.Lookup("b"); err != ErrorKeyNotFound {
+		t.Errorf("expected b not to be written, got %v", err)
+	}
+}
+
+// Test replicating every key of an LSM storage to another storage while it
+// is being written and compacted
+func TestLSMReplicate(t *testing.T) {
+	s := openTestLSM(t, t.TempDir())
+	defer s.Close()
+
+	expected := make(map[string]string)
+	for i := 0; i < 500; i++ {
+		key := fmt.Sprintf("key%03d", i)
+		if err := s.Set(key, []byte(key)); err != nil {
+			t.Fatalf("setting failed: %v", err)
+		}
+		expected[key] = key
+	}
+	for i := 0; i < 500; i += 2 {
+		key := fmt.Sprintf("key%03d", i)
+		if err := s.Delete(key, 0); err != nil {
+			t.Fatalf("deleting failed: %v", err)
+		}
+		delete(expected, key)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 500; i++ {
+			s.Set(fmt.Sprintf("other%03d", i), []byte("x"))
+		}
+	}()
+
+	var buf bytes.Buffer
+	if err := s.ReplicateTo(&buf); err != nil {
+		t.Fatalf("replicating failed: %v", err)
+	}
+	<-done
+
+	// the replicated keys replace the ones of the replica, flushed or not
+	dir := t.TempDir()
+	replica := openTestLSM(t, dir)
+	for i := 0; i < 200; i++ {
+		replica.Set(fmt.Sprintf("key%03d", i), []byte("stale"))
+	}
+	if err := replica.ReplicateFrom(&buf); err != nil {
+		t.Fatalf("receiving failed: %v", err)
+	}
+	replica.Close()
+	replica = openTestLSM(t, dir)
+	defer replica.Close()
+
+	for key := range expected {
+		if e, err := replica.Lookup(key); err != nil || string(e.Value) != key {
+			t.Fatalf("%s: expected the key to be replicated, got %+v (%v)", key, e, err)
+		}
+	}
+	items, err := replica.Scan("key", "kez", 0)
+	if err != nil {
+		t.Fatalf("scan failed: %v", err)
+	}
+	if len(items) != len(expected) {
+		t.Errorf("expected %d keys, got %d", len(expected), len(items))
+	}
+
+	// the revision of a versioned storage is kept
+	vs := NewVersionedStore(0)
+	vs.SetNextRevision(42)
+	vs.Set("a", []byte("1"))
+	buf.Reset()
+	if err := vs.ReplicateTo(&buf); err != nil {
+		t.Fatalf("replicating failed: %v", err)
+	}
+	if err := replica.ReplicateFrom(&buf); err != nil {
+		t.Fatalf("receiving failed: %v", err)
+	}
+	if r := replica.replicatedRevision(); r != 42 {
+		t.Errorf("expected revision 42, got %d", r)
+	}
+	checkLSM(t, replica, map[string]string{"a": "1"})
+}
+
+// Test that deleted keys keep their version through flushes, compactions and
+// reopening, like in the memory store
+func TestLSMVersions(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestLSM(t, dir)
+
+	s.Set("key", []byte("1"))
+	s.Set("key", []byte("2"))
+	if err := s.Delete("key", 0); err != nil {
+		t.Fatalf("deleting failed: %v", err)
+	}
+	// an older write arriving after the deletion is dropped
+	if err := s.Apply("key", &Entry{Value: []byte("1"), Version: 1}); err != nil {
+		t.Fatalf("applying failed: %v", err)
+	}
+	if _, err := s.Lookup("key"); err != ErrorKeyNotFound {
+		t.Errorf("expected the older write to be dropped, got %v", err)
+	}
+
+	// enough writes to flush and compact the tombstone
+	for i := 0; i < 500; i++ {
+		s.Set(fmt.Sprintf("other%03d", i), bytes.Repeat([]byte("x"), 32))
+	}
+	s.compaction.Wait()
+	if len(s.l1) == 0 {
+		t.Fatal("expected tables to be compacted")
+	}
+	s.Close()
+	s = openTestLSM(t, dir)
+	defer s.Close()
+
+	if e, err := s.Put("key", []byte("3"), "", 0); err != nil || e.Version != 3 {
+		t.Errorf("expected version 3, got %+v (%v)", e, err)
+	}
+}
+
+// Test that a slave storing its data in memory applies the writes of an LSM
+// master to a key written again after a deletion
+func TestLSMMasterMemorySlave(t *testing.T) {
+	ctx := context.Background()
+	net := NewMemoryNetwork()
+	config := DefaultConfig("")
+	config.WriteConcern = WriteConcernAll
+	lsmConfig := *config
+	lsmConfig.Storage = StorageConfig{Backend: "lsm", Path: t.TempDir()}
+
+	m, err := startMaster("master:1", WithConfig(&lsmConfig), WithTransport(net.Transport()))
+	if m != nil {
+		defer m.Close()
+	}
+	if err != nil {
+		t.Fatalf("creating a master failed with error: %v", err)
+	}
+	s, err := startSlave("slave:1", "master:1", WithConfig(config), WithTransport(net.Transport()))
+	if s != nil {
+		defer s.Close()
+	}
+	if err != nil {
+		t.Fatalf("creating a slave failed with error: %v", err)
+	}
+
+	m.WriteValue(ctx, "key", []byte("1"))
+	m.WriteValue(ctx, "key", []byte("2"))
+	if err := m.DeleteValue(ctx, "key", 0); err != nil {
+		t.Fatalf("deleting failed: %v", err)
+	}
+	if err := m.WriteValue(ctx, "key", []byte("3")); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	expectValue(t, s, "key", "3")
+}
+
+// Test a node persisting its data in an LSM storage
+func TestLSMNode(t *testing.T) {
+	config := DefaultConfig("node:0")
+	config.Storage = StorageConfig{Backend: "lsm", Path: t.TempDir()}
+
+	n, err := NewMaster("node:0", WithConfig(config), WithTransport(NewMemoryNetwork().Transport()))
+	if err != nil {
+		t.Fatalf("creating failed: %v", err)
+	}
+	if err := n.WriteValue(context.Background(), "key", []byte("value")); err != nil {
+		t.Fatalf("writing failed: %v", err)
+	}
+	n.Close()
+
+	n, err = NewMaster("node:0", WithConfig(config), WithTransport(NewMemoryNetwork().Transport()))
+	if err != nil {
+		t.Fatalf("creating failed: %v", err)
+	}
+	defer n.Close()
+	if value, err := n.ReadValue(context.Background(), "key"); err != nil || string(value) != "value" {
+		t.Errorf("expected the value to be persisted, got %q, %v", value, err)
+	}
+}
+
+// Test that a slave storing its data in an LSM storage applies the writes of
+// a batch in order, even when they are pushed again
+func TestLSMSlaveBatch(t *testing.T) {
+	ctx := context.Background()
+	net := NewMemoryNetwork()
+	m, _ := memoryCluster(t, net, WriteConcernAll)
+
+	lsm := openTestLSM(t, t.TempDir())
+	defer lsm.Close()
+	s, err := startSlave("slave:1", "master:1", WithStorage(lsm), WithConfig(m.config), WithTransport(net.Transport()))
+	if s != nil {
+		defer s.Close()
+	}
+	if err != nil {
+		t.Fatalf("creating a slave failed with error: %v", err)
+	}
+
+	if err := m.WriteValue(ctx, "key", []byte("1")); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	if _, err := m.WriteBatch(ctx, []*BatchOp{
+		{Op: OpDelete, Key: "key"},
+		{Op: OpPut, Key: "key", Value: []byte("2")},
+	}); err != nil {
+		t.Fatalf("batch failed: %v", err)
+	}
+	expectValue(t, s, "key", "2")
+
+	// the put is compared to the deletion before it, not to the stored key
+	writes := []*Write{{Key: "key"}, {Key: "key", Entry: &Entry{Value: []byte("2"), Version: 2}}}
+	if err := lsm.ApplyWrites(writes); err != nil {
+		t.Fatalf("applying failed: %v", err)
+	}
+	checkLSM(t, lsm, map[string]string{"key": "2"})
+}
+
+func TestBloom(t *testing.T) {
+	var hashes []uint64
+	for i := 0; i < 1000; i++ {
+		hashes = append(hashes, keyHash(fmt.Sprintf("key%d", i)))
+	}
+	b := newBloom(hashes, 10)
+
+	for _, h := range hashes {
+		if !b.mayContain(h) {
+			t.Fatal("expected no false negatives")
+		}
+	}
+
+	var positives int
+	for i := 0; i < 1000; i++ {
+		if b.mayContain(keyHash(fmt.Sprintf("other%d", i))) {
+			positives++
+		}
+	}
+	if positives > 50 {
+		t.Errorf("expected about 1%% of false positives, got %d out of 1000", positives)
+	}
+}
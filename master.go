@@ -1,11 +1,12 @@
 package dkvs
 
 import (
-	"bytes"
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
-	"log"
-	"net/http"
+	"io"
+	"strconv"
+	"sync/atomic"
 	"time"
 )
 
@@ -14,59 +15,148 @@ func (n *Node) checkNodesHealth() error {
 	return errorNotImplemented
 }
 
-// Replicates a write to all the nodes
-func (n *Node) pushWriteToSlaves(key, val string) error {
-	for id, slave := range n.nodes {
+// Replicates a write to all the nodes; a nil entry replicates a deletion. It
+// returns once enough slaves acknowledged the write for the write concern.
+func (n *Node) pushWriteToSlaves(ctx context.Context, index uint64, key string, e *Entry) error {
+	return n.pushToSlaves(ctx, &Message{Kind: MessageWrite, Index: index, Key: key, Entry: e})
+}
+
+// Replicates writes applied together to all the nodes, as a single message,
+// so that slaves apply them together too
+func (n *Node) pushWritesToSlaves(ctx context.Context, index uint64, writes []*Write) error {
+	return n.pushToSlaves(ctx, &Message{Kind: MessageWrites, Index: index, Writes: writes})
+}
+
+// pushToSlaves sends a write message to all the slaves, retrying on failures,
+// and returns once enough slaves acknowledged it for the write concern
+func (n *Node) pushToSlaves(ctx context.Context, msg *Message) error {
+	// pushes outlive the request that triggered them, which only waits for
+	// the acknowledgements
+	requestCtx := ctx
+	ctx = context.WithoutCancel(ctx)
+
+	field, value := describeWrite(msg)
+
+	// slaves join meanwhile
+	n.nMutex.RLock()
+	nodes := n.copyNodes()
+	n.nMutex.RUnlock()
+
+	acks := make(chan error, len(nodes))
+	slaves := 0
+	for id, slave := range nodes {
 		// do not push to self
 		if id == n.ID {
 			continue
 		}
+		slaves++
 
 		// run goroutines to asynchronously push to all slaves, and retry on fails
 		go func(slave *Node) {
-			for i := 0; i < defaultConfig.retriesCount; i++ {
-				if err := n.pushWriteToOneSlave(slave, key, val); err != nil {
-					log.Printf("try %d pushing to %s: %v", i+1, slave.ID, err)
-					time.Sleep(defaultConfig.retriesDelayMs * time.Millisecond)
+			ctx, span := n.startSpan(ctx, "replication.push", "peer", slave.ID, field, value, "index", strconv.FormatUint(msg.Index, 10))
+
+			var err error
+			for i := 0; i < n.config.Retry.Count; i++ {
+				if i > 0 {
+					n.metrics.pushRetries.inc()
+					time.Sleep(n.config.retryDelay(i))
+				}
+
+				// the slave skips the writes it missed before, which would
+				// hold this one back
+				msg := *msg
+				msg.Settled = n.settledFor(slave.ID)
+
+				err = n.pushToOneSlave(ctx, slave, &msg)
+				if err == nil {
+					n.recordAck(slave.ID, msg.Index)
+					n.settle(slave.ID, msg.Index)
+					n.metrics.pushes.inc("success")
+					span.Attributes["tries"] = strconv.Itoa(i + 1)
+					span.finish(nil)
+					acks <- nil
+					return
 				}
-				break
+
+				n.metrics.pushes.inc("failure")
+				n.logWarn("pushing write failed", "peer", slave.ID, field, value, "try", i+1, "error", err)
 			}
+
+			// the write is lost for this slave
+			n.settle(slave.ID, msg.Index)
+			span.Attributes["tries"] = strconv.Itoa(n.config.Retry.Count)
+			span.finish(err)
+			acks <- err
 		}(slave)
 	}
-	return nil
-}
 
-func (n *Node) pushWriteToOneSlave(slave *Node, key, val string) error {
-	url := "http://" + slave.Address + "/receive"
+	return n.waitForAcks(requestCtx, acks, slaves)
+}
 
-	payload := map[string]string{
-		"key": key,
-		"val": val,
+// waitForAcks waits until enough slaves acknowledged a write for the write
+// concern, until the request timeout or until the context is done. Either way
+// the write is applied on the master, and keeps being pushed to the slaves in
+// the background.
+func (n *Node) waitForAcks(ctx context.Context, acks <-chan error, slaves int) error {
+	needed := 0
+	switch n.config.WriteConcern {
+	case WriteConcernOne:
+		needed = 1
+	case WriteConcernAll:
+		needed = slaves
+	}
+	if needed > slaves {
+		needed = slaves
 	}
-	jsonPayload, _ := json.Marshal(payload)
-	buffer := bytes.NewBuffer(jsonPayload)
 
-	resp, err := http.Post(url, encoding, buffer)
-	if err != nil {
-		return fmt.Errorf("pushing write: %v", err)
+	timeout := time.NewTimer(time.Duration(n.config.RequestTimeout))
+	defer timeout.Stop()
+
+	for acked, failed := 0, 0; acked < needed; {
+		select {
+		case err := <-acks:
+			if err == nil {
+				acked++
+				continue
+			}
+			if failed++; slaves-failed < needed {
+				return &Error{Code: CodeTimeout, Message: "write not acknowledged by enough slaves: " + err.Error(), Retryable: true}
+			}
+		case <-timeout.C:
+			return ErrorTimeout
+		case <-ctx.Done():
+			return toError(ctx.Err())
+		}
 	}
-	defer resp.Body.Close()
-	buf := new(bytes.Buffer)
-	buf.ReadFrom(resp.Body)
-	body := buf.String()
+	return nil
+}
 
-	if resp.StatusCode != 200 {
-		return fmt.Errorf("pushing write bad response: %v", body)
+func (n *Node) pushToOneSlave(ctx context.Context, slave *Node, msg *Message) error {
+	if err := n.transport.Send(ctx, slave.Address, msg); err != nil {
+		return fmt.Errorf("pushing write: %v", err)
 	}
 
-	log.Printf("pushed write to %s", slave.ID)
+	field, value := describeWrite(msg)
+	n.logDebug("pushed write", "peer", slave.ID, field, value, "index", msg.Index)
 
 	return nil
 }
 
-// Replicates a list update to all the nodes
-func (n *Node) pushListUpdateToSlaves() error {
-	for id, slave := range n.nodes {
+// describeWrite returns the attribute describing a write message in logs and
+// spans: its key, or its number of writes
+func describeWrite(msg *Message) (string, string) {
+	if msg.Kind == MessageWrites {
+		return "writes", strconv.Itoa(len(msg.Writes))
+	}
+	return "key", msg.Key
+}
+
+// Replicates a list update to all the nodes of a copy of the nodes list
+func (n *Node) pushListUpdateToSlaves(ctx context.Context, nodes map[string]*Node) error {
+	// pushes outlive the request that triggered them
+	ctx = context.WithoutCancel(ctx)
+
+	for id, slave := range nodes {
 		// do not push to self
 		if id == n.ID {
 			continue
@@ -74,105 +164,207 @@ func (n *Node) pushListUpdateToSlaves() error {
 
 		// run goroutines to asynchronously push to all slaves, and retry on fails
 		go func(slave *Node) {
-			for i := 0; i < defaultConfig.retriesCount; i++ {
-				if err := n.pushListUpdateToOneSlave(slave); err == nil {
+			for i := 0; i < n.config.Retry.Count; i++ {
+				if i > 0 {
+					time.Sleep(n.config.retryDelay(i))
+				}
+				if err := n.pushListUpdateToOneSlave(ctx, slave); err == nil {
 					break
 				}
-				time.Sleep(defaultConfig.retriesDelayMs * time.Millisecond)
 			}
 		}(slave)
 	}
 	return nil
 }
 
-func (n *Node) pushListUpdateToOneSlave(slave *Node) error {
-	url := "http://" + slave.Address + "/update"
-	payload, _ := json.Marshal(n.nodes)
-	buffer := bytes.NewBuffer(payload)
+func (n *Node) pushListUpdateToOneSlave(ctx context.Context, slave *Node) error {
+	n.nMutex.RLock()
+	nodes := n.copyNodes()
+	n.nMutex.RUnlock()
 
-	resp, err := http.Post(url, encoding, buffer)
-	if err != nil {
-		return fmt.Errorf("pushing list update: %v", err)
-	}
+	return n.sendListUpdate(ctx, slave, nodes)
+}
 
-	defer resp.Body.Close()
-	buf := new(bytes.Buffer)
-	buf.ReadFrom(resp.Body)
-	body := buf.String()
+// copyNodes copies the nodes list; the caller must hold nMutex
+func (n *Node) copyNodes() map[string]*Node {
+	nodes := make(map[string]*Node, len(n.nodes))
+	for id, node := range n.nodes {
+		nodes[id] = node
+	}
+	return nodes
+}
 
-	if resp.StatusCode != 200 {
-		return fmt.Errorf("pushing list update bad response: %v", body)
+func (n *Node) sendListUpdate(ctx context.Context, slave *Node, nodes map[string]*Node) error {
+	if err := n.transport.Send(ctx, slave.Address, &Message{Kind: MessageUpdate, Nodes: nodes}); err != nil {
+		return fmt.Errorf("pushing list update: %v", err)
 	}
 
 	return nil
 }
 
 // replicateToSlave replicates data by streaming it from the master to the slave.
-func (n *Node) replicateToSlave(slave *Node) error {
-	buffer, err := n.storage.ReplicateTo()
-
-	if err != nil {
-		return err
+// It returns the index of the last write included in the replicated data.
+func (n *Node) replicateToSlave(ctx context.Context, slave *Node) (uint64, error) {
+	// writes done while copying may be included too, which only makes the
+	// slave look a bit more behind than it is
+	index := atomic.LoadUint64(&n.index)
+
+	// the data is sent while it is read from the storage
+	r, w := io.Pipe()
+	defer r.Close()
+	go func() {
+		w.CloseWithError(n.storage.ReplicateTo(w))
+	}()
+
+	msg := &Message{Kind: MessageReplicate, Index: index, Stream: r}
+	if err := n.transport.Send(ctx, slave.Address, msg); err != nil {
+		return 0, fmt.Errorf("replicate: %v", err)
 	}
 
-	url := "http://" + slave.Address + "/replicate"
+	return index, nil
+}
 
-	resp, err := http.Post(url, encoding, buffer)
+// NewMaster creates a new node as a master, listening on addr once started
+func NewMaster(addr string, opts ...Option) (*Node, error) {
+	n, err := newNode(addr, "", false, opts)
 	if err != nil {
-		return fmt.Errorf("replicate: %v", err)
-	}
-	defer resp.Body.Close()
-	buf := new(bytes.Buffer)
-	buf.ReadFrom(resp.Body)
-	body := buf.String()
-
-	if resp.StatusCode != 200 {
-		return fmt.Errorf("replicate bad response: %v", body)
+		return nil, err
 	}
-
-	return nil
-}
-
-// NewMaster creates a new node as a master
-func NewMaster(addr string) (*Node, error) {
-	n, err := newNode(addr)
 	n.MasterID = n.ID
 	n.nodes[n.ID] = n
-	return n, err
+	// the writes of a storage opened with data go on with its revisions
+	if vs, ok := n.storage.(VersionedStorage); ok {
+		n.index = vs.Revision()
+	}
+	return n, nil
 }
 
 // Join allows a slave to join this node
-func (n *Node) Join(slave *Node) error {
+func (n *Node) Join(ctx context.Context, slave *Node) error {
 	if !n.IsMaster() {
-		return errorNotMaster
+		return ErrorNotMaster
 	}
 
 	n.nMutex.Lock()
-	defer n.nMutex.Unlock()
-
-	slave.MasterID = n.MasterID
+	slave.MasterID = n.masterID()
+	// a slave restarted at the address of a former one replaces it, whose
+	// writes it would otherwise receive, along with which of them were
+	// given up on
+	for id, node := range n.nodes {
+		if id != n.ID && node.Address == slave.Address {
+			delete(n.nodes, id)
+		}
+	}
 	n.nodes[slave.ID] = slave
 
-	if err := n.replicateToSlave(slave); err != nil {
+	index, err := n.replicateToSlave(ctx, slave)
+	if err != nil {
+		n.nMutex.Unlock()
 		return err
 	}
+	slave.ackedIndex, slave.settledIndex = index, index
+	nodes := n.copyNodes()
+	n.nMutex.Unlock()
+
+	// the list is sent without holding the lock, so that a slow node doesn't
+	// hold up the writes and the other joins. The joining slave gets it before
+	// the join returns, so that it knows its master once started.
+	if err := n.sendListUpdate(ctx, slave, nodes); err != nil {
+		return err
+	}
+
+	n.logInfo("node joined", "peer", slave.ID, "addr", slave.Address)
+
+	return n.pushListUpdateToSlaves(ctx, nodes)
+}
 
-	log.Printf("node %s joined", slave.ID)
+// commit applies writes to the storage with apply, and numbers them with the
+// next replication index, unless there are none. It holds the lock of the
+// watches meanwhile, so that the watchers and the change log get the writes in
+// the order of their indexes, and so that the change log gets the previous
+// entries of the keys.
+func (n *Node) commit(keys []string, apply func() ([]*Write, error)) (uint64, error) {
+	n.watches.lock.Lock()
+	defer n.watches.lock.Unlock()
+
+	previous := n.previousEntries(keys)
+	n.setRevision(atomic.LoadUint64(&n.index) + 1)
+	writes, err := apply()
+	if err != nil || len(writes) == 0 {
+		return 0, err
+	}
 
-	return n.pushListUpdateToSlaves()
+	index := n.recordWrite()
+	n.publish(index, writes, previous)
+	return index, nil
 }
 
 // WriteValue will write a value to the internal
 // storage and push it to all the slaves.
 // This can only be run on the master.
-func (n *Node) WriteValue(key, val string) error {
+func (n *Node) WriteValue(ctx context.Context, key string, val []byte) error {
+	_, err := n.PutValue(ctx, key, val, "", 0)
+	return err
+}
+
+// PutValue writes a value along with its content type and pushes it to all
+// the slaves. When version isn't 0, the write only succeeds if it matches the
+// current version of the key.
+// This can only be run on the master.
+func (n *Node) PutValue(ctx context.Context, key string, val []byte, contentType string, version uint64) (*Entry, error) {
+	e, _, err := n.putValue(ctx, key, val, contentType, version)
+	return e, err
+}
+
+// putValue is PutValue, also telling whether the key was created rather than
+// replaced. A deleted key is created again, whatever its version.
+func (n *Node) putValue(ctx context.Context, key string, val []byte, contentType string, version uint64) (*Entry, bool, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, false, err
+	}
 	if !n.IsMaster() {
-		return errorNotMaster
+		return nil, false, ErrorNotMaster
+	}
+
+	var e *Entry
+	var created bool
+	_, span := n.startSpan(ctx, "storage.put", "key", key)
+	index, err := n.commit([]string{key}, func() ([]*Write, error) {
+		// writes are serialized by commit, so the key can't change between
+		// the lookup and the write
+		_, err := n.storage.Lookup(key)
+		created = errors.Is(err, ErrorKeyNotFound)
+		e, err = n.storage.Put(key, val, contentType, version)
+		return []*Write{{Key: key, Entry: e}}, err
+	})
+	span.finish(err)
+	if err != nil {
+		return nil, false, err
 	}
 
-	if err := n.storage.Set(key, val); err != nil {
+	return e, created, n.pushWriteToSlaves(ctx, index, key, e)
+}
+
+// DeleteValue removes a key and pushes the deletion to all the slaves. When
+// version isn't 0, the deletion only succeeds if it matches the current
+// version of the key.
+// This can only be run on the master.
+func (n *Node) DeleteValue(ctx context.Context, key string, version uint64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if !n.IsMaster() {
+		return ErrorNotMaster
+	}
+
+	_, span := n.startSpan(ctx, "storage.delete", "key", key)
+	index, err := n.commit([]string{key}, func() ([]*Write, error) {
+		return []*Write{{Key: key}}, n.storage.Delete(key, version)
+	})
+	span.finish(err)
+	if err != nil {
 		return err
 	}
 
-	return n.pushWriteToSlaves(key, val)
+	return n.pushWriteToSlaves(ctx, index, key, nil)
 }
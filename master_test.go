@@ -2,7 +2,9 @@ package dkvs
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"testing"
@@ -13,7 +15,7 @@ import (
 func TestMaster(t *testing.T) {
 	masterAddr := ":1212"
 
-	if m, err := NewMaster(masterAddr); m != nil {
+	if m, err := startMaster(masterAddr); m != nil {
 		defer m.Close()
 	} else if err != nil {
 		t.Errorf("error creating master: %v", err)
@@ -104,8 +106,8 @@ func TestMaster(t *testing.T) {
 
 	type responsePayload struct {
 		Key   string `json:"k"`
-		Value string `json:"v"`
-		Error error  `json:"e"`
+		Value []byte `json:"v"`
+		Error *Error `json:"e"`
 	}
 	var rp []responsePayload
 
@@ -139,7 +141,7 @@ func TestMaster(t *testing.T) {
 		if val.Error != nil {
 			t.Errorf("missing value: %v", val.Error)
 			hasError = true
-		} else if expected := data[val.Key]; expected != val.Value {
+		} else if expected := data[val.Key]; expected != string(val.Value) {
 			t.Errorf("expected value %v for key %v, got %v instead", expected, val.Key, val.Value)
 			hasError = true
 		}
@@ -194,3 +196,46 @@ func TestMaster(t *testing.T) {
 		return
 	}
 }
+
+// Test writing while slaves join, which the race detector checks
+func TestJoinWhileWriting(t *testing.T) {
+	ctx := context.Background()
+	net := NewMemoryNetwork()
+	m, _ := memoryCluster(t, net, WriteConcernAsync)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 50; i++ {
+			m.WriteValue(ctx, fmt.Sprintf("key%d", i), []byte("val"))
+		}
+	}()
+
+	var slaves []*Node
+	for i := 0; i < 3; i++ {
+		s, err := startSlave(fmt.Sprintf("slave:%d", i), "master:1", WithConfig(m.config), WithTransport(net.Transport()))
+		if s != nil {
+			defer s.Close()
+		}
+		if err != nil {
+			t.Fatalf("creating a slave failed with error: %v", err)
+		}
+		slaves = append(slaves, s)
+	}
+	<-done
+
+	if err := m.WriteValue(ctx, "last", []byte("val")); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	// the write concern is async
+	deadline := time.Now().Add(time.Second)
+	for _, s := range slaves {
+		for time.Now().Before(deadline) {
+			if _, err := s.ReadValue(ctx, "last"); err == nil {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+		expectValue(t, s, "last", "val")
+	}
+}
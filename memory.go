@@ -0,0 +1,385 @@
+package dkvs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// MemoryNetwork connects in-memory transports, so that the nodes of a test
+// run in a single process without binding ports. Messages between nodes go
+// through channels, and faults can be injected in them.
+type MemoryNetwork struct {
+	lock       sync.Mutex
+	transports map[string]*memoryTransport
+	faults     FaultFunc
+	// partition groups by address; addresses in no group reach every node
+	groups map[string]int
+}
+
+// Fault describes what happens to a message sent through a MemoryNetwork
+type Fault struct {
+	// the message is lost, and the sender gets a timeout error
+	Drop bool
+	// the message is delivered after this delay, letting later messages
+	// overtake it
+	Delay time.Duration
+	// the message is delivered this many more times; the sender only gets
+	// the answer to the first delivery
+	Duplicates int
+	// the message is delivered right after the next message to the same node,
+	// or after maxHold when no message follows
+	Reorder bool
+}
+
+// maxHold is the time a reordered message waits for the next message
+const maxHold = 50 * time.Millisecond
+
+// FaultFunc decides the fault injected in a message, given the addresses of
+// the sender and the recipient
+type FaultFunc func(from, to string, msg *Message) Fault
+
+// errorUnreachable is returned for messages to addresses where no node listens
+var errorUnreachable = &Error{Code: CodeTimeout, Message: "node unreachable", Retryable: true}
+
+// errorDropped is returned for messages dropped by a fault or a partition
+var errorDropped = &Error{Code: CodeTimeout, Message: "message dropped", Retryable: true}
+
+// NewMemoryNetwork creates a network without faults
+func NewMemoryNetwork() *MemoryNetwork {
+	return &MemoryNetwork{
+		transports: make(map[string]*memoryTransport),
+		groups:     make(map[string]int),
+	}
+}
+
+// Transport creates a transport attached to the network, to pass to a node
+// with WithTransport
+func (net *MemoryNetwork) Transport() Transport {
+	return &memoryTransport{network: net}
+}
+
+// SetFaults sets the faults injected in the messages; nil removes them
+func (net *MemoryNetwork) SetFaults(f FaultFunc) {
+	net.lock.Lock()
+	defer net.lock.Unlock()
+	net.faults = f
+}
+
+// Partition splits the network: messages between nodes of different groups
+// are dropped. Nodes in no group can still reach every node.
+func (net *MemoryNetwork) Partition(groups ...[]string) {
+	net.lock.Lock()
+	defer net.lock.Unlock()
+
+	net.groups = make(map[string]int)
+	for i, group := range groups {
+		for _, addr := range group {
+			net.groups[addr] = i
+		}
+	}
+}
+
+// Heal removes the partitions
+func (net *MemoryNetwork) Heal() {
+	net.Partition()
+}
+
+// Client creates a client for the /v1 API of the node listening on addr.
+// Clients are in no partition group, so they reach every node.
+func (net *MemoryNetwork) Client(addr string) *Client {
+	return newClient(addr, "http", &memoryRoundTripper{network: net})
+}
+
+// route finds the transport of the recipient of a message, and checks that
+// the partitions let the message through
+func (net *MemoryNetwork) route(from, to string) (*memoryTransport, error) {
+	net.lock.Lock()
+	defer net.lock.Unlock()
+
+	dst := net.transports[to]
+	if dst == nil {
+		return nil, errorUnreachable
+	}
+
+	fromGroup, fromOK := net.groups[from]
+	toGroup, toOK := net.groups[to]
+	if fromOK && toOK && fromGroup != toGroup {
+		return nil, errorDropped
+	}
+	return dst, nil
+}
+
+// send delivers a message and waits for the recipient to handle it
+func (net *MemoryNetwork) send(ctx context.Context, from, to string, msg *Message) error {
+	dst, err := net.route(from, to)
+	if err != nil {
+		return err
+	}
+
+	net.lock.Lock()
+	faults := net.faults
+	net.lock.Unlock()
+
+	var fault Fault
+	if faults != nil {
+		fault = faults(from, to, msg)
+	}
+	if fault.Drop {
+		return errorDropped
+	}
+
+	// messages are copied as they would be on the wire, so that nodes never
+	// share memory
+	if msg.Stream != nil {
+		copied := *msg
+		if copied.Data, err = ioutil.ReadAll(msg.Stream); err != nil {
+			return err
+		}
+		copied.Stream = nil
+		msg = &copied
+	}
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	if fault.Delay > 0 {
+		select {
+		case <-time.After(fault.Delay):
+		case <-ctx.Done():
+			return toError(ctx.Err())
+		}
+	}
+
+	reply := make(chan error, 1)
+	for i := 0; i <= fault.Duplicates; i++ {
+		d := &delivery{ctx: ctx, msg: new(Message)}
+		if err := json.Unmarshal(data, d.msg); err != nil {
+			return err
+		}
+		// only the first delivery is answered, and reordered; nobody waits
+		// for the others
+		if i == 0 {
+			d.reply, d.reorder = reply, fault.Reorder
+		} else {
+			d.ctx = context.WithoutCancel(ctx)
+		}
+
+		select {
+		case dst.inbox <- d:
+		case <-dst.done:
+			return errorUnreachable
+		case <-ctx.Done():
+			return toError(ctx.Err())
+		}
+	}
+
+	select {
+	case err := <-reply:
+		return err
+	case <-dst.done:
+		return errorUnreachable
+	case <-ctx.Done():
+		return toError(ctx.Err())
+	}
+}
+
+// delivery is a message waiting to be handled by a node
+type delivery struct {
+	ctx     context.Context
+	msg     *Message
+	reply   chan error
+	reorder bool
+}
+
+// memoryRoundTripper serves the HTTP requests of clients and nodes with the
+// handlers of the recipient, without going through a socket. Faults only
+// apply to messages, but partitions apply to requests too.
+type memoryRoundTripper struct {
+	network *MemoryNetwork
+	// address of the sending node, empty for clients
+	from string
+}
+
+func (rt *memoryRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	dst, err := rt.network.route(rt.from, req.URL.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	r := req.Clone(req.Context())
+	r.RequestURI = req.URL.RequestURI()
+	r.RemoteAddr = rt.from
+	if r.Body == nil {
+		r.Body = http.NoBody
+	}
+
+	w := &memoryResponse{header: make(http.Header), status: http.StatusOK}
+	dst.handler.ServeHTTP(w, r)
+
+	// a node stopped while handling the request never answers
+	select {
+	case <-dst.done:
+		return nil, errorUnreachable
+	default:
+	}
+
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", w.status, http.StatusText(w.status)),
+		StatusCode:    w.status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        w.header,
+		Body:          ioutil.NopCloser(&w.body),
+		ContentLength: int64(w.body.Len()),
+		Request:       req,
+	}, nil
+}
+
+// memoryResponse records the response written by a handler
+type memoryResponse struct {
+	header      http.Header
+	status      int
+	body        bytes.Buffer
+	wroteHeader bool
+}
+
+func (w *memoryResponse) Header() http.Header {
+	return w.header
+}
+
+func (w *memoryResponse) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.status, w.wroteHeader = status, true
+	}
+}
+
+func (w *memoryResponse) Write(b []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.body.Write(b)
+}
+
+type memoryTransport struct {
+	network *MemoryNetwork
+	n       *Node
+	handler http.Handler
+
+	inbox chan *delivery
+	done  chan struct{}
+}
+
+func (t *memoryTransport) Start(ctx context.Context, n *Node) error {
+	t.network.lock.Lock()
+	defer t.network.lock.Unlock()
+
+	if _, ok := t.network.transports[n.Address]; ok {
+		return fmt.Errorf("address %s already in use", n.Address)
+	}
+
+	t.n = n
+	t.handler = (&httpTransport{n: n}).handler()
+	t.inbox = make(chan *delivery)
+	t.done = make(chan struct{})
+	t.network.transports[n.Address] = t
+
+	// requests sent by the node itself, such as status requests to the
+	// master, go through the network too
+	n.client.Transport = &memoryRoundTripper{network: t.network, from: n.Address}
+
+	go t.serve()
+
+	return nil
+}
+
+func (t *memoryTransport) Stop(ctx context.Context) error {
+	if t.n == nil {
+		return nil
+	}
+
+	t.network.lock.Lock()
+	defer t.network.lock.Unlock()
+
+	if t.network.transports[t.n.Address] == t {
+		delete(t.network.transports, t.n.Address)
+		close(t.done)
+	}
+	return nil
+}
+
+// serve handles the messages concurrently like an HTTP server, starting them
+// in the order they arrive, unless they are reordered
+func (t *memoryTransport) serve() {
+	var held []*delivery
+	// fires when the held messages waited long enough for the next one
+	var release <-chan time.Time
+
+	for {
+		select {
+		case d := <-t.inbox:
+			if d.reorder {
+				if len(held) == 0 {
+					release = time.After(maxHold)
+				}
+				held = append(held, d)
+				continue
+			}
+			go t.handle(d)
+			for _, h := range held {
+				go t.handle(h)
+			}
+			held, release = nil, nil
+		case <-release:
+			for _, h := range held {
+				go t.handle(h)
+			}
+			held, release = nil, nil
+		case <-t.done:
+			return
+		}
+	}
+}
+
+func (t *memoryTransport) handle(d *delivery) {
+	err := t.n.receive(d.ctx, d.msg)
+	if err != nil {
+		// errors are decoded as *Error on the wire
+		err = toError(err)
+	}
+	if d.reply != nil {
+		d.reply <- err
+	}
+}
+
+// Send times messages out after the request timeout of the node, but for the
+// replication stream, like the HTTP transport
+func (t *memoryTransport) Send(ctx context.Context, addr string, msg *Message) error {
+	if msg.Kind != MessageReplicate {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(t.n.config.RequestTimeout))
+		defer cancel()
+	}
+	return t.network.send(ctx, t.n.Address, addr, msg)
+}
+
+func (t *memoryTransport) Write(ctx context.Context, key string, val []byte) error {
+	return t.n.WriteValue(ctx, key, val)
+}
+
+func (t *memoryTransport) Read(ctx context.Context, key string) ([]byte, error) {
+	return t.n.ReadValue(ctx, key)
+}
+
+func (t *memoryTransport) List(ctx context.Context) ([]*Node, error) {
+	return t.n.ListNodes(ctx)
+}
+
+func (t *memoryTransport) Join(ctx context.Context, slave *Node) error {
+	return t.n.Join(ctx, slave)
+}
@@ -0,0 +1,228 @@
+package dkvs
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memoryCluster starts a master and slaves connected by an in-memory network.
+// Writes wait for every slave, so that tests don't need to sleep.
+func memoryCluster(t *testing.T, net *MemoryNetwork, concern string, slaves ...string) (*Node, []*Node) {
+	c := DefaultConfig("")
+	c.WriteConcern = concern
+	c.RequestTimeout = Duration(time.Second)
+	c.Retry.Delay = Duration(time.Millisecond)
+	c.Retry.MaxDelay = Duration(time.Millisecond)
+
+	m, err := startMaster("master:1", WithConfig(c), WithTransport(net.Transport()))
+	if m != nil {
+		t.Cleanup(func() { m.Close() })
+	}
+	if err != nil {
+		t.Fatalf("creating a master failed with error: %v", err)
+	}
+
+	nodes := make([]*Node, 0, len(slaves))
+	for _, addr := range slaves {
+		s, err := startSlave(addr, "master:1", WithConfig(c), WithTransport(net.Transport()))
+		if s != nil {
+			t.Cleanup(func() { s.Close() })
+		}
+		if err != nil {
+			t.Fatalf("creating a slave failed with error: %v", err)
+		}
+		nodes = append(nodes, s)
+	}
+
+	return m, nodes
+}
+
+func expectValue(t *testing.T, n *Node, key, expected string) {
+	t.Helper()
+
+	val, err := n.ReadValue(context.Background(), key)
+	if err != nil || string(val) != expected {
+		t.Errorf(`%s: expected "%s", got "%s" (%v)`, n.Address, expected, val, err)
+	}
+}
+
+// Test replicating writes and joins through the in-memory transport
+func TestMemoryTransport(t *testing.T) {
+	ctx := context.Background()
+	net := NewMemoryNetwork()
+	m, slaves := memoryCluster(t, net, WriteConcernAll, "slave:1", "slave:2")
+
+	if err := m.WriteValue(ctx, "key", []byte("val")); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	for _, s := range slaves {
+		expectValue(t, s, "key", "val")
+	}
+
+	if err := m.DeleteValue(ctx, "key", 0); err != nil {
+		t.Fatalf("delete failed: %v", err)
+	}
+	for _, s := range slaves {
+		if _, err := s.ReadValue(ctx, "key"); !errors.Is(err, ErrorKeyNotFound) {
+			t.Errorf("%s: expected the key to be deleted, got %v", s.Address, err)
+		}
+	}
+
+	if _, err := startMaster("master:1", WithTransport(net.Transport())); err == nil {
+		t.Error("expected the address to be in use")
+	}
+	if _, err := startSlave("slave:3", "nowhere:1", WithTransport(net.Transport())); err == nil {
+		t.Error("expected joining an unknown master to fail")
+	}
+}
+
+// Test that dropped, delayed and duplicated messages are retried or ignored
+func TestMemoryFaults(t *testing.T) {
+	ctx := context.Background()
+	net := NewMemoryNetwork()
+	m, slaves := memoryCluster(t, net, WriteConcernAll, "slave:1", "slave:2")
+
+	var lock sync.Mutex
+	sent := make(map[string]int)
+	net.SetFaults(func(from, to string, msg *Message) Fault {
+		if msg.Kind != MessageWrite {
+			return Fault{}
+		}
+
+		lock.Lock()
+		defer lock.Unlock()
+		sent[to]++
+
+		switch to {
+		case "slave:1":
+			// the first try is lost, the retry gets through
+			return Fault{Drop: sent[to] == 1}
+		default:
+			return Fault{Delay: time.Millisecond, Duplicates: 2}
+		}
+	})
+
+	if err := m.WriteValue(ctx, "key", []byte("val")); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	for _, s := range slaves {
+		expectValue(t, s, "key", "val")
+	}
+	if sent["slave:1"] != 2 {
+		t.Errorf("expected the push to slave:1 to be retried once, got %d tries", sent["slave:1"])
+	}
+}
+
+// Test that a slave keeps the latest value when writes arrive out of order
+func TestMemoryReorder(t *testing.T) {
+	ctx := context.Background()
+	net := NewMemoryNetwork()
+	m, slaves := memoryCluster(t, net, WriteConcernAsync, "slave:1")
+	s := slaves[0]
+
+	net.SetFaults(func(from, to string, msg *Message) Fault {
+		return Fault{Reorder: msg.Kind == MessageWrite && string(msg.Entry.Value) == "v1"}
+	})
+
+	m.WriteValue(ctx, "key", []byte("v1"))
+	time.Sleep(10 * time.Millisecond)
+	m.WriteValue(ctx, "key", []byte("v2"))
+
+	deadline := time.Now().Add(time.Second)
+	for m.Status(ctx).Nodes[0].AckedIndex < 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	expectValue(t, s, "key", "v2")
+}
+
+// Test that a reordered message is delivered even when no message follows,
+// and that messages time out after the request timeout
+func TestMemoryHeldMessages(t *testing.T) {
+	ctx := context.Background()
+	net := NewMemoryNetwork()
+	m, slaves := memoryCluster(t, net, WriteConcernAll, "slave:1")
+
+	net.SetFaults(func(from, to string, msg *Message) Fault {
+		return Fault{Reorder: msg.Kind == MessageWrite}
+	})
+	start := time.Now()
+	if err := m.WriteValue(ctx, "key", []byte("val")); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed >= time.Duration(m.config.RequestTimeout) {
+		t.Errorf("expected the write to be acknowledged before the request timeout, took %v", elapsed)
+	}
+	expectValue(t, slaves[0], "key", "val")
+
+	net.SetFaults(func(from, to string, msg *Message) Fault {
+		return Fault{Delay: time.Minute}
+	})
+	msg := &Message{Kind: MessageWrite, Index: 2, Key: "key"}
+	if err := m.transport.Send(ctx, "slave:1", msg); !errors.Is(err, ErrorTimeout) {
+		t.Errorf("expected the message to time out, got %v", err)
+	}
+}
+
+// Test that writes don't reach partitioned slaves
+func TestMemoryPartition(t *testing.T) {
+	ctx := context.Background()
+	net := NewMemoryNetwork()
+	m, slaves := memoryCluster(t, net, WriteConcernAll, "slave:1")
+	s := slaves[0]
+
+	net.Partition([]string{"master:1"}, []string{"slave:1"})
+
+	if err := m.WriteValue(ctx, "lost", []byte("val")); !errors.Is(err, ErrorTimeout) {
+		t.Errorf("expected the write to time out, got %v", err)
+	}
+
+	net.Heal()
+
+	if err := m.WriteValue(ctx, "key", []byte("val")); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	expectValue(t, s, "key", "val")
+
+	// there is no anti-entropy: writes missed during the partition are lost
+	if _, err := s.ReadValue(ctx, "lost"); !errors.Is(err, ErrorKeyNotFound) {
+		t.Errorf("expected the write to be lost, got %v", err)
+	}
+}
+
+// Test the client through the in-memory network, following writes from a
+// slave to the master
+func TestMemoryClient(t *testing.T) {
+	ctx := context.Background()
+	net := NewMemoryNetwork()
+	m, slaves := memoryCluster(t, net, WriteConcernAll, "slave:1")
+	c := net.Client("slave:1")
+
+	if err := c.Put(ctx, "key", []byte("v1")); err != nil {
+		t.Fatalf("put failed: %v", err)
+	}
+	expectValue(t, m, "key", "v1")
+
+	if err := c.CompareAndSwap(ctx, "key", []byte("v0"), []byte("v2")); !errors.Is(err, ErrorConflict) {
+		t.Errorf("expected %v, got %v", ErrorConflict, err)
+	}
+	if err := c.CompareAndSwap(ctx, "key", []byte("v1"), []byte("v2")); err != nil {
+		t.Errorf("compare and swap failed: %v", err)
+	}
+	if val, err := c.Get(ctx, "key"); err != nil || string(val) != "v2" {
+		t.Errorf(`expected "v2", got "%s" (%v)`, val, err)
+	}
+
+	// slaves ask the master for their lag through the network too
+	if s := slaves[0].Status(ctx); s.LagEntries == nil || *s.LagEntries != 0 {
+		t.Errorf("expected the slave to know it is in sync, got %+v", s)
+	}
+
+	slaves[0].Close()
+	if _, err := c.Get(ctx, "key"); !errors.Is(err, ErrorTimeout) {
+		t.Errorf("expected the stopped slave to be unreachable, got %v", err)
+	}
+}
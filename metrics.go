@@ -0,0 +1,325 @@
+package dkvs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// metrics are exposed on /metrics in the Prometheus text exposition format.
+// Only what dkvs needs is implemented, to avoid pulling in the client library.
+type metrics struct {
+	requests        *counterVec
+	requestDuration *histogramVec
+	pushes          *counterVec
+	pushRetries     *counterVec
+	elections       *counterVec // stays at 0 until elections are implemented
+	cdcDeliveries   *counterVec
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		requests: newCounterVec("dkvs_http_requests_total",
+			"HTTP requests handled, by route, method and status code.", "route", "method", "code"),
+		requestDuration: newHistogramVec("dkvs_http_request_duration_seconds",
+			"Latency of the HTTP requests, by route.", "route"),
+		pushes: newCounterVec("dkvs_replication_pushes_total",
+			"Writes pushed to the slaves, by result.", "result"),
+		pushRetries: newCounterVec("dkvs_replication_push_retries_total",
+			"Writes pushed to the slaves again after a failure."),
+		elections: newCounterVec("dkvs_elections_total",
+			"Master elections started by this node."),
+		cdcDeliveries: newCounterVec("dkvs_cdc_deliveries_total",
+			"Deliveries of changes to the sinks, by sink and result.", "sink", "result"),
+	}
+}
+
+// writeTo writes all the metrics of a node
+func (m *metrics) writeTo(w io.Writer, n *Node) {
+	m.requests.writeTo(w)
+	m.requestDuration.writeTo(w)
+	m.pushes.writeTo(w)
+	m.pushRetries.writeTo(w)
+	m.elections.writeTo(w)
+	m.cdcDeliveries.writeTo(w)
+
+	stats := n.storage.Stats()
+	writeGauge(w, "dkvs_storage_keys", "Keys stored by this node.", float64(stats.Keys))
+	writeGauge(w, "dkvs_storage_bytes", "Approximate size of the keys and values stored by this node.", float64(stats.Bytes))
+
+	var master float64
+	if n.IsMaster() {
+		master = 1
+	}
+	writeGauge(w, "dkvs_master", "Whether this node is the master.", master)
+
+	// the lag of the slaves is computed from the writes they acknowledged
+	lagEntries := newGaugeVec("dkvs_replication_lag_entries",
+		"Writes of the master not acknowledged by a slave yet.", "slave")
+	lagSeconds := newGaugeVec("dkvs_replication_lag_seconds",
+		"Age of the oldest write of the master not acknowledged by a slave yet.", "slave")
+
+	n.nMutex.RLock()
+	nodes := len(n.nodes)
+	if master == 1 {
+		for id, node := range n.nodes {
+			if id == n.ID {
+				continue
+			}
+			entries, seconds := n.lag(node.ackedIndex)
+			lagEntries.set(float64(entries), id)
+			lagSeconds.set(seconds, id)
+		}
+	}
+	n.nMutex.RUnlock()
+	writeGauge(w, "dkvs_nodes", "Nodes known by this node.", float64(nodes))
+	lagEntries.writeTo(w)
+	lagSeconds.writeTo(w)
+}
+
+// metricsHandler serves the metrics of the node
+func (t *httpTransport) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	t.n.metrics.writeTo(w, t.n)
+}
+
+// instrument counts and times the requests served by a route
+func (t *httpTransport) instrument(route string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+
+		// the request ID is passed along by clients and proxies, or generated
+		requestID := r.Header.Get("X-Request-Id")
+		if requestID == "" {
+			requestID = newID(16)
+		}
+		w.Header().Set("X-Request-Id", requestID)
+
+		ctx, span := t.n.startSpan(extractTrace(r), "http "+route, "http.method", r.Method, "request_id", requestID)
+
+		h(rec, r.WithContext(ctx))
+
+		span.Attributes["http.status_code"] = strconv.Itoa(rec.status)
+		if rec.status >= http.StatusInternalServerError {
+			span.finish(errors.New(http.StatusText(rec.status)))
+		} else {
+			span.finish(nil)
+		}
+
+		duration := time.Since(start)
+		t.n.metrics.requests.inc(route, r.Method, strconv.Itoa(rec.status))
+		t.n.metrics.requestDuration.observe(duration.Seconds(), route)
+		t.n.logDebug("handled request", "request_id", requestID, "route", route, "method", r.Method,
+			"status", rec.status, "duration", duration, "peer", r.Header.Get(headerNode))
+	}
+}
+
+// statusRecorder remembers the status code written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+// Unwrap lets http.ResponseController flush the response, for streams
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// vec holds the label names of a metric and formats its samples
+type vec struct {
+	name   string
+	help   string
+	labels []string
+}
+
+func (v *vec) header(w io.Writer, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", v.name, v.help, v.name, kind)
+}
+
+// key joins label values into a map key
+func (v *vec) key(values []string) string {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("%s: expected %d label values, got %d", v.name, len(v.labels), len(values)))
+	}
+	return strings.Join(values, "\xff")
+}
+
+// format renders the labels of a sample, with optional extra labels
+func (v *vec) format(key string, extra ...string) string {
+	pairs := make([]string, 0, len(v.labels)+1)
+	if len(v.labels) > 0 {
+		for i, value := range strings.Split(key, "\xff") {
+			pairs = append(pairs, v.labels[i]+"="+strconv.Quote(value))
+		}
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+"="+strconv.Quote(extra[i+1]))
+	}
+
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+type counterVec struct {
+	vec
+	values map[string]float64
+	lock   sync.Mutex
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{
+		vec:    vec{name: name, help: help, labels: labels},
+		values: make(map[string]float64),
+	}
+}
+
+func (c *counterVec) inc(values ...string) {
+	c.add(1, values...)
+}
+
+func (c *counterVec) add(delta float64, values ...string) {
+	key := c.key(values)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.values[key] += delta
+}
+
+func (c *counterVec) writeTo(w io.Writer) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.header(w, "counter")
+	// counters without labels are always exposed, even before any increment
+	if len(c.labels) == 0 && len(c.values) == 0 {
+		fmt.Fprintf(w, "%s 0\n", c.name)
+	}
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, c.format(key), formatFloat(c.values[key]))
+	}
+}
+
+type gaugeVec struct {
+	counterVec
+}
+
+func newGaugeVec(name, help string, labels ...string) *gaugeVec {
+	return &gaugeVec{*newCounterVec(name, help, labels...)}
+}
+
+func (g *gaugeVec) set(value float64, values ...string) {
+	key := g.key(values)
+
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.values[key] = value
+}
+
+func (g *gaugeVec) writeTo(w io.Writer) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	g.header(w, "gauge")
+	for _, key := range sortedKeys(g.values) {
+		fmt.Fprintf(w, "%s%s %s\n", g.name, g.format(key), formatFloat(g.values[key]))
+	}
+}
+
+// latency buckets, in seconds
+var defaultBuckets = []float64{.001, .005, .01, .05, .1, .5, 1, 5}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+type histogramVec struct {
+	vec
+	buckets []float64
+	values  map[string]*histogram
+	lock    sync.Mutex
+}
+
+func newHistogramVec(name, help string, labels ...string) *histogramVec {
+	return &histogramVec{
+		vec:     vec{name: name, help: help, labels: labels},
+		buckets: defaultBuckets,
+		values:  make(map[string]*histogram),
+	}
+}
+
+func (h *histogramVec) observe(value float64, values ...string) {
+	key := h.key(values)
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	s, ok := h.values[key]
+	if !ok {
+		s = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.values[key] = s
+	}
+
+	for i, bound := range h.buckets {
+		if value <= bound {
+			s.counts[i]++
+		}
+	}
+	s.sum += value
+	s.count++
+}
+
+func (h *histogramVec) writeTo(w io.Writer) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.header(w, "histogram")
+	for _, key := range sortedKeys(h.values) {
+		s := h.values[key]
+		for i, bound := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.format(key, "le", formatFloat(bound)), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.format(key, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, h.format(key), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, h.format(key), s.count)
+	}
+}
+
+func writeGauge(w io.Writer, name, help string, value float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", name, help, name, name, formatFloat(value))
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func sortedKeys(m interface{}) []string {
+	var keys []string
+	switch m := m.(type) {
+	case map[string]float64:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	case map[string]*histogram:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
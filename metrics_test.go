@@ -0,0 +1,114 @@
+package dkvs
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Test the exposition format of counters and histograms
+func TestMetricsFormat(t *testing.T) {
+	c := newCounterVec("requests_total", "Requests.", "route", "code")
+	c.inc("/a", "200")
+	c.inc("/a", "200")
+	c.inc("/b", "404")
+
+	h := newHistogramVec("duration_seconds", "Duration.", "route")
+	h.observe(0.003, "/a")
+	h.observe(2, "/a")
+
+	buf := new(bytes.Buffer)
+	c.writeTo(buf)
+	h.writeTo(buf)
+
+	expected := `# HELP requests_total Requests.
+# TYPE requests_total counter
+requests_total{route="/a",code="200"} 2
+requests_total{route="/b",code="404"} 1
+# HELP duration_seconds Duration.
+# TYPE duration_seconds histogram
+duration_seconds_bucket{route="/a",le="0.001"} 0
+duration_seconds_bucket{route="/a",le="0.005"} 1
+duration_seconds_bucket{route="/a",le="0.01"} 1
+duration_seconds_bucket{route="/a",le="0.05"} 1
+duration_seconds_bucket{route="/a",le="0.1"} 1
+duration_seconds_bucket{route="/a",le="0.5"} 1
+duration_seconds_bucket{route="/a",le="1"} 1
+duration_seconds_bucket{route="/a",le="5"} 2
+duration_seconds_bucket{route="/a",le="+Inf"} 2
+duration_seconds_sum{route="/a"} 2.003
+duration_seconds_count{route="/a"} 2
+`
+
+	if actual := buf.String(); actual != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, actual)
+	}
+}
+
+// Test scraping the metrics of a master replicating to a slave
+func TestMetricsEndpoint(t *testing.T) {
+	masterAddr := ":5959"
+	slaveAddr := ":6060"
+
+	m, err := startMaster(masterAddr)
+	if m != nil {
+		defer m.Close()
+	}
+	if err != nil {
+		t.Errorf("creating a master failed with error: %v", err)
+		return
+	}
+
+	// wait for the server to start
+	time.Sleep(100 * time.Millisecond)
+
+	s, err := startSlave(slaveAddr, masterAddr)
+	if s != nil {
+		defer s.Close()
+	}
+	if err != nil {
+		t.Errorf("creating a slave failed with error: %v", err)
+		return
+	}
+
+	c := NewClient(masterAddr)
+	if err := c.Put(context.Background(), "key", []byte("value")); err != nil {
+		t.Errorf("put failed: %v", err)
+		return
+	}
+	if _, err := c.Get(context.Background(), "missing"); err == nil {
+		t.Error("expected an error reading a missing key")
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	resp, err := http.Get("http://" + masterAddr + "/metrics")
+	if err != nil {
+		t.Errorf("error getting /metrics: %v", err)
+		return
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+
+	for _, line := range []string{
+		`dkvs_http_requests_total{route="/v1/keys/",method="PUT",code="201"} 1`,
+		`dkvs_http_requests_total{route="/v1/keys/",method="GET",code="404"} 1`,
+		`dkvs_http_request_duration_seconds_count{route="/v1/keys/"} 2`,
+		`dkvs_replication_pushes_total{result="success"} 1`,
+		`dkvs_replication_lag_entries{slave="` + s.ID + `"} 0`,
+		`dkvs_replication_lag_seconds{slave="` + s.ID + `"} 0`,
+		"dkvs_storage_keys 1",
+		"dkvs_storage_bytes 32", // key, value and content type
+		"dkvs_master 1",
+		"dkvs_nodes 2",
+		"dkvs_elections_total 0",
+	} {
+		if !strings.Contains(string(body), line) {
+			t.Errorf("expected the metrics to contain %s, got:\n%s", line, body)
+		}
+	}
+}
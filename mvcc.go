@@ -0,0 +1,287 @@
+package dkvs
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+)
+
+// number of past revisions kept by default by the memory store
+const defaultRetention = 1000
+
+var errorNotVersioned = &Error{Code: CodeBadRequest, Message: "the storage doesn't keep past revisions"}
+
+// VersionedStorage is a storage that keeps the past entries of the keys, so
+// that they can be read as they were at a revision. Each write operation
+// applied by the storage gets a revision, the writes of a transaction or of a
+// batch sharing the same one. Nodes number them with the replication index of
+// the master, so that a revision is the same on every node.
+type VersionedStorage interface {
+	Storage
+
+	// Revision returns the revision of the last write
+	Revision() uint64
+	// SetNextRevision sets the revision of the next write operation, which
+	// is otherwise the one after the last. Revisions only increase, so a
+	// revision below the last one is ignored.
+	SetNextRevision(revision uint64)
+	// LookupAt returns the entry of a key as it was at a revision. It fails
+	// with ErrorCompacted when the revision was compacted.
+	LookupAt(key string, revision uint64) (*Entry, error)
+	// History returns the entries of a key since the compacted revision,
+	// oldest first
+	History(key string) ([]*KeyRevision, error)
+	// Compact forgets the entries replaced before a revision
+	Compact(revision uint64) error
+}
+
+// KeyRevision is the entry of a key from a revision on, a nil entry meaning
+// the key was deleted
+type KeyRevision struct {
+	Revision uint64 `json:"revision"`
+	Entry    *Entry `json:"entry,omitempty"`
+
+	// last version of a deleted key
+	version uint64
+}
+
+// NewVersionedStore creates an in memory data store keeping the last
+// retention revisions, or all of them when retention is 0
+func NewVersionedStore(retention int) VersionedStorage {
+	return &store{
+		data:      newSkipList(),
+		history:   make(map[string][]*KeyRevision),
+		retention: uint64(retention),
+	}
+}
+
+func (s *store) Revision() uint64 {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.revision
+}
+
+func (s *store) SetNextRevision(revision uint64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.next = revision
+}
+
+func (s *store) LookupAt(key string, revision uint64) (*Entry, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if err := s.checkRevision(revision); err != nil {
+		return nil, err
+	}
+
+	h := s.history[key]
+	for i := len(h) - 1; i >= 0; i-- {
+		if h[i].Revision > revision {
+			continue
+		}
+		if h[i].Entry == nil {
+			break
+		}
+		return h[i].Entry.clone(), nil
+	}
+	return nil, ErrorKeyNotFound
+}
+
+func (s *store) History(key string) ([]*KeyRevision, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	h := s.history[key]
+	if len(h) == 0 {
+		return nil, ErrorKeyNotFound
+	}
+
+	history := make([]*KeyRevision, len(h))
+	for i, kr := range h {
+		history[i] = &KeyRevision{Revision: kr.Revision}
+		if kr.Entry != nil {
+			history[i].Entry = kr.Entry.clone()
+		}
+	}
+	return history, nil
+}
+
+func (s *store) Compact(revision uint64) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if revision > s.revision {
+		return &Error{Code: CodeBadRequest, Message: fmt.Sprintf("revision %d doesn't exist", revision)}
+	}
+	if revision > s.compacted {
+		s.compact(revision)
+	}
+	return nil
+}
+
+// checkRevision tells whether a revision can be read; the caller holds the
+// lock
+func (s *store) checkRevision(revision uint64) error {
+	if revision > s.revision {
+		return &Error{Code: CodeBadRequest, Message: fmt.Sprintf("revision %d doesn't exist", revision)}
+	}
+	if revision < s.compacted {
+		return ErrorCompacted
+	}
+	return nil
+}
+
+// advance moves to the revision of a write operation; the caller holds the
+// lock
+func (s *store) advance() {
+	if s.next > s.revision {
+		s.revision = s.next
+	} else {
+		s.revision++
+	}
+	s.next = 0
+}
+
+// record stores the entry of a key at the current revision, a nil entry
+// deleting it; the caller holds the lock
+func (s *store) record(key string, e *Entry) {
+	kr := &KeyRevision{Revision: s.revision, Entry: e}
+	if e == nil {
+		_, kr.version, _ = s.lookup(key)
+		s.data.delete(key)
+	} else {
+		s.data.set(key, e)
+	}
+
+	// a batch can write a key more than once in a revision
+	h := s.history[key]
+	if len(h) > 0 && h[len(h)-1].Revision == s.revision {
+		h[len(h)-1] = kr
+		return
+	}
+	s.history[key] = append(h, kr)
+}
+
+// maybeCompact compacts the history once it holds twice the retention, so
+// that compactions are spread over many writes; the caller holds the lock
+func (s *store) maybeCompact() {
+	if s.retention > 0 && s.revision > s.compacted+2*s.retention {
+		s.compact(s.revision - s.retention)
+	}
+}
+
+// compact drops the entries replaced at or before a revision, and the keys
+// deleted by then along with their last version; the caller holds the lock
+func (s *store) compact(revision uint64) {
+	for key, h := range s.history {
+		// the last entry at or before the revision is still visible from it
+		i := len(h) - 1
+		for i > 0 && h[i].Revision > revision {
+			i--
+		}
+
+		if i == len(h)-1 && h[i].Entry == nil && h[i].Revision <= revision {
+			delete(s.history, key)
+		} else if i > 0 {
+			s.history[key] = append([]*KeyRevision{}, h[i:]...)
+		}
+	}
+	s.compacted = revision
+}
+
+// versioned returns the storage of the node if it keeps past revisions
+func (n *Node) versioned() (VersionedStorage, error) {
+	vs, ok := n.storage.(VersionedStorage)
+	if !ok {
+		return nil, errorNotVersioned
+	}
+	return vs, nil
+}
+
+// setRevision numbers the next write of the storage with a replication index;
+// the caller holds the lock of the watches
+func (n *Node) setRevision(index uint64) {
+	if vs, ok := n.storage.(VersionedStorage); ok {
+		vs.SetNextRevision(index)
+	}
+}
+
+// Revision returns the revision of the last write applied by the storage of
+// the node, which is its replication index
+func (n *Node) Revision(ctx context.Context) (uint64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	vs, err := n.versioned()
+	if err != nil {
+		return 0, err
+	}
+	return vs.Revision(), nil
+}
+
+// ReadEntryAt returns the entry of a key as it was at a revision, or as it is
+// when revision is 0. A slave that didn't apply the revision yet fails with a
+// retryable syncing error, and one that joined after it can't read it.
+func (n *Node) ReadEntryAt(ctx context.Context, key string, revision uint64) (*Entry, error) {
+	if revision == 0 {
+		return n.ReadEntry(ctx, key)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if n.isSyncing() {
+		return nil, ErrorSyncing
+	}
+	vs, err := n.versioned()
+	if err != nil {
+		return nil, err
+	}
+
+	// the revision may exist on the master, and be pushed to this slave soon
+	if !n.IsMaster() && revision > vs.Revision() {
+		return nil, &Error{
+			Code:      CodeSyncing,
+			Message:   fmt.Sprintf("revision %d isn't applied by this node yet", revision),
+			Retryable: true,
+		}
+	}
+
+	_, span := n.startSpan(ctx, "storage.get", "key", key, "revision", strconv.FormatUint(revision, 10))
+	e, err := vs.LookupAt(key, revision)
+	span.finish(err)
+	return e, err
+}
+
+// History returns the past entries of a key the storage of the node still
+// keeps, oldest first
+func (n *Node) History(ctx context.Context, key string) ([]*KeyRevision, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if n.isSyncing() {
+		return nil, ErrorSyncing
+	}
+	vs, err := n.versioned()
+	if err != nil {
+		return nil, err
+	}
+	return vs.History(key)
+}
+
+// Compact forgets the entries the storage of the node replaced before a
+// revision. Each node compacts its own storage.
+func (n *Node) Compact(ctx context.Context, revision uint64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	vs, err := n.versioned()
+	if err != nil {
+		return err
+	}
+
+	n.logInfo("compacting storage", "revision", revision)
+	return vs.Compact(revision)
+}
@@ -0,0 +1,238 @@
+package dkvs
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// Test reading the keys of the memory store at past revisions
+func TestVersionedStore(t *testing.T) {
+	s := NewVersionedStore(2)
+
+	s.Put("a", []byte("1"), "", 0)
+	s.Put("b", []byte("1"), "", 0)
+	s.Batch([]*BatchOp{
+		{Op: OpPut, Key: "a", Value: []byte("2")},
+		{Op: OpPut, Key: "a", Value: []byte("3")},
+		{Op: OpDelete, Key: "b"},
+	})
+	if r := s.Revision(); r != 3 {
+		t.Fatalf("expected revision 3, got %d", r)
+	}
+
+	expected := []struct {
+		key      string
+		revision uint64
+		value    string
+		err      error
+	}{
+		{"a", 1, "1", nil},
+		{"b", 1, "", ErrorKeyNotFound},
+		{"b", 2, "1", nil},
+		{"a", 3, "3", nil},
+		{"b", 3, "", ErrorKeyNotFound},
+		{"a", 4, "", &Error{Code: CodeBadRequest}},
+	}
+	for _, ex := range expected {
+		e, err := s.LookupAt(ex.key, ex.revision)
+		if ex.err != nil {
+			if !errors.Is(err, ex.err) {
+				t.Errorf("%s@%d: expected %v, got %v", ex.key, ex.revision, ex.err, err)
+			}
+		} else if err != nil || string(e.Value) != ex.value {
+			t.Errorf("%s@%d: expected %q, got %+v (%v)", ex.key, ex.revision, ex.value, e, err)
+		}
+	}
+
+	// the writes of a revision to a key are kept as one entry
+	history, err := s.History("a")
+	if err != nil || len(history) != 2 || history[1].Revision != 3 || string(history[1].Entry.Value) != "3" {
+		t.Errorf("unexpected history %+v (%v)", history, err)
+	}
+
+	if err := s.Compact(2); err != nil {
+		t.Fatalf("compacting failed: %v", err)
+	}
+	if _, err := s.LookupAt("a", 1); !errors.Is(err, ErrorCompacted) {
+		t.Errorf("expected %v, got %v", ErrorCompacted, err)
+	}
+	if e, err := s.LookupAt("a", 2); err != nil || string(e.Value) != "1" {
+		t.Errorf("expected the entry visible at the compacted revision to be kept, got %+v (%v)", e, err)
+	}
+
+	// past the retention, the store compacts itself and forgets deleted keys
+	for i := 0; i < 4; i++ {
+		s.Put("c", []byte("x"), "", 0)
+	}
+	if _, err := s.LookupAt("a", 3); !errors.Is(err, ErrorCompacted) {
+		t.Errorf("expected %v, got %v", ErrorCompacted, err)
+	}
+	if _, err := s.History("b"); !errors.Is(err, ErrorKeyNotFound) {
+		t.Errorf("expected the history of b to be dropped, got %v", err)
+	}
+	// along with its last version
+	if e, err := s.Put("b", []byte("x"), "", 0); err != nil || e.Version != 1 {
+		t.Errorf("expected version 1, got %+v (%v)", e, err)
+	}
+	if history, _ := s.History("a"); len(history) != 1 {
+		t.Errorf("expected only the current entry of a, got %+v", history)
+	}
+}
+
+// Test point-in-time reads and histories through the client
+func TestClientRevisions(t *testing.T) {
+	ctx := context.Background()
+	net := NewMemoryNetwork()
+	m, _ := memoryCluster(t, net, WriteConcernAll, "slave:1")
+	c := net.Client("master:1")
+
+	m.WriteValue(ctx, "a", []byte("1"))
+	revision, _ := m.Revision(ctx)
+	m.WriteValue(ctx, "a", []byte("2"))
+
+	if v, err := c.GetAt(ctx, "a", revision); err != nil || string(v) != "1" {
+		t.Errorf(`expected "1", got %q (%v)`, v, err)
+	}
+	if v, err := c.Get(ctx, "a"); err != nil || string(v) != "2" {
+		t.Errorf(`expected "2", got %q (%v)`, v, err)
+	}
+
+	history, err := c.History(ctx, "a")
+	if err != nil || len(history) != 2 || string(history[0].Entry.Value) != "1" || history[0].Revision != revision {
+		t.Errorf("unexpected history %+v (%v)", history, err)
+	}
+
+	if err := c.Compact(ctx, revision+1); err != nil {
+		t.Fatalf("compacting failed: %v", err)
+	}
+	if _, err := c.GetAt(ctx, "a", revision); !errors.Is(err, ErrorCompacted) {
+		t.Errorf("expected %v, got %v", ErrorCompacted, err)
+	}
+
+	// the keys of a batch read share a revision
+	req, _ := http.NewRequest(http.MethodGet, "http://master:1/v1/keys?key=a", nil)
+	resp, err := net.Client("master:1").http.Do(req)
+	if err != nil {
+		t.Fatalf("reading failed: %v", err)
+	}
+	resp.Body.Close()
+	if r := resp.Header.Get("X-Revision"); r != "2" {
+		t.Errorf("expected the revision read to be 2, got %q", r)
+	}
+}
+
+// Test that a slave reads the revisions of the master as the master does,
+// from the one it joined at
+func TestSlaveRevisions(t *testing.T) {
+	ctx := context.Background()
+	net := NewMemoryNetwork()
+	m, slaves := memoryCluster(t, net, WriteConcernAll, "slave:1")
+
+	m.WriteValue(ctx, "a", []byte("1"))
+	m.WriteValue(ctx, "a", []byte("2"))
+	m.DeleteValue(ctx, "a", 0)
+
+	c := DefaultConfig("")
+	late, err := startSlave("slave:2", "master:1", WithConfig(c), WithTransport(net.Transport()))
+	if late != nil {
+		defer late.Close()
+	}
+	if err != nil {
+		t.Fatalf("creating a slave failed with error: %v", err)
+	}
+	joined, _ := late.Revision(ctx)
+
+	m.WriteValue(ctx, "a", []byte("3"))
+	m.WriteBatch(ctx, []*BatchOp{
+		{Op: OpPut, Key: "a", Value: []byte("4")},
+		{Op: OpPut, Key: "b", Value: []byte("1")},
+	})
+	expectValue(t, late, "b", "1")
+
+	last, _ := m.Revision(ctx)
+	for _, s := range append(slaves, late) {
+		if r, _ := s.Revision(ctx); r != last {
+			t.Errorf("%s: expected the revision %d, got %d", s.Address, last, r)
+		}
+	}
+
+	for revision := uint64(1); revision <= last; revision++ {
+		for _, key := range []string{"a", "b"} {
+			expected, expectedErr := m.ReadEntryAt(ctx, key, revision)
+			for _, s := range append(slaves, late) {
+				e, err := s.ReadEntryAt(ctx, key, revision)
+				if s == late && revision < joined {
+					// the past entries aren't replicated
+					if !errors.Is(err, ErrorCompacted) {
+						t.Errorf("%s@%d: expected %v, got %v", key, revision, ErrorCompacted, err)
+					}
+					continue
+				}
+				if !errors.Is(err, expectedErr) || (e == nil) != (expected == nil) ||
+					(e != nil && (string(e.Value) != string(expected.Value) || e.Version != expected.Version)) {
+					t.Errorf("%s: %s@%d: expected %+v (%v), got %+v (%v)", s.Address, key, revision, expected, expectedErr, e, err)
+				}
+			}
+		}
+	}
+}
+
+// Test reading a revision from a slave that didn't apply it yet
+func TestLaggingSlaveRevision(t *testing.T) {
+	ctx := context.Background()
+	net := NewMemoryNetwork()
+	m, slaves := memoryCluster(t, net, WriteConcernAsync, "slave:1")
+	s := slaves[0]
+
+	m.WriteValue(ctx, "a", []byte("1"))
+	applied, _ := m.Revision(ctx)
+	for start := time.Now(); time.Since(start) < time.Second; time.Sleep(time.Millisecond) {
+		if r, _ := s.Revision(ctx); r == applied {
+			break
+		}
+	}
+
+	// the next write doesn't reach the slave
+	net.SetFaults(func(from, to string, msg *Message) Fault {
+		return Fault{Drop: msg.Kind == MessageWrite}
+	})
+	m.WriteValue(ctx, "a", []byte("2"))
+	last, _ := m.Revision(ctx)
+
+	if e, err := s.ReadEntryAt(ctx, "a", applied); err != nil || string(e.Value) != "1" {
+		t.Errorf(`expected "1", got %+v (%v)`, e, err)
+	}
+	_, err := s.ReadEntryAt(ctx, "a", last)
+	var e *Error
+	if !errors.Is(err, ErrorSyncing) || !errors.As(err, &e) || !e.Retryable {
+		t.Errorf("expected a retryable %v, got %v", ErrorSyncing, err)
+	}
+	// the master doesn't have later revisions
+	if _, err := m.ReadEntryAt(ctx, "a", last+1); !errors.Is(err, &Error{Code: CodeBadRequest}) {
+		t.Errorf("expected a bad request, got %v", err)
+	}
+}
+
+// Test that nodes backed by storages without revisions reject them
+func TestUnversionedStorage(t *testing.T) {
+	lsm, err := OpenLSM(t.TempDir(), nil)
+	if err != nil {
+		t.Fatalf("opening failed: %v", err)
+	}
+	defer lsm.Close()
+
+	n, err := startMaster("lsm:1", WithStorage(lsm), WithTransport(NewMemoryNetwork().Transport()))
+	if n != nil {
+		defer n.Close()
+	}
+	if err != nil {
+		t.Fatalf("creating a master failed with error: %v", err)
+	}
+
+	if _, err := n.ReadEntryAt(context.Background(), "a", 1); !errors.Is(err, errorNotVersioned) {
+		t.Errorf("expected %v, got %v", errorNotVersioned, err)
+	}
+}
@@ -1,11 +1,16 @@
 package dkvs
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
-	"log"
+	"io"
+	"io/ioutil"
 	"math/rand"
+	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -17,39 +22,128 @@ type Node struct {
 
 	nodes  map[string]*Node
 	nMutex sync.RWMutex
+	// guards MasterID, which slaves update when receiving the nodes list
+	mMutex sync.RWMutex
 
 	storage   Storage
 	transport Transport
+	// closes the storage, when the node opened it
+	closer io.Closer
+
+	config *Config
+	tls    *TLSConfig
+	client *http.Client
+	// sends the streamed requests, which the request timeout would cut
+	streamClient *http.Client
+	secret       []byte
+
+	metrics *metrics
+	logger  Logger
+
+	spanExporter SpanExporter
+
+	// parsed access list, see acl.go
+	acl aclCache
+
+	// set while a slave waits for its initial replication; accessed atomically
+	syncing int32
+
+	// index of the last write done by the master, or applied by a slave;
+	// accessed atomically
+	index uint64
+	// writes received by a slave ahead of the previous ones, by index;
+	// guarded by the lock of the watches, see slave.go
+	pending map[uint64]*pendingWrites
+	// when the last writes happened on the master
+	writes writeLog
+	// watchers of the writes applied by this node, see watch.go
+	watches watchHub
+	// streams the writes applied by this node to sinks, nil when there are
+	// none; see cdc.go
+	changes *changeLog
+	// last write acknowledged by this slave, tracked by the master in its
+	// nodes list; guarded by the master's nMutex
+	ackedIndex uint64
+	// index up to which the master is done pushing writes to this slave, and
+	// the writes done above it, tracked like ackedIndex
+	settledIndex uint64
+	settled      map[uint64]bool
+
+	started time.Time
+	// wall clock of the node, which tests can skew
+	clock func() time.Time
 }
 
 // ReadValue searches the value for the provided key in the storage
-func (n *Node) ReadValue(key string) ([]byte, error) {
+func (n *Node) ReadValue(ctx context.Context, key string) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if n.isSyncing() {
+		return nil, ErrorSyncing
+	}
 	return n.storage.Get(key)
 }
 
+// ReadEntry searches the value and metadata for the provided key in the storage
+func (n *Node) ReadEntry(ctx context.Context, key string) (*Entry, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if n.isSyncing() {
+		return nil, ErrorSyncing
+	}
+
+	_, span := n.startSpan(ctx, "storage.get", "key", key)
+	e, err := n.storage.Lookup(key)
+	span.finish(err)
+	return e, err
+}
+
+func (n *Node) isSyncing() bool {
+	return atomic.LoadInt32(&n.syncing) == 1
+}
+
 // ReadMultipleValues searches for values associated with a range of keys
-func (n *Node) ReadMultipleValues(keys ...string) ([]byte, error) {
+func (n *Node) ReadMultipleValues(ctx context.Context, keys ...string) ([]byte, error) {
 	type payload struct {
 		Key   string `json:"k"`
-		Value string `json:"v"`
-		Error error  `json:"e"`
+		Value []byte `json:"v"`
+		Error *Error `json:"e,omitempty"`
 	}
 	p := make([]*payload, 0)
 
+	// reading every key at the same revision, when the storage keeps them,
+	// so that writes applied meanwhile aren't seen for only some of the keys
+	read := n.ReadValue
+	if vs, ok := n.storage.(VersionedStorage); ok {
+		revision := vs.Revision()
+		read = func(ctx context.Context, key string) ([]byte, error) {
+			e, err := n.ReadEntryAt(ctx, key, revision)
+			if err != nil {
+				return nil, err
+			}
+			return e.Value, nil
+		}
+	}
+
 	for _, k := range keys {
-		v, err := n.storage.Get(k)
-		p = append(p, &payload{
+		v, err := read(ctx, k)
+		item := &payload{
 			Key:   k,
-			Value: string(v),
-			Error: err,
-		})
+			Value: v,
+		}
+		if err != nil {
+			item.Error = toError(err)
+		}
+		p = append(p, item)
 	}
 
 	return json.Marshal(p)
 }
 
 // ListNodes returns a slice of all nodes
-func (n *Node) ListNodes() ([]*Node, error) {
+func (n *Node) ListNodes(ctx context.Context) ([]*Node, error) {
 	// if the node list is empty (for example, in a slave that just got started)
 	if n.nodes == nil {
 		// we fetch the list from the master
@@ -68,7 +162,77 @@ func (n *Node) ListNodes() ([]*Node, error) {
 
 // IsMaster checks if the current node is the master
 func (n *Node) IsMaster() bool {
-	return n.MasterID == n.ID
+	return n.masterID() == n.ID
+}
+
+// masterID returns the ID of the master as known by this node
+func (n *Node) masterID() string {
+	n.mMutex.RLock()
+	defer n.mMutex.RUnlock()
+	return n.MasterID
+}
+
+// url builds the URL of a route on another node
+func (n *Node) url(addr, route string) string {
+	if n.tls != nil {
+		return "https://" + addr + route
+	}
+	return "http://" + addr + route
+}
+
+// post sends a signed request to another node, propagating the trace context
+func (n *Node) post(ctx context.Context, url, contentType string, body io.Reader) (*http.Response, error) {
+	// the body is streamed, unless it must be read to be signed
+	var payload []byte
+	if len(n.secret) > 0 {
+		var err error
+		if payload, err = ioutil.ReadAll(body); err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(payload)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	injectTrace(ctx, req)
+	n.sign(req, payload)
+
+	return n.client.Do(req)
+}
+
+// postStream sends a request to another node like post, but streams the body
+// as it is read, without the request timeout. The body is signed by a trailer,
+// which the receiver checks once it read it all.
+func (n *Node) postStream(ctx context.Context, url, contentType string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	injectTrace(ctx, req)
+	req.Body = ioutil.NopCloser(n.signStream(req, body))
+
+	return n.streamClient.Do(req)
+}
+
+// now returns the current time according to the clock of the node
+func (n *Node) now() time.Time {
+	if n.clock == nil {
+		return time.Now()
+	}
+	return n.clock()
+}
+
+// master returns the master as known by this node, or nil if it isn't in the
+// nodes list
+func (n *Node) master() *Node {
+	n.nMutex.RLock()
+	defer n.nMutex.RUnlock()
+
+	return n.nodes[n.masterID()]
 }
 
 const allowedCharacters = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
@@ -86,31 +250,135 @@ func newID(n int) string {
 	return string(b)
 }
 
-func newNode(addr string) (*Node, error) {
+// newNode creates a node from the options; addr and master override the
+// addresses of the config when they aren't empty, and slaves need one
+func newNode(addr, master string, slave bool, opts []Option) (*Node, error) {
+	o := &options{
+		config:       DefaultConfig(addr),
+		logger:       defaults.logger,
+		spanExporter: defaults.spanExporter,
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	// copied, so that the config can be shared by several nodes
+	c := *o.config
+	if addr != "" {
+		c.Address = addr
+	}
+	if master != "" {
+		c.MasterAddress = master
+	}
+
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	// checked before opening the storage, which would be left open
+	if slave && c.MasterAddress == "" {
+		return nil, &ConfigError{"master_address", "is required"}
+	}
+	if c.TLS != nil {
+		if err := c.TLS.load(); err != nil {
+			return nil, err
+		}
+	}
+
+	// storages opened from the config are closed along with the node
+	var closer io.Closer
+	if o.storage == nil && c.Storage.Backend == "lsm" {
+		lsm, err := OpenLSM(c.Storage.Path, nil)
+		if err != nil {
+			return nil, fmt.Errorf("opening storage: %v", err)
+		}
+		o.storage, closer = lsm, lsm
+	}
+	if o.storage == nil {
+		o.storage = NewVersionedStore(c.Storage.Retention)
+	}
+	if o.transport == nil {
+		o.transport = NewHTTPTransport()
+	}
+
 	id := newID(16)
 
 	n := &Node{
 		ID:        id,
 		nodes:     make(map[string]*Node),
-		Address:   addr,
-		storage:   NewStore(),
-		transport: NewHTTPTransport(),
+		pending:   make(map[uint64]*pendingWrites),
+		Address:   c.Address,
+		storage:   o.storage,
+		closer:    closer,
+		transport: o.transport,
+		config:    &c,
+		tls:       c.TLS,
+		client:    newHTTPClient(c.TLS),
+		secret:    []byte(c.ClusterSecret),
+		metrics:   newMetrics(),
+		logger:    o.logger,
+
+		spanExporter: o.spanExporter,
+		clock:        o.clock,
 	}
+	n.started = n.now()
+	n.client.Timeout = time.Duration(c.RequestTimeout)
+	n.streamClient = &http.Client{Transport: n.client.Transport}
 
-	go func() {
-		err := n.transport.Start(n)
-		if err != nil {
-			panic(fmt.Sprintf("failed to start transport with error: %v", err))
+	if err := n.openChangeLog(o.sinks); err != nil {
+		if closer != nil {
+			closer.Close()
 		}
-	}()
+		return nil, err
+	}
 
-	log.Printf("Created node with id %s\n", n.ID)
+	n.logInfo("created node", "addr", n.Address)
 
 	return n, nil
 }
 
-// Close properly closes the node
-func (n *Node) Close() error {
+// Start starts serving requests, then makes a slave join its master. It
+// returns once the node is ready, or with the error that prevented it from
+// listening or joining.
+func (n *Node) Start(ctx context.Context) error {
+	if err := n.transport.Start(ctx, n); err != nil {
+		return fmt.Errorf("starting transport: %v", err)
+	}
+
+	if n.IsMaster() {
+		return nil
+	}
+
+	if err := n.join(ctx); err != nil {
+		n.Close()
+		return err
+	}
+	return nil
+}
+
+// Shutdown stops the node gracefully, waiting for pending requests until the
+// context is done
+func (n *Node) Shutdown(ctx context.Context) error {
 	// todo: send a message to master indicating that the node shut down
-	return n.transport.Stop()
+	// watches would hold their requests until the timeout
+	n.watches.closeAll()
+	err := n.transport.Stop(ctx)
+	if n.changes != nil {
+		if closeErr := n.changes.close(); err == nil {
+			err = closeErr
+		}
+	}
+	if n.closer != nil {
+		if closeErr := n.closer.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// Close stops the node, waiting for pending requests up to the shutdown
+// timeout
+func (n *Node) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(n.config.ShutdownTimeout))
+	defer cancel()
+	return n.Shutdown(ctx)
 }
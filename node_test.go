@@ -1,13 +1,35 @@
 package dkvs
 
 import (
+	"context"
+	"errors"
+	"net"
 	"testing"
 	"time"
 )
 
+// startMaster creates and starts a master. The node is returned even if it
+// failed to start, so that it can be closed.
+func startMaster(addr string, opts ...Option) (*Node, error) {
+	n, err := NewMaster(addr, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return n, n.Start(context.Background())
+}
+
+// startSlave creates a slave and makes it join the master
+func startSlave(addr, master string, opts ...Option) (*Node, error) {
+	n, err := NewSlave(addr, master, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return n, n.Start(context.Background())
+}
+
 // Test instantiating masters and slaves
 func TestNewNode(t *testing.T) {
-	m, err := NewMaster(":1234")
+	m, err := startMaster(":1234")
 	if m != nil {
 		defer m.Close()
 	}
@@ -24,7 +46,7 @@ func TestNewNode(t *testing.T) {
 
 	time.Sleep(100 * time.Millisecond)
 
-	s, err := NewSlave(":1235", ":1234")
+	s, err := startSlave(":1235", ":1234")
 	if s != nil {
 		defer s.Close()
 	}
@@ -44,8 +66,90 @@ func TestNewNode(t *testing.T) {
 
 // Test that nodes cannot start without a master
 func TestIsolatedNode(t *testing.T) {
-	_, err := NewSlave(":9999", ":123")
+	_, err := startSlave(":9999", ":123")
 	if err == nil {
 		t.Error("slaves should not be created without a valid master")
 	}
 }
+
+// Test that listen errors are returned by Start
+func TestStartError(t *testing.T) {
+	ln, err := net.Listen("tcp", ":7171")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	m, err := NewMaster(":7171")
+	if err != nil {
+		t.Fatalf("creating a master failed with error: %v", err)
+	}
+	if err := m.Start(context.Background()); err == nil {
+		m.Close()
+		t.Error("starting a node on a port in use should fail")
+	}
+
+	if _, err := NewMaster(":7171", WithConfig(&Config{})); err == nil {
+		t.Error("creating a node with an invalid config should fail")
+	}
+}
+
+// Test that nodes use the storage and transport they are given
+func TestOptions(t *testing.T) {
+	store := NewStore()
+	store.Set("key", []byte("val"))
+	transport := NewHTTPTransport()
+
+	m, err := startMaster(":7272", WithStorage(store), WithTransport(transport), WithLogger(NewDiscardLogger()))
+	if m != nil {
+		defer m.Close()
+	}
+	if err != nil {
+		t.Fatalf("creating a master failed with error: %v", err)
+	}
+
+	if m.transport != transport {
+		t.Error("expected the node to use the given transport")
+	}
+
+	if val, err := NewClient(":7272").Get(context.Background(), "key"); err != nil || string(val) != "val" {
+		t.Errorf(`expected "val", got "%s" (%v)`, val, err)
+	}
+
+	var configErr *ConfigError
+	if _, err := NewSlave(":7373", ""); !errors.As(err, &configErr) {
+		t.Errorf("expected a config error, got %v", err)
+	}
+}
+
+// Test that canceled contexts stop the calls
+func TestCanceledContext(t *testing.T) {
+	m, err := startMaster(":7474")
+	if m != nil {
+		defer m.Close()
+	}
+	if err != nil {
+		t.Fatalf("creating a master failed with error: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := m.WriteValue(ctx, "key", []byte("val")); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the write to be canceled, got %v", err)
+	}
+	if _, err := m.ReadValue(ctx, "key"); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the read to be canceled, got %v", err)
+	}
+	if _, err := NewClient(":7474").Get(ctx, "key"); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the request to be canceled, got %v", err)
+	}
+	s, err := NewSlave(":7676", ":7474")
+	if err != nil {
+		t.Fatalf("creating a slave failed with error: %v", err)
+	}
+	if err := s.Start(ctx); err == nil {
+		s.Close()
+		t.Error("expected the slave not to start with a canceled context")
+	}
+}
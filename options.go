@@ -0,0 +1,77 @@
+package dkvs
+
+import "time"
+
+// Option customizes a node created by NewMaster or NewSlave
+type Option func(*options)
+
+type options struct {
+	config       *Config
+	storage      Storage
+	transport    Transport
+	logger       Logger
+	spanExporter SpanExporter
+	clock        func() time.Time
+	sinks        map[string]Sink
+}
+
+// WithConfig sets the settings of the node. The addresses passed to NewMaster
+// and NewSlave take precedence over the ones of the config unless empty.
+func WithConfig(c *Config) Option {
+	return func(o *options) {
+		o.config = c
+	}
+}
+
+// WithStorage sets the storage of the node, instead of an in-memory store
+func WithStorage(s Storage) Option {
+	return func(o *options) {
+		o.storage = s
+	}
+}
+
+// WithTransport sets how the node communicates with clients and other nodes,
+// instead of HTTP
+func WithTransport(t Transport) Option {
+	return func(o *options) {
+		o.transport = t
+	}
+}
+
+// WithLogger sets the logger of the node, instead of the one set with
+// SetLogger
+func WithLogger(l Logger) Option {
+	return func(o *options) {
+		o.logger = l
+	}
+}
+
+// WithSpanExporter sets where the spans of the node are sent, instead of the
+// exporter set with SetSpanExporter
+func WithSpanExporter(e SpanExporter) Option {
+	return func(o *options) {
+		o.spanExporter = e
+	}
+}
+
+// WithClock sets the wall clock of the node, instead of time.Now. It is used
+// to timestamp and check signed requests, spans and replication lag, so that
+// tests can simulate clock skew between nodes.
+func WithClock(clock func() time.Time) Option {
+	return func(o *options) {
+		o.clock = clock
+	}
+}
+
+// WithSink adds a sink that the node streams its changes to, along with the
+// sinks of the cdc settings. The name identifies the sink in the CDC
+// directory, where its offset is saved, so it must stay the same across
+// restarts. The node closes the sink when it shuts down.
+func WithSink(name string, s Sink) Option {
+	return func(o *options) {
+		if o.sinks == nil {
+			o.sinks = make(map[string]Sink)
+		}
+		o.sinks[name] = s
+	}
+}
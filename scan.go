@@ -0,0 +1,111 @@
+package dkvs
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+)
+
+const (
+	// number of items of a page when no limit is given
+	defaultScanLimit = 100
+	// maximum number of items of a page
+	maxScanLimit = 1000
+)
+
+var errorInvalidCursor = &Error{Code: CodeBadRequest, Message: "invalid cursor"}
+
+// Page is a page of the keys of a scan, in order
+type Page struct {
+	Items []*Item `json:"items"`
+	// Cursor is passed to NextPage to get the next page, and is empty on the
+	// last page
+	Cursor string `json:"cursor,omitempty"`
+}
+
+// cursor is where the next page of a scan starts, and where the scan ends
+type cursor struct {
+	Start string `json:"s"`
+	End   string `json:"e,omitempty"`
+}
+
+// Scan returns the keys from start included to end excluded, an empty end
+// meaning no upper bound. A page has at most limit items, or a default
+// number of items when limit isn't positive.
+func (n *Node) Scan(ctx context.Context, start, end string, limit int) (*Page, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if n.isSyncing() {
+		return nil, ErrorSyncing
+	}
+
+	if limit <= 0 {
+		limit = defaultScanLimit
+	}
+	if limit > maxScanLimit {
+		limit = maxScanLimit
+	}
+
+	_, span := n.startSpan(ctx, "storage.scan", "start", start, "end", end)
+	// one more item tells whether there is a next page
+	items, err := n.storage.Scan(start, end, limit+1)
+	span.finish(err)
+	if err != nil {
+		return nil, err
+	}
+
+	page := &Page{Items: items}
+	if len(items) > limit {
+		page.Items = items[:limit]
+		// the smallest key after the last one of the page
+		page.Cursor = encodeCursor(&cursor{Start: items[limit-1].Key + "\x00", End: end})
+	}
+	return page, nil
+}
+
+// Prefix returns the keys starting with prefix, see Scan
+func (n *Node) Prefix(ctx context.Context, prefix string, limit int) (*Page, error) {
+	return n.Scan(ctx, prefix, prefixEnd(prefix), limit)
+}
+
+// NextPage continues a scan from the cursor of the previous page
+func (n *Node) NextPage(ctx context.Context, cursor string, limit int) (*Page, error) {
+	c, err := decodeCursor(cursor)
+	if err != nil {
+		return nil, err
+	}
+	return n.Scan(ctx, c.Start, c.End, limit)
+}
+
+// prefixEnd returns the smallest key greater than every key starting with
+// prefix, or an empty string if there is none
+func prefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	return ""
+}
+
+// cursors are opaque to clients, so that their format can change
+func encodeCursor(c *cursor) string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(s string) (*cursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errorInvalidCursor
+	}
+
+	var c cursor
+	if err := json.Unmarshal(data, &c); err != nil || c.Start == "" {
+		return nil, errorInvalidCursor
+	}
+	return &c, nil
+}
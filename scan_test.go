@@ -0,0 +1,72 @@
+package dkvs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// Test paginating scans and prefix scans through a slave
+func TestScanPages(t *testing.T) {
+	ctx := context.Background()
+	net := NewMemoryNetwork()
+	m, _ := memoryCluster(t, net, WriteConcernAll, "slave:1")
+
+	for i := 0; i < 25; i++ {
+		if err := m.WriteValue(ctx, fmt.Sprintf("users/%02d", i), []byte("val")); err != nil {
+			t.Fatalf("write failed: %v", err)
+		}
+	}
+	m.WriteValue(ctx, "users", []byte("val"))
+	m.WriteValue(ctx, "usersz", []byte("val"))
+
+	c := net.Client("slave:1")
+
+	var keys []string
+	page, err := c.Prefix(ctx, "users/", 10)
+	for pages := 1; ; pages++ {
+		if err != nil {
+			t.Fatalf("scan failed: %v", err)
+		}
+		for _, i := range page.Items {
+			keys = append(keys, i.Key)
+		}
+		if page.Cursor == "" {
+			if pages != 3 {
+				t.Errorf("expected 3 pages, got %d", pages)
+			}
+			break
+		}
+		page, err = c.NextPage(ctx, page.Cursor, 10)
+	}
+
+	if len(keys) != 25 || keys[0] != "users/00" || keys[24] != "users/24" {
+		t.Errorf("unexpected keys %v", keys)
+	}
+
+	page, err = c.Scan(ctx, "users/20", "usersz", 0)
+	if err != nil || len(page.Items) != 5 || page.Cursor != "" {
+		t.Errorf("expected the 5 last users, got %+v (%v)", page, err)
+	}
+
+	if _, err := c.NextPage(ctx, "nope", 0); !errors.Is(err, &Error{Code: CodeBadRequest}) {
+		t.Errorf("expected an invalid cursor to be rejected, got %v", err)
+	}
+}
+
+func TestPrefixEnd(t *testing.T) {
+	testCases := map[string]string{
+		"":         "",
+		"a":        "b",
+		"users/":   "users0",
+		"a\xff":    "b",
+		"\xff\xff": "",
+	}
+
+	for prefix, expected := range testCases {
+		if actual := prefixEnd(prefix); actual != expected {
+			t.Errorf("%q: expected %q, got %q", prefix, expected, actual)
+		}
+	}
+}
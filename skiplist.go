@@ -0,0 +1,117 @@
+package dkvs
+
+import "math/rand"
+
+const (
+	// enough levels for billions of keys
+	skipListMaxLevel = 24
+	// a node has a 1 in skipListBranching chance to be promoted to each level
+	skipListBranching = 4
+)
+
+// skipList is a sorted map of keys to entries. It isn't safe for concurrent
+// use.
+type skipList struct {
+	head   *skipNode
+	level  int
+	length int
+	rand   *rand.Rand
+}
+
+type skipNode struct {
+	key   string
+	entry *Entry
+	// next node at each level of the node
+	next []*skipNode
+}
+
+func newSkipList() *skipList {
+	return &skipList{
+		head:  &skipNode{next: make([]*skipNode, skipListMaxLevel)},
+		level: 1,
+		rand:  rand.New(rand.NewSource(rand.Int63())),
+	}
+}
+
+func (l *skipList) randomLevel() int {
+	level := 1
+	for level < skipListMaxLevel && l.rand.Intn(skipListBranching) == 0 {
+		level++
+	}
+	return level
+}
+
+// path returns, for each level, the last node with a key lower than key
+func (l *skipList) path(key string) []*skipNode {
+	path := make([]*skipNode, skipListMaxLevel)
+	x := l.head
+	for i := l.level - 1; i >= 0; i-- {
+		for x.next[i] != nil && x.next[i].key < key {
+			x = x.next[i]
+		}
+		path[i] = x
+	}
+	return path
+}
+
+// seek returns the first node with a key greater than or equal to key, nil if
+// there is none
+func (l *skipList) seek(key string) *skipNode {
+	x := l.head
+	for i := l.level - 1; i >= 0; i-- {
+		for x.next[i] != nil && x.next[i].key < key {
+			x = x.next[i]
+		}
+	}
+	return x.next[0]
+}
+
+// get returns the entry of a key, nil if it isn't in the list
+func (l *skipList) get(key string) *Entry {
+	if x := l.seek(key); x != nil && x.key == key {
+		return x.entry
+	}
+	return nil
+}
+
+// set inserts a key, or replaces its entry
+func (l *skipList) set(key string, e *Entry) {
+	path := l.path(key)
+	if x := path[0].next[0]; x != nil && x.key == key {
+		x.entry = e
+		return
+	}
+
+	level := l.randomLevel()
+	if level > l.level {
+		for i := l.level; i < level; i++ {
+			path[i] = l.head
+		}
+		l.level = level
+	}
+
+	x := &skipNode{key: key, entry: e, next: make([]*skipNode, level)}
+	for i := 0; i < level; i++ {
+		x.next[i] = path[i].next[i]
+		path[i].next[i] = x
+	}
+	l.length++
+}
+
+// delete removes a key, and tells whether it was in the list
+func (l *skipList) delete(key string) bool {
+	path := l.path(key)
+	x := path[0].next[0]
+	if x == nil || x.key != key {
+		return false
+	}
+
+	for i := 0; i < len(x.next); i++ {
+		path[i].next[i] = x.next[i]
+	}
+	for l.level > 1 && l.head.next[l.level-1] == nil {
+		l.level--
+	}
+	l.length--
+	return true
+}
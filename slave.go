@@ -1,12 +1,12 @@
 package dkvs
 
 import (
-	"bytes"
-	"encoding/json"
+	"context"
 	"fmt"
 	"io"
-	"log"
-	"net/http"
+	"io/ioutil"
+	"sync/atomic"
+	"time"
 )
 
 func (n *Node) checkMasterHealth() error {
@@ -22,79 +22,210 @@ func (n *Node) promoteToMaster() error {
 }
 
 // ReceiveListUpdate applies a nodes list update sent from the master
-func (n *Node) ReceiveListUpdate(nodes map[string]*Node) error {
+func (n *Node) ReceiveListUpdate(ctx context.Context, nodes map[string]*Node) error {
+	// lists sent before this node joined reach it when it took the address
+	// of a former node, which they are meant for
+	self, ok := nodes[n.ID]
+	if !ok {
+		n.logDebug("ignoring a nodes list without this node")
+		return nil
+	}
+
 	n.nMutex.Lock()
 	defer n.nMutex.Unlock()
 	n.nodes = nodes
 
-	n.MasterID = nodes[n.ID].MasterID
+	n.mMutex.Lock()
+	n.MasterID = self.MasterID
+	n.mMutex.Unlock()
 
 	return nil
 }
 
-// ReceiveWrite applies a write sent from the master
-func (n *Node) ReceiveWrite(key, val string) error {
+// ReceiveWrite applies a write sent from the master; a nil entry is a deletion
+func (n *Node) ReceiveWrite(ctx context.Context, index uint64, key string, e *Entry) error {
 	if n.IsMaster() {
-		return errorNotSlave
+		return ErrorNotSlave
 	}
 
-	if err := n.storage.Set(key, val); err != nil {
+	_, span := n.startSpan(ctx, "storage.apply", "key", key)
+	err := n.received(ctx, index, []*Write{{Key: key, Entry: e}}, func() error {
+		return n.storage.Apply(key, e)
+	})
+	span.finish(err)
+	if err != nil {
 		return err
 	}
 
-	log.Printf("node %s replicated key %s", n.ID, key)
+	n.logDebug("replicated write", "key", key, "index", index)
 
 	return nil
 }
 
-// ReplicateFromMaster will read a stream of data from the master and save it
-// locally to this slave
-// next steps:
-// 1/ until the initial replication is complete, slave shouldn't accept reads: it
-// will either return an error or redirect the read query to another node.
-// 2/ slaves will still accept writes but store them in an ordered queue. It
-// will apply all the writes in sequential order (first in, first out) once the
-// replication is done
-func (n *Node) ReplicateFromMaster(r io.Reader) error {
-	err := n.storage.ReplicateFrom(r)
-	if err != nil {
-		log.Println("shutting the node down because replication failed: ", err)
-		defer n.Close()
+// pendingWrites are writes received from the master ahead of a previous one,
+// held back until it is applied
+type pendingWrites struct {
+	writes []*Write
+	apply  func() error
+	// closed once the writes are applied, or failed with err
+	done chan struct{}
+	err  error
+}
+
+// received applies writes sent from the master with apply, in the order of
+// their indexes: pushes are concurrent and retried, so writes can arrive
+// ahead of the previous ones, which hold them back, or twice, and writes
+// already applied are dropped. It returns once the writes are applied, so
+// that the master only counts them as acknowledged then, or after the request
+// timeout, so that the master retries them.
+func (n *Node) received(ctx context.Context, index uint64, writes []*Write, apply func() error) error {
+	n.watches.lock.Lock()
+	if index <= atomic.LoadUint64(&n.index) {
+		n.watches.lock.Unlock()
+		return nil
 	}
+	p, ok := n.pending[index]
+	if !ok {
+		p = &pendingWrites{writes: writes, apply: apply, done: make(chan struct{})}
+		n.pending[index] = p
+		n.applyPending(0)
+	}
+	n.watches.lock.Unlock()
+
+	timeout := time.NewTimer(time.Duration(n.config.RequestTimeout))
+	defer timeout.Stop()
+
+	select {
+	case <-p.done:
+		return p.err
+	case <-timeout.C:
+		return ErrorTimeout
+	case <-ctx.Done():
+		return toError(ctx.Err())
+	}
+}
 
-	log.Printf("node %s replicated the database", n.ID)
+// skipMissing applies the writes held back behind writes up to settled that
+// never arrived: the master is done pushing them, so they are lost
+func (n *Node) skipMissing(settled uint64) {
+	n.watches.lock.Lock()
+	defer n.watches.lock.Unlock()
 
-	return err
+	n.applyPending(settled)
 }
 
-// NewSlave creates a new node that joins an existing master
-func NewSlave(addr, master string) (*Node, error) {
-	n, err := newNode(addr)
+// applyPending applies the writes held back that follow the last applied one,
+// in order, holding the lock of the watches like commit, so that the watchers
+// and the change log get them in order too. The writes missing up to settled
+// are skipped. Nothing is applied before the initial replication, which
+// includes the writes up to its index.
+func (n *Node) applyPending(settled uint64) {
+	if n.isSyncing() {
+		return
+	}
+
+	for {
+		index := atomic.LoadUint64(&n.index) + 1
+		p, ok := n.pending[index]
+		if !ok {
+			if index > settled {
+				return
+			}
+			n.logWarn("skipping a write lost by the master", "index", index)
+			n.applyIndex(index)
+			continue
+		}
+		delete(n.pending, index)
+
+		keys := make([]string, len(p.writes))
+		for i, w := range p.writes {
+			keys[i] = w.Key
+		}
+		previous := n.previousEntries(keys)
+		n.setRevision(index)
+		if p.err = p.apply(); p.err != nil {
+			// held back until the master pushes it again
+			close(p.done)
+			return
+		}
+
+		n.applyIndex(index)
+		n.publish(index, p.writes, previous)
+		close(p.done)
+	}
+}
 
+// ReplicateFromMaster will read a stream of data from the master and save it
+// locally to this slave. Until it completes, the slave rejects reads with
+// ErrorSyncing.
+// next step: slaves will still accept writes but store them in an ordered
+// queue. It will apply all the writes in sequential order (first in, first
+// out) once the replication is done
+func (n *Node) ReplicateFromMaster(ctx context.Context, index uint64, r io.Reader) error {
+	n.setRevision(index)
+	err := n.storage.ReplicateFrom(r)
+	if err == nil {
+		// the signature of a stream is checked once it is read to its end
+		_, err = io.Copy(ioutil.Discard, r)
+	}
 	if err != nil {
+		n.logError("shutting the node down because replication failed", "error", err)
 		defer n.Close()
-		return nil, fmt.Errorf("creating node: %v", err)
+		return err
+	}
+
+	// the copy of a versioned storage is at the index of the last write it
+	// includes, and writes done on the master while the copy started were
+	// only pushed
+	var revision uint64
+	switch s := n.storage.(type) {
+	case VersionedStorage:
+		revision = s.Revision()
+	case interface{ replicatedRevision() uint64 }:
+		revision = s.replicatedRevision()
+	}
+	if revision > index {
+		index = revision
+	}
+	n.applyIndex(index)
+	n.watches.reset(index)
+	atomic.StoreInt32(&n.syncing, 0)
+
+	// the writes received meanwhile that the replicated data doesn't include
+	n.watches.lock.Lock()
+	for i, p := range n.pending {
+		if i <= index {
+			delete(n.pending, i)
+			close(p.done)
+		}
 	}
+	n.applyPending(0)
+	n.watches.lock.Unlock()
 
-	url := "http://" + master + "/join"
-	payload, _ := json.Marshal(n)
-	buffer := bytes.NewBuffer(payload)
+	n.logInfo("replicated the database", "index", index)
 
-	resp, err := http.Post(url, encoding, buffer)
+	return err
+}
+
+// NewSlave creates a new node listening on addr, that joins the master at the
+// master address when started
+func NewSlave(addr, master string, opts ...Option) (*Node, error) {
+	n, err := newNode(addr, master, true, opts)
 	if err != nil {
-		defer n.Close()
-		return nil, fmt.Errorf("joining master: %v", err)
+		return nil, err
 	}
 
-	defer resp.Body.Close()
-	buf := new(bytes.Buffer)
-	buf.ReadFrom(resp.Body)
-	body := buf.String()
+	// reads are rejected until the master replicated its data to this node
+	atomic.StoreInt32(&n.syncing, 1)
 
-	if resp.StatusCode != 200 {
-		defer n.Close()
-		return nil, fmt.Errorf("joining master bad response: %v", body)
+	return n, nil
+}
+
+// join asks the master to add this node to the cluster
+func (n *Node) join(ctx context.Context) error {
+	if err := n.transport.Send(ctx, n.config.MasterAddress, &Message{Kind: MessageJoin, Node: n}); err != nil {
+		return fmt.Errorf("joining master: %v", err)
 	}
 
-	return n, err
+	return nil
 }
@@ -3,6 +3,7 @@ package dkvs
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"io/ioutil"
 	"net/http"
 	"testing"
@@ -16,7 +17,7 @@ func TestSlave(t *testing.T) {
 	slaveAddr1 := ":2222"
 	slaveAddr2 := ":2323"
 
-	m, err := NewMaster(masterAddr)
+	m, err := startMaster(masterAddr)
 	if m != nil {
 		defer m.Close()
 	}
@@ -34,7 +35,7 @@ func TestSlave(t *testing.T) {
 	// wait for the server to start
 	time.Sleep(500 * time.Millisecond)
 
-	s1, err := NewSlave(slaveAddr1, masterAddr)
+	s1, err := startSlave(slaveAddr1, masterAddr)
 	if s1 != nil {
 		defer s1.Close()
 	}
@@ -43,7 +44,7 @@ func TestSlave(t *testing.T) {
 		return
 	}
 
-	s2, err := NewSlave(slaveAddr2, masterAddr)
+	s2, err := startSlave(slaveAddr2, masterAddr)
 	if s2 != nil {
 		defer s2.Close()
 	}
@@ -171,7 +172,7 @@ func TestInitialReplication(t *testing.T) {
 	masterAddr := ":9873"
 	slaveAddr := ":9872"
 
-	m, err := NewMaster(masterAddr)
+	m, err := startMaster(masterAddr)
 	if m != nil {
 		defer m.Close()
 	}
@@ -226,7 +227,7 @@ func TestInitialReplication(t *testing.T) {
 
 	time.Sleep(500 * time.Millisecond)
 
-	slave, err := NewSlave(slaveAddr, masterAddr)
+	slave, err := startSlave(slaveAddr, masterAddr)
 	if slave != nil {
 		defer slave.Close()
 	}
@@ -272,8 +273,8 @@ func TestInitialReplication(t *testing.T) {
 
 	type responsePayload struct {
 		Key   string `json:"k"`
-		Value string `json:"v"`
-		Error error  `json:"e"`
+		Value []byte `json:"v"`
+		Error *Error `json:"e"`
 	}
 	var rp []responsePayload
 
@@ -303,19 +304,19 @@ func TestInitialReplication(t *testing.T) {
 	}
 
 	key := "pain au chocolat"
-	if actual, expected := actualData[key].Value, data[key]; actual != expected {
+	if actual, expected := string(actualData[key].Value), data[key]; actual != expected {
 		t.Errorf("expected value for %s to be %s, got %s", key, expected, actual)
 		return
 	}
 
 	key = "qwerty"
-	if actual, expected := actualData[key].Value, data[key]; actual != expected {
+	if actual, expected := string(actualData[key].Value), data[key]; actual != expected {
 		t.Errorf("expected value for %s to be %s, got %s", key, expected, actual)
 		return
 	}
 
 	key = "toto"
-	if actual, expected := actualData[key].Value, "__le__100__"; actual != expected {
+	if actual, expected := string(actualData[key].Value), "__le__100__"; actual != expected {
 		t.Errorf("expected value for %s to be %s, got %s", key, expected, actual)
 		return
 	}
@@ -326,7 +327,7 @@ func TestWriteSlave(t *testing.T) {
 	masterAddr := ":3121"
 	slaveAddr := ":3222"
 
-	m, err := NewMaster(masterAddr)
+	m, err := startMaster(masterAddr)
 	if m != nil {
 		defer m.Close()
 	}
@@ -344,7 +345,7 @@ func TestWriteSlave(t *testing.T) {
 	// wait for the server to start
 	time.Sleep(500 * time.Millisecond)
 
-	s, err := NewSlave(slaveAddr, masterAddr)
+	s, err := startSlave(slaveAddr, masterAddr)
 	if s != nil {
 		defer s.Close()
 	}
@@ -371,12 +372,9 @@ func TestWriteSlave(t *testing.T) {
 		return
 	}
 	defer resp.Body.Close()
-	buf := new(bytes.Buffer)
-	buf.ReadFrom(resp.Body)
-	body := buf.String()
 
-	if resp.StatusCode == 200 || body != errorNotMaster.Error() {
-		t.Errorf("should be denied, instead got: %v", body)
+	if err := decodeError(resp); resp.StatusCode == 200 || !errors.Is(err, ErrorNotMaster) {
+		t.Errorf("should be denied, instead got: %v", err)
 		return
 	}
 }
@@ -0,0 +1,396 @@
+package dkvs
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+)
+
+// Tables are immutable files of records sorted by key:
+//
+//	data blocks | index block | bloom filter | footer
+//
+// The index holds the smallest key of the table, then the last key, offset
+// and length of each block. The footer holds the offsets and lengths of the
+// index and of the bloom filter, the number of keys and a magic number.
+const (
+	tableMagic = 0x64_6b_76_73_73_73_74_31 // "dkvssst1"
+	footerSize = 6 * 8
+)
+
+// tablePath returns the path of the table with the given number
+func tablePath(dir string, num uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%06d.sst", num))
+}
+
+type blockHandle struct {
+	lastKey        string
+	offset, length uint64
+}
+
+// tableWriter writes a table, whose keys must be added in order
+type tableWriter struct {
+	path      string
+	f         *os.File
+	w         *bufio.Writer
+	blockSize int
+
+	offset   uint64
+	block    []byte
+	lastKey  string
+	smallest string
+	index    []blockHandle
+	hashes   []uint64
+}
+
+func newTableWriter(path string, blockSize int) (*tableWriter, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return &tableWriter{path: path, f: f, w: bufio.NewWriter(f), blockSize: blockSize}, nil
+}
+
+func (t *tableWriter) add(key string, e *Entry) error {
+	if len(t.hashes) == 0 {
+		t.smallest = key
+	}
+	t.block = appendRecord(t.block, key, e)
+	t.lastKey = key
+	t.hashes = append(t.hashes, keyHash(key))
+
+	if len(t.block) >= t.blockSize {
+		return t.flushBlock()
+	}
+	return nil
+}
+
+// size returns the number of bytes written so far
+func (t *tableWriter) size() uint64 {
+	return t.offset + uint64(len(t.block))
+}
+
+func (t *tableWriter) flushBlock() error {
+	if len(t.block) == 0 {
+		return nil
+	}
+	if _, err := t.w.Write(t.block); err != nil {
+		return err
+	}
+	t.index = append(t.index, blockHandle{lastKey: t.lastKey, offset: t.offset, length: uint64(len(t.block))})
+	t.offset += uint64(len(t.block))
+	t.block = t.block[:0]
+	return nil
+}
+
+// finish writes the index, the bloom filter and the footer, and syncs the
+// table to the disk
+func (t *tableWriter) finish(bloomBitsPerKey int) error {
+	if err := t.flushBlock(); err != nil {
+		t.abort()
+		return err
+	}
+
+	index := binary.AppendUvarint(nil, uint64(len(t.smallest)))
+	index = append(index, t.smallest...)
+	index = binary.AppendUvarint(index, uint64(len(t.index)))
+	for _, h := range t.index {
+		index = binary.AppendUvarint(index, uint64(len(h.lastKey)))
+		index = append(index, h.lastKey...)
+		index = binary.AppendUvarint(index, h.offset)
+		index = binary.AppendUvarint(index, h.length)
+	}
+	filter := newBloom(t.hashes, bloomBitsPerKey)
+
+	footer := make([]byte, footerSize)
+	binary.LittleEndian.PutUint64(footer, t.offset)
+	binary.LittleEndian.PutUint64(footer[8:], uint64(len(index)))
+	binary.LittleEndian.PutUint64(footer[16:], t.offset+uint64(len(index)))
+	binary.LittleEndian.PutUint64(footer[24:], uint64(len(filter)))
+	binary.LittleEndian.PutUint64(footer[32:], uint64(len(t.hashes)))
+	binary.LittleEndian.PutUint64(footer[40:], tableMagic)
+
+	t.w.Write(index)
+	t.w.Write(filter)
+	t.w.Write(footer)
+	if err := t.w.Flush(); err != nil {
+		t.abort()
+		return err
+	}
+	if err := t.f.Sync(); err != nil {
+		t.abort()
+		return err
+	}
+	return t.f.Close()
+}
+
+// abort removes a table that won't be finished
+func (t *tableWriter) abort() {
+	t.f.Close()
+	os.Remove(t.path)
+}
+
+// table is an open table. Tables are reference counted, so that the files
+// replaced by a compaction are only removed once no scan reads them.
+type table struct {
+	num   uint64
+	path  string
+	f     *os.File
+	size  int64
+	count uint64
+
+	smallest, largest string
+	index             []blockHandle
+	bloom             bloom
+
+	refs     int32
+	obsolete int32
+}
+
+func openTable(dir string, num uint64) (*table, error) {
+	path := tablePath(dir, num)
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &table{num: num, path: path, f: f, refs: 1}
+	if err := t.load(); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return t, nil
+}
+
+// load reads the footer, the index and the bloom filter of the table
+func (t *table) load() error {
+	info, err := t.f.Stat()
+	if err != nil {
+		return err
+	}
+	t.size = info.Size()
+	if t.size < footerSize {
+		return errorCorrupt
+	}
+
+	footer := make([]byte, footerSize)
+	if _, err := t.f.ReadAt(footer, t.size-footerSize); err != nil {
+		return err
+	}
+	if binary.LittleEndian.Uint64(footer[40:]) != tableMagic {
+		return errorCorrupt
+	}
+	indexOffset := binary.LittleEndian.Uint64(footer)
+	indexLength := binary.LittleEndian.Uint64(footer[8:])
+	bloomOffset := binary.LittleEndian.Uint64(footer[16:])
+	bloomLength := binary.LittleEndian.Uint64(footer[24:])
+	t.count = binary.LittleEndian.Uint64(footer[32:])
+	if bloomOffset+bloomLength > uint64(t.size) || indexOffset+indexLength > bloomOffset {
+		return errorCorrupt
+	}
+
+	index := make([]byte, indexLength)
+	if _, err := t.f.ReadAt(index, int64(indexOffset)); err != nil {
+		return err
+	}
+	d := &recordDecoder{b: index}
+	t.smallest = d.string()
+	t.index = make([]blockHandle, d.uvarint())
+	for i := range t.index {
+		t.index[i] = blockHandle{lastKey: d.string(), offset: d.uvarint(), length: d.uvarint()}
+	}
+	if d.err != nil {
+		return d.err
+	}
+	if len(t.index) > 0 {
+		t.largest = t.index[len(t.index)-1].lastKey
+	}
+
+	t.bloom = make(bloom, bloomLength)
+	_, err = t.f.ReadAt(t.bloom, int64(bloomOffset))
+	return err
+}
+
+func (t *table) acquire() {
+	atomic.AddInt32(&t.refs, 1)
+}
+
+// release drops a reference to the table, and closes it once unused; it is
+// removed as well if a compaction replaced it
+func (t *table) release() {
+	if atomic.AddInt32(&t.refs, -1) > 0 {
+		return
+	}
+	t.f.Close()
+	if atomic.LoadInt32(&t.obsolete) == 1 {
+		os.Remove(t.path)
+	}
+}
+
+func (t *table) readBlock(i int) ([]byte, error) {
+	h := t.index[i]
+	b := make([]byte, h.length)
+	if _, err := t.f.ReadAt(b, int64(h.offset)); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// findBlock returns the first block that may hold key
+func (t *table) findBlock(key string) int {
+	return sort.Search(len(t.index), func(i int) bool { return t.index[i].lastKey >= key })
+}
+
+// get returns the entry of a key, a tombstone if it was deleted, or nil if
+// the table doesn't have it
+func (t *table) get(key string) (*Entry, error) {
+	if key < t.smallest || key > t.largest || !t.bloom.mayContain(keyHash(key)) {
+		return nil, nil
+	}
+
+	i := t.findBlock(key)
+	if i == len(t.index) {
+		return nil, nil
+	}
+	b, err := t.readBlock(i)
+	if err != nil {
+		return nil, err
+	}
+
+	for pos := 0; pos < len(b); {
+		k, e, n, err := decodeRecord(b[pos:])
+		if err != nil {
+			return nil, err
+		}
+		if k == key {
+			return e, nil
+		}
+		if k > key {
+			break
+		}
+		pos += n
+	}
+	return nil, nil
+}
+
+// tableIterator iterates over the records of a table
+type tableIterator struct {
+	t     *table
+	block int
+	data  []byte
+	pos   int
+	k     string
+	e     *Entry
+	error error
+}
+
+// iterator returns an iterator starting at the first key greater than or
+// equal to start
+func (t *table) iterator(start string) iterator {
+	it := &tableIterator{t: t, block: t.findBlock(start) - 1}
+	for it.next() {
+		if it.k >= start {
+			it.pos = -it.pos // replays the current record on the first next
+			return it
+		}
+	}
+	return it
+}
+
+func (it *tableIterator) next() bool {
+	if it.error != nil {
+		return false
+	}
+	// set by iterator after seeking, so that next returns the first record
+	if it.pos < 0 {
+		it.pos = -it.pos
+		return true
+	}
+
+	for it.pos >= len(it.data) {
+		it.block++
+		if it.block >= len(it.t.index) {
+			return false
+		}
+		if it.data, it.error = it.t.readBlock(it.block); it.error != nil {
+			return false
+		}
+		it.pos = 0
+	}
+
+	k, e, n, err := decodeRecord(it.data[it.pos:])
+	if err != nil {
+		it.error = err
+		return false
+	}
+	it.k, it.e = k, e
+	it.pos += n
+	return true
+}
+
+func (it *tableIterator) key() string   { return it.k }
+func (it *tableIterator) entry() *Entry { return it.e }
+func (it *tableIterator) err() error    { return it.error }
+
+// bloom is a bloom filter of the keys of a table. Its last byte is the number
+// of hash functions.
+type bloom []byte
+
+func keyHash(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return h.Sum64()
+}
+
+func newBloom(hashes []uint64, bitsPerKey int) bloom {
+	// the number of hash functions minimizing false positives is
+	// bitsPerKey * ln(2)
+	k := bitsPerKey * 69 / 100
+	if k < 1 {
+		k = 1
+	}
+	if k > 30 {
+		k = 30
+	}
+
+	bits := len(hashes) * bitsPerKey
+	if bits < 64 {
+		bits = 64
+	}
+	b := make(bloom, (bits+7)/8+1)
+	bits = (len(b) - 1) * 8
+	b[len(b)-1] = byte(k)
+
+	for _, h := range hashes {
+		delta := h>>33 | h<<31
+		for i := 0; i < k; i++ {
+			bit := h % uint64(bits)
+			b[bit/8] |= 1 << (bit % 8)
+			h += delta
+		}
+	}
+	return b
+}
+
+func (b bloom) mayContain(h uint64) bool {
+	if len(b) < 2 {
+		return true
+	}
+	bits := uint64(len(b)-1) * 8
+	k := int(b[len(b)-1])
+
+	delta := h>>33 | h<<31
+	for i := 0; i < k; i++ {
+		bit := h % bits
+		if b[bit/8]&(1<<(bit%8)) == 0 {
+			return false
+		}
+		h += delta
+	}
+	return true
+}
@@ -0,0 +1,234 @@
+package dkvs
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// node states reported by /status
+const (
+	stateSyncing = "syncing"
+	stateLagging = "lagging"
+	stateInSync  = "in_sync"
+)
+
+// Status describes the replication state of a node
+type Status struct {
+	ID       string `json:"id"`
+	Role     string `json:"role"`
+	MasterID string `json:"master"`
+	// index of the last write applied by this node
+	Index uint64 `json:"index"`
+	State string `json:"state"`
+	// writes and time this node is behind the master, unknown when the master
+	// can't be reached
+	LagEntries    *uint64  `json:"lag_entries,omitempty"`
+	LagSeconds    *float64 `json:"lag_seconds,omitempty"`
+	UptimeSeconds float64  `json:"uptime_seconds"`
+	// replication state of every slave, as tracked by the master
+	Nodes []*NodeStatus `json:"nodes,omitempty"`
+}
+
+// NodeStatus is the replication state of a slave, as tracked by the master
+type NodeStatus struct {
+	ID         string  `json:"id"`
+	Address    string  `json:"addr"`
+	AckedIndex uint64  `json:"acked_index"`
+	LagEntries uint64  `json:"lag_entries"`
+	LagSeconds float64 `json:"lag_seconds"`
+}
+
+// writeLogSize is the number of write times remembered by the master to
+// compute the lag of the slaves; older writes are assumed to be as old as
+// the oldest remembered one
+const writeLogSize = 1024
+
+// writeLog remembers when the last writes happened on the master
+type writeLog struct {
+	times [writeLogSize]time.Time
+	lock  sync.Mutex
+}
+
+// record assigns the next index to a write
+func (n *Node) recordWrite() uint64 {
+	n.writes.lock.Lock()
+	defer n.writes.lock.Unlock()
+
+	index := atomic.AddUint64(&n.index, 1)
+	n.writes.times[index%writeLogSize] = n.now()
+	return index
+}
+
+// writtenAt returns when the write with the given index happened on the master
+func (n *Node) writtenAt(index uint64) time.Time {
+	n.writes.lock.Lock()
+	defer n.writes.lock.Unlock()
+
+	current := atomic.LoadUint64(&n.index)
+	if current-index >= writeLogSize {
+		index = current + 1
+	}
+	return n.writes.times[index%writeLogSize]
+}
+
+// recordAck remembers the last write acknowledged by a slave. Writes are
+// pushed concurrently, so acknowledgements can arrive out of order.
+func (n *Node) recordAck(slaveID string, index uint64) {
+	n.nMutex.Lock()
+	defer n.nMutex.Unlock()
+
+	if slave, ok := n.nodes[slaveID]; ok && index > slave.ackedIndex {
+		slave.ackedIndex = index
+	}
+}
+
+// settle records that the master is done pushing a write to a slave, which
+// acknowledged it or missed it for good
+func (n *Node) settle(slaveID string, index uint64) {
+	n.nMutex.Lock()
+	defer n.nMutex.Unlock()
+
+	slave, ok := n.nodes[slaveID]
+	if !ok || index <= slave.settledIndex {
+		return
+	}
+	if slave.settled == nil {
+		slave.settled = make(map[uint64]bool)
+	}
+	slave.settled[index] = true
+	for slave.settled[slave.settledIndex+1] {
+		slave.settledIndex++
+		delete(slave.settled, slave.settledIndex)
+	}
+}
+
+// settledFor returns the index up to which the master is done pushing writes
+// to a slave: the slave has every write up to it, but those it missed
+func (n *Node) settledFor(slaveID string) uint64 {
+	n.nMutex.RLock()
+	defer n.nMutex.RUnlock()
+
+	if slave, ok := n.nodes[slaveID]; ok {
+		return slave.settledIndex
+	}
+	return 0
+}
+
+// applyIndex remembers the last write applied by a slave
+func (n *Node) applyIndex(index uint64) {
+	for {
+		current := atomic.LoadUint64(&n.index)
+		if index <= current || atomic.CompareAndSwapUint64(&n.index, current, index) {
+			return
+		}
+	}
+}
+
+// lag computes how far behind the master a slave is
+func (n *Node) lag(acked uint64) (uint64, float64) {
+	current := atomic.LoadUint64(&n.index)
+	if acked >= current {
+		return 0, 0
+	}
+	return current - acked, n.now().Sub(n.writtenAt(acked + 1)).Seconds()
+}
+
+// Status returns the replication state of the node. Slaves ask the master how
+// far behind they are.
+func (n *Node) Status(ctx context.Context) *Status {
+	s := &Status{
+		ID:            n.ID,
+		Role:          "slave",
+		MasterID:      n.masterID(),
+		Index:         atomic.LoadUint64(&n.index),
+		State:         stateInSync,
+		UptimeSeconds: n.now().Sub(n.started).Seconds(),
+	}
+
+	if n.IsMaster() {
+		var zero uint64
+		var none float64
+		s.Role, s.LagEntries, s.LagSeconds = "master", &zero, &none
+
+		n.nMutex.RLock()
+		defer n.nMutex.RUnlock()
+
+		s.Nodes = make([]*NodeStatus, 0)
+		for id, node := range n.nodes {
+			if id == n.ID {
+				continue
+			}
+			entries, seconds := n.lag(node.ackedIndex)
+			s.Nodes = append(s.Nodes, &NodeStatus{
+				ID:         id,
+				Address:    node.Address,
+				AckedIndex: node.ackedIndex,
+				LagEntries: entries,
+				LagSeconds: seconds,
+			})
+		}
+		return s
+	}
+
+	if n.isSyncing() {
+		s.State = stateSyncing
+		return s
+	}
+
+	if ns := n.statusFromMaster(ctx); ns != nil {
+		s.LagEntries, s.LagSeconds = &ns.LagEntries, &ns.LagSeconds
+		if ns.LagEntries > 0 {
+			s.State = stateLagging
+		}
+	}
+
+	return s
+}
+
+// statusFromMaster fetches the replication state of this node from the master
+func (n *Node) statusFromMaster(ctx context.Context) *NodeStatus {
+	m := n.master()
+	if m == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, n.url(m.Address, "/status"), nil)
+	if err != nil {
+		return nil
+	}
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return nil
+	}
+	defer resp.Body.Close()
+
+	var s Status
+	if resp.StatusCode != http.StatusOK || json.NewDecoder(resp.Body).Decode(&s) != nil {
+		return nil
+	}
+
+	for _, ns := range s.Nodes {
+		if ns.ID == n.ID {
+			return ns
+		}
+	}
+	return nil
+}
+
+// statusHandler serves the replication state of the node: GET /status
+func (t *httpTransport) statusHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, t.n.Status(r.Context()))
+}
@@ -0,0 +1,69 @@
+package dkvs
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// Test tracking how far behind the master the slaves are
+func TestStatus(t *testing.T) {
+	masterAddr := ":6161"
+	slaveAddr := ":6262"
+
+	m, err := startMaster(masterAddr)
+	if m != nil {
+		defer m.Close()
+	}
+	if err != nil {
+		t.Errorf("creating a master failed with error: %v", err)
+		return
+	}
+
+	// wait for the server to start
+	time.Sleep(100 * time.Millisecond)
+
+	m.WriteValue(context.Background(), "before", []byte("joining"))
+
+	s, err := startSlave(slaveAddr, masterAddr)
+	if err != nil {
+		t.Errorf("creating a slave failed with error: %v", err)
+		return
+	}
+
+	m.WriteValue(context.Background(), "after", []byte("joining"))
+
+	time.Sleep(100 * time.Millisecond)
+
+	status, err := NewClient(slaveAddr).Status(context.Background())
+	if err != nil {
+		t.Errorf("getting the status failed: %v", err)
+		return
+	}
+	if status.Role != "slave" || status.MasterID != m.ID || status.Index != 2 || status.State != stateInSync {
+		t.Errorf("unexpected slave status: %+v", status)
+	}
+	if status.LagEntries == nil || *status.LagEntries != 0 {
+		t.Errorf("expected the slave to be up to date, got %+v", status)
+	}
+
+	// the slave stops receiving writes
+	s.Close()
+	m.WriteValue(context.Background(), "while", []byte("down"))
+	time.Sleep(100 * time.Millisecond)
+
+	status, err = NewClient(masterAddr).Status(context.Background())
+	if err != nil {
+		t.Errorf("getting the status failed: %v", err)
+		return
+	}
+	if status.Role != "master" || status.Index != 3 || len(status.Nodes) != 1 {
+		t.Errorf("unexpected master status: %+v", status)
+		return
+	}
+
+	slave := status.Nodes[0]
+	if slave.ID != s.ID || slave.AckedIndex != 2 || slave.LagEntries != 1 || slave.LagSeconds < 0.1 {
+		t.Errorf("unexpected slave replication state: %+v", slave)
+	}
+}
@@ -1,8 +1,9 @@
 package dkvs
 
 import (
-	"bytes"
-	"encoding/json"
+	"bufio"
+	"encoding/binary"
+	"fmt"
 	"io"
 	"sync"
 )
@@ -10,57 +11,397 @@ import (
 // Storage is a generic storage that can save and retrieve values
 type Storage interface {
 	Get(key string) ([]byte, error)
-	Set(key, val string) error
-	ReplicateTo() (*bytes.Buffer, error)
+	Set(key string, val []byte) error
+	// ReplicateTo writes every key and its entry to w, in a binary format,
+	// and ReplicateFrom replaces every key with the ones written by
+	// ReplicateTo
+	ReplicateTo(w io.Writer) error
 	ReplicateFrom(data io.Reader) error
+
+	// Lookup returns the value stored for a key along with its metadata
+	Lookup(key string) (*Entry, error)
+	// Put writes a value; when version isn't 0, the write is only applied if
+	// the current version of the key matches it
+	Put(key string, val []byte, contentType string, version uint64) (*Entry, error)
+	// Delete removes a key; when version isn't 0, the key is only removed if
+	// its current version matches it
+	Delete(key string, version uint64) error
+	// Stats returns the number of keys and the approximate size of the data
+	Stats() StorageStats
+
+	// Apply stores an entry as-is, as received from the master, unless it is
+	// older than the stored one. A nil entry deletes the key.
+	Apply(key string, e *Entry) error
+
+	// Txn checks the comparisons against the current versions of the keys,
+	// then applies the writes atomically, and returns them as entries to
+	// replicate. Nothing is written if a comparison doesn't hold, and it
+	// fails with ErrorConflict.
+	Txn(compares []*Compare, ops []*TxnOp) ([]*Write, error)
+	// ApplyWrites applies writes received from the master as Apply does,
+	// atomically
+	ApplyWrites(writes []*Write) error
+	// Batch applies in order, atomically, the writes whose version matches
+	// and that don't delete a missing key. It returns for each of them the
+	// write applied, or why it wasn't.
+	Batch(ops []*BatchOp) ([]*Write, []error, error)
+
+	// Scan returns the keys from start included to end excluded, in order,
+	// along with their entries. An empty end means no upper bound, and at
+	// most limit items are returned when limit is positive.
+	Scan(start, end string, limit int) ([]*Item, error)
+}
+
+// Entry is a stored value along with its metadata. Values are arbitrary
+// bytes, encoded as base64 in JSON.
+type Entry struct {
+	Value       []byte `json:"v"`
+	ContentType string `json:"t,omitempty"`
+	Version     uint64 `json:"n"`
+
+	// deleted marks the tombstones of an LSM storage, see newTombstone
+	deleted bool
+}
+
+// clone copies an entry along with its value, so that callers can't modify
+// the stored one
+func (e *Entry) clone() *Entry {
+	copied := *e
+	copied.Value = append([]byte{}, e.Value...)
+	return &copied
 }
 
-// maps are not safe for concurrent use:
-// https://blog.golang.org/go-maps-in-action#TOC_6.
+// Item is a key along with its entry, as returned by scans
+type Item struct {
+	Key string `json:"k"`
+	Entry
+}
+
+// StorageStats describes the data held by a storage
+type StorageStats struct {
+	Keys  int
+	Bytes int
+}
+
+// keys are kept sorted in a skip list, so that they can be scanned in order.
+// Skip lists are not safe for concurrent use.
 type store struct {
-	data map[string]string
+	data *skipList
 	lock sync.RWMutex
+
+	// revision of the last write, and of the next one when set, see mvcc.go
+	revision uint64
+	next     uint64
+	// entries of each key since the compacted revision, oldest first
+	history map[string][]*KeyRevision
+	// reads at revisions older than this one fail
+	compacted uint64
+	// number of past revisions kept, all of them when 0
+	retention uint64
 }
 
-// NewStore creates an in memory data store
-func NewStore() Storage {
-	return &store{
-		data: make(map[string]string),
+// versionLookup returns the entry of a key, nil when it is missing, along
+// with the last version the key had, which is kept by deleted keys
+type versionLookup func(key string) (*Entry, uint64, error)
+
+// lookup implements versionLookup. Deleted keys keep their last version in
+// their history until it is compacted, so that the versions of a key only
+// increase and an old ETag doesn't match a new value. The caller holds the
+// lock.
+func (s *store) lookup(key string) (*Entry, uint64, error) {
+	if e := s.data.get(key); e != nil {
+		return e, e.Version, nil
+	}
+	if h := s.history[key]; len(h) > 0 {
+		return nil, h[len(h)-1].version, nil
 	}
+	return nil, 0, nil
+}
+
+// NewStore creates an in memory data store, keeping the last 1000 revisions
+func NewStore() Storage {
+	return NewVersionedStore(defaultRetention)
 }
 
 func (s *store) Get(key string) ([]byte, error) {
+	e, err := s.Lookup(key)
+	if err != nil {
+		return nil, err
+	}
+	return e.Value, nil
+}
+
+func (s *store) Set(key string, val []byte) error {
+	_, err := s.Put(key, val, "", 0)
+	return err
+}
+
+func (s *store) Lookup(key string) (*Entry, error) {
 	s.lock.RLock()
 	defer s.lock.RUnlock()
 
-	val, ok := s.data[key]
-	if !ok {
-		return nil, errorKeyNotFound
+	e := s.data.get(key)
+	if e == nil {
+		return nil, ErrorKeyNotFound
+	}
+	return e.clone(), nil
+}
+
+func (s *store) Put(key string, val []byte, contentType string, version uint64) (*Entry, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	current, last, _ := s.lookup(key)
+	if version != 0 && (current == nil || version != current.Version) {
+		return nil, ErrorConflict
+	}
+
+	e := &Entry{
+		Value:       append([]byte{}, val...),
+		ContentType: contentType,
+		Version:     last + 1,
+	}
+	s.advance()
+	s.record(key, e)
+	s.maybeCompact()
+
+	return e.clone(), nil
+}
+
+func (s *store) Delete(key string, version uint64) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	e := s.data.get(key)
+	if e == nil {
+		return ErrorKeyNotFound
+	}
+	if version != 0 && version != e.Version {
+		return ErrorConflict
+	}
+
+	s.advance()
+	s.record(key, nil)
+	s.maybeCompact()
+	return nil
+}
+
+func (s *store) Apply(key string, e *Entry) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.advance()
+	s.apply(key, e)
+	s.maybeCompact()
+	return nil
+}
+
+// apply stores an entry at the current revision unless it is older than the
+// stored one. The caller holds the lock.
+func (s *store) apply(key string, e *Entry) {
+	current := s.data.get(key)
+	if e == nil {
+		if current != nil {
+			s.record(key, nil)
+		}
+		return
 	}
-	return []byte(val), nil
+
+	// writes are pushed concurrently, so an older version can arrive last,
+	// even after the key was deleted
+	if _, last, _ := s.lookup(key); last >= e.Version {
+		return
+	}
+
+	s.record(key, e.clone())
+}
+
+func (s *store) Txn(compares []*Compare, ops []*TxnOp) ([]*Write, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	writes, err := prepareTxn(compares, ops, s.lookup)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(writes) > 0 {
+		s.advance()
+	}
+	for _, w := range writes {
+		if w.Entry == nil {
+			// deleting a missing key is a no-op
+			if s.data.get(w.Key) != nil {
+				s.record(w.Key, nil)
+			}
+		} else {
+			s.record(w.Key, w.Entry.clone())
+		}
+	}
+	s.maybeCompact()
+	return writes, nil
 }
 
-func (s *store) Set(key, val string) error {
+func (s *store) Batch(ops []*BatchOp) ([]*Write, []error, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	writes, errs, err := prepareBatch(ops, s.lookup)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(applied(writes)) > 0 {
+		s.advance()
+	}
+	for _, w := range applied(writes) {
+		if w.Entry == nil {
+			s.record(w.Key, nil)
+		} else {
+			s.record(w.Key, w.Entry.clone())
+		}
+	}
+	s.maybeCompact()
+	return writes, errs, nil
+}
+
+func (s *store) ApplyWrites(writes []*Write) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.advance()
+	for _, w := range writes {
+		s.apply(w.Key, w.Entry)
+	}
+	s.maybeCompact()
+	return nil
+}
+
+func (s *store) Stats() StorageStats {
 	s.lock.RLock()
 	defer s.lock.RUnlock()
 
-	s.data[key] = val
-	return nil
+	stats := StorageStats{Keys: s.data.length}
+	for x := s.data.head.next[0]; x != nil; x = x.next[0] {
+		stats.Bytes += len(x.key) + len(x.entry.Value) + len(x.entry.ContentType)
+	}
+	return stats
 }
 
-func (s *store) ReplicateTo() (*bytes.Buffer, error) {
+func (s *store) Scan(start, end string, limit int) ([]*Item, error) {
 	s.lock.RLock()
 	defer s.lock.RUnlock()
 
-	buf := new(bytes.Buffer)
-	encoder := json.NewEncoder(buf)
-	return buf, encoder.Encode(s.data)
+	items := make([]*Item, 0)
+	for x := s.data.seek(start); x != nil; x = x.next[0] {
+		if (end != "" && x.key >= end) || (limit > 0 && len(items) == limit) {
+			break
+		}
+		items = append(items, &Item{Key: x.key, Entry: *x.entry.clone()})
+	}
+	return items, nil
 }
 
-func (s *store) ReplicateFrom(data io.Reader) error {
+func (s *store) ReplicateTo(w io.Writer) error {
 	s.lock.RLock()
 	defer s.lock.RUnlock()
 
-	decoder := json.NewDecoder(data)
-	return decoder.Decode(&s.data)
+	out := newReplicationWriter(w, s.revision)
+	for x := s.data.head.next[0]; x != nil; x = x.next[0] {
+		if err := out.write(x.key, x.entry); err != nil {
+			return err
+		}
+	}
+	return out.close()
+}
+
+// replicationWriter writes keys and entries one at a time, so that the whole
+// data is never encoded at once. The data starts with its revision, 0 for
+// storages without revisions. Each key is written as its length followed by
+// its record, and a length of 0 ends the data.
+type replicationWriter struct {
+	w *bufio.Writer
+}
+
+func newReplicationWriter(w io.Writer, revision uint64) *replicationWriter {
+	r := &replicationWriter{w: bufio.NewWriter(w)}
+	r.w.Write(binary.AppendUvarint(nil, revision))
+	return r
+}
+
+func (r *replicationWriter) write(key string, e *Entry) error {
+	record := appendRecord(nil, key, e)
+	r.w.Write(binary.AppendUvarint(nil, uint64(len(record))))
+	_, err := r.w.Write(record)
+	return err
+}
+
+func (r *replicationWriter) close() error {
+	r.w.WriteByte(0)
+	return r.w.Flush()
+}
+
+func (s *store) ReplicateFrom(data io.Reader) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.data = newSkipList()
+	s.history = make(map[string][]*KeyRevision)
+	defer s.maybeCompact()
+	begin := func(revision uint64) {
+		// the copy is at the revision of the storage it was made from, or
+		// at the next one set for copies of storages without revisions,
+		// and has none of the past entries
+		if revision < s.next {
+			revision = s.next
+		}
+		if revision > s.revision {
+			s.revision = revision
+		}
+		s.next = 0
+		s.compacted = s.revision
+	}
+	return readReplication(data, begin, func(key string, e *Entry) error {
+		s.record(key, e)
+		return nil
+	})
+}
+
+// readReplication decodes the data written by a replicationWriter: it passes
+// its revision to begin, then its keys one at a time to apply
+func readReplication(r io.Reader, begin func(revision uint64), apply func(key string, e *Entry) error) error {
+	br := bufio.NewReader(r)
+	revision, err := binary.ReadUvarint(br)
+	if err != nil {
+		return err
+	}
+	begin(revision)
+
+	for {
+		l, err := binary.ReadUvarint(br)
+		if err == io.EOF {
+			// the end of the data is always marked
+			return io.ErrUnexpectedEOF
+		} else if err != nil {
+			return err
+		}
+		if l == 0 {
+			return nil
+		}
+
+		record := make([]byte, l)
+		if _, err := io.ReadFull(br, record); err != nil {
+			return err
+		}
+		key, e, _, err := decodeRecord(record)
+		if err != nil {
+			return err
+		}
+		if e.deleted {
+			return fmt.Errorf("unexpected deleted key %q in replication data", key)
+		}
+		if err := apply(key, e); err != nil {
+			return err
+		}
+	}
 }
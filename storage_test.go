@@ -1,6 +1,11 @@
 package dkvs
 
-import "testing"
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+)
 
 // Test setting then getting a value
 func TestSetGet(t *testing.T) {
@@ -34,7 +39,7 @@ func TestSetGet(t *testing.T) {
 	}
 
 	for _, test := range testCases {
-		if err := s.Set(test.key, test.value); err != nil {
+		if err := s.Set(test.key, []byte(test.value)); err != nil {
 			t.Errorf("setting failed: %v", err)
 			return
 		}
@@ -60,7 +65,7 @@ func TestNotFound(t *testing.T) {
 	getkey := "thisKeyDoesntExist"
 	value := "hello"
 
-	if err := s.Set(setkey, value); err != nil {
+	if err := s.Set(setkey, []byte(value)); err != nil {
 		t.Errorf("setting failed: %v", err)
 		return
 	}
@@ -71,3 +76,137 @@ func TestNotFound(t *testing.T) {
 		t.Errorf("should have failed, instead found value: %s", string(actual))
 	}
 }
+
+// Test that writes bump the version and honor the expected version
+func TestVersions(t *testing.T) {
+	s := NewStore()
+
+	e, err := s.Put("key", []byte("v1"), "text/plain", 0)
+	if err != nil {
+		t.Errorf("putting failed: %v", err)
+		return
+	}
+	if e.Version != 1 {
+		t.Errorf("expected version 1, got %d", e.Version)
+	}
+
+	if _, err := s.Put("key", []byte("v2"), "", 2); err != ErrorConflict {
+		t.Errorf("expected %v, got %v", ErrorConflict, err)
+	}
+
+	if e, err = s.Put("key", []byte("v2"), "", 1); err != nil || e.Version != 2 {
+		t.Errorf("expected version 2, got %v (%v)", e, err)
+	}
+
+	if err := s.Delete("key", 1); err != ErrorConflict {
+		t.Errorf("expected %v, got %v", ErrorConflict, err)
+	}
+
+	if err := s.Delete("key", 2); err != nil {
+		t.Errorf("deleting failed: %v", err)
+	}
+
+	if _, err := s.Lookup("key"); err != ErrorKeyNotFound {
+		t.Errorf("expected %v, got %v", ErrorKeyNotFound, err)
+	}
+
+	// versions keep increasing after a deletion, so old versions never match
+	if _, err := s.Put("key", []byte("v3"), "", 2); err != ErrorConflict {
+		t.Errorf("expected %v, got %v", ErrorConflict, err)
+	}
+	if e, err = s.Put("key", []byte("v3"), "", 0); err != nil || e.Version != 3 {
+		t.Errorf("expected version 3, got %v (%v)", e, err)
+	}
+}
+
+// Test that slaves don't apply writes older than a deletion
+func TestApplyAfterDelete(t *testing.T) {
+	s := NewStore()
+
+	s.Apply("key", &Entry{Value: []byte("v1"), Version: 1})
+	s.Apply("key", &Entry{Value: []byte("v2"), Version: 2})
+	s.Apply("key", nil)
+
+	// a retried push of an older write
+	s.Apply("key", &Entry{Value: []byte("v1"), Version: 1})
+	if _, err := s.Lookup("key"); err != ErrorKeyNotFound {
+		t.Errorf("expected the older write to be dropped, got %v", err)
+	}
+
+	s.Apply("key", &Entry{Value: []byte("v3"), Version: 3})
+	if e, err := s.Lookup("key"); err != nil || string(e.Value) != "v3" {
+		t.Errorf(`expected "v3", got %+v (%v)`, e, err)
+	}
+}
+
+// Test that scans return the keys in order, after random writes and deletes
+func TestScan(t *testing.T) {
+	s := NewStore()
+	keys := make(map[string]bool)
+
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 2000; i++ {
+		key := fmt.Sprintf("key%d", r.Intn(500))
+		if r.Intn(3) == 0 {
+			s.Delete(key, 0)
+			delete(keys, key)
+			continue
+		}
+		s.Set(key, []byte(key))
+		keys[key] = true
+	}
+
+	var sorted []string
+	for key := range keys {
+		sorted = append(sorted, key)
+	}
+	sort.Strings(sorted)
+
+	items, err := s.Scan("", "", 0)
+	if err != nil {
+		t.Fatalf("scan failed: %v", err)
+	}
+	if len(items) != len(sorted) {
+		t.Fatalf("expected %d keys, got %d", len(sorted), len(items))
+	}
+	for i, item := range items {
+		if item.Key != sorted[i] || string(item.Value) != sorted[i] {
+			t.Fatalf("item %d: expected %s, got %+v", i, sorted[i], item)
+		}
+	}
+
+	type testCase struct {
+		start, end string
+		limit      int
+		expected   []string
+	}
+
+	s = NewStore()
+	for _, key := range []string{"a", "ab", "abc", "b", "c"} {
+		s.Set(key, []byte(key))
+	}
+
+	testCases := []*testCase{
+		{start: "", end: "", limit: 0, expected: []string{"a", "ab", "abc", "b", "c"}},
+		{start: "ab", end: "b", limit: 0, expected: []string{"ab", "abc"}},
+		{start: "aa", end: "", limit: 2, expected: []string{"ab", "abc"}},
+		{start: "c", end: "a", limit: 0, expected: []string{}},
+		{start: "d", end: "", limit: 0, expected: []string{}},
+	}
+
+	for _, test := range testCases {
+		items, err := s.Scan(test.start, test.end, test.limit)
+		if err != nil {
+			t.Errorf("scan failed: %v", err)
+			continue
+		}
+
+		actual := make([]string, len(items))
+		for i, item := range items {
+			actual[i] = item.Key
+		}
+		if fmt.Sprint(actual) != fmt.Sprint(test.expected) {
+			t.Errorf("scan [%q, %q) limit %d: expected %v, got %v", test.start, test.end, test.limit, test.expected, actual)
+		}
+	}
+}
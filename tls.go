@@ -0,0 +1,102 @@
+package dkvs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+)
+
+// TLSConfig holds the certificates securing a node. The node certificate is
+// served to clients and presented to other nodes, and must be signed by the
+// cluster CA so that peers accept it.
+type TLSConfig struct {
+	// PEM encoded files, used when Certificate or CA aren't set
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+	CAFile   string `json:"ca_file"`
+
+	Certificate *tls.Certificate `json:"-"`
+	CA          *x509.CertPool   `json:"-"`
+}
+
+// load reads the certificate files if needed
+func (c *TLSConfig) load() error {
+	if c.Certificate == nil {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return fmt.Errorf("loading certificate: %v", err)
+		}
+		c.Certificate = &cert
+	}
+
+	if c.CA == nil {
+		pem, err := ioutil.ReadFile(c.CAFile)
+		if err != nil {
+			return fmt.Errorf("loading CA: %v", err)
+		}
+		c.CA = x509.NewCertPool()
+		if !c.CA.AppendCertsFromPEM(pem) {
+			return errors.New("loading CA: no certificate found")
+		}
+	}
+
+	return nil
+}
+
+// serverConfig accepts any client, but verifies the certificates presented by
+// other nodes against the cluster CA
+func (c *TLSConfig) serverConfig() *tls.Config {
+	return &tls.Config{
+		Certificates: []tls.Certificate{*c.Certificate},
+		ClientCAs:    c.CA,
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+		MinVersion:   tls.VersionTLS12,
+	}
+}
+
+// clientConfig presents the node certificate when calling other nodes
+func (c *TLSConfig) clientConfig() *tls.Config {
+	return &tls.Config{
+		Certificates: []tls.Certificate{*c.Certificate},
+		RootCAs:      c.CA,
+		MinVersion:   tls.VersionTLS12,
+	}
+}
+
+// newHTTPClient creates the client used for node to node calls
+func newHTTPClient(c *TLSConfig) *http.Client {
+	if c == nil {
+		return &http.Client{}
+	}
+
+	return &http.Client{
+		Transport: &http.Transport{TLSClientConfig: c.clientConfig()},
+	}
+}
+
+// isPeer checks that a request comes from another node of the cluster, i.e.
+// that it presented a certificate signed by the cluster CA. Without TLS, every
+// request is trusted.
+func isPeer(c *TLSConfig, r *http.Request) bool {
+	if c == nil {
+		return true
+	}
+
+	return r.TLS != nil && len(r.TLS.VerifiedChains) > 0
+}
+
+// isFromHost checks that a request comes with a verified certificate valid
+// for the host of an address. Nodes present their certificate when calling
+// other nodes too, so a master calling its slaves presents the certificate
+// they check when they call it at their master address.
+func isFromHost(r *http.Request, addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil || host == "" || r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return false
+	}
+	return r.TLS.VerifiedChains[0][0].VerifyHostname(host) == nil
+}
@@ -0,0 +1,209 @@
+package dkvs
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// testCA is a throwaway certificate authority
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generating CA key: %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "dkvs test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("creating CA certificate: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+
+	return &testCA{cert: cert, key: key, pool: pool}
+}
+
+// issue creates a certificate valid for localhost and name, usable by servers
+// and clients
+func (ca *testCA) issue(t *testing.T, name string) *tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:     []string{"localhost", name},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("creating certificate: %v", err)
+	}
+
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func (ca *testCA) config(t *testing.T, name string) *TLSConfig {
+	return &TLSConfig{Certificate: ca.issue(t, name), CA: ca.pool}
+}
+
+// Test a master and a slave talking over mutual TLS, and that only nodes
+// holding a certificate from the cluster CA can use node to node routes
+func TestTLS(t *testing.T) {
+	masterAddr := "localhost:5151"
+	slaveAddr := "localhost:5252"
+
+	ca := newTestCA(t)
+
+	mc := DefaultConfig(masterAddr)
+	mc.TLS = ca.config(t, "master")
+
+	m, err := startMaster(masterAddr, WithConfig(mc))
+	if m != nil {
+		defer m.Close()
+	}
+	if err != nil {
+		t.Errorf("creating a master failed with error: %v", err)
+		return
+	}
+
+	// wait for the server to start
+	time.Sleep(100 * time.Millisecond)
+
+	sc := DefaultConfig(slaveAddr)
+	sc.TLS = ca.config(t, "slave")
+
+	s, err := startSlave(slaveAddr, masterAddr, WithConfig(sc))
+	if s != nil {
+		defer s.Close()
+	}
+	if err != nil {
+		t.Errorf("creating a slave failed with error: %v", err)
+		return
+	}
+
+	// clients only need to trust the CA
+	c := NewTLSClient(masterAddr, &tls.Config{RootCAs: ca.pool})
+	if err := c.Put(context.Background(), "key", []byte("val")); err != nil {
+		t.Errorf("put failed: %v", err)
+		return
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	val, err := NewTLSClient(slaveAddr, &tls.Config{RootCAs: ca.pool}).Get(context.Background(), "key")
+	if err != nil {
+		t.Errorf("get failed: %v", err)
+		return
+	}
+	if string(val) != "val" {
+		t.Errorf(`expected "val", got "%s"`, val)
+	}
+
+	// a client without certificate can't push writes to the slave
+	payload := bytes.NewBufferString(`{"key": "key", "entry": {"v": "hacked", "n": 99}}`)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: ca.pool}}}
+	resp, err := client.Post("https://"+slaveAddr+"/receive", encoding, payload)
+	if err != nil {
+		t.Errorf("error posting /receive: %v", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected status %d, got %d", http.StatusForbidden, resp.StatusCode)
+	}
+
+	// neither can a client holding a certificate from another CA
+	rogue := newTestCA(t).issue(t, "rogue")
+	client = &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+		RootCAs:      ca.pool,
+		Certificates: []tls.Certificate{*rogue},
+	}}}
+	payload = bytes.NewBufferString(`{"key": "key", "entry": {"v": "hacked", "n": 99}}`)
+	resp, err = client.Post("https://"+slaveAddr+"/receive", encoding, payload)
+	if err == nil {
+		resp.Body.Close()
+		t.Errorf("expected the handshake to fail, got status %d", resp.StatusCode)
+	}
+
+	// plain HTTP isn't served
+	if _, err := NewClient(slaveAddr).Get(context.Background(), "key"); err == nil {
+		t.Error("expected plain HTTP to fail")
+	}
+}
+
+// Test that with mutual TLS, a slave only accepts the requests of its master
+// from a node presenting the certificate of the master address, even when
+// the sender claims to be the master
+func TestMasterCertificate(t *testing.T) {
+	ca := newTestCA(t)
+
+	c := DefaultConfig("")
+	c.TLS = ca.config(t, "slave")
+	c.ClusterSecret = "s3cret"
+	s, err := NewSlave("slave:5353", "master:5151", WithConfig(c))
+	if err != nil {
+		t.Fatalf("creating a slave failed with error: %v", err)
+	}
+	tr := &httpTransport{n: s}
+	handler := tr.masterOnly(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	for name, expected := range map[string]int{"master": http.StatusNoContent, "other": http.StatusForbidden} {
+		leaf, err := x509.ParseCertificate(ca.issue(t, name).Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := httptest.NewRequest(http.MethodPost, "/receive", nil)
+		r.TLS = &tls.ConnectionState{
+			PeerCertificates: []*x509.Certificate{leaf},
+			VerifiedChains:   [][]*x509.Certificate{{leaf, ca.cert}},
+		}
+		// the slave doesn't know the ID of its master yet, so only the
+		// certificate tells the nodes apart
+		r.Header.Set(headerNode, name)
+
+		w := httptest.NewRecorder()
+		handler(w, r)
+		if w.Code != expected {
+			t.Errorf("%s: expected status %d, got %d", name, expected, w.Code)
+		}
+	}
+}
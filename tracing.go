@@ -0,0 +1,172 @@
+package dkvs
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// header carrying the trace context, see https://www.w3.org/TR/trace-context/
+const headerTraceparent = "traceparent"
+
+// Span is a timed operation, part of a trace spanning several nodes
+type Span struct {
+	Name       string            `json:"name"`
+	TraceID    string            `json:"trace_id"`
+	SpanID     string            `json:"span_id"`
+	ParentID   string            `json:"parent_id,omitempty"`
+	NodeID     string            `json:"node"`
+	Start      time.Time         `json:"start"`
+	End        time.Time         `json:"end"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	Error      string            `json:"error,omitempty"`
+
+	exporter SpanExporter
+	clock    func() time.Time
+}
+
+// SpanExporter receives the spans once they end
+type SpanExporter interface {
+	ExportSpan(s *Span)
+}
+
+// SetSpanExporter sets the exporter of the nodes created afterwards. Without
+// exporter, the trace context is still propagated but spans are dropped.
+func SetSpanExporter(e SpanExporter) {
+	defaults.spanExporter = e
+}
+
+type spanKey struct{}
+
+// spanFromContext returns the current span, nil if there is none
+func spanFromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey{}).(*Span)
+	return s
+}
+
+// startSpan starts a span, child of the span of the context if any. Attributes
+// are alternating keys and values.
+func (n *Node) startSpan(ctx context.Context, name string, attributes ...string) (context.Context, *Span) {
+	s := &Span{
+		Name:       name,
+		SpanID:     randomHex(8),
+		NodeID:     n.ID,
+		Start:      n.now(),
+		Attributes: make(map[string]string),
+		exporter:   n.spanExporter,
+		clock:      n.now,
+	}
+
+	if parent := spanFromContext(ctx); parent != nil {
+		s.TraceID, s.ParentID = parent.TraceID, parent.SpanID
+	} else {
+		s.TraceID = randomHex(16)
+	}
+
+	for i := 0; i+1 < len(attributes); i += 2 {
+		s.Attributes[attributes[i]] = attributes[i+1]
+	}
+
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// finish ends the span and exports it
+func (s *Span) finish(err error) {
+	s.End = s.clock()
+	if err != nil {
+		s.Error = err.Error()
+	}
+	if s.exporter != nil {
+		s.exporter.ExportSpan(s)
+	}
+}
+
+// traceparent formats the trace context of the span
+func (s *Span) traceparent() string {
+	return "00-" + s.TraceID + "-" + s.SpanID + "-01"
+}
+
+// injectTrace propagates the trace context of ctx to an outgoing request
+func injectTrace(ctx context.Context, r *http.Request) {
+	if s := spanFromContext(ctx); s != nil {
+		r.Header.Set(headerTraceparent, s.traceparent())
+	}
+}
+
+// extractTrace returns a context holding the remote span of an incoming
+// request, if it carries a valid trace context
+func extractTrace(r *http.Request) context.Context {
+	ctx := r.Context()
+
+	parts := strings.Split(r.Header.Get(headerTraceparent), "-")
+	if len(parts) != 4 || len(parts[1]) != 32 || len(parts[2]) != 16 || !isHex(parts[1]) || !isHex(parts[2]) {
+		return ctx
+	}
+	if parts[1] == strings.Repeat("0", 32) || parts[2] == strings.Repeat("0", 16) {
+		return ctx
+	}
+
+	return context.WithValue(ctx, spanKey{}, &Span{TraceID: parts[1], SpanID: parts[2]})
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func isHex(s string) bool {
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+// InMemoryExporter keeps the spans in memory, e.g. to check them in tests
+type InMemoryExporter struct {
+	spans []*Span
+	lock  sync.Mutex
+}
+
+// ExportSpan keeps the span
+func (e *InMemoryExporter) ExportSpan(s *Span) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.spans = append(e.spans, s)
+}
+
+// Spans returns the spans exported so far
+func (e *InMemoryExporter) Spans() []*Span {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return append([]*Span(nil), e.spans...)
+}
+
+// Reset drops the spans exported so far
+func (e *InMemoryExporter) Reset() {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.spans = nil
+}
+
+// JSONExporter writes the spans to w as newline delimited JSON
+type JSONExporter struct {
+	w    io.Writer
+	lock sync.Mutex
+}
+
+// NewJSONExporter creates an exporter writing to w
+func NewJSONExporter(w io.Writer) *JSONExporter {
+	return &JSONExporter{w: w}
+}
+
+// ExportSpan writes the span
+func (e *JSONExporter) ExportSpan(s *Span) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	json.NewEncoder(e.w).Encode(s)
+}
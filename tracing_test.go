@@ -0,0 +1,99 @@
+package dkvs
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// Test that a write is traced from the client request down to the slaves
+func TestTracing(t *testing.T) {
+	masterAddr := ":6363"
+	slaveAddr := ":6464"
+
+	exporter := &InMemoryExporter{}
+
+	m, err := startMaster(masterAddr, WithSpanExporter(exporter))
+	if m != nil {
+		defer m.Close()
+	}
+	if err != nil {
+		t.Errorf("creating a master failed with error: %v", err)
+		return
+	}
+
+	// wait for the server to start
+	time.Sleep(100 * time.Millisecond)
+
+	s, err := startSlave(slaveAddr, masterAddr, WithSpanExporter(exporter))
+	if s != nil {
+		defer s.Close()
+	}
+	if err != nil {
+		t.Errorf("creating a slave failed with error: %v", err)
+		return
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	exporter.Reset()
+
+	traceID := "4bf92f3577b34da6a3ce929d0e0e4736"
+	clientSpanID := "00f067aa0ba902b7"
+
+	req, _ := http.NewRequest(http.MethodPut, "http://"+masterAddr+"/v1/keys/key", bytes.NewBufferString("val"))
+	req.Header.Set("traceparent", "00-"+traceID+"-"+clientSpanID+"-01")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Errorf("error putting key: %v", err)
+		return
+	}
+	resp.Body.Close()
+
+	time.Sleep(100 * time.Millisecond)
+
+	spans := make(map[string]*Span)
+	for _, span := range exporter.Spans() {
+		if span.TraceID != traceID {
+			t.Errorf("span %s isn't part of the trace: %+v", span.Name, span)
+		}
+		spans[span.NodeID+" "+span.Name] = span
+	}
+
+	type testCase struct {
+		span, parent string
+	}
+
+	testCases := []*testCase{
+		{span: m.ID + " http /v1/keys/"},
+		{span: m.ID + " storage.put", parent: m.ID + " http /v1/keys/"},
+		{span: m.ID + " replication.push", parent: m.ID + " http /v1/keys/"},
+		{span: s.ID + " http /receive", parent: m.ID + " replication.push"},
+		{span: s.ID + " storage.apply", parent: s.ID + " http /receive"},
+	}
+
+	for _, test := range testCases {
+		span, ok := spans[test.span]
+		if !ok {
+			t.Errorf("missing span %s", test.span)
+			continue
+		}
+
+		expectedParent := clientSpanID
+		if test.parent != "" {
+			parent, ok := spans[test.parent]
+			if !ok {
+				continue
+			}
+			expectedParent = parent.SpanID
+		}
+
+		if span.ParentID != expectedParent {
+			t.Errorf("expected %s to be a child of %s, got parent %s", test.span, expectedParent, span.ParentID)
+		}
+	}
+
+	if push := spans[m.ID+" replication.push"]; push != nil && push.Attributes["peer"] != s.ID {
+		t.Errorf("expected the push to be to %s, got %v", s.ID, push.Attributes)
+	}
+}
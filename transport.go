@@ -1,28 +1,96 @@
 package dkvs
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
+	"io/ioutil"
+	"net"
 	"net/http"
-	"os"
-	"os/signal"
-	"syscall"
-	"time"
+	"strconv"
 )
 
 // Transport describes the communication layer
 type Transport interface {
-	Start(n *Node) error
-	Stop() error
+	// Start serves the requests for the node, and returns once it listens
+	Start(ctx context.Context, n *Node) error
+	// Stop waits for pending requests until the context is done
+	Stop(ctx context.Context) error
 
-	Write(key, val string) error
-	Read(key string) ([]byte, error)
-	List() ([]*Node, error)
+	Write(ctx context.Context, key string, val []byte) error
+	Read(ctx context.Context, key string) ([]byte, error)
+	List(ctx context.Context) ([]*Node, error)
 
-	Join(slave *Node) error
+	Join(ctx context.Context, slave *Node) error
+
+	// Send delivers a message to the node listening on addr, and returns
+	// once it was handled
+	Send(ctx context.Context, addr string, msg *Message) error
+}
+
+// MessageKind identifies a message sent from one node to another
+type MessageKind string
+
+// Messages between nodes
+const (
+	// a slave asks the master to join the cluster
+	MessageJoin MessageKind = "join"
+	// the master sends the list of nodes
+	MessageUpdate MessageKind = "update"
+	// the master pushes a write, or a deletion when Entry is nil
+	MessageWrite MessageKind = "write"
+	// the master pushes writes that must be applied together
+	MessageWrites MessageKind = "writes"
+	// the master sends a copy of its storage to a joining slave
+	MessageReplicate MessageKind = "replicate"
+)
+
+// Message is sent from one node to another through the transport
+type Message struct {
+	Kind  MessageKind `json:"kind"`
+	Index uint64      `json:"index,omitempty"`
+	// index up to which the master is done pushing writes to the recipient
+	// of a write, see Node.skipMissing
+	Settled uint64           `json:"settled,omitempty"`
+	Key     string           `json:"key,omitempty"`
+	Entry   *Entry           `json:"entry,omitempty"`
+	Writes  []*Write         `json:"writes,omitempty"`
+	Node    *Node            `json:"node,omitempty"`
+	Nodes   map[string]*Node `json:"nodes,omitempty"`
+	Data    []byte           `json:"data,omitempty"`
+	// Stream is read instead of Data when set, by transports that can send
+	// it without reading it all first
+	Stream io.Reader `json:"-"`
+}
+
+// data returns a reader of the data of a message
+func (msg *Message) data() io.Reader {
+	if msg.Stream != nil {
+		return msg.Stream
+	}
+	return bytes.NewReader(msg.Data)
+}
+
+// receive handles a message sent by another node
+func (n *Node) receive(ctx context.Context, msg *Message) error {
+	switch msg.Kind {
+	case MessageJoin:
+		return n.Join(ctx, msg.Node)
+	case MessageUpdate:
+		return n.ReceiveListUpdate(ctx, msg.Nodes)
+	case MessageWrite:
+		n.skipMissing(msg.Settled)
+		return n.ReceiveWrite(ctx, msg.Index, msg.Key, msg.Entry)
+	case MessageWrites:
+		n.skipMissing(msg.Settled)
+		return n.ReceiveWrites(ctx, msg.Index, msg.Writes)
+	case MessageReplicate:
+		return n.ReplicateFromMaster(ctx, msg.Index, msg.data())
+	default:
+		return badRequest(fmt.Errorf("unknown message %q", msg.Kind))
+	}
 }
 
 // NewHTTPTransport creates an http transport
@@ -35,70 +103,230 @@ type httpTransport struct {
 	n   *Node
 }
 
-func (t *httpTransport) Start(n *Node) error {
+func (t *httpTransport) Start(ctx context.Context, n *Node) error {
 	t.n = n
-	h := http.NewServeMux()
+	t.srv = &http.Server{Addr: t.n.Address, Handler: t.handler()}
 
-	// simplistic routes; using gRPC or a REST API would be better practice
-	h.HandleFunc("/write", t.writeHandler)
-	h.HandleFunc("/read", t.readHandler)
-	h.HandleFunc("/multi", t.multiHandler)
-	h.HandleFunc("/list", t.listHandler)
-	h.HandleFunc("/join", t.joinHandler)
-	h.HandleFunc("/update", t.updateHandler)
-	h.HandleFunc("/receive", t.receiveHandler)
-	h.HandleFunc("/replicate", t.replicateHandler)
-
-	t.srv = &http.Server{Addr: t.n.Address, Handler: h}
+	// listen synchronously, so that errors such as a port already in use are
+	// returned to the caller
+	var lc net.ListenConfig
+	ln, err := lc.Listen(ctx, "tcp", t.n.Address)
+	if err != nil {
+		return err
+	}
 
 	go func() {
-		if err := t.srv.ListenAndServe(); err != nil {
-			log.Println(err)
+		var err error
+		if t.n.tls != nil {
+			t.srv.TLSConfig = t.n.tls.serverConfig()
+			err = t.srv.ServeTLS(ln, "", "")
+		} else {
+			err = t.srv.Serve(ln)
+		}
+		if err == http.ErrServerClosed {
+			t.n.logDebug("transport stopped")
+		} else if err != nil {
+			t.n.logError("transport failed", "error", err)
 		}
 	}()
 
-	// Setting up signal capturing
-	stop := make(chan os.Signal, 1)
-	signal.Notify(stop, os.Interrupt)
-	signal.Notify(stop, syscall.SIGTERM)
-	signal.Notify(stop, syscall.SIGKILL)
+	return nil
+}
+
+// handler routes the requests to the node
+func (t *httpTransport) handler() http.Handler {
+	mux := http.NewServeMux()
+	h := func(route string, handler http.HandlerFunc) {
+		mux.HandleFunc(route, t.instrument(route, handler))
+	}
+
+	// original POST-only client routes, kept for compatibility
+	if t.n.config.LegacyRoutes {
+		h("/write", t.writeHandler)
+		h("/read", t.readHandler)
+		h("/multi", t.multiHandler)
+		h("/list", t.listHandler)
+	}
 
-	// Waiting for SIGINT (pkill -2)
-	<-stop
+	// resource oriented client API
+	h("/v1/keys", t.keysHandler)
+	h("/v1/keys/", t.keyHandler)
+	h("/v1/scan", t.scanHandler)
+	h("/v1/txn", t.txnHandler)
+	h("/v1/batch", t.batchHandler)
+	h("/v1/incr/", t.incrHandler)
+	h("/v1/decr/", t.incrHandler)
+	h("/v1/ops", t.opsHandler)
+	h("/v1/watch", t.watchHandler)
+	h("/v1/history/", t.historyHandler)
+	h("/v1/compact", t.compactHandler)
+	h("/v1/nodes", t.nodesHandler)
+	h("/v1/acl", t.aclHandler)
+	h("/v1/acl/", t.principalHandler)
+
+	// node to node routes
+	h("/join", t.peerOnly(t.joinHandler))
+	h("/update", t.peerOnly(t.masterOnly(t.updateHandler)))
+	h("/receive", t.peerOnly(t.masterOnly(t.receiveHandler)))
+	h("/replicate", t.peerStreamOnly(t.masterOnly(t.replicateHandler)))
+
+	h("/status", t.statusHandler)
+	mux.HandleFunc("/metrics", t.metricsHandler)
+
+	return mux
+}
+
+// Send posts a message to the matching node to node route, signed when the
+// cluster has a secret
+func (t *httpTransport) Send(ctx context.Context, addr string, msg *Message) error {
+	var route string
+	var payload []byte
+	var body io.Reader
+	contentType := encoding
+
+	switch msg.Kind {
+	case MessageJoin:
+		route = "/join"
+		payload, _ = json.Marshal(msg.Node)
+	case MessageUpdate:
+		route = "/update"
+		payload, _ = json.Marshal(msg.Nodes)
+	case MessageWrite:
+		route = "/receive"
+		payload, _ = json.Marshal(map[string]interface{}{
+			"index":   msg.Index,
+			"settled": msg.Settled,
+			"key":     msg.Key,
+			"entry":   msg.Entry,
+		})
+	case MessageWrites:
+		route = "/receive"
+		payload, _ = json.Marshal(map[string]interface{}{
+			"index":   msg.Index,
+			"settled": msg.Settled,
+			"writes":  msg.Writes,
+		})
+	case MessageReplicate:
+		route = "/replicate?index=" + strconv.FormatUint(msg.Index, 10)
+		body = msg.data()
+		contentType = defaultContentType
+	default:
+		return fmt.Errorf("unknown message %q", msg.Kind)
+	}
+	if body == nil {
+		body = bytes.NewReader(payload)
+	}
 
-	// Shutdown gracefully or after 1 sec
-	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
-	defer cancel()
-	if err := t.srv.Shutdown(ctx); err != nil {
+	post := t.n.post
+	if msg.Kind == MessageReplicate {
+		// the replication streams the whole database, which can take longer
+		// than a request
+		post = t.n.postStream
+	}
+	resp, err := post(ctx, t.n.url(addr, route), contentType, body)
+	if err != nil {
 		return err
 	}
+	defer resp.Body.Close()
 
+	if resp.StatusCode != http.StatusOK {
+		return decodeError(resp)
+	}
 	return nil
 }
 
-func (t *httpTransport) Stop() error {
-	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
-	defer cancel()
+func (t *httpTransport) Stop(ctx context.Context) error {
+	if t.srv == nil {
+		return nil
+	}
 	return t.srv.Shutdown(ctx)
 }
 
+// authorized checks that the client may access the keys, and writes the error
+// response otherwise
+func (t *httpTransport) authorized(w http.ResponseWriter, r *http.Request, write bool, keys ...string) bool {
+	if err := t.n.authorize(requestToken(r), write, keys...); err != nil {
+		writeError(w, err)
+		return false
+	}
+	return true
+}
+
+// peerOnly rejects requests that don't come from another node
+func (t *httpTransport) peerOnly(h http.HandlerFunc) http.HandlerFunc {
+	return t.peer(t.n.authenticate, h)
+}
+
+// peerStreamOnly is peerOnly for the routes whose body is streamed, and
+// signed by a trailer
+func (t *httpTransport) peerStreamOnly(h http.HandlerFunc) http.HandlerFunc {
+	return t.peer(t.n.authenticateStream, h)
+}
+
+func (t *httpTransport) peer(authenticate func(*http.Request) (string, error), h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !isPeer(t.n.tls, r) {
+			writeError(w, ErrorForbidden)
+			return
+		}
+		if _, err := authenticate(r); err != nil {
+			writeError(w, err)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// masterOnly rejects requests that don't come from the master. It must be
+// wrapped by peerOnly, which authenticates the sender. Every node holds the
+// cluster secret, so with mutual TLS a slave also checks that the master
+// presented the certificate of its master address, which another node can't.
+func (t *httpTransport) masterOnly(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if len(t.n.secret) != 0 && !t.n.isFromMaster(r.Header.Get(headerNode)) {
+			writeError(w, ErrorForbidden)
+			return
+		}
+		if t.n.tls != nil && t.n.config.MasterAddress != "" && !isFromHost(r, t.n.config.MasterAddress) {
+			writeError(w, ErrorForbidden)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// writeHandler takes the value as the body of an octet-stream request, with
+// the key in the query string, or as a string in a JSON body
 func (t *httpTransport) writeHandler(w http.ResponseWriter, r *http.Request) {
 	var p struct {
 		Key   string `json:"key"`
 		Value string `json:"val"`
 	}
+	var val []byte
+
+	if r.Header.Get("Content-Type") == defaultContentType {
+		p.Key = r.URL.Query().Get("key")
+		var err error
+		if val, err = ioutil.ReadAll(r.Body); err != nil {
+			writeError(w, badRequest(err))
+			return
+		}
+	} else {
+		decoder := json.NewDecoder(r.Body)
+		if err := decoder.Decode(&p); err != nil {
+			writeError(w, badRequest(err))
+			return
+		}
+		val = []byte(p.Value)
+	}
 
-	decoder := json.NewDecoder(r.Body)
-	if err := decoder.Decode(&p); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprint(w, err)
+	if !t.authorized(w, r, true, p.Key) {
 		return
 	}
 
-	err := t.Write(p.Key, p.Value)
+	err := t.Write(r.Context(), p.Key, val)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprint(w, err)
+		writeError(w, err)
 		return
 	}
 
@@ -107,21 +335,28 @@ func (t *httpTransport) writeHandler(w http.ResponseWriter, r *http.Request) {
 
 func (t *httpTransport) receiveHandler(w http.ResponseWriter, r *http.Request) {
 	var p struct {
-		Key   string `json:"key"`
-		Value string `json:"val"`
+		Index   uint64   `json:"index"`
+		Settled uint64   `json:"settled"`
+		Key     string   `json:"key"`
+		Entry   *Entry   `json:"entry"`
+		Writes  []*Write `json:"writes"`
 	}
 
 	decoder := json.NewDecoder(r.Body)
 	if err := decoder.Decode(&p); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprint(w, err)
+		writeError(w, badRequest(err))
 		return
 	}
 
-	err := t.Receive(p.Key, p.Value)
+	t.n.skipMissing(p.Settled)
+	var err error
+	if p.Writes != nil {
+		err = t.n.ReceiveWrites(r.Context(), p.Index, p.Writes)
+	} else {
+		err = t.Receive(r.Context(), p.Index, p.Key, p.Entry)
+	}
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprint(w, err)
+		writeError(w, err)
 		return
 	}
 
@@ -135,18 +370,21 @@ func (t *httpTransport) readHandler(w http.ResponseWriter, r *http.Request) {
 
 	decoder := json.NewDecoder(r.Body)
 	if err := decoder.Decode(&p); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprint(w, err)
+		writeError(w, badRequest(err))
 		return
 	}
 
-	val, err := t.Read(p.Key)
+	if !t.authorized(w, r, false, p.Key) {
+		return
+	}
+
+	val, err := t.Read(r.Context(), p.Key)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprint(w, err)
+		writeError(w, err)
 		return
 	}
 
+	w.Header().Set("Content-Type", defaultContentType)
 	w.WriteHeader(http.StatusOK)
 	w.Write(val)
 }
@@ -158,15 +396,17 @@ func (t *httpTransport) multiHandler(w http.ResponseWriter, r *http.Request) {
 
 	decoder := json.NewDecoder(r.Body)
 	if err := decoder.Decode(&p); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprint(w, err)
+		writeError(w, badRequest(err))
 		return
 	}
 
-	values, err := t.Multi(p.Keys)
+	if !t.authorized(w, r, false, p.Keys...) {
+		return
+	}
+
+	values, err := t.Multi(r.Context(), p.Keys)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprint(w, err)
+		writeError(w, err)
 		return
 	}
 
@@ -175,18 +415,20 @@ func (t *httpTransport) multiHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func (t *httpTransport) listHandler(w http.ResponseWriter, r *http.Request) {
-	val, err := t.List()
+	if !t.authorized(w, r, false) {
+		return
+	}
+
+	val, err := t.List(r.Context())
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprint(w, err)
+		writeError(w, err)
 		return
 	}
 	w.WriteHeader(http.StatusOK)
 
 	jsonVal, err := json.Marshal(val)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprint(w, err)
+		writeError(w, err)
 		return
 	}
 
@@ -198,15 +440,13 @@ func (t *httpTransport) joinHandler(w http.ResponseWriter, r *http.Request) {
 
 	decoder := json.NewDecoder(r.Body)
 	if err := decoder.Decode(&p); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprint(w, err)
+		writeError(w, badRequest(err))
 		return
 	}
 
-	err := t.Join(p)
+	err := t.Join(r.Context(), p)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprint(w, err)
+		writeError(w, err)
 		return
 	}
 
@@ -218,15 +458,13 @@ func (t *httpTransport) updateHandler(w http.ResponseWriter, r *http.Request) {
 
 	decoder := json.NewDecoder(r.Body)
 	if err := decoder.Decode(&p); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprint(w, err)
+		writeError(w, badRequest(err))
 		return
 	}
 
-	err := t.Update(p)
+	err := t.Update(r.Context(), p)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprint(w, err)
+		writeError(w, err)
 		return
 	}
 
@@ -234,46 +472,51 @@ func (t *httpTransport) updateHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func (t *httpTransport) replicateHandler(w http.ResponseWriter, r *http.Request) {
-	if err := t.Replicate(r.Body); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprint(w, err)
+	index, err := strconv.ParseUint(r.URL.Query().Get("index"), 10, 64)
+	if err != nil {
+		writeError(w, badRequest(err))
+		return
+	}
+
+	if err := t.Replicate(r.Context(), index, r.Body); err != nil {
+		writeError(w, err)
 		return
 	}
 
 	w.WriteHeader(http.StatusOK)
 }
 
-func (t *httpTransport) Write(key, val string) error {
-	return t.n.WriteValue(key, val)
+func (t *httpTransport) Write(ctx context.Context, key string, val []byte) error {
+	return t.n.WriteValue(ctx, key, val)
 }
 
-func (t *httpTransport) Read(key string) ([]byte, error) {
-	return t.n.ReadValue(key)
+func (t *httpTransport) Read(ctx context.Context, key string) ([]byte, error) {
+	return t.n.ReadValue(ctx, key)
 
 }
 
-func (t *httpTransport) Multi(keys []string) ([]byte, error) {
-	return t.n.ReadMultipleValues(keys...)
+func (t *httpTransport) Multi(ctx context.Context, keys []string) ([]byte, error) {
+	return t.n.ReadMultipleValues(ctx, keys...)
 
 }
 
-func (t *httpTransport) List() ([]*Node, error) {
-	return t.n.ListNodes()
+func (t *httpTransport) List(ctx context.Context) ([]*Node, error) {
+	return t.n.ListNodes(ctx)
 
 }
 
-func (t *httpTransport) Join(slave *Node) error {
-	return t.n.Join(slave)
+func (t *httpTransport) Join(ctx context.Context, slave *Node) error {
+	return t.n.Join(ctx, slave)
 }
 
-func (t *httpTransport) Update(nodes map[string]*Node) error {
-	return t.n.ReceiveListUpdate(nodes)
+func (t *httpTransport) Update(ctx context.Context, nodes map[string]*Node) error {
+	return t.n.ReceiveListUpdate(ctx, nodes)
 }
 
-func (t *httpTransport) Receive(key, val string) error {
-	return t.n.ReceiveWrite(key, val)
+func (t *httpTransport) Receive(ctx context.Context, index uint64, key string, e *Entry) error {
+	return t.n.ReceiveWrite(ctx, index, key, e)
 }
 
-func (t *httpTransport) Replicate(r io.Reader) error {
-	return t.n.ReplicateFromMaster(r)
+func (t *httpTransport) Replicate(ctx context.Context, index uint64, r io.Reader) error {
+	return t.n.ReplicateFromMaster(ctx, index, r)
 }
@@ -1,6 +1,7 @@
 package dkvs
 
 import (
+	"context"
 	"testing"
 	"time"
 )
@@ -9,17 +10,16 @@ import (
 func TestTransport(t *testing.T) {
 	tp := NewHTTPTransport()
 
-	go func() {
-		err := tp.Start(&Node{Address: ":2345"})
-		if err != nil {
-			t.Errorf("failed to start transport with error: %v", err)
-			return
-		}
-	}()
+	// Start returns once the transport listens
+	err := tp.Start(context.Background(), &Node{Address: ":2345", config: DefaultConfig(":2345")})
+	if err != nil {
+		t.Errorf("failed to start transport with error: %v", err)
+		return
+	}
 
 	time.Sleep(100 * time.Millisecond)
 
-	err := tp.Stop()
+	err = tp.Stop(context.Background())
 	if err != nil {
 		t.Errorf("failed to stop transport with error: %v", err)
 		return
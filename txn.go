@@ -0,0 +1,238 @@
+package dkvs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// maximum number of comparisons and of writes of a transaction
+const maxTxnOps = 128
+
+// comparison operators
+const (
+	CompareEqual        = "="
+	CompareNotEqual     = "!="
+	CompareLess         = "<"
+	CompareLessEqual    = "<="
+	CompareGreater      = ">"
+	CompareGreaterEqual = ">="
+)
+
+// write operations
+const (
+	OpPut    = "put"
+	OpDelete = "delete"
+)
+
+// Compare is a condition of a transaction on the version of a key. Missing
+// keys have the version 0, so {key, "=", 0} checks that a key doesn't exist
+// and {key, ">", 0} that it exists.
+type Compare struct {
+	Key     string `json:"key"`
+	Op      string `json:"op"`
+	Version uint64 `json:"version"`
+}
+
+// TxnOp is a write of a transaction: a put, or the deletion of a key, which
+// is a no-op if the key doesn't exist
+type TxnOp struct {
+	Op          string `json:"op"`
+	Key         string `json:"key"`
+	Value       []byte `json:"value,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+}
+
+// Txn is a transaction: the writes of Then are applied atomically if every
+// comparison of If holds, and none of them otherwise
+type Txn struct {
+	If   []*Compare `json:"if"`
+	Then []*TxnOp   `json:"then"`
+}
+
+// TxnResult tells whether a transaction was applied
+type TxnResult struct {
+	Succeeded bool `json:"succeeded"`
+	// Versions holds the new version of each key written, in the order of
+	// the writes, 0 for deletions; it is empty when the transaction failed
+	Versions []uint64 `json:"versions,omitempty"`
+}
+
+// Write is a key written by the master, or deleted when Entry is nil, as
+// pushed to the slaves
+type Write struct {
+	Key   string `json:"key"`
+	Entry *Entry `json:"entry,omitempty"`
+}
+
+// holds tells whether the comparison holds for the current version of its key
+func (c *Compare) holds(version uint64) bool {
+	switch c.Op {
+	case CompareEqual:
+		return version == c.Version
+	case CompareNotEqual:
+		return version != c.Version
+	case CompareLess:
+		return version < c.Version
+	case CompareLessEqual:
+		return version <= c.Version
+	case CompareGreater:
+		return version > c.Version
+	case CompareGreaterEqual:
+		return version >= c.Version
+	}
+	return false
+}
+
+// validate rejects transactions that can't be applied whatever the data
+func (txn *Txn) validate() error {
+	if len(txn.If) > maxTxnOps || len(txn.Then) > maxTxnOps {
+		return badRequest(fmt.Errorf("a transaction has at most %d comparisons and %d writes", maxTxnOps, maxTxnOps))
+	}
+
+	for _, c := range txn.If {
+		if c.Key == "" {
+			return badRequest(errors.New("comparison without key"))
+		}
+		if !c.valid() {
+			return badRequest(fmt.Errorf("%s: unknown comparison %q", c.Key, c.Op))
+		}
+	}
+
+	// the outcome of writing a key twice would depend on the order
+	written := make(map[string]bool)
+	for _, op := range txn.Then {
+		if op.Key == "" {
+			return badRequest(errors.New("write without key"))
+		}
+		if op.Op != OpPut && op.Op != OpDelete {
+			return badRequest(fmt.Errorf("%s: unknown write %q", op.Key, op.Op))
+		}
+		if written[op.Key] {
+			return badRequest(fmt.Errorf("%s: written twice", op.Key))
+		}
+		written[op.Key] = true
+	}
+	return nil
+}
+
+func (c *Compare) valid() bool {
+	switch c.Op {
+	case CompareEqual, CompareNotEqual, CompareLess, CompareLessEqual, CompareGreater, CompareGreaterEqual:
+		return true
+	}
+	return false
+}
+
+// keys returns the keys read by the comparisons, and the keys written
+func (txn *Txn) keys() ([]string, []string) {
+	read := make([]string, 0, len(txn.If))
+	for _, c := range txn.If {
+		read = append(read, c.Key)
+	}
+	written := make([]string, 0, len(txn.Then))
+	for _, op := range txn.Then {
+		written = append(written, op.Key)
+	}
+	return read, written
+}
+
+// prepareTxn checks the comparisons of a transaction against the current
+// versions of the keys, and returns the writes that apply it, or
+// ErrorConflict. Storages call it while holding their lock.
+func prepareTxn(compares []*Compare, ops []*TxnOp, lookup versionLookup) ([]*Write, error) {
+	for _, c := range compares {
+		e, _, err := lookup(c.Key)
+		if err != nil {
+			return nil, err
+		}
+		var v uint64
+		if e != nil {
+			v = e.Version
+		}
+		if !c.holds(v) {
+			return nil, ErrorConflict
+		}
+	}
+
+	writes := make([]*Write, 0, len(ops))
+	for _, op := range ops {
+		w := &Write{Key: op.Key}
+		if op.Op == OpPut {
+			_, last, err := lookup(op.Key)
+			if err != nil {
+				return nil, err
+			}
+			w.Entry = &Entry{
+				Value:       append([]byte{}, op.Value...),
+				ContentType: op.ContentType,
+				Version:     last + 1,
+			}
+		}
+		writes = append(writes, w)
+	}
+	return writes, nil
+}
+
+// Txn applies a transaction on the master, then pushes its writes to the
+// slaves as a single message. A transaction whose comparisons don't hold
+// isn't an error, but a result that didn't succeed.
+// This can only be run on the master.
+func (n *Node) Txn(ctx context.Context, txn *Txn) (*TxnResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if !n.IsMaster() {
+		return nil, ErrorNotMaster
+	}
+	if err := txn.validate(); err != nil {
+		return nil, err
+	}
+
+	var writes []*Write
+	_, written := txn.keys()
+	_, span := n.startSpan(ctx, "storage.txn")
+	index, err := n.commit(written, func() ([]*Write, error) {
+		var err error
+		writes, err = n.storage.Txn(txn.If, txn.Then)
+		return writes, err
+	})
+	span.finish(err)
+	if errors.Is(err, ErrorConflict) {
+		return &TxnResult{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	result := &TxnResult{Succeeded: true, Versions: make([]uint64, len(writes))}
+	for i, w := range writes {
+		if w.Entry != nil {
+			result.Versions[i] = w.Entry.Version
+		}
+	}
+
+	if len(writes) == 0 {
+		return result, nil
+	}
+	return result, n.pushWritesToSlaves(ctx, index, writes)
+}
+
+// ReceiveWrites applies writes sent together from the master, atomically
+func (n *Node) ReceiveWrites(ctx context.Context, index uint64, writes []*Write) error {
+	if n.IsMaster() {
+		return ErrorNotSlave
+	}
+
+	_, span := n.startSpan(ctx, "storage.apply")
+	err := n.received(ctx, index, writes, func() error {
+		return n.storage.ApplyWrites(writes)
+	})
+	span.finish(err)
+	if err != nil {
+		return err
+	}
+
+	n.logDebug("replicated writes", "writes", len(writes), "index", index)
+
+	return nil
+}
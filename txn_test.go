@@ -0,0 +1,123 @@
+package dkvs
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+)
+
+// Test transactions through a slave, which redirects them to the master
+func TestTxn(t *testing.T) {
+	ctx := context.Background()
+	net := NewMemoryNetwork()
+	_, slaves := memoryCluster(t, net, WriteConcernAll, "slave:1")
+	s := slaves[0]
+	c := net.Client("slave:1")
+
+	// each transaction is pushed to the slave as a single message
+	var messages int32
+	net.SetFaults(func(from, to string, msg *Message) Fault {
+		if msg.Kind == MessageWrite || msg.Kind == MessageWrites {
+			atomic.AddInt32(&messages, 1)
+		}
+		return Fault{}
+	})
+
+	create := &Txn{
+		If: []*Compare{{Key: "a", Op: CompareEqual, Version: 0}},
+		Then: []*TxnOp{
+			{Op: OpPut, Key: "a", Value: []byte("1")},
+			{Op: OpPut, Key: "b", Value: []byte("1"), ContentType: "text/plain"},
+		},
+	}
+	r, err := c.Txn(ctx, create)
+	if err != nil || !r.Succeeded || len(r.Versions) != 2 || r.Versions[0] != 1 || r.Versions[1] != 1 {
+		t.Fatalf("expected the transaction to succeed, got %+v (%v)", r, err)
+	}
+	expectValue(t, s, "a", "1")
+	expectValue(t, s, "b", "1")
+	if n := atomic.LoadInt32(&messages); n != 1 {
+		t.Errorf("expected 1 replication message, got %d", n)
+	}
+
+	// a already exists
+	if r, err := c.Txn(ctx, create); err != nil || r.Succeeded {
+		t.Errorf("expected the transaction to fail, got %+v (%v)", r, err)
+	}
+	if n := atomic.LoadInt32(&messages); n != 1 {
+		t.Errorf("expected failed transactions not to be replicated, got %d messages", n)
+	}
+
+	r, err = c.Txn(ctx, &Txn{
+		If: []*Compare{
+			{Key: "a", Op: CompareEqual, Version: 1},
+			{Key: "b", Op: CompareGreater, Version: 0},
+		},
+		Then: []*TxnOp{
+			{Op: OpPut, Key: "a", Value: []byte("2")},
+			{Op: OpDelete, Key: "b"},
+			{Op: OpDelete, Key: "missing"},
+		},
+	})
+	if err != nil || !r.Succeeded || r.Versions[0] != 2 || r.Versions[1] != 0 {
+		t.Fatalf("expected the transaction to succeed, got %+v (%v)", r, err)
+	}
+	expectValue(t, s, "a", "2")
+	if _, err := s.ReadValue(ctx, "b"); !errors.Is(err, ErrorKeyNotFound) {
+		t.Errorf("expected b to be deleted, got %v", err)
+	}
+
+	invalid := []*Txn{
+		{Then: []*TxnOp{{Op: OpPut, Key: "a"}, {Op: OpDelete, Key: "a"}}},
+		{Then: []*TxnOp{{Op: "increment", Key: "a"}}},
+		{If: []*Compare{{Key: "a", Op: "~"}}},
+		{Then: []*TxnOp{{Op: OpPut, Key: reservedPrefix + "acl"}}},
+	}
+	for _, txn := range invalid {
+		if _, err := c.Txn(ctx, txn); err == nil {
+			t.Errorf("expected %+v to be rejected", txn.Then)
+		}
+	}
+}
+
+// Test that storages apply transactions entirely or not at all
+func TestStorageTxn(t *testing.T) {
+	lsm, err := OpenLSM(t.TempDir(), nil)
+	if err != nil {
+		t.Fatalf("opening failed: %v", err)
+	}
+	defer lsm.Close()
+
+	for name, s := range map[string]Storage{"memory": NewStore(), "lsm": lsm} {
+		s.Put("a", []byte("1"), "", 0)
+		s.Put("a", []byte("2"), "", 0)
+
+		ops := []*TxnOp{{Op: OpPut, Key: "a", Value: []byte("3")}, {Op: OpPut, Key: "b", Value: []byte("1")}}
+		if _, err := s.Txn([]*Compare{{Key: "a", Op: CompareLess, Version: 2}}, ops); err != ErrorConflict {
+			t.Errorf("%s: expected %v, got %v", name, ErrorConflict, err)
+		}
+		if _, err := s.Lookup("b"); err != ErrorKeyNotFound {
+			t.Errorf("%s: expected the failed transaction not to write b, got %v", name, err)
+		}
+
+		writes, err := s.Txn([]*Compare{{Key: "a", Op: CompareGreaterEqual, Version: 2}}, ops)
+		if err != nil || len(writes) != 2 || writes[0].Entry.Version != 3 || writes[1].Entry.Version != 1 {
+			t.Errorf("%s: unexpected writes %+v (%v)", name, writes, err)
+		}
+
+		// writes received from the master, an older one being ignored
+		err = s.ApplyWrites([]*Write{
+			{Key: "a", Entry: &Entry{Value: []byte("old"), Version: 1}},
+			{Key: "b"},
+			{Key: "c", Entry: &Entry{Value: []byte("1"), Version: 5}},
+		})
+		if err != nil {
+			t.Errorf("%s: applying failed: %v", name, err)
+		}
+		items, _ := s.Scan("", "", 0)
+		if len(items) != 2 || string(items[0].Value) != "3" || items[1].Key != "c" || items[1].Version != 5 {
+			t.Errorf("%s: unexpected items %+v", name, items)
+		}
+	}
+}
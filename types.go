@@ -0,0 +1,487 @@
+package dkvs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+)
+
+// value types
+const (
+	TypeString = "string"
+	TypeHash   = "hash"
+	TypeList   = "list"
+	TypeSet    = "set"
+	TypeZSet   = "zset"
+)
+
+// contentTypes are the content types of the entries holding typed values,
+// which are stored as JSON so that every storage and the replication handle
+// them as any other value
+var contentTypes = map[string]string{
+	TypeHash: "application/vnd.dkvs.hash+json",
+	TypeList: "application/vnd.dkvs.list+json",
+	TypeSet:  "application/vnd.dkvs.set+json",
+	TypeZSet: "application/vnd.dkvs.zset+json",
+}
+
+// Type returns the type of the value of an entry, TypeString for the values
+// written as they are
+func (e *Entry) Type() string {
+	for typ, contentType := range contentTypes {
+		if e.ContentType == contentType {
+			return typ
+		}
+	}
+	return TypeString
+}
+
+// ZMember is a member of a sorted set along with its score
+type ZMember struct {
+	Member string  `json:"member"`
+	Score  float64 `json:"score"`
+}
+
+// HSet sets a field of the hash of a key, creating the hash if needed.
+// Writes to typed values can only be run on the master, and are pushed to the
+// slaves as the resulting value.
+func (n *Node) HSet(ctx context.Context, key, field string, val []byte) error {
+	h := make(map[string][]byte)
+	return n.updateTyped(ctx, key, TypeHash, &h, func() (bool, error) {
+		h[field] = val
+		return true, nil
+	})
+}
+
+// HGet returns a field of the hash of a key
+func (n *Node) HGet(ctx context.Context, key, field string) ([]byte, error) {
+	h := make(map[string][]byte)
+	if err := n.readTyped(ctx, key, TypeHash, &h); err != nil {
+		return nil, err
+	}
+
+	val, ok := h[field]
+	if !ok {
+		return nil, ErrorKeyNotFound
+	}
+	return val, nil
+}
+
+// HGetAll returns every field of the hash of a key, none when the key is
+// missing
+func (n *Node) HGetAll(ctx context.Context, key string) (map[string][]byte, error) {
+	h := make(map[string][]byte)
+	return h, n.readTyped(ctx, key, TypeHash, &h)
+}
+
+// HDel removes fields of the hash of a key, and returns how many there were.
+// Removing the last field removes the key.
+func (n *Node) HDel(ctx context.Context, key string, fields ...string) (int, error) {
+	h := make(map[string][]byte)
+	removed := 0
+	err := n.updateTyped(ctx, key, TypeHash, &h, func() (bool, error) {
+		for _, f := range fields {
+			if _, ok := h[f]; ok {
+				delete(h, f)
+				removed++
+			}
+		}
+		return removed > 0, nil
+	})
+	return removed, err
+}
+
+// LPush inserts values at the head of the list of a key, creating the list if
+// needed, and returns its length. The values end up in reverse order, the
+// last one first.
+func (n *Node) LPush(ctx context.Context, key string, values ...[]byte) (int, error) {
+	return n.push(ctx, key, values, true)
+}
+
+// RPush appends values to the list of a key, see LPush
+func (n *Node) RPush(ctx context.Context, key string, values ...[]byte) (int, error) {
+	return n.push(ctx, key, values, false)
+}
+
+func (n *Node) push(ctx context.Context, key string, values [][]byte, head bool) (int, error) {
+	var l [][]byte
+	err := n.updateTyped(ctx, key, TypeList, &l, func() (bool, error) {
+		if !head {
+			l = append(l, values...)
+			return len(values) > 0, nil
+		}
+
+		pushed := make([][]byte, 0, len(values)+len(l))
+		for i := len(values) - 1; i >= 0; i-- {
+			pushed = append(pushed, values[i])
+		}
+		l = append(pushed, l...)
+		return len(values) > 0, nil
+	})
+	return len(l), err
+}
+
+// LPop removes and returns the first value of the list of a key, and fails
+// with ErrorKeyNotFound when the list is empty. Popping the last value
+// removes the key.
+func (n *Node) LPop(ctx context.Context, key string) ([]byte, error) {
+	return n.pop(ctx, key, true)
+}
+
+// RPop removes and returns the last value of the list of a key, see LPop
+func (n *Node) RPop(ctx context.Context, key string) ([]byte, error) {
+	return n.pop(ctx, key, false)
+}
+
+func (n *Node) pop(ctx context.Context, key string, head bool) ([]byte, error) {
+	var l [][]byte
+	var val []byte
+	err := n.updateTyped(ctx, key, TypeList, &l, func() (bool, error) {
+		if len(l) == 0 {
+			return false, ErrorKeyNotFound
+		}
+		if head {
+			val, l = l[0], l[1:]
+		} else {
+			val, l = l[len(l)-1], l[:len(l)-1]
+		}
+		return true, nil
+	})
+	return val, err
+}
+
+// LRange returns the values of the list of a key from start to stop included.
+// Negative indexes count from the end of the list, -1 being the last value.
+func (n *Node) LRange(ctx context.Context, key string, start, stop int) ([][]byte, error) {
+	var l [][]byte
+	if err := n.readTyped(ctx, key, TypeList, &l); err != nil {
+		return nil, err
+	}
+
+	if start < 0 {
+		start += len(l)
+	}
+	if stop < 0 {
+		stop += len(l)
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= len(l) {
+		stop = len(l) - 1
+	}
+	if start > stop {
+		return [][]byte{}, nil
+	}
+	return l[start : stop+1], nil
+}
+
+// SAdd adds members to the set of a key, creating the set if needed, and
+// returns how many weren't in it
+func (n *Node) SAdd(ctx context.Context, key string, members ...string) (int, error) {
+	var s []string
+	added := 0
+	err := n.updateTyped(ctx, key, TypeSet, &s, func() (bool, error) {
+		for _, m := range members {
+			// members are kept sorted
+			i := sort.SearchStrings(s, m)
+			if i < len(s) && s[i] == m {
+				continue
+			}
+			s = append(s, "")
+			copy(s[i+1:], s[i:])
+			s[i] = m
+			added++
+		}
+		return added > 0, nil
+	})
+	return added, err
+}
+
+// SRem removes members from the set of a key, and returns how many were in
+// it. Removing the last member removes the key.
+func (n *Node) SRem(ctx context.Context, key string, members ...string) (int, error) {
+	var s []string
+	removed := 0
+	err := n.updateTyped(ctx, key, TypeSet, &s, func() (bool, error) {
+		for _, m := range members {
+			i := sort.SearchStrings(s, m)
+			if i < len(s) && s[i] == m {
+				s = append(s[:i], s[i+1:]...)
+				removed++
+			}
+		}
+		return removed > 0, nil
+	})
+	return removed, err
+}
+
+// SMembers returns the members of the set of a key, in order
+func (n *Node) SMembers(ctx context.Context, key string) ([]string, error) {
+	s := []string{}
+	return s, n.readTyped(ctx, key, TypeSet, &s)
+}
+
+// ZAdd adds members to the sorted set of a key, or updates their score, and
+// returns how many weren't in it
+func (n *Node) ZAdd(ctx context.Context, key string, members ...*ZMember) (int, error) {
+	for _, m := range members {
+		if m == nil {
+			return 0, badRequest(errors.New("missing member"))
+		}
+		if math.IsNaN(m.Score) || math.IsInf(m.Score, 0) {
+			return 0, badRequest(fmt.Errorf("invalid score of %q", m.Member))
+		}
+	}
+
+	var z []*ZMember
+	added := 0
+	err := n.updateTyped(ctx, key, TypeZSet, &z, func() (bool, error) {
+		changed := false
+		for _, m := range members {
+			i := zIndex(z, m.Member)
+			if i >= 0 && z[i].Score == m.Score {
+				continue
+			}
+			if i >= 0 {
+				z = append(z[:i], z[i+1:]...)
+			} else {
+				added++
+			}
+			z = zInsert(z, &ZMember{Member: m.Member, Score: m.Score})
+			changed = true
+		}
+		return changed, nil
+	})
+	return added, err
+}
+
+// ZRem removes members from the sorted set of a key, and returns how many were
+// in it. Removing the last member removes the key.
+func (n *Node) ZRem(ctx context.Context, key string, members ...string) (int, error) {
+	var z []*ZMember
+	removed := 0
+	err := n.updateTyped(ctx, key, TypeZSet, &z, func() (bool, error) {
+		for _, m := range members {
+			if i := zIndex(z, m); i >= 0 {
+				z = append(z[:i], z[i+1:]...)
+				removed++
+			}
+		}
+		return removed > 0, nil
+	})
+	return removed, err
+}
+
+// ZRangeByScore returns the members of the sorted set of a key whose score is
+// between min and max included, by score then by member. Infinite bounds
+// select every score on their side.
+func (n *Node) ZRangeByScore(ctx context.Context, key string, min, max float64) ([]*ZMember, error) {
+	var z []*ZMember
+	if err := n.readTyped(ctx, key, TypeZSet, &z); err != nil {
+		return nil, err
+	}
+
+	start := sort.Search(len(z), func(i int) bool { return z[i].Score >= min })
+	end := sort.Search(len(z), func(i int) bool { return z[i].Score > max })
+	if start >= end {
+		return []*ZMember{}, nil
+	}
+	return z[start:end], nil
+}
+
+// zIndex returns the index of a member of a sorted set, or -1
+func zIndex(z []*ZMember, member string) int {
+	for i, m := range z {
+		if m.Member == member {
+			return i
+		}
+	}
+	return -1
+}
+
+// zInsert inserts a member in a sorted set, ordered by score then by member
+func zInsert(z []*ZMember, m *ZMember) []*ZMember {
+	i := sort.Search(len(z), func(i int) bool {
+		return z[i].Score > m.Score || (z[i].Score == m.Score && z[i].Member >= m.Member)
+	})
+	z = append(z, nil)
+	copy(z[i+1:], z[i:])
+	z[i] = m
+	return z
+}
+
+// readTyped decodes the value of a key holding a typ value into v, which is
+// left as it is when the key is missing
+func (n *Node) readTyped(ctx context.Context, key, typ string, v interface{}) error {
+	e, err := n.ReadEntry(ctx, key)
+	if errors.Is(err, ErrorKeyNotFound) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return decodeTyped(key, e, typ, v)
+}
+
+// updateTyped decodes the typ value of a key into v, a pointer to an empty
+// map or slice, and writes v back when update changed it. The key is removed
+// when v ends up empty.
+func (n *Node) updateTyped(ctx context.Context, key, typ string, v interface{}, update func() (bool, error)) error {
+	return n.modify(ctx, key, "storage."+typ, func(current *Entry) ([]byte, string, bool, error) {
+		if err := decodeTyped(key, current, typ, v); err != nil {
+			return nil, "", false, err
+		}
+
+		changed, err := update()
+		if err != nil || !changed {
+			return nil, "", false, err
+		}
+		if reflect.ValueOf(v).Elem().Len() == 0 {
+			return nil, "", true, nil
+		}
+
+		val, err := json.Marshal(v)
+		return val, contentTypes[typ], true, err
+	})
+}
+
+// decodeTyped decodes an entry holding a typ value into v, leaving v as it is
+// when the entry is nil
+func decodeTyped(key string, e *Entry, typ string, v interface{}) error {
+	if e == nil {
+		return nil
+	}
+	if t := e.Type(); t != typ {
+		return &Error{Code: CodeBadRequest, Message: fmt.Sprintf("%s holds a %s, not a %s", key, t, typ)}
+	}
+	// values written directly with the content type of a type can be invalid
+	if err := json.Unmarshal(e.Value, v); err != nil {
+		return &Error{Code: CodeBadRequest, Message: fmt.Sprintf("%s holds an invalid %s: %v", key, typ, err)}
+	}
+	return nil
+}
+
+// modify replaces the value of a key by its update, given the current entry
+// or nil when the key is missing, and pushes the write to the slaves. update
+// returns the new value and its content type, a nil value removing the key,
+// and whether it changed anything at all.
+// This can only be run on the master.
+func (n *Node) modify(ctx context.Context, key, operation string, update func(current *Entry) ([]byte, string, bool, error)) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if !n.IsMaster() {
+		return ErrorNotMaster
+	}
+
+	var e *Entry
+	_, span := n.startSpan(ctx, operation, "key", key)
+	index, err := n.commit([]string{key}, func() ([]*Write, error) {
+		current, err := n.storage.Lookup(key)
+		if errors.Is(err, ErrorKeyNotFound) {
+			current, err = nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		val, contentType, changed, err := update(current)
+		if err != nil || !changed {
+			return nil, err
+		}
+
+		// the writes of the master are committed one at a time, pinning the
+		// version only guards against writes made to the storage directly
+		var version uint64
+		if current != nil {
+			version = current.Version
+		}
+		if val == nil {
+			if current == nil {
+				return nil, nil
+			}
+			return []*Write{{Key: key}}, n.storage.Delete(key, version)
+		}
+		e, err = n.storage.Put(key, val, contentType, version)
+		return []*Write{{Key: key, Entry: e}}, err
+	})
+	span.finish(err)
+	if err != nil || index == 0 {
+		return err
+	}
+
+	return n.pushWriteToSlaves(ctx, index, key, e)
+}
+
+// typeOp is an operation on a typed value, as sent to POST /v1/ops
+type typeOp struct {
+	Op      string     `json:"op"`
+	Key     string     `json:"key"`
+	Field   string     `json:"field,omitempty"`
+	Fields  []string   `json:"fields,omitempty"`
+	Value   []byte     `json:"value,omitempty"`
+	Values  [][]byte   `json:"values,omitempty"`
+	Members []string   `json:"members,omitempty"`
+	Scores  []*ZMember `json:"scores,omitempty"`
+	Start   int        `json:"start,omitempty"`
+	Stop    int        `json:"stop,omitempty"`
+	// bounds of the scores, unbounded when nil
+	Min *float64 `json:"min,omitempty"`
+	Max *float64 `json:"max,omitempty"`
+}
+
+// typeOps tells whether each operation on typed values is a write
+var typeOps = map[string]bool{
+	"hset": true, "hget": false, "hgetall": false, "hdel": true,
+	"lpush": true, "rpush": true, "lpop": true, "rpop": true, "lrange": false,
+	"sadd": true, "srem": true, "smembers": false,
+	"zadd": true, "zrem": true, "zrangebyscore": false,
+}
+
+// applyTypeOp runs an operation on a typed value and returns its result
+func (n *Node) applyTypeOp(ctx context.Context, op *typeOp) (interface{}, error) {
+	switch op.Op {
+	case "hset":
+		return nil, n.HSet(ctx, op.Key, op.Field, op.Value)
+	case "hget":
+		return n.HGet(ctx, op.Key, op.Field)
+	case "hgetall":
+		return n.HGetAll(ctx, op.Key)
+	case "hdel":
+		return n.HDel(ctx, op.Key, op.Fields...)
+	case "lpush":
+		return n.LPush(ctx, op.Key, op.Values...)
+	case "rpush":
+		return n.RPush(ctx, op.Key, op.Values...)
+	case "lpop":
+		return n.LPop(ctx, op.Key)
+	case "rpop":
+		return n.RPop(ctx, op.Key)
+	case "lrange":
+		return n.LRange(ctx, op.Key, op.Start, op.Stop)
+	case "sadd":
+		return n.SAdd(ctx, op.Key, op.Members...)
+	case "srem":
+		return n.SRem(ctx, op.Key, op.Members...)
+	case "smembers":
+		return n.SMembers(ctx, op.Key)
+	case "zadd":
+		return n.ZAdd(ctx, op.Key, op.Scores...)
+	case "zrem":
+		return n.ZRem(ctx, op.Key, op.Members...)
+	case "zrangebyscore":
+		min, max := math.Inf(-1), math.Inf(1)
+		if op.Min != nil {
+			min = *op.Min
+		}
+		if op.Max != nil {
+			max = *op.Max
+		}
+		return n.ZRangeByScore(ctx, op.Key, min, max)
+	}
+	return nil, badRequest(fmt.Errorf("unknown operation %q", op.Op))
+}
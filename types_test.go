@@ -0,0 +1,104 @@
+package dkvs
+
+import (
+	"context"
+	"errors"
+	"math"
+	"reflect"
+	"testing"
+)
+
+// Test operations on typed values through a slave, which reads them itself
+// and redirects the writes to the master
+func TestTypes(t *testing.T) {
+	ctx := context.Background()
+	net := NewMemoryNetwork()
+	m, slaves := memoryCluster(t, net, WriteConcernAll, "slave:1")
+	s := slaves[0]
+	c := net.Client("slave:1")
+
+	// hashes
+	c.HSet(ctx, "user", "name", []byte("ada"))
+	c.HSet(ctx, "user", "lang", []byte("go"))
+	if v, err := c.HGet(ctx, "user", "name"); err != nil || string(v) != "ada" {
+		t.Errorf(`expected "ada", got %q (%v)`, v, err)
+	}
+	if _, err := c.HGet(ctx, "user", "age"); !errors.Is(err, ErrorKeyNotFound) {
+		t.Errorf("expected %v, got %v", ErrorKeyNotFound, err)
+	}
+	if n, err := c.HDel(ctx, "user", "lang", "age"); err != nil || n != 1 {
+		t.Errorf("expected 1 field removed, got %d (%v)", n, err)
+	}
+	if h, err := s.HGetAll(ctx, "user"); err != nil || !reflect.DeepEqual(h, map[string][]byte{"name": []byte("ada")}) {
+		t.Errorf("unexpected hash %q (%v)", h, err)
+	}
+
+	// lists
+	c.RPush(ctx, "queue", []byte("b"), []byte("c"))
+	if n, err := c.LPush(ctx, "queue", []byte("x"), []byte("a")); err != nil || n != 4 {
+		t.Errorf("expected a length of 4, got %d (%v)", n, err)
+	}
+	if v, err := c.LPop(ctx, "queue"); err != nil || string(v) != "a" {
+		t.Errorf(`expected "a", got %q (%v)`, v, err)
+	}
+	if v, err := c.RPop(ctx, "queue"); err != nil || string(v) != "c" {
+		t.Errorf(`expected "c", got %q (%v)`, v, err)
+	}
+	if l, err := c.LRange(ctx, "queue", 0, -1); err != nil || !reflect.DeepEqual(l, [][]byte{[]byte("x"), []byte("b")}) {
+		t.Errorf("unexpected list %q (%v)", l, err)
+	}
+	if l, _ := c.LRange(ctx, "queue", -1, 10); len(l) != 1 || string(l[0]) != "b" {
+		t.Errorf("unexpected range %q", l)
+	}
+
+	// sets
+	if n, err := c.SAdd(ctx, "tags", "go", "kv", "go"); err != nil || n != 2 {
+		t.Errorf("expected 2 members added, got %d (%v)", n, err)
+	}
+	c.SAdd(ctx, "tags", "db")
+	c.SRem(ctx, "tags", "kv", "missing")
+	if members, err := c.SMembers(ctx, "tags"); err != nil || !reflect.DeepEqual(members, []string{"db", "go"}) {
+		t.Errorf("unexpected members %v (%v)", members, err)
+	}
+
+	// sorted sets
+	c.ZAdd(ctx, "scores", &ZMember{"a", 3}, &ZMember{"b", 1}, &ZMember{"c", 2})
+	if n, err := c.ZAdd(ctx, "scores", &ZMember{"a", 0}, &ZMember{"d", 5}); err != nil || n != 1 {
+		t.Errorf("expected 1 member added, got %d (%v)", n, err)
+	}
+	c.ZRem(ctx, "scores", "c")
+	expected := []*ZMember{{"a", 0}, {"b", 1}}
+	if z, err := c.ZRangeByScore(ctx, "scores", math.Inf(-1), 4); err != nil || !reflect.DeepEqual(z, expected) {
+		t.Errorf("unexpected range %v (%v)", z, err)
+	}
+	if z, _ := c.ZRangeByScore(ctx, "scores", 1, math.Inf(1)); len(z) != 2 || z[1].Member != "d" {
+		t.Errorf("unexpected range %v", z)
+	}
+
+	// values are replicated with their type
+	for key, typ := range map[string]string{"user": TypeHash, "queue": TypeList, "tags": TypeSet, "scores": TypeZSet} {
+		e, err := s.ReadEntry(ctx, key)
+		if err != nil || e.Type() != typ {
+			t.Errorf("%s: expected a %s, got %+v (%v)", key, typ, e, err)
+		}
+	}
+
+	// operations don't apply to other types
+	m.WriteValue(ctx, "name", []byte("dkvs"))
+	if _, err := c.LPush(ctx, "name", []byte("a")); !errors.Is(err, &Error{Code: CodeBadRequest}) {
+		t.Errorf("expected a type error, got %v", err)
+	}
+	if _, err := c.SMembers(ctx, "user"); !errors.Is(err, &Error{Code: CodeBadRequest}) {
+		t.Errorf("expected a type error, got %v", err)
+	}
+
+	// emptied values are removed
+	c.RPop(ctx, "queue")
+	c.RPop(ctx, "queue")
+	if _, err := s.ReadEntry(ctx, "queue"); !errors.Is(err, ErrorKeyNotFound) {
+		t.Errorf("expected the list to be removed, got %v", err)
+	}
+	if _, err := c.LPop(ctx, "queue"); !errors.Is(err, ErrorKeyNotFound) {
+		t.Errorf("expected %v, got %v", ErrorKeyNotFound, err)
+	}
+}
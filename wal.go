@@ -0,0 +1,224 @@
+package dkvs
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+// errorCorrupt is returned when the files of an LSM storage can't be decoded
+var errorCorrupt = errors.New("corrupt storage file")
+
+// newTombstone returns the entry of a deleted key in the memtable and the
+// tables of an LSM storage. It keeps the last version of the key, so that the
+// versions of a key only increase and an old ETag doesn't match a new value.
+func newTombstone(version uint64) *Entry {
+	return &Entry{Version: version, deleted: true}
+}
+
+// appendRecord encodes a key and its entry, as stored in the write-ahead log
+// and in the blocks of the tables. The byte following the key tells whether
+// the key was deleted: 2 for the tombstones, followed by their version, and 1
+// for the tombstones written before they had one.
+func appendRecord(b []byte, key string, e *Entry) []byte {
+	b = binary.AppendUvarint(b, uint64(len(key)))
+	b = append(b, key...)
+	if e.deleted {
+		b = append(b, 2)
+		return binary.AppendUvarint(b, e.Version)
+	}
+
+	b = append(b, 0)
+	b = binary.AppendUvarint(b, e.Version)
+	b = binary.AppendUvarint(b, uint64(len(e.ContentType)))
+	b = append(b, e.ContentType...)
+	b = binary.AppendUvarint(b, uint64(len(e.Value)))
+	return append(b, e.Value...)
+}
+
+// decodeRecord decodes a record, and returns its length
+func decodeRecord(b []byte) (string, *Entry, int, error) {
+	d := &recordDecoder{b: b}
+	key := d.string()
+	deleted := d.byte()
+	if d.err != nil {
+		return "", nil, 0, d.err
+	}
+	switch deleted {
+	case 1:
+		return key, newTombstone(0), d.pos, nil
+	case 2:
+		version := d.uvarint()
+		return key, newTombstone(version), d.pos, d.err
+	}
+
+	e := &Entry{Version: d.uvarint()}
+	e.ContentType = d.string()
+	e.Value = d.bytes()
+	return key, e, d.pos, d.err
+}
+
+// recordDecoder reads the fields of records, and remembers the first error
+type recordDecoder struct {
+	b   []byte
+	pos int
+	err error
+}
+
+func (d *recordDecoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.b[d.pos:])
+	if n <= 0 {
+		d.err = errorCorrupt
+		return 0
+	}
+	d.pos += n
+	return v
+}
+
+// bytes reads a field prefixed by its length
+func (d *recordDecoder) bytes() []byte {
+	l := d.uvarint()
+	if d.err != nil {
+		return nil
+	}
+	if l > uint64(len(d.b)-d.pos) {
+		d.err = errorCorrupt
+		return nil
+	}
+	b := make([]byte, l)
+	copy(b, d.b[d.pos:])
+	d.pos += int(l)
+	return b
+}
+
+func (d *recordDecoder) string() string {
+	return string(d.bytes())
+}
+
+func (d *recordDecoder) byte() byte {
+	if d.err != nil {
+		return 0
+	}
+	if d.pos >= len(d.b) {
+		d.err = errorCorrupt
+		return 0
+	}
+	d.pos++
+	return d.b[d.pos-1]
+}
+
+// wal is the write-ahead log of the memtable: writes are appended to it
+// before being applied, so that they survive a crash until the memtable is
+// flushed to a table. Each entry of the log holds the records of writes
+// applied together, prefixed by their length and checksum.
+type wal struct {
+	f    *os.File
+	w    *bufio.Writer
+	sync bool
+}
+
+// openWAL opens the log at path, and replays its records. A record cut by a
+// crash ends the log.
+func openWAL(path string, sync bool, replay func(key string, e *Entry)) (*wal, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	r := bufio.NewReader(f)
+	var offset int64
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			break
+		}
+		payload := make([]byte, binary.LittleEndian.Uint32(header))
+		if _, err := io.ReadFull(r, payload); err != nil {
+			break
+		}
+		if crc32.ChecksumIEEE(payload) != binary.LittleEndian.Uint32(header[4:]) {
+			break
+		}
+		if err := replayRecords(payload, replay); err != nil {
+			break
+		}
+
+		offset += int64(len(header) + len(payload))
+	}
+
+	// drop what follows the last complete record
+	if err := f.Truncate(offset); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return &wal{f: f, w: bufio.NewWriter(f), sync: sync}, nil
+}
+
+// replayRecords decodes the records of a log entry, and replays them once
+// they are all decoded
+func replayRecords(payload []byte, replay func(key string, e *Entry)) error {
+	var keys []string
+	var entries []*Entry
+	for pos := 0; pos < len(payload); {
+		key, e, n, err := decodeRecord(payload[pos:])
+		if err != nil {
+			return err
+		}
+		keys = append(keys, key)
+		entries = append(entries, e)
+		pos += n
+	}
+
+	for i, key := range keys {
+		replay(key, entries[i])
+	}
+	return nil
+}
+
+// append writes writes to the log as a single entry, deletions being written
+// as tombstones. It is handed to the OS before returning, and synced to the
+// disk if the log is synchronous.
+func (w *wal) append(writes []*Write) error {
+	var payload []byte
+	for _, write := range writes {
+		payload = appendRecord(payload, write.Key, write.Entry)
+	}
+
+	header := make([]byte, 8)
+	binary.LittleEndian.PutUint32(header, uint32(len(payload)))
+	binary.LittleEndian.PutUint32(header[4:], crc32.ChecksumIEEE(payload))
+
+	w.w.Write(header)
+	w.w.Write(payload)
+	if err := w.w.Flush(); err != nil {
+		return err
+	}
+	if w.sync {
+		return w.f.Sync()
+	}
+	return nil
+}
+
+// reset empties the log, once its records are in a table
+func (w *wal) reset() error {
+	if err := w.f.Truncate(0); err != nil {
+		return err
+	}
+	_, err := w.f.Seek(0, io.SeekStart)
+	return err
+}
+
+func (w *wal) close() error {
+	return w.f.Close()
+}
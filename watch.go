@@ -0,0 +1,242 @@
+package dkvs
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// number of events kept by a node, so that watches can resume from a
+	// past revision
+	watchHistory = 1000
+	// number of events a watcher can be behind before it is stopped
+	watchBuffer = 256
+)
+
+// event types
+const (
+	EventPut    = "put"
+	EventDelete = "delete"
+)
+
+// errorWatcherBehind stops watchers that don't read their events fast enough
+var errorWatcherBehind = &Error{Code: CodeTimeout, Message: "watcher fell behind, resume from the next revision", Retryable: true}
+
+// Event is a change of a key seen by a watcher
+type Event struct {
+	Type        string `json:"type"`
+	Key         string `json:"key"`
+	Value       []byte `json:"value,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	Version     uint64 `json:"version,omitempty"`
+	// Revision is the replication index of the write; the writes of a
+	// transaction or of a batch share the same revision
+	Revision uint64 `json:"revision"`
+}
+
+// Watcher receives the changes of a key, or of the keys with a prefix
+type Watcher struct {
+	// Events receives the events in the order of their revisions. It is
+	// closed when the watch stops.
+	Events <-chan *Event
+
+	events chan *Event
+	done   chan struct{}
+	// why the watch stopped, set before Events is closed
+	err error
+	// next revision expected by the watcher
+	from   uint64
+	key    string
+	prefix bool
+	cancel func()
+}
+
+// Err returns why the watch stopped once Events is closed: nil when it was
+// closed or its context is done, ErrorCompacted when the node lost track of
+// the revisions it was waiting for, or a retryable error when the watcher fell
+// behind. A watch can be resumed from the revision of the last event
+// received, getting the events of that revision already received again.
+func (w *Watcher) Err() error {
+	return w.err
+}
+
+// Close stops the watch
+func (w *Watcher) Close() {
+	w.cancel()
+}
+
+func (w *Watcher) matches(key string) bool {
+	if w.prefix {
+		return strings.HasPrefix(key, w.key)
+	}
+	return key == w.key
+}
+
+// watchHub dispatches the writes applied by a node to its watchers, and keeps
+// the last events so that watches can resume from a past revision
+type watchHub struct {
+	lock     sync.Mutex
+	watchers map[*Watcher]struct{}
+	history  []*Event
+	// first revision whose events are all in history
+	first uint64
+}
+
+// Watch returns a watcher of the changes of a key, starting from revision, or
+// from the next write when revision is 0. Watchers stop with ErrorCompacted
+// when the revision is older than the events the node keeps.
+func (n *Node) Watch(ctx context.Context, key string, revision uint64) (*Watcher, error) {
+	return n.watch(ctx, key, false, revision)
+}
+
+// WatchPrefix returns a watcher of the changes of the keys starting with
+// prefix; see Watch
+func (n *Node) WatchPrefix(ctx context.Context, prefix string, revision uint64) (*Watcher, error) {
+	return n.watch(ctx, prefix, true, revision)
+}
+
+func (n *Node) watch(ctx context.Context, key string, prefix bool, revision uint64) (*Watcher, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if n.isSyncing() {
+		return nil, ErrorSyncing
+	}
+
+	h := &n.watches
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if revision != 0 && revision < h.first {
+		return nil, ErrorCompacted
+	}
+	if revision == 0 {
+		revision = atomic.LoadUint64(&n.index) + 1
+	}
+
+	w := &Watcher{done: make(chan struct{}), from: revision, key: key, prefix: prefix}
+	var backlog []*Event
+	for _, e := range h.history {
+		if e.Revision >= revision && w.matches(e.Key) {
+			backlog = append(backlog, e)
+		}
+	}
+	w.events = make(chan *Event, watchBuffer+len(backlog))
+	w.Events = w.events
+	for _, e := range backlog {
+		w.events <- e
+	}
+
+	w.cancel = func() {
+		h.lock.Lock()
+		defer h.lock.Unlock()
+		h.stop(w, nil)
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			w.cancel()
+		case <-w.done:
+		}
+	}()
+
+	if h.watchers == nil {
+		h.watchers = make(map[*Watcher]struct{})
+	}
+	h.watchers[w] = struct{}{}
+	return w, nil
+}
+
+// publish adds the events of writes to the history and sends them to the
+// watchers; the caller must hold the lock
+func (h *watchHub) publish(index uint64, writes []*Write) {
+	for _, wr := range writes {
+		e := &Event{Type: EventDelete, Key: wr.Key, Revision: index}
+		if wr.Entry != nil {
+			e.Type = EventPut
+			e.Value = wr.Entry.Value
+			e.ContentType = wr.Entry.ContentType
+			e.Version = wr.Entry.Version
+		}
+		h.history = append(h.history, e)
+
+		for w := range h.watchers {
+			if e.Revision < w.from || !w.matches(e.Key) {
+				continue
+			}
+			select {
+			case w.events <- e:
+			default:
+				h.stop(w, errorWatcherBehind)
+			}
+		}
+	}
+
+	// the history is trimmed by halves, keeping the events of a revision
+	// together
+	if len(h.history) > 2*watchHistory {
+		cut := len(h.history) - watchHistory
+		for cut < len(h.history) && h.history[cut].Revision == h.history[cut-1].Revision {
+			cut++
+		}
+		h.first = h.history[cut-1].Revision + 1
+		h.history = append([]*Event{}, h.history[cut:]...)
+	}
+}
+
+// pending returns the events received by a watcher that it didn't read yet,
+// and why it stopped if it did. Holding the lock, it never returns part of
+// the events of a revision.
+func (h *watchHub) pending(w *Watcher) ([]*Event, error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	var events []*Event
+	for {
+		select {
+		case e, ok := <-w.events:
+			if !ok {
+				return events, w.err
+			}
+			events = append(events, e)
+		default:
+			return events, nil
+		}
+	}
+}
+
+// reset forgets the history when a slave replaced its data with a copy of the
+// master at index, stopping the watchers that can't know what changed
+func (h *watchHub) reset(index uint64) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.history = nil
+	h.first = index + 1
+	for w := range h.watchers {
+		h.stop(w, ErrorCompacted)
+	}
+}
+
+// closeAll stops all the watchers, when the node shuts down
+func (h *watchHub) closeAll() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	for w := range h.watchers {
+		h.stop(w, nil)
+	}
+}
+
+// stop removes a watcher and closes its channel; the caller must hold the lock
+func (h *watchHub) stop(w *Watcher, err error) {
+	if _, ok := h.watchers[w]; !ok {
+		return
+	}
+	delete(h.watchers, w)
+	w.err = err
+	close(w.done)
+	close(w.events)
+}
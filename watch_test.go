@@ -0,0 +1,186 @@
+package dkvs
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// nextEvent waits for the next event of a watcher
+func nextEvent(t *testing.T, w *Watcher) *Event {
+	t.Helper()
+
+	select {
+	case e, ok := <-w.Events:
+		if !ok {
+			t.Fatalf("watch stopped: %v", w.Err())
+		}
+		return e
+	case <-time.After(time.Second):
+		t.Fatalf("no event received")
+	}
+	return nil
+}
+
+// Test watching the writes replicated to a slave
+func TestWatch(t *testing.T) {
+	ctx := context.Background()
+	net := NewMemoryNetwork()
+	m, slaves := memoryCluster(t, net, WriteConcernAll, "slave:1")
+	s := slaves[0]
+
+	w, err := s.WatchPrefix(ctx, "users/", 0)
+	if err != nil {
+		t.Fatalf("watching failed: %v", err)
+	}
+	defer w.Close()
+
+	m.WriteValue(ctx, "users/1", []byte("a"))
+	m.WriteValue(ctx, "other", []byte("b"))
+	m.WriteBatch(ctx, []*BatchOp{
+		{Op: OpPut, Key: "users/2", Value: []byte("c")},
+		{Op: OpDelete, Key: "users/1"},
+	})
+
+	expected := []Event{
+		{Type: EventPut, Key: "users/1", Value: []byte("a"), Version: 1, Revision: 1},
+		{Type: EventPut, Key: "users/2", Value: []byte("c"), Version: 1, Revision: 3},
+		{Type: EventDelete, Key: "users/1", Revision: 3},
+	}
+	for _, ex := range expected {
+		e := nextEvent(t, w)
+		if e.Type != ex.Type || e.Key != ex.Key || string(e.Value) != string(ex.Value) || e.Version != ex.Version || e.Revision != ex.Revision {
+			t.Errorf("expected %+v, got %+v", ex, e)
+		}
+	}
+
+	// resuming from a past revision, on the master
+	resumed, err := m.Watch(ctx, "users/1", 2)
+	if err != nil {
+		t.Fatalf("watching failed: %v", err)
+	}
+	if e := nextEvent(t, resumed); e.Type != EventDelete || e.Revision != 3 {
+		t.Errorf("expected the deletion of users/1, got %+v", e)
+	}
+	resumed.Close()
+	if _, ok := <-resumed.Events; ok || resumed.Err() != nil {
+		t.Errorf("expected the watch to be closed without error, got %v", resumed.Err())
+	}
+
+	// watchers that don't read their events are stopped
+	slow, _ := m.Watch(ctx, "slow", 0)
+	for i := 0; i <= watchBuffer; i++ {
+		m.WriteValue(ctx, "slow", []byte("x"))
+	}
+	received := 0
+	for range slow.Events {
+		received++
+	}
+	if received != watchBuffer || !errors.Is(slow.Err(), errorWatcherBehind) {
+		t.Errorf("expected %d events then an error, got %d events and %v", watchBuffer, received, slow.Err())
+	}
+
+	// the first revisions are forgotten
+	for i := 0; i < 2*watchHistory; i++ {
+		m.WriteValue(ctx, "many", []byte("x"))
+	}
+	if _, err := m.Watch(ctx, "many", 1); !errors.Is(err, ErrorCompacted) {
+		t.Errorf("expected %v, got %v", ErrorCompacted, err)
+	}
+}
+
+// Test long-polling watches through the client
+func TestClientWatch(t *testing.T) {
+	ctx := context.Background()
+	net := NewMemoryNetwork()
+	m, _ := memoryCluster(t, net, WriteConcernAll, "slave:1")
+	c := net.Client("slave:1")
+
+	w, err := c.Watch(ctx, "a", 0)
+	if err != nil {
+		t.Fatalf("watching failed: %v", err)
+	}
+
+	go func() {
+		// let the client poll before the write
+		time.Sleep(10 * time.Millisecond)
+		m.WriteValue(ctx, "a", []byte("1"))
+		m.WriteValue(ctx, "b", []byte("1"))
+		m.WriteValue(ctx, "a", []byte("2"))
+	}()
+	for i, expected := range []string{"1", "2"} {
+		if e := nextEvent(t, w); string(e.Value) != expected || e.Revision != uint64(2*i+1) {
+			t.Errorf("expected %q, got %+v", expected, e)
+		}
+	}
+	w.Close()
+
+	if _, ok := <-w.Events; ok || w.Err() != nil {
+		t.Errorf("expected the watch to be closed without error, got %v", w.Err())
+	}
+
+	if _, err := c.Watch(ctx, "", 0); !errors.Is(err, &Error{Code: CodeBadRequest}) {
+		t.Errorf("expected watches without key to be rejected, got %v", err)
+	}
+}
+
+// Test streaming events over HTTP, and resuming a stream
+func TestWatchStream(t *testing.T) {
+	m, err := startMaster(":6565")
+	if m != nil {
+		defer m.Close()
+	}
+	if err != nil {
+		t.Fatalf("creating a master failed with error: %v", err)
+	}
+
+	ctx := context.Background()
+	m.WriteValue(ctx, "a", []byte("1"))
+	m.WriteValue(ctx, "b", []byte("1"))
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "http://:6565/v1/watch?prefix=", nil)
+	req.Header.Set("Accept", "text/event-stream")
+	req.Header.Set("Last-Event-ID", "1")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("watching failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	m.WriteBatch(ctx, []*BatchOp{{Op: OpPut, Key: "c", Value: []byte("1")}, {Op: OpDelete, Key: "a"}})
+
+	var lines []string
+	scanner := bufio.NewScanner(resp.Body)
+	for len(lines) < 9 && scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+
+	expected := []string{
+		"event: put",
+		`data: {"type":"put","key":"b","value":"MQ==","version":1,"revision":2}`,
+		"id: 2",
+		"",
+		"event: put",
+		`data: {"type":"put","key":"c","value":"MQ==","version":1,"revision":3}`,
+		"",
+		"event: delete",
+		`data: {"type":"delete","key":"a","revision":3}`,
+	}
+	if strings.Join(lines, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected:\n%s\ngot:\n%s", strings.Join(expected, "\n"), strings.Join(lines, "\n"))
+	}
+	if scanner.Scan(); scanner.Text() != "id: 3" {
+		t.Errorf("expected the id of the revision after its last event, got %q", scanner.Text())
+	}
+
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("unexpected content type %q", ct)
+	}
+}